@@ -0,0 +1,369 @@
+package kelips
+
+import (
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"sync"
+)
+
+// Number of locks keys are striped across to serialize authorizing and
+// applying mutations of a key
+const ownerLockStripes = 64
+
+// AccessOp is a mutation checked by an Authorizer
+type AccessOp uint8
+
+const (
+	// AccessInsert is the insert of a key tuple
+	AccessInsert AccessOp = iota
+
+	// AccessDelete is the delete of a key tuple
+	AccessDelete
+
+	// AccessExpire is the removal of a host from all keys
+	AccessExpire
+
+	// AccessPurge is the removal of all keys in a namespace
+	AccessPurge
+
+	// AccessResize is the switch to a new layout of groups
+	AccessResize
+
+	// AccessJoin is the addition of a node joining the cluster
+	AccessJoin
+)
+
+func (op AccessOp) String() string {
+	switch op {
+	case AccessInsert:
+		return "insert"
+	case AccessDelete:
+		return "delete"
+	case AccessExpire:
+		return "expire"
+	case AccessPurge:
+		return "purge"
+	case AccessResize:
+		return "resize"
+	case AccessJoin:
+		return "join"
+	}
+	return fmt.Sprintf("AccessOp(%d)", uint8(op))
+}
+
+// Caller identifies the origin of a mutation
+type Caller struct {
+	// Principal the mutation is made on behalf of.  It is supplied by the
+	// sender and only trusted from authenticated peers.  Empty is anonymous
+	Principal string
+
+	// Authenticated identity of the sender.  It is "key:<id>" for signed
+	// requests and "noise:<hex static key>" for encrypted ones.  Empty if the
+	// transport is not authenticated
+	Peer string
+
+	// Remote is true if the mutation was received over the transport
+	Remote bool
+
+	// Network address the request was received from.  Empty for local calls
+	Addr string
+}
+
+// verified returns the principal if it can be trusted.  The principal of a
+// remote caller is only trusted if the peer is authenticated
+func (c Caller) verified() string {
+	if c.Remote && c.Peer == "" {
+		return ""
+	}
+	return c.Principal
+}
+
+// isCluster returns true for operations that affect the whole store or cluster
+// rather than a single key tuple
+func (op AccessOp) isCluster() bool {
+	return op >= AccessExpire && op <= AccessJoin
+}
+
+// AccessRequest is a mutation to be authorized against the local tuple store.
+// The key is only set for inserts and deletes.  The tuple is the expired host
+// and the address of the joining node for expires and joins.  Remote cluster
+// operations carry no principal
+type AccessRequest struct {
+	Caller
+
+	Op    AccessOp
+	Key   []byte
+	Tuple TupleHost
+
+	// Namespace being purged
+	Namespace string
+
+	// Principal that inserted the tuple.  Empty if the tuple does not exist or
+	// was inserted anonymously
+	Owner string
+
+	// Propagated is true for writes propogated or migrated from another
+	// node in which case the principal is that of the original caller
+	Propagated bool
+}
+
+// Authorizer decides whether a mutation is allowed.  It is consulted on each
+// node applying the mutation including those it is propogated to.  A non-nil
+// error denies the mutation and is returned to the caller as an
+// AccessDeniedError
+type Authorizer interface {
+	Authorize(req *AccessRequest) error
+}
+
+// AccessDeniedError is returned when an Authorizer denies a mutation.  It is
+// preserved across the transport
+type AccessDeniedError struct {
+	Op        AccessOp
+	Key       []byte
+	Principal string
+	Reason    string
+}
+
+func (e *AccessDeniedError) Error() string {
+	return fmt.Sprintf("access denied: %s key=%q principal=%q: %s", e.Op, e.Key, e.Principal, e.Reason)
+}
+
+// marshal encodes the error as the op, principal, key and reason
+func (e *AccessDeniedError) marshal() ([]byte, error) {
+	buf, err := appendUint16Bytes([]byte{byte(e.Op)}, []byte(e.Principal))
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = appendUint16Bytes(buf, e.Key); err != nil {
+		return nil, err
+	}
+	return append(buf, e.Reason...), nil
+}
+
+func unmarshalAccessDenied(b []byte) (*AccessDeniedError, error) {
+	if len(b) < 1 {
+		return nil, fmt.Errorf("access denied: size too small")
+	}
+
+	principal, rest, err := readUint16Bytes(b[1:])
+	if err != nil {
+		return nil, err
+	}
+	key, rest, err := readUint16Bytes(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AccessDeniedError{
+		Op:        AccessOp(b[0]),
+		Principal: string(principal),
+		Key:       append([]byte{}, key...),
+		Reason:    string(rest),
+	}, nil
+}
+
+// OwnerAuthorizer only allows a tuple to be inserted again or deleted by the
+// principal that inserted it.  Tuples inserted anonymously may be modified by
+// anyone.  Remote callers that are not authenticated act anonymously whatever
+// principal they supply
+type OwnerAuthorizer struct {
+	// Peers maps authenticated peer identities to the principal each is allowed
+	// to act as.  Peers mapped to "*" such as cluster nodes may act as any
+	// principal and are the only remote callers allowed to expire, purge,
+	// resize and join.  Remote mutations from peers not listed are denied.  If
+	// nil any authenticated peer may act as any principal and cluster
+	// operations are allowed
+	Peers map[string]string
+}
+
+// Authorize checks the caller is allowed to act as the principal and that the
+// principal owns the tuple if it has an owner
+func (oa *OwnerAuthorizer) Authorize(req *AccessRequest) error {
+	if req.Op.isCluster() {
+		if req.Remote && oa.Peers != nil && oa.Peers[req.Peer] != "*" {
+			return fmt.Errorf("peer %q cannot %s", req.Peer, req.Op)
+		}
+		return nil
+	}
+
+	if req.Remote && oa.Peers != nil {
+		p, ok := oa.Peers[req.Peer]
+		if !ok {
+			return fmt.Errorf("unknown peer %q", req.Peer)
+		}
+		if p != "*" && p != req.Principal {
+			return fmt.Errorf("peer %q cannot act as principal", req.Peer)
+		}
+	}
+
+	if req.Owner != "" && req.Owner != req.verified() {
+		return fmt.Errorf("tuple owned by %q", req.Owner)
+	}
+	return nil
+}
+
+// ownerIndex holds the principal of each owned key tuple.  It is kept by a
+// hook on the tuple store so an owner is removed under the same lock as its
+// tuple however the tuple is removed.  Keys are striped across shards each
+// with its own lock
+type ownerIndex struct {
+	shards [ownerLockStripes]ownerShard
+
+	// Held while a mutation of a key is authorized and applied
+	locks [ownerLockStripes]sync.Mutex
+}
+
+// ownerShard holds the owners of a subset of the keys
+type ownerShard struct {
+	mu sync.RWMutex
+	m  map[string]map[string]string
+}
+
+func newOwnerIndex() *ownerIndex {
+	oi := &ownerIndex{}
+	for i := range oi.shards {
+		oi.shards[i].m = make(map[string]map[string]string)
+	}
+	return oi
+}
+
+// stripe returns the stripe of the key
+func (oi *ownerIndex) stripe(key []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(key)
+	return h.Sum32() % ownerLockStripes
+}
+
+// lock locks the stripe of the key returning the function to unlock it
+func (oi *ownerIndex) lock(key []byte) func() {
+	mu := &oi.locks[oi.stripe(key)]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (oi *ownerIndex) get(key []byte, h TupleHost) string {
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], h)
+
+	s := &oi.shards[oi.stripe(key)]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.m[string(key)][string(hk)]
+}
+
+// set records the principal as the owner of the tuple.  An empty principal
+// removes the owner
+func (oi *ownerIndex) set(key []byte, h TupleHost, principal string) {
+	if principal == "" {
+		oi.remove(key, h)
+		return
+	}
+
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], h)
+
+	s := &oi.shards[oi.stripe(key)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hosts, ok := s.m[string(key)]
+	if !ok {
+		hosts = make(map[string]string)
+		s.m[string(key)] = hosts
+	}
+	hosts[string(hk)] = principal
+}
+
+func (oi *ownerIndex) remove(key []byte, h TupleHost) {
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], h)
+
+	s := &oi.shards[oi.stripe(key)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hosts, ok := s.m[string(key)]
+	if !ok {
+		return
+	}
+	delete(hosts, string(hk))
+	if len(hosts) == 0 {
+		delete(s.m, string(key))
+	}
+}
+
+// change is the tuple store hook removing the owner of a host removed from a
+// key
+func (oi *ownerIndex) change(key []byte, h TupleHost, before, after int) error {
+	if after < before {
+		oi.remove(key, h)
+	}
+	return nil
+}
+
+// peerIdentity returns the authenticated identity of a request using the
+// signing key id or the remote static key of the encrypted session
+func peerIdentity(keyID uint32, signed bool, sess *noiseSession) string {
+	if signed {
+		return fmt.Sprintf("key:%d", keyID)
+	}
+	if sess != nil {
+		return "noise:" + hex.EncodeToString(sess.remote)
+	}
+	return ""
+}
+
+// owner returns the owner of the tuple if it is in the tuple store
+func (lrpc *localGroup) owner(key []byte, tuple TupleHost) string {
+	hosts, _ := lrpc.tuples.Get(key)
+	if !containsHost(hosts, tuple) {
+		return ""
+	}
+	return lrpc.owners.get(key, tuple)
+}
+
+// authorize consults the authorizer for the mutation if one is configured.  The
+// key must be locked so the owner cannot change before the mutation is applied
+func (lrpc *localGroup) authorize(op AccessOp, key []byte, tuple TupleHost, caller Caller, propogate bool) error {
+	if lrpc.authorizer == nil {
+		return nil
+	}
+
+	return lrpc.authorizeRequest(&AccessRequest{
+		Caller:     caller,
+		Op:         op,
+		Key:        key,
+		Tuple:      tuple,
+		Owner:      lrpc.owner(key, tuple),
+		Propagated: !propogate,
+	})
+}
+
+// authorizeCluster consults the authorizer for an operation affecting the
+// whole store or cluster if one is configured
+func (lrpc *localGroup) authorizeCluster(op AccessOp, tuple TupleHost, ns string, caller Caller) error {
+	if lrpc.authorizer == nil {
+		return nil
+	}
+
+	return lrpc.authorizeRequest(&AccessRequest{
+		Caller:    caller,
+		Op:        op,
+		Tuple:     tuple,
+		Namespace: ns,
+	})
+}
+
+func (lrpc *localGroup) authorizeRequest(req *AccessRequest) error {
+	if err := lrpc.authorizer.Authorize(req); err != nil {
+		return &AccessDeniedError{
+			Op:        req.Op,
+			Key:       append([]byte{}, req.Key...),
+			Principal: req.Principal,
+			Reason:    err.Error(),
+		}
+	}
+	return nil
+}
@@ -0,0 +1,333 @@
+package kelips
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+func Test_OwnerAuthorizer(t *testing.T) {
+	tuple := NewTupleHost("127.0.0.1:80")
+	req := func(principal, peer, owner string, remote bool) *AccessRequest {
+		return &AccessRequest{
+			Caller: Caller{Principal: principal, Peer: peer, Remote: remote},
+			Op:     AccessDelete,
+			Key:    []byte("key"),
+			Tuple:  tuple,
+			Owner:  owner,
+		}
+	}
+
+	oa := &OwnerAuthorizer{}
+	if err := oa.Authorize(req("a", "", "", true)); err != nil {
+		t.Fatal("unowned tuple should be allowed", err)
+	}
+	if err := oa.Authorize(req("a", "key:1", "a", true)); err != nil {
+		t.Fatal("owner should be allowed", err)
+	}
+	if err := oa.Authorize(req("b", "key:1", "a", true)); err == nil {
+		t.Fatal("non-owner should be denied")
+	}
+	// Principals of unauthenticated peers are not trusted
+	if err := oa.Authorize(req("a", "", "a", true)); err == nil {
+		t.Fatal("unauthenticated owner should be denied")
+	}
+	if err := oa.Authorize(req("", "", "a", false)); err == nil {
+		t.Fatal("anonymous should be denied on owned tuple")
+	}
+
+	oa.Peers = map[string]string{"key:1": "a", "key:9": "*"}
+	if err := oa.Authorize(req("a", "key:1", "a", true)); err != nil {
+		t.Fatal(err)
+	}
+	if err := oa.Authorize(req("a", "key:2", "a", true)); err == nil {
+		t.Fatal("unknown peer should be denied")
+	}
+	if err := oa.Authorize(req("b", "key:1", "", true)); err == nil {
+		t.Fatal("peer should not act as another principal")
+	}
+	if err := oa.Authorize(req("b", "key:9", "b", true)); err != nil {
+		t.Fatal("wildcard peer should act as any principal", err)
+	}
+	// Local calls are not bound to a peer
+	if err := oa.Authorize(req("a", "", "a", false)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Remote cluster operations are only allowed from wildcard peers
+	for _, op := range []AccessOp{AccessExpire, AccessPurge, AccessResize, AccessJoin} {
+		r := &AccessRequest{Caller: Caller{Peer: "key:1", Remote: true}, Op: op, Tuple: tuple}
+		if err := oa.Authorize(r); err == nil {
+			t.Fatalf("%s should be denied", op)
+		}
+		r.Peer = "key:9"
+		if err := oa.Authorize(r); err != nil {
+			t.Fatalf("%s should be allowed: %v", op, err)
+		}
+		r.Peer, r.Remote = "", false
+		if err := oa.Authorize(r); err != nil {
+			t.Fatalf("local %s should be allowed: %v", op, err)
+		}
+	}
+}
+
+// slowAuthorizer widens the window between authorizing and applying a mutation
+type slowAuthorizer struct {
+	OwnerAuthorizer
+}
+
+func (sa *slowAuthorizer) Authorize(req *AccessRequest) error {
+	time.Sleep(time.Millisecond)
+	return sa.OwnerAuthorizer.Authorize(req)
+}
+
+func Test_localGroup_authorizeConcurrent(t *testing.T) {
+	sn, _ := NewSimNetwork(1, DefaultSimConfig())
+	conf := fastTestConf("10.0.0.1:4000")
+	conf.Authorizer = &slowAuthorizer{}
+	k, err := Create(conf, sn.Transport(conf.AdvertiseHost))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := NewTupleHost("10.0.0.2:8080")
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+
+		var (
+			wg   sync.WaitGroup
+			errs [2]error
+		)
+		for j, principal := range []string{"a", "b"} {
+			wg.Add(1)
+			go func(j int, principal string) {
+				defer wg.Done()
+				errs[j] = k.local.Insert(key, tuple, Caller{Principal: principal}, false)
+			}(j, principal)
+		}
+		wg.Wait()
+
+		// Only one principal may claim the tuple
+		if (errs[0] == nil) == (errs[1] == nil) {
+			t.Fatalf("%s errs=%v", key, errs)
+		}
+		winner := "a"
+		if errs[0] != nil {
+			winner = "b"
+		}
+		if owner := k.local.owner(key, tuple); owner != winner {
+			t.Fatalf("%s owner=%q winner=%q", key, owner, winner)
+		}
+	}
+}
+
+func Test_localGroup_owners(t *testing.T) {
+	nodes, _ := testACLCluster(t, 1)
+	k := nodes[0]
+	tuple := NewTupleHost("10.0.0.2:8080")
+
+	insert := func(key string, caller Caller) {
+		if err := k.local.Insert([]byte(key), tuple, caller, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	insert("a", Caller{Principal: "team-a"})
+	insert("b", Caller{Principal: "team-a", Peer: "key:1", Remote: true})
+	insert("c", Caller{Principal: "team-a", Remote: true})
+
+	if owner := k.local.owners.get([]byte("b"), tuple); owner != "team-a" {
+		t.Fatalf("authenticated peer should own the tuple %q", owner)
+	}
+	if owner := k.local.owners.get([]byte("c"), tuple); owner != "" {
+		t.Fatalf("unauthenticated peer should not own the tuple %q", owner)
+	}
+
+	// Owners are removed with the tuple however it is removed
+	if err := k.tuples.Delete([]byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if owner := k.local.owners.get([]byte("a"), tuple); owner != "" {
+		t.Fatalf("owner should be removed with the key %q", owner)
+	}
+	k.RemoveNode(tuple.String())
+	if owner := k.local.owners.get([]byte("b"), tuple); owner != "" {
+		t.Fatalf("owner should be removed with the node %q", owner)
+	}
+
+	// A rejected insert does not claim the tuple
+	k.namespaces.SetQuota("ns", 1)
+	key := NamespaceKey("ns", []byte("d"))
+	insert(string(key), Caller{Principal: "team-a"})
+	other := NewTupleHost("10.0.0.3:8080")
+	if err := k.local.Insert(key, other, Caller{Principal: "team-b"}, false); err == nil {
+		t.Fatal("quota should be exceeded")
+	}
+	if owner := k.local.owners.get(key, other); owner != "" {
+		t.Fatalf("rejected insert should not own the tuple %q", owner)
+	}
+}
+
+func Test_AccessDeniedError_marshal(t *testing.T) {
+	in := &AccessDeniedError{Op: AccessInsert, Key: []byte("key"), Principal: "team-a", Reason: "nope"}
+	typ, b := encodeError(in)
+	if typ != respTypeDenied {
+		t.Fatal("wrong response type", typ)
+	}
+
+	var out *AccessDeniedError
+	if err := decodeError(typ, b); !errors.As(err, &out) {
+		t.Fatalf("should be access denied %v", err)
+	}
+	if out.Op != in.Op || string(out.Key) != "key" || out.Principal != "team-a" || out.Reason != "nope" {
+		t.Fatalf("wrong error %+v", out)
+	}
+
+	if typ, _ = encodeError(fmt.Errorf("other")); typ != respTypeFail {
+		t.Fatal("should be a failed response", typ)
+	}
+}
+
+// testACLCluster creates a single group cluster authorizing by owner
+func testACLCluster(t *testing.T, n int) ([]*Kelips, *SimNetwork) {
+	sn := testSimNetwork(t)
+	nodes, _ := testCluster(t, sn, n, func(conf *Config) {
+		conf.K = 1
+		conf.Authorizer = &OwnerAuthorizer{}
+	})
+	return nodes, sn
+}
+
+func Test_Kelips_ACL(t *testing.T) {
+	nodes, sn := testACLCluster(t, 2)
+	tuple := NewTupleHost("10.0.0.1:8080")
+
+	teamA, _ := sn.Client("10.0.1.1:4000", nodes[0].conf.AdvertiseHost)
+	defer teamA.Close()
+	teamA.SetPrincipal("team-a")
+	teamB, _ := sn.Client("10.0.1.2:4000", nodes[1].conf.AdvertiseHost)
+	defer teamB.Close()
+	teamB.SetPrincipal("team-b")
+
+	if err := teamA.Insert([]byte("svc/a"), tuple); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Ownership is propogated with the insert
+	for _, k := range nodes {
+		if owner := k.local.owner([]byte("svc/a"), tuple); owner != "team-a" {
+			t.Fatalf("host=%s wrong owner %q", k.conf.AdvertiseHost, owner)
+		}
+	}
+
+	var denied *AccessDeniedError
+	err := teamB.Delete([]byte("svc/a"), tuple)
+	if !errors.As(err, &denied) {
+		t.Fatalf("delete should be denied: %v", err)
+	}
+	if denied.Op != AccessDelete || denied.Principal != "team-b" || string(denied.Key) != "svc/a" {
+		t.Fatalf("wrong error %+v", denied)
+	}
+
+	// Batch errors are typed as well
+	errs, err := teamB.DeleteBatch([]BatchEntry{{Key: []byte("svc/a"), Tuple: tuple}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.As(errs[0], &denied) {
+		t.Fatalf("batch delete should be denied: %v", errs[0])
+	}
+
+	if _, err = nodes[1].Lookup([]byte("svc/a")); err != nil {
+		t.Fatal("tuple should remain", err)
+	}
+
+	// Owned tuples are kept in snapshots
+	snapshot := nodes[0].Snapshot()
+	if len(snapshot.Tuples) != 1 || len(snapshot.Tuples[0].Owners) != 1 || snapshot.Tuples[0].Owners[0] != "team-a" {
+		t.Fatalf("snapshot should have owner %+v", snapshot.Tuples)
+	}
+
+	if err = teamA.Delete([]byte("svc/a"), tuple); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, k := range nodes {
+		if hosts, _ := k.local.tuples.Get([]byte("svc/a")); len(hosts) != 0 {
+			t.Fatalf("host=%s tuple should be deleted", k.conf.AdvertiseHost)
+		}
+	}
+
+	// Once deleted anyone may insert it
+	if err = teamB.Insert([]byte("svc/a"), tuple); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Kelips_ACL_peers(t *testing.T) {
+	host := "127.0.0.1:54682"
+	conf := fastTestConf(host)
+	conf.Authorizer = &OwnerAuthorizer{Peers: map[string]string{"key:1": "team-a", "key:2": "team-b"}}
+
+	kr := NewHMACKeyring(0, []byte("node"))
+	kr.AddKey(1, []byte("secret-a"))
+	kr.AddKey(2, []byte("secret-b"))
+
+	trans := newBareTrans(host)
+	trans.SetAuth(NewTransportAuth(kr, 0))
+	k, err := Create(conf, trans)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var clients []*Client
+	defer func() {
+		for _, c := range clients {
+			c.Close()
+		}
+	}()
+	newClient := func(id uint32, secret, principal string) *Client {
+		ckr := NewHMACKeyring(id, []byte(secret))
+		ckr.AddKey(0, []byte("node"))
+
+		c, _ := NewClient(host)
+		clients = append(clients, c)
+		c.SetAuth(NewTransportAuth(ckr, 0))
+		c.SetPrincipal(principal)
+		return c
+	}
+
+	tuple := NewTupleHost("10.0.0.1:8080")
+	if err := newClient(1, "secret-a", "team-a").Insert([]byte("svc/a"), tuple); err != nil {
+		t.Fatal(err)
+	}
+
+	// Team b claiming to be team a
+	var denied *AccessDeniedError
+	if err := newClient(2, "secret-b", "team-a").Delete([]byte("svc/a"), tuple); !errors.As(err, &denied) {
+		t.Fatalf("should be denied: %v", err)
+	}
+
+	// Cluster operations are denied to peers acting as a single principal
+	teamB := newClient(2, "secret-b", "team-b")
+	if err := teamB.ExpireHost(tuple.String()); !errors.As(err, &denied) || denied.Op != AccessExpire {
+		t.Fatalf("expire should be denied: %v", err)
+	}
+	if err := teamB.purgeNamespace("ns"); !errors.As(err, &denied) || denied.Op != AccessPurge {
+		t.Fatalf("purge should be denied: %v", err)
+	}
+	if err := teamB.trans.Resize(host, 10, 4); !errors.As(err, &denied) || denied.Op != AccessResize {
+		t.Fatalf("resize should be denied: %v", err)
+	}
+	if _, err := teamB.trans.Join(host, &kelipspb.Node{Address: kelipspb.Address(NewTupleHost("10.0.0.2:4000"))}); !errors.As(err, &denied) || denied.Op != AccessJoin {
+		t.Fatalf("join should be denied: %v", err)
+	}
+	if _, err = k.local.tuples.Get([]byte("svc/a")); err != nil {
+		t.Fatal("tuple should remain", err)
+	}
+}
@@ -0,0 +1,349 @@
+package kelips
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Size of the random nonce in each request
+	nonceSize = 16
+
+	// Default max difference between the request timestamp and local time
+	defaultMaxSkew = 30 * time.Second
+)
+
+// MessageSigner signs and verifies transport messages.  Keys are identified by
+// an id allowing them to be rotated without interruption
+type MessageSigner interface {
+	// Sign signs the message with the primary key returning its id
+	Sign(msg []byte) (uint32, []byte, error)
+
+	// Verify verifies the signature of the message with the key of the id
+	Verify(keyID uint32, msg, sig []byte) error
+}
+
+// HMACKeyring signs messages with HMAC-SHA256 using shared keys.  A key is
+// rotated by adding the new key on all nodes, making it the primary and then
+// removing the old key
+type HMACKeyring struct {
+	mu      sync.RWMutex
+	primary uint32
+	keys    map[uint32][]byte
+}
+
+// NewHMACKeyring inits a keyring with the primary key
+func NewHMACKeyring(id uint32, key []byte) *HMACKeyring {
+	return &HMACKeyring{primary: id, keys: map[uint32][]byte{id: key}}
+}
+
+// AddKey adds a key used to verify messages.  It replaces an existing key with
+// the same id
+func (kr *HMACKeyring) AddKey(id uint32, key []byte) {
+	kr.mu.Lock()
+	kr.keys[id] = key
+	kr.mu.Unlock()
+}
+
+// SetPrimary sets the key used to sign messages
+func (kr *HMACKeyring) SetPrimary(id uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, ok := kr.keys[id]; !ok {
+		return fmt.Errorf("key not found: %d", id)
+	}
+	kr.primary = id
+	return nil
+}
+
+// RemoveKey removes a key.  The primary key cannot be removed
+func (kr *HMACKeyring) RemoveKey(id uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if id == kr.primary {
+		return fmt.Errorf("primary key cannot be removed: %d", id)
+	}
+	delete(kr.keys, id)
+	return nil
+}
+
+// Sign returns the HMAC of the message using the primary key
+func (kr *HMACKeyring) Sign(msg []byte) (uint32, []byte, error) {
+	kr.mu.RLock()
+	id, key := kr.primary, kr.keys[kr.primary]
+	kr.mu.RUnlock()
+
+	return id, kr.mac(key, msg), nil
+}
+
+// Verify checks the HMAC of the message using the key of the id
+func (kr *HMACKeyring) Verify(keyID uint32, msg, sig []byte) error {
+	kr.mu.RLock()
+	key, ok := kr.keys[keyID]
+	kr.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown key: %d", keyID)
+	}
+	if !hmac.Equal(kr.mac(key, msg), sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func (kr *HMACKeyring) mac(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// Ed25519Keyring signs messages with an Ed25519 private key and verifies them
+// with the public keys of all trusted signers.  Nodes may hold their own key
+// pair with each trusting the public keys of the others
+type Ed25519Keyring struct {
+	mu      sync.RWMutex
+	primary uint32
+	private map[uint32]ed25519.PrivateKey
+	public  map[uint32]ed25519.PublicKey
+}
+
+// NewEd25519Keyring inits a keyring with the primary private key
+func NewEd25519Keyring(id uint32, key ed25519.PrivateKey) *Ed25519Keyring {
+	kr := &Ed25519Keyring{
+		private: make(map[uint32]ed25519.PrivateKey),
+		public:  make(map[uint32]ed25519.PublicKey),
+	}
+	kr.AddPrivateKey(id, key)
+	kr.primary = id
+	return kr
+}
+
+// AddPrivateKey adds a private key that can be made the primary along with its
+// public key
+func (kr *Ed25519Keyring) AddPrivateKey(id uint32, key ed25519.PrivateKey) {
+	kr.mu.Lock()
+	kr.private[id] = key
+	kr.public[id] = key.Public().(ed25519.PublicKey)
+	kr.mu.Unlock()
+}
+
+// AddKey adds a public key used to verify messages
+func (kr *Ed25519Keyring) AddKey(id uint32, key ed25519.PublicKey) {
+	kr.mu.Lock()
+	kr.public[id] = key
+	kr.mu.Unlock()
+}
+
+// SetPrimary sets the private key used to sign messages
+func (kr *Ed25519Keyring) SetPrimary(id uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if _, ok := kr.private[id]; !ok {
+		return fmt.Errorf("private key not found: %d", id)
+	}
+	kr.primary = id
+	return nil
+}
+
+// RemoveKey removes the public and private key.  The primary key cannot be
+// removed
+func (kr *Ed25519Keyring) RemoveKey(id uint32) error {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+
+	if id == kr.primary {
+		return fmt.Errorf("primary key cannot be removed: %d", id)
+	}
+	delete(kr.private, id)
+	delete(kr.public, id)
+	return nil
+}
+
+// Sign signs the message with the primary private key
+func (kr *Ed25519Keyring) Sign(msg []byte) (uint32, []byte, error) {
+	kr.mu.RLock()
+	id, key := kr.primary, kr.private[kr.primary]
+	kr.mu.RUnlock()
+
+	return id, ed25519.Sign(key, msg), nil
+}
+
+// Verify verifies the signature with the public key of the id
+func (kr *Ed25519Keyring) Verify(keyID uint32, msg, sig []byte) error {
+	kr.mu.RLock()
+	key, ok := kr.public[keyID]
+	kr.mu.RUnlock()
+
+	if !ok {
+		return fmt.Errorf("unknown key: %d", keyID)
+	}
+	if !ed25519.Verify(key, msg, sig) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// replayCache tracks nonces seen within the allowed clock skew
+type replayCache struct {
+	mu        sync.Mutex
+	seen      map[[nonceSize]byte]int64
+	lastPrune time.Time
+}
+
+// check returns an error if the nonce has already been seen.  Nonces are kept
+// until the timestamp is beyond the skew after which the request is rejected
+// based on its timestamp
+func (rc *replayCache) check(nonce []byte, expires time.Time, now time.Time) error {
+	var n [nonceSize]byte
+	copy(n[:], nonce)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if _, ok := rc.seen[n]; ok {
+		return fmt.Errorf("replayed request")
+	}
+	rc.seen[n] = expires.UnixNano()
+
+	if now.Sub(rc.lastPrune) > time.Second {
+		ts := now.UnixNano()
+		for k, exp := range rc.seen {
+			if exp < ts {
+				delete(rc.seen, k)
+			}
+		}
+		rc.lastPrune = now
+	}
+	return nil
+}
+
+// TransportAuth signs and verifies requests and responses sent by the
+// UDPTransport.  Requests carry a timestamp and random nonce which are checked
+// to reject replays.  Responses are signed along with the nonce of the request
+// so they cannot be replayed to other requests
+type TransportAuth struct {
+	signer  MessageSigner
+	maxSkew time.Duration
+	replay  *replayCache
+}
+
+// NewTransportAuth inits authentication using the signer.  Requests with a
+// timestamp further than the max skew from the local time are rejected.  The
+// default skew is used if it is not positive
+func NewTransportAuth(signer MessageSigner, maxSkew time.Duration) *TransportAuth {
+	if maxSkew <= 0 {
+		maxSkew = defaultMaxSkew
+	}
+	return &TransportAuth{
+		signer:  signer,
+		maxSkew: maxSkew,
+		replay:  &replayCache{seen: make(map[[nonceSize]byte]int64)},
+	}
+}
+
+// envelope builds the signed envelope [key id][sig len][sig][signed data]
+func (auth *TransportAuth) envelope(signed []byte, prefix []byte) ([]byte, error) {
+	msg := make([]byte, 0, len(prefix)+len(signed))
+	msg = append(append(msg, prefix...), signed...)
+
+	id, sig, err := auth.signer.Sign(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 5, 5+len(sig)+len(signed))
+	binary.BigEndian.PutUint32(out, id)
+	out[4] = byte(len(sig))
+	out = append(out, sig...)
+	return append(out, signed...), nil
+}
+
+// verify verifies an envelope returning the signed data
+func (auth *TransportAuth) verify(b []byte, prefix []byte) ([]byte, error) {
+	if len(b) < 5 {
+		return nil, fmt.Errorf("auth: size too small")
+	}
+
+	id := binary.BigEndian.Uint32(b)
+	sl := int(b[4])
+	if len(b) < 5+sl {
+		return nil, fmt.Errorf("auth: invalid signature length")
+	}
+
+	sig, signed := b[5:5+sl], b[5+sl:]
+	msg := make([]byte, 0, len(prefix)+len(signed))
+	msg = append(append(msg, prefix...), signed...)
+	if err := auth.signer.Verify(id, msg, sig); err != nil {
+		return nil, err
+	}
+	return signed, nil
+}
+
+// sealRequest signs the request with the timestamp and a new nonce returning
+// the envelope and nonce
+func (auth *TransportAuth) sealRequest(req []byte) ([]byte, []byte, error) {
+	signed := make([]byte, 8+nonceSize, 8+nonceSize+len(req))
+	binary.BigEndian.PutUint64(signed, uint64(time.Now().UnixNano()))
+	if _, err := rand.Read(signed[8:]); err != nil {
+		return nil, nil, err
+	}
+	signed = append(signed, req...)
+
+	b, err := auth.envelope(signed, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, signed[8 : 8+nonceSize], nil
+}
+
+// envelopeKeyID returns the id of the key an envelope was signed with
+func envelopeKeyID(b []byte) uint32 {
+	if len(b) < 4 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+// openRequest verifies the request envelope, its timestamp and nonce
+// returning the request and nonce
+func (auth *TransportAuth) openRequest(b []byte) ([]byte, []byte, error) {
+	signed, err := auth.verify(b, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(signed) < 8+nonceSize {
+		return nil, nil, fmt.Errorf("auth: size too small")
+	}
+
+	now := time.Now()
+	ts := time.Unix(0, int64(binary.BigEndian.Uint64(signed)))
+	if d := now.Sub(ts); d > auth.maxSkew || d < -auth.maxSkew {
+		return nil, nil, fmt.Errorf("request timestamp outside allowed skew: %v", d)
+	}
+
+	nonce := signed[8 : 8+nonceSize]
+	if err = auth.replay.check(nonce, ts.Add(auth.maxSkew), now); err != nil {
+		return nil, nil, err
+	}
+
+	return signed[8+nonceSize:], nonce, nil
+}
+
+// sealResponse signs the response along with the request nonce
+func (auth *TransportAuth) sealResponse(nonce []byte, resp []byte) ([]byte, error) {
+	return auth.envelope(resp, nonce)
+}
+
+// openResponse verifies the response was signed for the request nonce
+func (auth *TransportAuth) openResponse(nonce []byte, b []byte) ([]byte, error) {
+	return auth.verify(b, nonce)
+}
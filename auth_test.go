@@ -0,0 +1,182 @@
+package kelips
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+func newAuthTestTransport(addr string, auth *TransportAuth) *UDPTransport {
+	trans := newBareTrans(addr)
+	trans.SetAuth(auth)
+	trans.Register(&MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)})
+	return trans
+}
+
+func Test_HMACKeyring(t *testing.T) {
+	kr := NewHMACKeyring(1, []byte("key-1"))
+	id, sig, err := kr.Sign([]byte("msg"))
+	if err != nil || id != 1 {
+		t.Fatal("should sign with primary", id, err)
+	}
+	if err = kr.Verify(1, []byte("msg"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if err = kr.Verify(1, []byte("other"), sig); err == nil {
+		t.Fatal("should fail with modified message")
+	}
+	if err = kr.Verify(2, []byte("msg"), sig); err == nil {
+		t.Fatal("should fail with unknown key")
+	}
+
+	// Rotate
+	if err = kr.SetPrimary(2); err == nil {
+		t.Fatal("should fail with missing key")
+	}
+	kr.AddKey(2, []byte("key-2"))
+	if err = kr.SetPrimary(2); err != nil {
+		t.Fatal(err)
+	}
+	if err = kr.RemoveKey(2); err == nil {
+		t.Fatal("should not remove primary")
+	}
+	if err = kr.RemoveKey(1); err != nil {
+		t.Fatal(err)
+	}
+	if err = kr.Verify(1, []byte("msg"), sig); err == nil {
+		t.Fatal("should fail with removed key")
+	}
+	if id, _, _ = kr.Sign([]byte("msg")); id != 2 {
+		t.Fatal("should sign with new primary", id)
+	}
+}
+
+func Test_Ed25519Keyring(t *testing.T) {
+	_, priv1, _ := ed25519.GenerateKey(rand.Reader)
+	pub2, priv2, _ := ed25519.GenerateKey(rand.Reader)
+
+	kr1 := NewEd25519Keyring(1, priv1)
+	kr2 := NewEd25519Keyring(2, priv2)
+	kr1.AddKey(2, pub2)
+
+	id, sig, _ := kr2.Sign([]byte("msg"))
+	if err := kr1.Verify(id, []byte("msg"), sig); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr1.SetPrimary(2); err == nil {
+		t.Fatal("should not use public key as primary")
+	}
+
+	id, sig, _ = kr1.Sign([]byte("msg"))
+	if err := kr2.Verify(id, []byte("msg"), sig); err == nil {
+		t.Fatal("should fail with untrusted key")
+	}
+}
+
+func Test_TransportAuth(t *testing.T) {
+	auth := NewTransportAuth(NewHMACKeyring(1, []byte("secret")), time.Second)
+
+	sealed, nonce, err := auth.sealRequest([]byte("request"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, rnonce, err := auth.openRequest(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(req) != "request" || string(rnonce) != string(nonce) {
+		t.Fatal("wrong request")
+	}
+	if _, _, err = auth.openRequest(sealed); err == nil {
+		t.Fatal("should fail with replayed request")
+	}
+
+	// Tampered
+	sealed, _, _ = auth.sealRequest([]byte("request"))
+	sealed[len(sealed)-1] ^= 0xff
+	if _, _, err = auth.openRequest(sealed); err == nil {
+		t.Fatal("should fail with tampered request")
+	}
+
+	// Outside of skew
+	old := NewTransportAuth(NewHMACKeyring(1, []byte("secret")), time.Second)
+	sealed, _, _ = old.sealRequest([]byte("request"))
+	<-time.After(1100 * time.Millisecond)
+	if _, _, err = auth.openRequest(sealed); err == nil {
+		t.Fatal("should fail with old timestamp")
+	}
+
+	// Response bound to the request nonce
+	resp, err := auth.sealResponse(nonce, []byte("response"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := auth.openResponse(nonce, resp); err != nil || string(b) != "response" {
+		t.Fatal("wrong response", err)
+	}
+	_, other, _ := auth.sealRequest([]byte("request"))
+	if _, err = auth.openResponse(other, resp); err == nil {
+		t.Fatal("should fail with response to another request")
+	}
+}
+
+func Test_UDPTransport_Auth(t *testing.T) {
+	kr := NewHMACKeyring(1, []byte("secret"))
+	newAuthTestTransport("127.0.0.1:54670", NewTransportAuth(kr, 0))
+
+	client := NewUDPTransport(nil)
+	tuple := NewTupleHost("127.0.0.1:54670")
+
+	// Unauthenticated requests are dropped
+	if err := client.Insert("127.0.0.1:54670", []byte("key"), tuple, "", false); err == nil {
+		t.Fatal("should fail without auth")
+	}
+
+	client.SetAuth(NewTransportAuth(NewHMACKeyring(1, []byte("wrong")), 0))
+	if err := client.Insert("127.0.0.1:54670", []byte("key"), tuple, "", false); err == nil {
+		t.Fatal("should fail with wrong key")
+	}
+
+	ckr := NewHMACKeyring(1, []byte("secret"))
+	client.SetAuth(NewTransportAuth(ckr, 0))
+	if err := client.Insert("127.0.0.1:54670", []byte("key"), tuple, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if nodes, err := client.Lookup("127.0.0.1:54670", []byte("key")); err != nil || len(nodes) == 0 {
+		t.Fatal("should have nodes", err)
+	}
+
+	// Rotate the key with the server accepting both
+	kr.AddKey(2, []byte("secret-2"))
+	ckr.AddKey(2, []byte("secret-2"))
+	ckr.SetPrimary(2)
+	if _, err := client.Lookup("127.0.0.1:54670", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replayed request is dropped
+	auth := NewTransportAuth(ckr, 0)
+	req, _, _ := auth.sealRequest(client.request(reqTypeLookup, []byte("key")))
+	conn, err := net.Dial("udp4", "127.0.0.1:54670")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, maxUDPBufSize)
+	for i := 0; i < 2; i++ {
+		conn.Write(framePacket([]byte{0, 0, 0, 1}, req))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = conn.Read(buf)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 {
+			if e, ok := err.(net.Error); !ok || !e.Timeout() {
+				t.Fatal("replayed request should be dropped", err)
+			}
+		}
+	}
+}
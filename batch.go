@@ -0,0 +1,485 @@
+package kelips
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+const (
+	// Max encoded size of a single batch request leaving room for the header
+	maxBatchRequestSize = maxUDPBufSize - 1024
+
+	// Max number of keys in a single batch lookup request as each may return
+	// a number of nodes
+	maxLookupBatchKeys = 64
+)
+
+// errLookupTooLarge is returned for a key in a batch lookup whose result does
+// not fit in the response
+var errLookupTooLarge = errors.New("batch: lookup result too large for response")
+
+// BatchEntry is a key and tuple pair in a batch insert or delete
+type BatchEntry struct {
+	Key   []byte
+	Tuple TupleHost
+}
+
+// LookupResult is the result of a single key in a batch lookup
+type LookupResult struct {
+	Nodes []*kelipspb.Node
+	Err   error
+}
+
+// batchGroups maps each index of a batch to the group it is sent to
+type batchGroups map[*affinityGroup][]int
+
+// groupBatch groups the batch indexes by the group each key belongs to in the
+// layout.  If a group has no nodes the next closest group with nodes is used.
+// Indexes of keys with no group are returned separately
+func (kelips *Kelips) groupBatch(l *layout, n int, key func(i int) []byte) (batchGroups, []int) {
+	h := kelips.conf.HashFunc()
+	groups := make(batchGroups)
+
+	var missing []int
+	for i := 0; i < n; i++ {
+		h.Reset()
+		h.Write(key(i))
+
+		group := l.groups.get(h.Sum(nil))
+		if group.count() == 0 {
+			if group = l.groups.nextClosestGroup(group); group == nil {
+				missing = append(missing, i)
+				continue
+			}
+		}
+		groups[group] = append(groups[group], i)
+	}
+
+	return groups, missing
+}
+
+// InsertBatch inserts each entry into the group the key belongs to.  A single
+// request is sent to a node of each foreign group.  The returned errors are in
+// the same order as the entries with a nil error for successful inserts
+func (kelips *Kelips) InsertBatch(entries []BatchEntry) []error {
+	errs := make([]error, len(entries))
+	valid, idxs := checkEntries(entries, errs)
+
+	for j, err := range kelips.updateBatch(kelips.local.layout(), valid, true) {
+		errs[idxs[j]] = err
+	}
+	return errs
+}
+
+// DeleteBatch deletes each entry from the group the key belongs to.  A single
+// request is sent to a node of each foreign group.  While a resize is in
+// progress entries are also deleted from the groups in the previous layout.
+// The returned errors are in the same order as the entries
+func (kelips *Kelips) DeleteBatch(entries []BatchEntry) []error {
+	errs := make([]error, len(entries))
+	valid, idxs := checkEntries(entries, errs)
+
+	cur, prev := kelips.local.layouts()
+	for j, err := range kelips.updateBatch(cur, valid, false) {
+		errs[idxs[j]] = err
+	}
+
+	if prev != nil {
+		// Remove tuples not yet migrated
+		kelips.updateBatch(prev, valid, false)
+	}
+	return errs
+}
+
+// checkEntries returns the entries with valid keys along with their indexes.
+// The error of each entry with an invalid key is set in errs
+func checkEntries(entries []BatchEntry, errs []error) ([]BatchEntry, []int) {
+	valid := make([]BatchEntry, 0, len(entries))
+	idxs := make([]int, 0, len(entries))
+	for i, e := range entries {
+		if errs[i] = checkKey(e.Key); errs[i] == nil {
+			valid = append(valid, e)
+			idxs = append(idxs, i)
+		}
+	}
+	return valid, idxs
+}
+
+// updateBatch inserts or deletes the entries grouping them by the groups in
+// the layout.  Groups are updated concurrently
+func (kelips *Kelips) updateBatch(l *layout, entries []BatchEntry, insert bool) []error {
+	errs := make([]error, len(entries))
+
+	groups, missing := kelips.groupBatch(l, len(entries), func(i int) []byte { return entries[i].Key })
+	for _, i := range missing {
+		errs[i] = fmt.Errorf("no nodes found for key: %x", entries[i].Key)
+	}
+
+	var wg sync.WaitGroup
+	for group, idxs := range groups {
+		wg.Add(1)
+		go func(group *affinityGroup, idxs []int) {
+			defer wg.Done()
+
+			batch := make([]BatchEntry, len(idxs))
+			for j, i := range idxs {
+				batch[j] = entries[i]
+			}
+
+			var berrs []error
+			if group.index == l.idx {
+				berrs = kelips.local.updateBatch(batch, insert, Caller{Principal: kelips.conf.Principal}, true)
+			} else {
+				berrs = kelips.remoteUpdateBatch(group, batch, insert)
+			}
+
+			for j, i := range idxs {
+				errs[i] = berrs[j]
+			}
+		}(group, idxs)
+	}
+	wg.Wait()
+
+	return errs
+}
+
+// remoteUpdateBatch sends the batch to the first node in the group that
+// responds
+func (kelips *Kelips) remoteUpdateBatch(group *affinityGroup, batch []BatchEntry, insert bool) []error {
+	var err error
+	for _, n := range group.Nodes() {
+		var errs []error
+		if insert {
+			errs, err = kelips.trans.InsertBatch(n.Address.String(), batch, kelips.conf.Principal, true)
+		} else {
+			errs, err = kelips.trans.DeleteBatch(n.Address.String(), batch, kelips.conf.Principal, true)
+		}
+		if err == nil {
+			return errs
+		}
+	}
+
+	errs := make([]error, len(batch))
+	for i := range errs {
+		errs[i] = err
+	}
+	return errs
+}
+
+// LookupBatch looks up the nodes for each key.  A single request is sent to a
+// node of each foreign group.  While a resize is in progress keys not found in
+// the current layout are looked up in the previous one.  The results are in
+// the same order as the keys with nodes ordered by the configured locality
+// preference
+func (kelips *Kelips) LookupBatch(keys [][]byte) []LookupResult {
+	cur, prev := kelips.local.layouts()
+	results := kelips.lookupBatch(cur, keys)
+
+	if prev != nil {
+		var (
+			retry [][]byte
+			idxs  []int
+		)
+		for i, r := range results {
+			if r.Err != nil || len(r.Nodes) == 0 {
+				retry = append(retry, keys[i])
+				idxs = append(idxs, i)
+			}
+		}
+
+		if len(retry) > 0 {
+			for j, r := range kelips.lookupBatch(prev, retry) {
+				if r.Err == nil && len(r.Nodes) > 0 {
+					results[idxs[j]] = r
+				}
+			}
+		}
+	}
+
+	for _, r := range results {
+		if r.Err == nil {
+			kelips.local.sortNodes(r.Nodes, kelips.conf.Locality)
+		}
+	}
+	return results
+}
+
+func (kelips *Kelips) lookupBatch(l *layout, keys [][]byte) []LookupResult {
+	results := make([]LookupResult, len(keys))
+
+	groups, missing := kelips.groupBatch(l, len(keys), func(i int) []byte { return keys[i] })
+	for _, i := range missing {
+		results[i].Err = fmt.Errorf("no nodes found for key: %x", keys[i])
+	}
+
+	var wg sync.WaitGroup
+	for group, idxs := range groups {
+		wg.Add(1)
+		go func(group *affinityGroup, idxs []int) {
+			defer wg.Done()
+
+			batch := make([][]byte, len(idxs))
+			for j, i := range idxs {
+				batch[j] = keys[i]
+			}
+
+			var res []LookupResult
+			if group.index == l.idx {
+				res = kelips.local.lookupBatch(batch)
+			} else {
+				res = kelips.remoteLookupBatch(group, batch)
+			}
+
+			for j, i := range idxs {
+				results[i] = res[j]
+			}
+		}(group, idxs)
+	}
+	wg.Wait()
+
+	return results
+}
+
+// remoteLookupBatch sends the lookup to the first node in the group that
+// responds
+func (kelips *Kelips) remoteLookupBatch(group *affinityGroup, keys [][]byte) []LookupResult {
+	var err error
+	for _, n := range group.Nodes() {
+		var res []LookupResult
+		if res, err = kelips.trans.LookupBatch(n.Address.String(), keys); err == nil {
+			return res
+		}
+	}
+
+	res := make([]LookupResult, len(keys))
+	for i := range res {
+		res[i].Err = err
+	}
+	return res
+}
+
+// updateBatch inserts or deletes each entry in the local group on behalf of the
+// caller
+func (lrpc *localGroup) updateBatch(entries []BatchEntry, insert bool, caller Caller, propogate bool) []error {
+	errs := make([]error, len(entries))
+	for i, e := range entries {
+		if insert {
+			errs[i] = lrpc.Insert(e.Key, e.Tuple, caller, propogate)
+		} else {
+			errs[i] = lrpc.Delete(e.Key, e.Tuple, caller, propogate)
+		}
+	}
+	return errs
+}
+
+// lookupBatch looks up each key in the local group
+func (lrpc *localGroup) lookupBatch(keys [][]byte) []LookupResult {
+	results := make([]LookupResult, len(keys))
+	for i, key := range keys {
+		results[i].Nodes, results[i].Err = lrpc.Lookup(key)
+	}
+	return results
+}
+
+// chunkEntries splits the entries into chunks whose encoded size fits in a
+// single request
+func chunkEntries(entries []BatchEntry) [][]BatchEntry {
+	var (
+		chunks [][]BatchEntry
+		start  int
+		size   int
+	)
+	for i, e := range entries {
+		s := 3 + len(e.Tuple) + len(e.Key)
+		if i > start && size+s > maxBatchRequestSize {
+			chunks = append(chunks, entries[start:i])
+			start, size = i, 0
+		}
+		size += s
+	}
+	if start < len(entries) {
+		chunks = append(chunks, entries[start:])
+	}
+	return chunks
+}
+
+// chunkKeys splits the keys into chunks whose encoded size fits in a single
+// request and do not exceed the max lookup keys
+func chunkKeys(keys [][]byte) [][][]byte {
+	var (
+		chunks [][][]byte
+		start  int
+		size   int
+	)
+	for i, key := range keys {
+		s := 2 + len(key)
+		if i > start && (size+s > maxBatchRequestSize || i-start >= maxLookupBatchKeys) {
+			chunks = append(chunks, keys[start:i])
+			start, size = i, 0
+		}
+		size += s
+	}
+	if start < len(keys) {
+		chunks = append(chunks, keys[start:])
+	}
+	return chunks
+}
+
+// encodeEntries encodes each entry as the tuple length, tuple, key length and
+// key
+func encodeEntries(entries []BatchEntry) ([]byte, error) {
+	var (
+		buf []byte
+		err error
+	)
+	for _, e := range entries {
+		buf = append(buf, byte(len(e.Tuple)))
+		buf = append(buf, e.Tuple...)
+		if buf, err = appendUint16Bytes(buf, e.Key); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func decodeEntries(b []byte) ([]BatchEntry, error) {
+	var entries []BatchEntry
+	for len(b) > 0 {
+		tl := int(b[0])
+		if len(b) < 1+tl {
+			return nil, fmt.Errorf("batch: invalid tuple")
+		}
+		tuple := TupleHost(b[1 : 1+tl])
+
+		key, rest, err := readUint16Bytes(b[1+tl:])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, BatchEntry{Key: key, Tuple: tuple})
+		b = rest
+	}
+	return entries, nil
+}
+
+// encodeKeys encodes each key prefixed with its length
+func encodeKeys(keys [][]byte) ([]byte, error) {
+	var (
+		buf []byte
+		err error
+	)
+	for _, key := range keys {
+		if buf, err = appendUint16Bytes(buf, key); err != nil {
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+func decodeKeys(b []byte) ([][]byte, error) {
+	var keys [][]byte
+	for len(b) > 0 {
+		key, rest, err := readUint16Bytes(b)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+		b = rest
+	}
+	return keys, nil
+}
+
+// encodeResult encodes a single batch result as the response type followed by
+// the length prefixed payload.  The payload is the encoded error on failure
+func encodeResult(buf []byte, payload []byte, err error) []byte {
+	typ := respTypeOk
+	if err != nil {
+		typ, payload = encodeError(err)
+	}
+
+	lb := make([]byte, 4)
+	binary.BigEndian.PutUint32(lb, uint32(len(payload)))
+	buf = append(append(buf, typ), lb...)
+	return append(buf, payload...)
+}
+
+// decodeResults decodes n results returning the payload and error of each
+func decodeResults(b []byte, n int) ([][]byte, []error, error) {
+	payloads := make([][]byte, n)
+	errs := make([]error, n)
+
+	for i := 0; i < n; i++ {
+		if len(b) < 5 {
+			return nil, nil, fmt.Errorf("batch: invalid result")
+		}
+		l := int(binary.BigEndian.Uint32(b[1:]))
+		if len(b) < 5+l {
+			return nil, nil, fmt.Errorf("batch: invalid result")
+		}
+
+		if b[0] == respTypeOk {
+			payloads[i] = b[5 : 5+l]
+		} else {
+			errs[i] = decodeError(b[0], b[5:5+l])
+		}
+		b = b[5+l:]
+	}
+
+	return payloads, errs, nil
+}
+
+// encodeLookupResults encodes each result with the nodes as a ReqResp.  The
+// response is kept within the size of a request with room left for the error
+// of each remaining key.  Results that do not fit are returned as
+// errLookupTooLarge so the key can be looked up on its own
+func encodeLookupResults(keys [][]byte, results []LookupResult) ([]byte, error) {
+	var (
+		buf     []byte
+		errSize = 5 + len(errLookupTooLarge.Error())
+	)
+	for i, r := range results {
+		if r.Err != nil {
+			buf = encodeResult(buf, nil, r.Err)
+			continue
+		}
+
+		b, err := proto.Marshal(&kelipspb.ReqResp{Key: keys[i], Nodes: r.Nodes})
+		if err != nil {
+			return nil, err
+		}
+		if len(buf)+5+len(b)+(len(results)-i-1)*errSize > maxBatchRequestSize {
+			buf = encodeResult(buf, nil, errLookupTooLarge)
+			continue
+		}
+		buf = encodeResult(buf, b, nil)
+	}
+	return buf, nil
+}
+
+// appendUint16Bytes appends b prefixed with its length.  It returns an error if
+// b is longer than a uint16 allows
+func appendUint16Bytes(buf []byte, b []byte) ([]byte, error) {
+	if len(b) > math.MaxUint16 {
+		return nil, fmt.Errorf("batch: length too large: %d", len(b))
+	}
+	lb := make([]byte, 2)
+	binary.BigEndian.PutUint16(lb, uint16(len(b)))
+	return append(append(buf, lb...), b...), nil
+}
+
+func readUint16Bytes(b []byte) ([]byte, []byte, error) {
+	if len(b) < 2 {
+		return nil, nil, fmt.Errorf("batch: size too small")
+	}
+	l := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+l {
+		return nil, nil, fmt.Errorf("batch: invalid length")
+	}
+	return b[2 : 2+l], b[2+l:], nil
+}
@@ -0,0 +1,340 @@
+package kelips
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_batch_encoding(t *testing.T) {
+	entries := []BatchEntry{
+		{Key: []byte("key1"), Tuple: NewTupleHostFromHostPort("127.0.0.1", 1000)},
+		{Key: []byte{}, Tuple: NewTupleHostFromHostPort("::1", 1001)},
+		{Key: []byte("key3"), Tuple: NewTupleHostFromHostPort("10.0.0.1", 1002)},
+	}
+
+	b, err := encodeEntries(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := decodeEntries(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(entries) {
+		t.Fatal("wrong count", len(out))
+	}
+	for i := range out {
+		if !bytes.Equal(out[i].Key, entries[i].Key) || out[i].Tuple.String() != entries[i].Tuple.String() {
+			t.Fatal("entry mismatch", i)
+		}
+	}
+	if _, err = decodeEntries([]byte{18, 1, 2}); err == nil {
+		t.Fatal("should fail with truncated entry")
+	}
+
+	keys := [][]byte{[]byte("a"), []byte("bb"), {}}
+	b, _ = encodeKeys(keys)
+	outKeys, err := decodeKeys(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(outKeys) != 3 || !bytes.Equal(outKeys[1], keys[1]) {
+		t.Fatal("key mismatch")
+	}
+
+	// Lengths are never truncated
+	if _, err = encodeKeys([][]byte{make([]byte, 1<<16)}); err == nil {
+		t.Fatal("should fail on key too large")
+	}
+	if _, err = encodeEntries([]BatchEntry{{Key: make([]byte, 1<<16)}}); err == nil {
+		t.Fatal("should fail on key too large")
+	}
+
+	buf := encodeResult(nil, []byte("ok"), nil)
+	buf = encodeResult(buf, nil, fmt.Errorf("failed"))
+	payloads, errs, err := decodeResults(buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(payloads[0]) != "ok" || errs[0] != nil || errs[1] == nil || errs[1].Error() != "failed" {
+		t.Fatal("result mismatch", payloads, errs)
+	}
+	if _, _, err = decodeResults(buf, 3); err == nil {
+		t.Fatal("should fail with missing result")
+	}
+}
+
+func Test_batch_chunking(t *testing.T) {
+	key := make([]byte, 1000)
+	entries := make([]BatchEntry, 200)
+	keys := make([][]byte, 200)
+	for i := range entries {
+		entries[i] = BatchEntry{Key: key, Tuple: NewTupleHostFromHostPort("127.0.0.1", i)}
+		keys[i] = key
+	}
+
+	var total int
+	for _, chunk := range chunkEntries(entries) {
+		if b, _ := encodeEntries(chunk); len(b) > maxBatchRequestSize {
+			t.Fatal("chunk too large")
+		}
+		total += len(chunk)
+	}
+	if total != len(entries) {
+		t.Fatal("entries missing", total)
+	}
+
+	total = 0
+	for _, chunk := range chunkKeys(keys) {
+		if b, _ := encodeKeys(chunk); len(chunk) > maxLookupBatchKeys || len(b) > maxBatchRequestSize {
+			t.Fatal("chunk too large", len(chunk))
+		}
+		total += len(chunk)
+	}
+	if total != len(keys) {
+		t.Fatal("keys missing", total)
+	}
+
+	if len(chunkEntries(nil)) != 0 || len(chunkKeys(nil)) != 0 {
+		t.Fatal("should have no chunks")
+	}
+}
+
+func Test_UDPTransport_LookupBatch_large(t *testing.T) {
+	t1 := newTestTransport("127.0.0.1:23461")
+	defer t1.Close()
+
+	// Results of the whole batch are well over a single response
+	group := &MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)}
+	keys := make([][]byte, maxLookupBatchKeys)
+	for i := range keys {
+		keys[i] = []byte(fmt.Sprintf("key-%d", i))
+		for j := 0; j < 100; j++ {
+			group.hosts[string(keys[i])] = append(group.hosts[string(keys[i])], NewTupleHostFromHostPort("10.0.0.1", j+1))
+		}
+	}
+	t2 := newBareTrans("127.0.0.1:23462")
+	defer t2.Close()
+	t2.Register(group)
+
+	results, err := t1.LookupBatch("127.0.0.1:23462", keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Err != nil || len(r.Nodes) != 100 {
+			t.Fatal(string(keys[i]), r.Err, len(r.Nodes))
+		}
+	}
+
+	buf, err := encodeLookupResults(keys, results)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) > maxBatchRequestSize {
+		t.Fatal("response too large", len(buf))
+	}
+	_, errs, err := decodeResults(buf, len(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] != nil || errs[len(errs)-1] == nil {
+		t.Fatal("trailing results should fail", errs[0], errs[len(errs)-1])
+	}
+}
+
+func Test_Kelips_Batch(t *testing.T) {
+	k1 := kelipsTestInstance(54590)
+	k2 := kelipsTestInstance(54591)
+	k3 := kelipsTestInstance(54592)
+	if err := k2.Join([]string{"127.0.0.1:54590"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k3.Join([]string{"127.0.0.1:54590", "127.0.0.1:54591"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := NewTupleHostFromHostPort("127.0.0.1", 54591)
+	entries := make([]BatchEntry, 100)
+	keys := make([][]byte, len(entries)+1)
+	for i := range entries {
+		entries[i] = BatchEntry{Key: []byte(fmt.Sprintf("batch-key-%d", i)), Tuple: tuple}
+		keys[i] = entries[i].Key
+	}
+	keys[len(entries)] = []byte("batch-key-missing")
+
+	for i, err := range k1.InsertBatch(entries) {
+		if err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	<-time.After(200 * time.Millisecond)
+
+	for _, kl := range []*Kelips{k1, k2, k3} {
+		results := kl.LookupBatch(keys)
+		if len(results) != len(keys) {
+			t.Fatal("wrong result count", len(results))
+		}
+		for i, r := range results[:len(entries)] {
+			if r.Err != nil {
+				t.Fatal(string(keys[i]), r.Err)
+			}
+			if len(r.Nodes) != 1 || r.Nodes[0].Address.String() != "127.0.0.1:54591" {
+				t.Fatal("wrong nodes", string(keys[i]), r.Nodes)
+			}
+		}
+		if results[len(entries)].Err == nil {
+			t.Fatal("missing key should fail")
+		}
+	}
+
+	for i, err := range k2.DeleteBatch(entries[:50]) {
+		if err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	<-time.After(200 * time.Millisecond)
+
+	results := k3.LookupBatch(keys)
+	for i, r := range results[:len(entries)] {
+		found := r.Err == nil && len(r.Nodes) > 0
+		if i < 50 && found {
+			t.Fatal("should be deleted", string(keys[i]))
+		} else if i >= 50 && !found {
+			t.Fatal("should exist", string(keys[i]), r.Err)
+		}
+	}
+}
+
+func Test_Client_Batch(t *testing.T) {
+	k := kelipsTestInstance(54593)
+	client, _ := NewClient("127.0.0.1:54593")
+	defer client.Close()
+
+	tuple := NewTupleHostFromHostPort("127.0.0.1", 54593)
+	entries := make([]BatchEntry, 80)
+	keys := make([][]byte, len(entries))
+	for i := range entries {
+		entries[i] = BatchEntry{Key: []byte(fmt.Sprintf("client-batch-%d", i)), Tuple: tuple}
+		keys[i] = entries[i].Key
+	}
+
+	errs, err := client.InsertBatch(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, er := range errs {
+		if er != nil {
+			t.Fatal(i, er)
+		}
+	}
+	if k.local.tuples.Count() != len(entries) {
+		t.Fatal("should have tuples", k.local.tuples.Count())
+	}
+
+	results, err := client.LookupBatch(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != len(keys) {
+		t.Fatal("wrong result count", len(results))
+	}
+	for i, r := range results {
+		if r.Err != nil || len(r.Nodes) != 1 {
+			t.Fatal(string(keys[i]), r.Err, r.Nodes)
+		}
+	}
+
+	if _, err = client.DeleteBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	results, _ = client.LookupBatch(keys[:1])
+	if results[0].Err == nil {
+		t.Fatal("lookup should fail after delete")
+	}
+}
+
+func Test_Client_Batch_groups(t *testing.T) {
+	sn := testSimNetwork(t)
+	nodes, peers := testCluster(t, sn, 4, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// Group index of each node
+	index := make(map[string]int)
+	for _, k := range nodes {
+		index[k.conf.AdvertiseHost] = k.local.index()
+	}
+	if nodes[0].local.groups().list[0].count() == 0 || nodes[0].local.groups().list[1].count() == 0 {
+		t.Fatal("nodes should be in all groups")
+	}
+
+	// Only the first node is a peer so a batch sent as is would only reach its
+	// group
+	client, _ := sn.Client("10.0.1.1:4000", peers[0])
+	defer client.Close()
+
+	tuple := NewTupleHost(peers[1])
+	entries := make([]BatchEntry, 40)
+	keys := make([][]byte, len(entries))
+	for i := range entries {
+		entries[i] = BatchEntry{Key: []byte(fmt.Sprintf("client-groups-%d", i)), Tuple: tuple}
+		keys[i] = entries[i].Key
+	}
+
+	errs, err := client.InsertBatch(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, er := range errs {
+		if er != nil {
+			t.Fatal(i, er)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Each key is only held by the nodes of its group
+	groups := make(map[int]bool)
+	for _, key := range keys {
+		owners, _ := nodes[0].local.LookupGroupNodes(key)
+		if len(owners) == 0 {
+			t.Fatal("no group nodes", string(key))
+		}
+		group := index[owners[0].Address.String()]
+		groups[group] = true
+
+		for _, k := range nodes {
+			_, err := k.local.tuples.Get(key)
+			if held := err == nil; held != (index[k.conf.AdvertiseHost] == group) {
+				t.Fatalf("%s held=%v on %s in group %d", key, held, k.conf.AdvertiseHost, group)
+			}
+		}
+	}
+	if len(groups) < 2 {
+		t.Fatal("keys should span groups", groups)
+	}
+
+	results, err := client.LookupBatch(keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Err != nil || len(r.Nodes) != 1 {
+			t.Fatal(string(keys[i]), r.Err, r.Nodes)
+		}
+	}
+
+	if _, err = client.DeleteBatch(entries); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if results, err = client.LookupBatch(keys); err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if r.Err == nil {
+			t.Fatal("lookup should fail after delete", string(keys[i]))
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package kelips
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+// versionedTuples wraps a TupleStore advancing its version whenever a tuple is
+// inserted or removed.  The version is returned with lookups allowing clients
+// to detect cached results that may be stale
+type versionedTuples struct {
+	TupleStore
+
+	version uint64
+}
+
+// newVersionedTuples wraps the store.  The version starts at the current time
+// so it keeps advancing across restarts of the node
+func newVersionedTuples(store TupleStore) *versionedTuples {
+	return &versionedTuples{
+		TupleStore: hookTuples(store),
+		version:    uint64(time.Now().UnixNano()),
+	}
+}
+
+// AddHook adds a hook to the underlying store
+func (vt *versionedTuples) AddHook(hook TupleHook) {
+	vt.TupleStore.(HookedTupleStore).AddHook(hook)
+}
+
+// Version returns the current version of the store
+func (vt *versionedTuples) Version() uint64 {
+	return atomic.LoadUint64(&vt.version)
+}
+
+func (vt *versionedTuples) changed() {
+	atomic.AddUint64(&vt.version, 1)
+}
+
+// Insert adds the host for the key advancing the version
+func (vt *versionedTuples) Insert(key []byte, h TupleHost) error {
+	err := vt.TupleStore.Insert(key, h)
+	if err == nil {
+		vt.changed()
+	}
+	return err
+}
+
+// Delete deletes the key advancing the version
+func (vt *versionedTuples) Delete(key []byte) error {
+	err := vt.TupleStore.Delete(key)
+	if err == nil {
+		vt.changed()
+	}
+	return err
+}
+
+// DeleteKeyHost deletes the host for the key advancing the version if it was
+// deleted
+func (vt *versionedTuples) DeleteKeyHost(key []byte, h TupleHost) bool {
+	ok := vt.TupleStore.DeleteKeyHost(key, h)
+	if ok {
+		vt.changed()
+	}
+	return ok
+}
+
+// ExpireHost removes the host from all keys advancing the version if any were
+// affected
+func (vt *versionedTuples) ExpireHost(tuple TupleHost) bool {
+	ok := vt.TupleStore.ExpireHost(tuple)
+	if ok {
+		vt.changed()
+	}
+	return ok
+}
+
+// LookupCacheConfig configures the client side cache of lookup results
+type LookupCacheConfig struct {
+	// Max number of keys cached.  The least recently used key is evicted once
+	// the cache is full
+	Size int
+
+	// Time a lookup result is cached for
+	TTL time.Duration
+
+	// Time a key not being found is cached for.  Zero disables negative
+	// caching
+	NegativeTTL time.Duration
+}
+
+// DefaultLookupCacheConfig returns a cache config suitable for keys that are
+// looked up frequently and change rarely
+func DefaultLookupCacheConfig() *LookupCacheConfig {
+	return &LookupCacheConfig{
+		Size:        10000,
+		TTL:         5 * time.Second,
+		NegativeTTL: time.Second,
+	}
+}
+
+// Validate returns an error if the config is invalid
+func (conf *LookupCacheConfig) Validate() error {
+	if conf.Size < 1 {
+		return fmt.Errorf("cache size must be atleast 1")
+	}
+	if conf.TTL <= 0 {
+		return fmt.Errorf("cache ttl must be positive")
+	}
+	if conf.NegativeTTL < 0 {
+		return fmt.Errorf("negative cache ttl must not be negative")
+	}
+	return nil
+}
+
+// CacheStats are counters of the lookup cache
+type CacheStats struct {
+	// Lookups answered from the cache.  NegativeHits are the hits for keys
+	// that were not found
+	Hits         uint64
+	NegativeHits uint64
+
+	// Lookups not in the cache or whose cached result had expired or was
+	// stale
+	Misses uint64
+
+	// Keys evicted as the cache was full
+	Evictions uint64
+
+	// Keys removed as they were stale or changed by the client
+	Invalidations uint64
+
+	// Number of keys currently cached
+	Entries int
+}
+
+// cacheEntry is the cached lookup result of a key.  The host and store version
+// it was looked up from are kept to detect when it is stale
+type cacheEntry struct {
+	key     string
+	nodes   []*kelipspb.Node
+	err     error
+	host    string
+	version uint64
+	expires time.Time
+}
+
+// lookupCache is a size bounded lru cache of lookup results.  An entry is
+// stale once a newer store version has been seen from the host it was looked
+// up from
+type lookupCache struct {
+	conf *LookupCacheConfig
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// Latest store version seen from each host
+	versions map[string]uint64
+
+	stats CacheStats
+}
+
+func newLookupCache(conf *LookupCacheConfig) *lookupCache {
+	return &lookupCache{
+		conf:     conf,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		versions: make(map[string]uint64),
+	}
+}
+
+// get returns the cached entry for the key.  It returns false if the key is not
+// cached, has expired or is stale
+func (c *lookupCache) get(key []byte, now time.Time) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[string(key)]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+
+	e := el.Value.(*cacheEntry)
+	if now.After(e.expires) {
+		c.remove(el)
+		c.stats.Misses++
+		return nil, false
+	}
+	if e.version < c.versions[e.host] {
+		c.remove(el)
+		c.stats.Invalidations++
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(el)
+	if e.err != nil {
+		c.stats.NegativeHits++
+	} else {
+		c.stats.Hits++
+	}
+	return e, true
+}
+
+// set caches the result of looking up the key on the host at the given store
+// version.  Errors are only cached if negative caching is enabled
+func (c *lookupCache) set(key []byte, nodes []*kelipspb.Node, err error, host string, version uint64, now time.Time) {
+	ttl := c.conf.TTL
+	if err != nil {
+		if ttl = c.conf.NegativeTTL; ttl == 0 {
+			return
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if version == 0 {
+		// Errors carry no version so the latest seen from the host is used
+		version = c.versions[host]
+	} else {
+		c.observe(host, version)
+	}
+
+	e := &cacheEntry{
+		key:     string(key),
+		nodes:   nodes,
+		err:     err,
+		host:    host,
+		version: version,
+		expires: now.Add(ttl),
+	}
+
+	if el, ok := c.entries[e.key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return
+	}
+
+	c.entries[e.key] = c.lru.PushFront(e)
+	for c.lru.Len() > c.conf.Size {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// observe records the store version seen from the host.  Entries looked up from
+// the host at an older version are stale.  The lock must be held
+func (c *lookupCache) observe(host string, version uint64) {
+	if version > c.versions[host] {
+		c.versions[host] = version
+	}
+}
+
+// invalidate removes the key from the cache
+func (c *lookupCache) invalidate(key []byte) {
+	c.mu.Lock()
+	if el, ok := c.entries[string(key)]; ok {
+		c.remove(el)
+		c.stats.Invalidations++
+	}
+	c.mu.Unlock()
+}
+
+// purge removes all keys from the cache
+func (c *lookupCache) purge() {
+	c.mu.Lock()
+	c.stats.Invalidations += uint64(c.lru.Len())
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+}
+
+// remove removes the element.  The lock must be held
+func (c *lookupCache) remove(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.entries, el.Value.(*cacheEntry).key)
+}
+
+func (c *lookupCache) getStats() CacheStats {
+	c.mu.Lock()
+	stats := c.stats
+	stats.Entries = c.lru.Len()
+	c.mu.Unlock()
+	return stats
+}
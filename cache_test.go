@@ -0,0 +1,124 @@
+package kelips
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+func Test_versionedTuples(t *testing.T) {
+	vt := newVersionedTuples(NewInmemTuples())
+	v := vt.Version()
+	if v == 0 {
+		t.Fatal("version should be seeded")
+	}
+
+	tuple := NewTupleHost("127.0.0.1:80")
+	vt.Insert([]byte("key"), tuple)
+	if vt.Version() != v+1 {
+		t.Fatal("insert should advance version")
+	}
+	if vt.DeleteKeyHost([]byte("other"), tuple); vt.Version() != v+1 {
+		t.Fatal("noop delete should not advance version")
+	}
+	if vt.ExpireHost(tuple); vt.Version() != v+2 {
+		t.Fatal("expire should advance version")
+	}
+}
+
+func Test_lookupCache(t *testing.T) {
+	c := newLookupCache(&LookupCacheConfig{Size: 2, TTL: time.Second, NegativeTTL: 100 * time.Millisecond})
+	now := time.Now()
+	nodes := []*kelipspb.Node{{Address: kelipspb.NewAddress("127.0.0.1:80")}}
+
+	c.set([]byte("a"), nodes, nil, "h1", 10, now)
+	if e, ok := c.get([]byte("a"), now); !ok || len(e.nodes) != 1 {
+		t.Fatal("should be cached")
+	}
+	if _, ok := c.get([]byte("a"), now.Add(2*time.Second)); ok {
+		t.Fatal("should be expired")
+	}
+
+	// Negative results use the shorter ttl
+	c.set([]byte("b"), nil, remoteError("key not found"), "h1", 0, now)
+	if e, ok := c.get([]byte("b"), now); !ok || e.err == nil {
+		t.Fatal("not found should be cached")
+	}
+	if _, ok := c.get([]byte("b"), now.Add(200*time.Millisecond)); ok {
+		t.Fatal("negative result should be expired")
+	}
+
+	// A newer version from the host makes older entries stale
+	c.set([]byte("a"), nodes, nil, "h1", 10, now)
+	c.set([]byte("c"), nodes, nil, "h2", 5, now)
+	c.set([]byte("d"), nodes, nil, "h1", 11, now)
+	if _, ok := c.get([]byte("a"), now); ok {
+		t.Fatal("should be evicted")
+	}
+	c.set([]byte("a"), nodes, nil, "h1", 10, now)
+	if _, ok := c.get([]byte("a"), now); ok {
+		t.Fatal("should be stale")
+	}
+	if _, ok := c.get([]byte("d"), now); !ok {
+		t.Fatal("should be cached")
+	}
+
+	c.invalidate([]byte("d"))
+	if _, ok := c.get([]byte("d"), now); ok {
+		t.Fatal("should be invalidated")
+	}
+
+	st := c.getStats()
+	if st.Hits != 2 || st.NegativeHits != 1 || st.Evictions != 2 || st.Invalidations != 2 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+}
+
+func Test_Client_LookupCache(t *testing.T) {
+	_, group := newLimitsTestTransport("127.0.0.1:54689", &ServerLimits{})
+	group.Insert([]byte("a"), NewTupleHost("127.0.0.1:80"), Caller{}, false)
+
+	client, _ := NewClient("127.0.0.1:54689")
+	defer client.Close()
+	if err := client.EnableLookupCache(&LookupCacheConfig{Size: 10, TTL: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.Lookup([]byte("a")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := client.CacheStats(); st.Hits != 2 || st.Misses != 1 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+
+	// Changed on the server and seen via the lookup of another key
+	group.Insert([]byte("a"), NewTupleHost("127.0.0.1:81"), Caller{}, false)
+	group.Insert([]byte("b"), NewTupleHost("127.0.0.1:80"), Caller{}, false)
+	if _, err := client.Lookup([]byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := client.Lookup([]byte("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatal("stale result should not be returned", len(nodes))
+	}
+
+	// Changed via the client
+	if err = client.Delete([]byte("a"), NewTupleHost("127.0.0.1:80")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = client.Lookup([]byte("a")); err == nil {
+		t.Fatal("should not be found")
+	}
+
+	// Not found is not cached without a negative ttl
+	client.Lookup([]byte("a"))
+	if st := client.CacheStats(); st.NegativeHits != 0 || st.Invalidations != 2 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+}
@@ -1,64 +1,650 @@
 package kelips
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"log"
+	"sync"
+	"time"
 
 	"github.com/hexablock/go-kelips/kelipspb"
 )
 
-// Client implements a kelips client
+// errLayoutUnknown is returned if the layout of the cluster cannot be learnt to
+// split batches by group
+var errLayoutUnknown = errors.New("cluster layout unknown")
+
+// Client implements a kelips client.  Operations are attempted on upto 3
+// peers, retrying on another peer if a peer cannot be reached.  Failed peers
+// are backed off and the peer set is periodically refreshed with the nodes
+// known to the cluster.  With routing enabled key operations are sent directly
+// to the nodes of the key's affinity group.  Batches are always split by
+// affinity group with a request sent to a node of each group
 type Client struct {
-	trans *UDPTransport
-	// existing peers
-	peers []string
+	trans clientTransport
+	// existing peers and their health
+	peers *peerSet
+	// principal inserts and deletes are made on behalf of
+	principal string
+	// optional cache of lookup results
+	cache *lookupCache
+
+	// routing config if enabled and the routes learnt with the peers.  Routes
+	// are always learnt to split batches by group
+	routing *RoutingConfig
+	rmu     sync.RWMutex
+	routes  *routeTable
 }
 
-// NewClient inits a new client using exising peers
+// NewClient inits a new client using exising peers.  The peers are kept as
+// seeds and never removed
 func NewClient(peers ...string) (*Client, error) {
+	return newClient(NewUDPTransport(nil), peers)
+}
+
+// clientTransport is the transport requests of a client are sent over
+type clientTransport interface {
+	Transport
+	LookupNodes(host string, key []byte, min int) ([]*kelipspb.Node, error)
+	Close() error
+
+	// lookup returns the nodes for the key along with the tuple version of the
+	// host
+	lookup(host string, key []byte) ([]*kelipspb.Node, uint64, error)
+}
+
+func newClient(trans clientTransport, peers []string) (*Client, error) {
 	if len(peers) == 0 {
 		return nil, fmt.Errorf("peers required")
 	}
 
 	client := &Client{
-		peers: peers,
-		trans: NewUDPTransport(nil),
+		peers: newPeerSet(peers),
+		trans: trans,
 	}
 	return client, nil
 }
 
-// randomly get a peer
-func (c *Client) getpeer() string {
-	i := rand.Int() % len(c.peers)
-	return c.peers[i]
+// Close closes the sockets used to send requests failing any pending ones.  The
+// client cannot be used after it is closed
+func (c *Client) Close() error {
+	return c.trans.Close()
+}
+
+// SetAuth enables signing of requests and verification of responses.  It must
+// match the authentication configured on the cluster nodes
+func (c *Client) SetAuth(auth *TransportAuth) {
+	if trans, ok := c.trans.(*UDPTransport); ok {
+		trans.SetAuth(auth)
+	}
+}
+
+// SetEncryption enables encryption of requests and responses.  It must be
+// enabled when the cluster uses encrypted transports
+func (c *Client) SetEncryption(conf *NoiseConfig) error {
+	trans, ok := c.trans.(*UDPTransport)
+	if !ok {
+		return fmt.Errorf("encryption not supported by the transport")
+	}
+	return trans.SetEncryption(conf)
+}
+
+// SetPrincipal sets the principal inserts and deletes are made on behalf of.
+// Nodes record it as the owner of inserted tuples.  Mutations denied by the
+// cluster return an *AccessDeniedError
+func (c *Client) SetPrincipal(principal string) {
+	c.principal = principal
+}
+
+// EnableLookupCache caches the results of Lookup on the client.  Cached results
+// are dropped once they expire, once the host they were looked up from returns
+// a newer tuple store version, or when the key is inserted or deleted via the
+// client.  It must be called before the client is used
+func (c *Client) EnableLookupCache(conf *LookupCacheConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	c.cache = newLookupCache(conf)
+	return nil
+}
+
+// CacheStats returns the lookup cache counters.  They are all zero if the cache
+// is not enabled
+func (c *Client) CacheStats() CacheStats {
+	if c.cache == nil {
+		return CacheStats{}
+	}
+	return c.cache.getStats()
+}
+
+// InvalidateLookup removes the key from the lookup cache.  It allows changes
+// learnt of by other means to be seen by the next lookup
+func (c *Client) InvalidateLookup(key []byte) {
+	if c.cache != nil {
+		c.cache.invalidate(key)
+	}
+}
+
+// PurgeLookupCache removes all keys from the lookup cache
+func (c *Client) PurgeLookupCache() {
+	if c.cache != nil {
+		c.cache.purge()
+	}
+}
+
+// invalidateEntries removes the keys of the batch entries from the lookup cache
+func (c *Client) invalidateEntries(entries []BatchEntry) {
+	if c.cache != nil {
+		for _, e := range entries {
+			c.cache.invalidate(e.Key)
+		}
+	}
+}
+
+// EnableRouting sends key operations directly to a node of the key's affinity
+// group falling back to any peer if none can be reached.  The layout of the
+// groups is learnt along with the peers.  It must be called before the client
+// is used and returns an error if the layout cannot be learnt
+func (c *Client) EnableRouting(conf *RoutingConfig) error {
+	c.routing = conf
+	return c.RefreshPeers()
+}
+
+// route returns the nodes of the key group if routing is enabled
+func (c *Client) route(key []byte) []string {
+	if c.routing == nil {
+		return nil
+	}
+	if rt := c.routeTable(); rt != nil {
+		return rt.route(key)
+	}
+	return nil
+}
+
+// routeTable returns the routes learnt with the peers if any
+func (c *Client) routeTable() *routeTable {
+	c.rmu.RLock()
+	defer c.rmu.RUnlock()
+	return c.routes
+}
+
+// batchRoutes returns the routes used to split batches by group learning them
+// from a peer if they are not yet known
+func (c *Client) batchRoutes() (*routeTable, error) {
+	if rt := c.routeTable(); rt != nil {
+		return rt, nil
+	}
+	if err := c.refreshPeers(); err != nil {
+		return nil, err
+	}
+	if rt := c.routeTable(); rt != nil {
+		return rt, nil
+	}
+	return nil, errLayoutUnknown
+}
+
+// Peers returns the peers known to the client along with their health
+func (c *Client) Peers() []PeerStatus {
+	return c.peers.list()
+}
+
+// RefreshPeers replaces the peers learned from the cluster with the nodes known
+// to a peer.  Seed peers are always kept
+func (c *Client) RefreshPeers() error {
+	if !c.peers.startRefresh(time.Now(), true) {
+		return nil
+	}
+	defer c.peers.endRefresh()
+	return c.refreshPeers()
+}
+
+// maybeRefresh refreshes the peers in the background if they are due
+func (c *Client) maybeRefresh() {
+	if !c.peers.startRefresh(time.Now(), false) {
+		return
+	}
+
+	go func() {
+		defer c.peers.endRefresh()
+		if err := c.refreshPeers(); err != nil {
+			log.Printf("[ERROR] Failed to refresh peers: %v", err)
+		}
+	}()
+}
+
+// refreshPeers requests the node pages of a snapshot from a peer.  The pages
+// are also used to learn the layout.  Failing to learn it is only an error if
+// routing is enabled
+func (c *Client) refreshPeers() error {
+	var (
+		nodes []string
+		rt    *routeTable
+		rtErr error
+		conf  = c.routing
+	)
+	if conf == nil {
+		conf = &RoutingConfig{}
+	}
+
+	err := c.do(nil, func(host string) error {
+		nodes = nodes[:0]
+		rt, rtErr = nil, nil
+
+		req := &SnapshotRequest{Group: -1, Cursor: newCursor(cursorNodes, nil)}
+		for {
+			page, err := c.trans.Snapshot(host, req)
+			if err != nil {
+				return err
+			}
+
+			for _, n := range page.Nodes {
+				if len(nodes) < maxDiscoveredPeers {
+					nodes = append(nodes, n.Address.String())
+				}
+			}
+			if rtErr == nil {
+				if rt == nil {
+					rt, rtErr = newRouteTable(conf, page)
+				}
+				if rt != nil {
+					rt.add(page.Nodes)
+				}
+			}
+
+			if len(page.Cursor) == 0 || (len(nodes) >= maxDiscoveredPeers && (rt == nil || rt.complete())) {
+				return nil
+			}
+			req.Cursor = page.Cursor
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	c.peers.update(nodes)
+	if rtErr == nil || c.routing != nil {
+		c.rmu.Lock()
+		c.routes = rt
+		c.rmu.Unlock()
+	}
+	if c.routing == nil {
+		return nil
+	}
+	return rtErr
+}
+
+// do calls op with upto 3 peers until one is reached.  Errors returned by a
+// reachable peer are not retried.  If the key is given, it is first sent to the
+// nodes of its group when routing or they are tried after the first failure
+func (c *Client) do(key []byte, op func(host string) error) error {
+	return c.doRoutes(key, c.route(key), op)
+}
+
+// doRoutes calls op similar to do trying the given routes of the key first
+func (c *Client) doRoutes(key []byte, routes []string, op func(host string) error) error {
+	var (
+		err    error
+		now    = time.Now()
+		hosts  = c.peers.candidates(now)
+		tried  = make(map[string]bool, maxClientAttempts)
+		routed bool
+	)
+
+	if key != nil {
+		// Leave an attempt for any peer
+		if routes = c.peers.healthy(routes, now); len(routes) > 0 {
+			if len(routes) > maxClientAttempts-1 {
+				routes = routes[:maxClientAttempts-1]
+			}
+			hosts = append(routes, hosts...)
+			routed = true
+		}
+	}
+
+	for len(hosts) > 0 && len(tried) < maxClientAttempts {
+		host := hosts[0]
+		hosts = hosts[1:]
+		if tried[host] {
+			continue
+		}
+		tried[host] = true
+
+		if err = op(host); !retriable(err) {
+			c.peers.success(host)
+			return err
+		}
+		c.peers.failure(host, time.Now())
+
+		if key != nil && !routed && len(tried) == 1 {
+			hosts = append(c.groupPeers(key, hosts, tried), hosts...)
+		}
+	}
+	return err
+}
+
+// groupPeers returns the nodes of the key group from the first reachable
+// candidate adding them to the peer set
+func (c *Client) groupPeers(key []byte, candidates []string, tried map[string]bool) []string {
+	for _, host := range candidates {
+		if tried[host] {
+			continue
+		}
+
+		nodes, err := c.trans.LookupGroupNodes(host, key)
+		if retriable(err) {
+			tried[host] = true
+			c.peers.failure(host, time.Now())
+			if len(tried) >= maxClientAttempts {
+				return nil
+			}
+			continue
+		}
+		c.peers.success(host)
+
+		addrs := make([]string, 0, len(nodes))
+		for _, n := range nodes {
+			addrs = append(addrs, n.Address.String())
+		}
+		c.peers.add(addrs)
+		return addrs
+	}
+	return nil
 }
 
 // LookupGroupNodes requests group nodes for a key from a peer
-func (c *Client) LookupGroupNodes(key []byte) ([]*kelipspb.Node, error) {
-	host := c.getpeer()
-	return c.trans.LookupGroupNodes(host, key)
+func (c *Client) LookupGroupNodes(key []byte) (nodes []*kelipspb.Node, err error) {
+	c.maybeRefresh()
+	err = c.do(nil, func(host string) (er error) {
+		nodes, er = c.trans.LookupGroupNodes(host, key)
+		return
+	})
+	return
 }
 
 // LookupNodes request nodes for key returning atleast min number of nodes
-func (c *Client) LookupNodes(key []byte, min int) ([]*kelipspb.Node, error) {
-	host := c.getpeer()
-	return c.trans.LookupNodes(host, key, min)
+func (c *Client) LookupNodes(key []byte, min int) (nodes []*kelipspb.Node, err error) {
+	c.maybeRefresh()
+	err = c.do(key, func(host string) (er error) {
+		nodes, er = c.trans.LookupNodes(host, key, min)
+		return
+	})
+	return
 }
 
-// Lookup returns nodes holding the key
-func (c *Client) Lookup(key []byte) ([]*kelipspb.Node, error) {
-	host := c.getpeer()
-	return c.trans.Lookup(host, key)
+// Lookup returns nodes holding the key.  If the lookup cache is enabled the
+// result is served from it when possible
+func (c *Client) Lookup(key []byte) (nodes []*kelipspb.Node, err error) {
+	if c.cache != nil {
+		if e, ok := c.cache.get(key, time.Now()); ok {
+			return e.nodes, e.err
+		}
+	}
+
+	c.maybeRefresh()
+
+	var (
+		from    string
+		version uint64
+	)
+	err = c.do(key, func(host string) (er error) {
+		from = host
+		nodes, version, er = c.trans.lookup(host, key)
+		return
+	})
+
+	if c.cache != nil && (err == nil || isRemoteError(err)) {
+		c.cache.set(key, nodes, err, from, version, time.Now())
+	}
+	return
 }
 
-// Insert sends an insert request for key-tuple mapping to a peer
+// Insert sends an insert request for key-tuple mapping to a peer.  Keys
+// starting with the namespace marker are rejected and must be inserted via a
+// Namespace
 func (c *Client) Insert(key []byte, tuple TupleHost) error {
-	host := c.getpeer()
-	return c.trans.Insert(host, key, tuple, true)
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return c.insertKey(key, tuple)
+}
+
+// insertKey inserts the stored key which may be namespaced
+func (c *Client) insertKey(key []byte, tuple TupleHost) error {
+	c.maybeRefresh()
+	err := c.do(key, func(host string) error {
+		return c.trans.Insert(host, key, tuple, c.principal, true)
+	})
+	c.InvalidateLookup(key)
+	return err
 }
 
-// Delete sends a delete request to delete a key
+// Delete sends a delete request to delete a key.  Keys starting with the
+// namespace marker are rejected and must be deleted via a Namespace
 func (c *Client) Delete(key []byte, tuple TupleHost) error {
-	host := c.getpeer()
-	return c.trans.Delete(host, key, tuple, true)
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return c.deleteKey(key, tuple)
+}
+
+// deleteKey deletes the stored key which may be namespaced
+func (c *Client) deleteKey(key []byte, tuple TupleHost) error {
+	c.maybeRefresh()
+	err := c.do(key, func(host string) error {
+		return c.trans.Delete(host, key, tuple, c.principal, true)
+	})
+	c.InvalidateLookup(key)
+	return err
+}
+
+// Snapshot requests a single snapshot page from a peer.  As a peer only holds
+// tuples for its own group, a group filter other than the peers group returns
+// only nodes
+func (c *Client) Snapshot(req *SnapshotRequest) (snapshot *kelipspb.Snapshot, err error) {
+	err = c.do(nil, func(host string) (er error) {
+		snapshot, er = c.trans.Snapshot(host, req)
+		return
+	})
+	return
+}
+
+// IterSnapshot requests all snapshot pages from the host starting at the
+// request cursor, calling f with each page until there are no more pages or
+// the callback returns false.  The cursor of the last page can be used to
+// resume
+func (c *Client) IterSnapshot(host string, req *SnapshotRequest, f func(*kelipspb.Snapshot) bool) error {
+	r := *req
+	for {
+		page, err := c.trans.Snapshot(host, &r)
+		if err != nil {
+			return err
+		}
+
+		if !f(page) || len(page.Cursor) == 0 {
+			return nil
+		}
+		r.Cursor = page.Cursor
+	}
+}
+
+// doBatch splits the indexes of n keys by affinity group calling op for each
+// group concurrently.  Each op is tried on the nodes of its group first similar
+// to do.  If the cluster layout is unknown op is called for each key on its own
+// as done for single key operations.  fail is called with the indexes of each
+// group op failed for.  The first error of a group is returned
+func (c *Client) doBatch(n int, key func(i int) []byte, op func(host string, idxs []int) error, fail func(idxs []int, err error)) error {
+	rt, err := c.batchRoutes()
+	if err != nil && err != errLayoutUnknown {
+		return err
+	}
+	c.maybeRefresh()
+
+	type batch struct {
+		routes []string
+		idxs   []int
+	}
+	var batches []batch
+
+	if rt == nil {
+		for i := 0; i < n; i++ {
+			batches = append(batches, batch{idxs: []int{i}})
+		}
+	} else {
+		groups := rt.split(n, key)
+		if groups == nil && n > 0 {
+			return fmt.Errorf("no nodes found")
+		}
+		for group, idxs := range groups {
+			batches = append(batches, batch{routes: rt.nodes(group), idxs: idxs})
+		}
+	}
+
+	var (
+		wg    sync.WaitGroup
+		mu    sync.Mutex
+		first error
+		sem   = make(chan struct{}, maxBatchRequests)
+	)
+	for _, b := range batches {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(routes []string, idxs []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			err := c.doRoutes(key(idxs[0]), routes, func(host string) error {
+				return op(host, idxs)
+			})
+			if err == nil {
+				return
+			}
+
+			fail(idxs, err)
+			mu.Lock()
+			if first == nil {
+				first = err
+			}
+			mu.Unlock()
+		}(b.routes, b.idxs)
+	}
+	wg.Wait()
+
+	return first
+}
+
+// InsertBatch inserts the entries splitting them by affinity group.  A request
+// is sent to a node of each group concurrently.  The returned errors are in the
+// same order as the entries.  Entries of a group that could not be updated fail
+// with the error of the group which is also returned
+func (c *Client) InsertBatch(entries []BatchEntry) ([]error, error) {
+	return c.updateBatch(entries, true)
+}
+
+// DeleteBatch deletes the entries splitting them by affinity group similar to
+// InsertBatch.  The returned errors are in the same order as the entries
+func (c *Client) DeleteBatch(entries []BatchEntry) ([]error, error) {
+	return c.updateBatch(entries, false)
+}
+
+func (c *Client) updateBatch(all []BatchEntry, insert bool) ([]error, error) {
+	errs := make([]error, len(all))
+	entries, valid := checkEntries(all, errs)
+
+	err := c.doBatch(len(entries), func(i int) []byte { return entries[i].Key }, func(host string, idxs []int) error {
+		batch := make([]BatchEntry, len(idxs))
+		for j, i := range idxs {
+			batch[j] = entries[i]
+		}
+
+		var (
+			berrs []error
+			err   error
+		)
+		if insert {
+			berrs, err = c.trans.InsertBatch(host, batch, c.principal, true)
+		} else {
+			berrs, err = c.trans.DeleteBatch(host, batch, c.principal, true)
+		}
+		if err == nil {
+			for j, i := range idxs {
+				errs[valid[i]] = berrs[j]
+			}
+		}
+		return err
+	}, func(idxs []int, err error) {
+		for _, i := range idxs {
+			errs[valid[i]] = err
+		}
+	})
+
+	c.invalidateEntries(entries)
+	return errs, err
+}
+
+// LookupBatch looks up the keys splitting them by affinity group.  A request is
+// sent to a node of each group concurrently.  A result is returned for each key
+// in the same order.  Keys of a group that could not be looked up fail with the
+// error of the group which is also returned
+func (c *Client) LookupBatch(keys [][]byte) ([]LookupResult, error) {
+	results := make([]LookupResult, len(keys))
+
+	err := c.doBatch(len(keys), func(i int) []byte { return keys[i] }, func(host string, idxs []int) error {
+		batch := make([][]byte, len(idxs))
+		for j, i := range idxs {
+			batch[j] = keys[i]
+		}
+
+		res, err := c.trans.LookupBatch(host, batch)
+		if err == nil {
+			for j, i := range idxs {
+				results[i] = res[j]
+			}
+		}
+		return err
+	}, func(idxs []int, err error) {
+		for _, i := range idxs {
+			results[i].Err = err
+		}
+	})
+
+	return results, err
+}
+
+// ExpireHost removes the host from all keys across the cluster via a peer
+func (c *Client) ExpireHost(host string) error {
+	err := c.do(nil, func(peer string) error {
+		return c.trans.ExpireHost(peer, NewTupleHost(host), ExpireCluster)
+	})
+	c.PurgeLookupCache()
+	return err
+}
+
+// Scan returns upto limit sorted keys with the prefix from all groups via a
+// peer.  The returned cursor is used to request the next page and is nil when
+// there are no more keys
+func (c *Client) Scan(prefix []byte, limit int, cursor []byte) ([][]byte, []byte, error) {
+	var (
+		keys [][]byte
+		more bool
+	)
+	err := c.do(nil, func(peer string) (er error) {
+		keys, more, er = c.trans.Scan(peer, prefix, cursor, limit, true)
+		return
+	})
+	return keys, scanCursor(keys, more), err
+}
+
+// Namespace returns a handle to operate on keys within the namespace via peers
+func (c *Client) Namespace(name string) (*Namespace, error) {
+	return newNamespace(name, c)
+}
+
+func (c *Client) purgeNamespace(ns string) error {
+	err := c.do(nil, func(peer string) error {
+		return c.trans.PurgeNamespace(peer, ns, ExpireCluster)
+	})
+	c.PurgeLookupCache()
+	return err
 }
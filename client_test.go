@@ -15,7 +15,10 @@ func Test_Client(t *testing.T) {
 
 	c1 := fastTestConf("127.0.0.1:54940")
 	t1 := newBareTrans("127.0.0.1:54940")
-	k1 := Create(c1, t1)
+	k1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	testkey := []byte("key")
 	testkey1 := []byte("test-key-test")
@@ -23,6 +26,7 @@ func Test_Client(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
+	before := openFDs()
 
 	if err = client.Insert(testkey, NewTupleHostFromHostPort("127.0.0.1", 54940)); err != nil {
 		t.Fatal(err)
@@ -70,4 +74,14 @@ func Test_Client(t *testing.T) {
 
 	k1.Snapshot()
 
+	// Sockets are released on close
+	if err = client.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := openFDs(); n > before {
+		t.Fatalf("sockets should be closed before=%d after=%d", before, n)
+	}
+	if _, err = client.Lookup(testkey1); err == nil {
+		t.Fatal("should fail once closed")
+	}
 }
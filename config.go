@@ -2,9 +2,17 @@ package kelips
 
 import (
 	"crypto/sha256"
+	"fmt"
 	"hash"
+	"net"
+	"time"
+
+	"github.com/hexablock/vivaldi"
 )
 
+// Max number of affinity groups supported by the wire protocol
+const maxGroups = 1<<16 - 1
+
 // Config holds the kelips config to initialize the dht
 type Config struct {
 	// AdvertiseHost used to compute the hash.  This may be different from the
@@ -22,15 +30,54 @@ type Config struct {
 	// Hash function to use
 	HashFunc func() hash.Hash
 
-	// Tuple store. Defaults in an in-mem one if not specified
+	// Partitioner used to map hash ids to affinity groups.  Defaults to
+	// NewRangePartitioner if not specified
+	Partitioner PartitionerFunc
+
+	// Maintain a sorted index of keys to answer prefix scans.  The tuple store
+	// is wrapped with an index unless it already implements KeyScanner
+	EnableScanIndex bool
+
+	// Max number of tuples per namespace in the local tuple store.  Namespaces
+	// not listed use the default quota.  Zero is unlimited.  It is enforced on
+	// every write to the store including remote and propogated ones so all
+	// nodes should use the same quotas
+	NamespaceQuotas       map[string]int
+	DefaultNamespaceQuota int
+
+	// Principal local inserts and deletes are made on behalf of.  It is
+	// recorded as the owner of inserted tuples
+	Principal string
+
+	// Authorizer consulted on every insert and delete applied to the local
+	// tuple store including propogated ones.  All mutations are allowed if nil
+	Authorizer Authorizer
+
+	// Tuple store. Defaults to a sharded in-mem one if not specified
 	TupleStore TupleStore
 
 	Region string
 	Sector string
 	Zone   string
 
+	// Locality preference used to order nodes returned from lookups relative
+	// to the local node
+	Locality Locality
+
+	// Require nodes returned by LookupNodes i.e. a key's replicas to span
+	// distinct zones.  Lookups fail if there are not enough zones
+	DistinctZones bool
+
 	// Meta is serialized to binary and made part of the node object
 	Meta map[string]string
+
+	// Min and max interval between each round of pinging known nodes.  A random
+	// value between the two is chosen for each round
+	PingMin time.Duration
+	PingMax time.Duration
+
+	// Vivaldi coordinate client config
+	Vivaldi *vivaldi.Config
 }
 
 // DefaultConfig returns a minimum required config
@@ -42,6 +89,58 @@ func DefaultConfig(host string) *Config {
 		Region:        "global",
 		Sector:        "sector1",
 		Zone:          "zone1",
+		Locality:      LocalityZone,
 		Meta:          make(map[string]string),
+		PingMin:       3 * time.Second,
+		PingMax:       6 * time.Second,
+		Vivaldi:       vivaldi.DefaultConfig(),
+	}
+}
+
+// Validate returns an error describing the first invalid or missing config
+// value
+func (conf *Config) Validate() error {
+	if conf.AdvertiseHost == "" {
+		return fmt.Errorf("advertise host required")
+	}
+	if _, _, err := net.SplitHostPort(conf.AdvertiseHost); err != nil {
+		return fmt.Errorf("invalid advertise host %q: %v", conf.AdvertiseHost, err)
 	}
+
+	if conf.K < 1 || conf.K > maxGroups {
+		return fmt.Errorf("number of groups K=%d must be between 1 and %d", conf.K, maxGroups)
+	}
+
+	if conf.HashFunc == nil {
+		return fmt.Errorf("hash function required")
+	}
+	// Each group requires a distinct id in the hash keyspace
+	if size := conf.HashFunc().Size(); size < 2 {
+		return fmt.Errorf("hash size %d too small: must be atleast 2 bytes", size)
+	}
+
+	if conf.Locality > LocalityZone {
+		return fmt.Errorf("invalid locality: %d", conf.Locality)
+	}
+
+	if conf.PingMin < 0 || conf.PingMax < 0 {
+		return fmt.Errorf("ping intervals must not be negative")
+	}
+	if conf.PingMax > 0 && conf.PingMax < conf.PingMin {
+		return fmt.Errorf("max ping interval %v less than min %v", conf.PingMax, conf.PingMin)
+	}
+
+	if conf.DefaultNamespaceQuota < 0 {
+		return fmt.Errorf("default namespace quota must not be negative")
+	}
+	for ns, quota := range conf.NamespaceQuotas {
+		if err := validateNamespace(ns); err != nil {
+			return err
+		}
+		if quota < 0 {
+			return fmt.Errorf("namespace quota must not be negative: %q", ns)
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,58 @@
+package kelips
+
+import (
+	"crypto/sha256"
+	"hash"
+	"hash/fnv"
+	"testing"
+	"time"
+)
+
+func Test_Config_Validate(t *testing.T) {
+	if err := DefaultConfig("127.0.0.1:43210").Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	invalid := map[string]func(*Config){
+		"no host":       func(c *Config) { c.AdvertiseHost = "" },
+		"no port":       func(c *Config) { c.AdvertiseHost = "127.0.0.1" },
+		"zero k":        func(c *Config) { c.K = 0 },
+		"negative k":    func(c *Config) { c.K = -1 },
+		"large k":       func(c *Config) { c.K = maxGroups + 1 },
+		"no hash":       func(c *Config) { c.HashFunc = nil },
+		"small hash":    func(c *Config) { c.HashFunc = func() hash.Hash { return testTinyHash{fnv.New32()} } },
+		"locality":      func(c *Config) { c.Locality = LocalityZone + 1 },
+		"negative ping": func(c *Config) { c.PingMin = -time.Second },
+		"ping range":    func(c *Config) { c.PingMin, c.PingMax = 2*time.Second, time.Second },
+		"default quota": func(c *Config) { c.DefaultNamespaceQuota = -1 },
+		"quota":         func(c *Config) { c.NamespaceQuotas = map[string]int{"ns": -1} },
+	}
+
+	for name, f := range invalid {
+		conf := DefaultConfig("127.0.0.1:43210")
+		f(conf)
+		if err := conf.Validate(); err == nil {
+			t.Errorf("%s: should fail", name)
+		}
+	}
+
+	conf := DefaultConfig("127.0.0.1:43210")
+	conf.K = 0
+	if _, err := Create(conf, nil); err == nil {
+		t.Fatal("create should fail with invalid config")
+	}
+
+	conf = DefaultConfig("127.0.0.1:43210")
+	conf.HashFunc = sha256.New224
+	conf.K = maxGroups
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testTinyHash reports a single byte digest size
+type testTinyHash struct {
+	hash.Hash
+}
+
+func (h testTinyHash) Size() int { return 1 }
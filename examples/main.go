@@ -70,13 +70,16 @@ func main() {
 		log.Fatal(err)
 	}
 
-	kelps := kelips.Create(conf, trans)
+	kelps, err := kelips.Create(conf, trans)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log.Println("Started cluster on", *advAddr)
 
 	if peers := parsePeers(); len(peers) > 0 {
-		err = kelps.Join(peers)
-		if err != nil {
-			log.Fatal(err)
+		// Peers may not be up yet in which case they join us instead
+		if err = kelps.Join(peers); err != nil {
+			log.Println("[WARN] Join failed:", err)
 		}
 	}
 
@@ -0,0 +1,124 @@
+package kelips
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ExpireScope is the set of nodes a host is expired or a namespace purged on
+type ExpireScope uint8
+
+const (
+	// ExpireLocal expires the host only on the receiving node
+	ExpireLocal ExpireScope = iota
+
+	// ExpireGroup expires the host on all nodes in the group of the receiving
+	// node
+	ExpireGroup
+
+	// ExpireCluster expires the host on all nodes in all groups
+	ExpireCluster
+)
+
+// ExpireHost removes the host from all keys in the local tuple store.  Based on
+// the scope it is also expired on the remaining nodes of the local group and a
+// node in each foreign group which in turn expires it on its group.  An error
+// is returned listing the groups where no node could be reached.  The caller
+// must be allowed to expire by the authorizer
+func (lrpc *localGroup) ExpireHost(tuple TupleHost, scope ExpireScope, caller Caller) error {
+	if scope > ExpireCluster {
+		return fmt.Errorf("invalid expire scope: %d", scope)
+	}
+	if err := lrpc.authorizeCluster(AccessExpire, tuple, "", caller); err != nil {
+		return err
+	}
+
+	lrpc.tuples.ExpireHost(tuple)
+
+	return lrpc.broadcast("expire host", scope, func(host string, scope ExpireScope) error {
+		return lrpc.trans.ExpireHost(host, tuple, scope)
+	})
+}
+
+// broadcast sends a request that has already been applied locally to the
+// nodes within the scope.  The remaining nodes of the local group are sent
+// ExpireLocal and a node in each foreign group is sent ExpireGroup so it is
+// applied to the rest of its group
+func (lrpc *localGroup) broadcast(op string, scope ExpireScope, send func(host string, scope ExpireScope) error) error {
+	if scope == ExpireLocal {
+		return nil
+	}
+
+	l := lrpc.layout()
+	lrpc.broadcastGroup(op, l.groups.list[l.idx], send)
+	if scope == ExpireGroup {
+		return nil
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed []string
+	)
+
+	for _, group := range l.groups.list {
+		if group.index == l.idx || group.count() == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(group *affinityGroup) {
+			defer wg.Done()
+			if err := lrpc.broadcastForeign(group, send); err != nil {
+				log.Printf("[ERROR] Failed to %s group=%d: %v", op, group.index, err)
+				mu.Lock()
+				failed = append(failed, strconv.Itoa(group.index))
+				mu.Unlock()
+			}
+		}(group)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to %s in groups: %s", op, strings.Join(failed, ","))
+	}
+	return nil
+}
+
+// broadcastGroup sends to all other nodes in the group.  Failures are only
+// logged
+func (lrpc *localGroup) broadcastGroup(op string, group *affinityGroup, send func(host string, scope ExpireScope) error) {
+	localhost := lrpc.local.Address.String()
+
+	var wg sync.WaitGroup
+	for _, node := range group.Nodes() {
+		host := node.Address.String()
+		if host == localhost {
+			continue
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := send(host, ExpireLocal); err != nil {
+				log.Printf("[ERROR] Failed to propogate %s: %v host=%s", op, err, host)
+			}
+		}(host)
+	}
+	wg.Wait()
+}
+
+// broadcastForeign sends to the first reachable node in the group which
+// applies it to the rest of its group
+func (lrpc *localGroup) broadcastForeign(group *affinityGroup, send func(host string, scope ExpireScope) error) error {
+	var err error
+	for _, node := range group.Nodes() {
+		if err = send(node.Address.String(), ExpireGroup); err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package kelips
+
+import (
+	"fmt"
+	"testing"
+)
+
+// testExpireCluster creates a cluster with 3 groups
+func testExpireCluster(t *testing.T, n int) ([]*Kelips, *SimNetwork) {
+	sn := testSimNetwork(t)
+	nodes, _ := testCluster(t, sn, n, func(conf *Config) {
+		conf.K = 3
+	})
+	return nodes, sn
+}
+
+// testHostTuples returns the number of keys referring to the host
+func testHostTuples(k *Kelips, host string) int {
+	var c int
+	k.local.tuples.Iter(func(key []byte, hosts []TupleHost) bool {
+		for _, h := range hosts {
+			if h.String() == host {
+				c++
+			}
+		}
+		return true
+	})
+	return c
+}
+
+func Test_Kelips_ExpireHost(t *testing.T) {
+	nodes, _ := testExpireCluster(t, 8)
+
+	groups := make(map[int]bool)
+	for _, k := range nodes {
+		groups[k.local.index()] = true
+	}
+	if len(groups) < 3 {
+		t.Fatal("test requires nodes in all groups")
+	}
+
+	service := "10.0.0.1:8080"
+	other := NewTupleHost("10.0.0.2:8080")
+	for i, k := range nodes {
+		for j := 0; j < 10; j++ {
+			key := []byte(fmt.Sprintf("service-%d-%d", i, j))
+			k.local.tuples.Insert(key, NewTupleHost(service))
+			k.local.tuples.Insert(key, other)
+		}
+	}
+
+	if err := nodes[0].ExpireHost(service); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range nodes {
+		if c := testHostTuples(k, service); c != 0 {
+			t.Fatalf("host=%s should have no tuples for service: %d", k.conf.AdvertiseHost, c)
+		}
+		if c := testHostTuples(k, other.String()); c != 10 {
+			t.Fatalf("host=%s other tuples should remain: %d", k.conf.AdvertiseHost, c)
+		}
+	}
+
+	if err := nodes[0].local.ExpireHost(other, ExpireCluster+1, Caller{}); err == nil {
+		t.Fatal("should fail with invalid scope")
+	}
+}
+
+func Test_Client_ExpireHost(t *testing.T) {
+	nodes, sn := testExpireCluster(t, 4)
+
+	service := "10.0.0.1:8080"
+	for i, k := range nodes {
+		k.local.tuples.Insert([]byte(fmt.Sprintf("service-%d", i)), NewTupleHost(service))
+	}
+
+	client, _ := sn.Client("10.0.1.1:4000", nodes[1].conf.AdvertiseHost)
+	defer client.Close()
+	if err := client.ExpireHost(service); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range nodes {
+		if c := testHostTuples(k, service); c != 0 {
+			t.Fatalf("host=%s should have no tuples for service: %d", k.conf.AdvertiseHost, c)
+		}
+	}
+}
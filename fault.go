@@ -0,0 +1,342 @@
+package kelips
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+// ErrFaultTimeout is returned by requests failed by an injected timeout
+var ErrFaultTimeout = errors.New("fault: request timed out")
+
+// FaultOp is a transport operation faults are injected into
+type FaultOp uint8
+
+const (
+	// FaultAny matches all operations
+	FaultAny FaultOp = iota
+
+	FaultLookupGroupNodes
+	FaultLookup
+	FaultInsert
+	FaultDelete
+	FaultPing
+	FaultJoin
+	FaultSnapshot
+	FaultResize
+	FaultInsertBatch
+	FaultDeleteBatch
+	FaultLookupBatch
+	FaultExpireHost
+	FaultScan
+	FaultPurgeNamespace
+
+	numFaultOps
+)
+
+var faultOpNames = [numFaultOps]string{
+	"any", "lookup-group-nodes", "lookup", "insert", "delete", "ping", "join",
+	"snapshot", "resize", "insert-batch", "delete-batch", "lookup-batch",
+	"expire-host", "scan", "purge-namespace",
+}
+
+func (op FaultOp) String() string {
+	if op < numFaultOps {
+		return faultOpNames[op]
+	}
+	return fmt.Sprintf("FaultOp(%d)", uint8(op))
+}
+
+// Fault is injected into the requests it matches.  The delay is applied first
+// after which the request fails with the error or the timeout, or is made
+type Fault struct {
+	// Delay before the request is made or failed
+	Delay time.Duration
+
+	// Error the request fails with without being made
+	Err error
+
+	// Fail the request with ErrFaultTimeout after waiting for the timeout
+	// without making it
+	Timeout time.Duration
+
+	// Drop propogations of inserts and deletes.  Propogated writes are
+	// reported as successful without being made and writes to be propogated
+	// by the remote host are made without propogation
+	DropPropagation bool
+
+	// Probability the fault is injected into a matching request.  Zero always
+	// injects it
+	Probability float64
+}
+
+type faultKey struct {
+	op   FaultOp
+	host string
+}
+
+// FaultTransport wraps a Transport injecting faults into requests by operation
+// and remote host.  Faults can be set, cleared, enabled and disabled at any
+// time.  The most specific fault of a request is injected in the order of
+// operation and host, operation, host and then any
+type FaultTransport struct {
+	Transport
+
+	enabled int32
+
+	mu     sync.RWMutex
+	faults map[faultKey]*Fault
+
+	// Decides whether probabilistic faults are injected
+	rmu sync.Mutex
+	rng *rand.Rand
+
+	injected [numFaultOps]uint64
+}
+
+// NewFaultTransport wraps the transport with faults enabled.  Probabilistic
+// faults are injected based on the seed
+func NewFaultTransport(trans Transport, seed int64) *FaultTransport {
+	return &FaultTransport{
+		Transport: trans,
+		enabled:   1,
+		faults:    make(map[faultKey]*Fault),
+		rng:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFault sets the fault for the operation to the host replacing any existing
+// one.  FaultAny matches all operations and an empty host all hosts
+func (ft *FaultTransport) SetFault(op FaultOp, host string, fault *Fault) error {
+	if op >= numFaultOps {
+		return fmt.Errorf("unknown operation: %v", op)
+	}
+	if fault.Delay < 0 || fault.Timeout < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	if fault.Probability < 0 || fault.Probability > 1 {
+		return fmt.Errorf("probability must be between 0 and 1")
+	}
+
+	f := *fault
+	ft.mu.Lock()
+	ft.faults[faultKey{op, host}] = &f
+	ft.mu.Unlock()
+	return nil
+}
+
+// ClearFault removes the fault for the operation to the host
+func (ft *FaultTransport) ClearFault(op FaultOp, host string) {
+	ft.mu.Lock()
+	delete(ft.faults, faultKey{op, host})
+	ft.mu.Unlock()
+}
+
+// ClearFaults removes all faults
+func (ft *FaultTransport) ClearFaults() {
+	ft.mu.Lock()
+	ft.faults = make(map[faultKey]*Fault)
+	ft.mu.Unlock()
+}
+
+// Enable resumes injecting the set faults
+func (ft *FaultTransport) Enable() {
+	atomic.StoreInt32(&ft.enabled, 1)
+}
+
+// Disable stops injecting faults retaining the set ones
+func (ft *FaultTransport) Disable() {
+	atomic.StoreInt32(&ft.enabled, 0)
+}
+
+// Injected returns the number of faults injected into the operation.  FaultAny
+// returns the total
+func (ft *FaultTransport) Injected(op FaultOp) uint64 {
+	if op == FaultAny {
+		var n uint64
+		for i := range ft.injected {
+			n += atomic.LoadUint64(&ft.injected[i])
+		}
+		return n
+	}
+	if op >= numFaultOps {
+		return 0
+	}
+	return atomic.LoadUint64(&ft.injected[op])
+}
+
+// fault returns the fault to inject into the request or nil
+func (ft *FaultTransport) fault(op FaultOp, host string) *Fault {
+	if atomic.LoadInt32(&ft.enabled) == 0 {
+		return nil
+	}
+
+	ft.mu.RLock()
+	var f *Fault
+	for _, key := range []faultKey{{op, host}, {op, ""}, {FaultAny, host}, {FaultAny, ""}} {
+		if f = ft.faults[key]; f != nil {
+			break
+		}
+	}
+	ft.mu.RUnlock()
+
+	if f == nil {
+		return nil
+	}
+	if f.Probability > 0 {
+		ft.rmu.Lock()
+		skip := ft.rng.Float64() >= f.Probability
+		ft.rmu.Unlock()
+		if skip {
+			return nil
+		}
+	}
+
+	atomic.AddUint64(&ft.injected[op], 1)
+	return f
+}
+
+// inject applies the fault of the request returning an error if it should fail
+// and the fault if the request should be made
+func (ft *FaultTransport) inject(op FaultOp, host string) (*Fault, error) {
+	f := ft.fault(op, host)
+	if f == nil {
+		return nil, nil
+	}
+
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	if f.Timeout > 0 {
+		time.Sleep(f.Timeout)
+		return nil, ErrFaultTimeout
+	}
+	return f, nil
+}
+
+// write injects the fault of a mutation.  It returns whether the mutation
+// should be skipped and the propogation flag to make it with
+func (ft *FaultTransport) write(op FaultOp, host string, propogate bool) (bool, bool, error) {
+	f, err := ft.inject(op, host)
+	if err != nil || f == nil || !f.DropPropagation {
+		return false, propogate, err
+	}
+	// Propogated writes are sent without propogation
+	return !propogate, false, nil
+}
+
+func (ft *FaultTransport) LookupGroupNodes(host string, key []byte) ([]*kelipspb.Node, error) {
+	if _, err := ft.inject(FaultLookupGroupNodes, host); err != nil {
+		return nil, err
+	}
+	return ft.Transport.LookupGroupNodes(host, key)
+}
+
+func (ft *FaultTransport) Lookup(host string, key []byte) ([]*kelipspb.Node, error) {
+	if _, err := ft.inject(FaultLookup, host); err != nil {
+		return nil, err
+	}
+	return ft.Transport.Lookup(host, key)
+}
+
+func (ft *FaultTransport) Insert(host string, key []byte, tuple TupleHost, principal string, propogate bool) error {
+	skip, propogate, err := ft.write(FaultInsert, host, propogate)
+	if err != nil || skip {
+		return err
+	}
+	return ft.Transport.Insert(host, key, tuple, principal, propogate)
+}
+
+func (ft *FaultTransport) Delete(host string, key []byte, tuple TupleHost, principal string, propogate bool) error {
+	skip, propogate, err := ft.write(FaultDelete, host, propogate)
+	if err != nil || skip {
+		return err
+	}
+	return ft.Transport.Delete(host, key, tuple, principal, propogate)
+}
+
+func (ft *FaultTransport) Ping(host string, node *kelipspb.Node) (*kelipspb.Node, time.Duration, error) {
+	if _, err := ft.inject(FaultPing, host); err != nil {
+		return nil, 0, err
+	}
+	return ft.Transport.Ping(host, node)
+}
+
+func (ft *FaultTransport) Join(host string, node *kelipspb.Node) (*kelipspb.Snapshot, error) {
+	if _, err := ft.inject(FaultJoin, host); err != nil {
+		return nil, err
+	}
+	return ft.Transport.Join(host, node)
+}
+
+func (ft *FaultTransport) Snapshot(host string, req *SnapshotRequest) (*kelipspb.Snapshot, error) {
+	if _, err := ft.inject(FaultSnapshot, host); err != nil {
+		return nil, err
+	}
+	return ft.Transport.Snapshot(host, req)
+}
+
+func (ft *FaultTransport) Resize(host string, gen uint64, k int) error {
+	if _, err := ft.inject(FaultResize, host); err != nil {
+		return err
+	}
+	return ft.Transport.Resize(host, gen, k)
+}
+
+func (ft *FaultTransport) InsertBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	skip, propogate, err := ft.write(FaultInsertBatch, host, propogate)
+	if err != nil {
+		return nil, err
+	}
+	if skip {
+		return make([]error, len(entries)), nil
+	}
+	return ft.Transport.InsertBatch(host, entries, principal, propogate)
+}
+
+func (ft *FaultTransport) DeleteBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	skip, propogate, err := ft.write(FaultDeleteBatch, host, propogate)
+	if err != nil {
+		return nil, err
+	}
+	if skip {
+		return make([]error, len(entries)), nil
+	}
+	return ft.Transport.DeleteBatch(host, entries, principal, propogate)
+}
+
+func (ft *FaultTransport) LookupBatch(host string, keys [][]byte) ([]LookupResult, error) {
+	if _, err := ft.inject(FaultLookupBatch, host); err != nil {
+		return nil, err
+	}
+	return ft.Transport.LookupBatch(host, keys)
+}
+
+func (ft *FaultTransport) ExpireHost(host string, tuple TupleHost, scope ExpireScope) error {
+	if _, err := ft.inject(FaultExpireHost, host); err != nil {
+		return err
+	}
+	return ft.Transport.ExpireHost(host, tuple, scope)
+}
+
+func (ft *FaultTransport) Scan(host string, prefix, cursor []byte, limit int, cluster bool) ([][]byte, bool, error) {
+	if _, err := ft.inject(FaultScan, host); err != nil {
+		return nil, false, err
+	}
+	return ft.Transport.Scan(host, prefix, cursor, limit, cluster)
+}
+
+func (ft *FaultTransport) PurgeNamespace(host string, ns string, scope ExpireScope) error {
+	if _, err := ft.inject(FaultPurgeNamespace, host); err != nil {
+		return err
+	}
+	return ft.Transport.PurgeNamespace(host, ns, scope)
+}
@@ -0,0 +1,116 @@
+package kelips
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// propTestGroup records the propogation flag of inserts
+type propTestGroup struct {
+	*MockAffinityGroupRPC
+	props []bool
+}
+
+func (group *propTestGroup) Insert(key []byte, tuple TupleHost, caller Caller, prop bool) error {
+	group.props = append(group.props, prop)
+	return group.MockAffinityGroupRPC.Insert(key, tuple, caller, prop)
+}
+
+func Test_FaultTransport(t *testing.T) {
+	sn, _ := NewSimNetwork(1, nil)
+	group := &propTestGroup{MockAffinityGroupRPC: &MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)}}
+	sn.Transport("10.0.0.1:4000").Register(group)
+	sn.Transport("10.0.0.2:4000").Register(&MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)})
+
+	ft := NewFaultTransport(sn.Transport("10.0.0.3:4000"), 1)
+	tuple := NewTupleHost("10.0.0.1:4000")
+	if err := ft.Insert("10.0.0.1:4000", []byte("key"), tuple, "", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// Host specific fault takes precedence
+	errDown := fmt.Errorf("down")
+	ft.SetFault(FaultAny, "", &Fault{Err: errDown})
+	ft.SetFault(FaultLookup, "10.0.0.1:4000", &Fault{Delay: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := ft.Lookup("10.0.0.1:4000", []byte("key")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatal("should be delayed")
+	}
+	if _, err := ft.Lookup("10.0.0.2:4000", []byte("key")); err != errDown {
+		t.Fatal("should fail", err)
+	}
+	if _, _, err := ft.Ping("10.0.0.1:4000", nil); err != errDown {
+		t.Fatal("should fail", err)
+	}
+
+	ft.SetFault(FaultScan, "", &Fault{Timeout: 10 * time.Millisecond})
+	if _, _, err := ft.Scan("10.0.0.1:4000", nil, nil, 10, false); err != ErrFaultTimeout {
+		t.Fatal("should time out", err)
+	}
+
+	// Faults are retained while disabled
+	ft.Disable()
+	if _, _, err := ft.Ping("10.0.0.1:4000", nil); err != nil {
+		t.Fatal(err)
+	}
+	ft.Enable()
+	if _, _, err := ft.Ping("10.0.0.1:4000", nil); err != errDown {
+		t.Fatal("should fail", err)
+	}
+
+	// Propogated writes are dropped and others made without propogation
+	ft.ClearFaults()
+	ft.SetFault(FaultInsert, "", &Fault{DropPropagation: true})
+	if err := ft.Insert("10.0.0.1:4000", []byte("key"), tuple, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := ft.Insert("10.0.0.1:4000", []byte("key"), tuple, "", true); err != nil {
+		t.Fatal(err)
+	}
+	if len(group.props) != 2 || !group.props[0] || group.props[1] {
+		t.Fatal("wrong propogation", group.props)
+	}
+
+	if ft.Injected(FaultLookup) != 2 || ft.Injected(FaultAny) != 7 {
+		t.Fatal("wrong count", ft.Injected(FaultLookup), ft.Injected(FaultAny))
+	}
+
+	if err := ft.SetFault(FaultLookup, "", &Fault{Probability: 2}); err == nil {
+		t.Fatal("should fail on probability")
+	}
+}
+
+func Test_FaultTransport_probability(t *testing.T) {
+	sn, _ := NewSimNetwork(1, nil)
+	sn.Transport("10.0.0.1:4000").Register(&MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)})
+
+	pattern := func(seed int64) []bool {
+		ft := NewFaultTransport(sn.Transport("10.0.0.2:4000"), seed)
+		ft.SetFault(FaultPing, "", &Fault{Err: fmt.Errorf("down"), Probability: 0.5})
+
+		out := make([]bool, 50)
+		for i := range out {
+			_, _, err := ft.Ping("10.0.0.1:4000", nil)
+			out[i] = err == nil
+		}
+		return out
+	}
+
+	a, b := pattern(3), pattern(3)
+	var failed, succeeded bool
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("same seed should inject the same faults")
+		}
+		failed = failed || !a[i]
+		succeeded = succeeded || a[i]
+	}
+	if !failed || !succeeded {
+		t.Fatal("faults not injected by probability")
+	}
+}
@@ -0,0 +1,148 @@
+package kelips
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+)
+
+// Version of the wire protocol.  Nodes only communicate with nodes of the same
+// version
+const protocolVersion uint8 = 4
+
+// Size of the fingerprint header prepended to each request
+const fingerprintSize = 19
+
+// Fingerprint identifies the parameters nodes must agree on to interoperate.  It
+// is sent in the header of each request and checked by the receiving node.
+// Zero Hash, Partitioner and K values are sent by clients that are not cluster
+// members and are not checked
+type Fingerprint struct {
+	// Wire protocol version
+	Version uint8
+
+	// Identifier of the hash function
+	Hash uint32
+
+	// Identifier of the partitioner
+	Partitioner uint32
+
+	// Layout generation and number of groups
+	Generation uint64
+	K          int
+}
+
+// clientFingerprint returns the fingerprint used by non-member clients
+func clientFingerprint() Fingerprint {
+	return Fingerprint{Version: protocolVersion}
+}
+
+// hashFuncID identifies a hash function by its digest size and the leading
+// bytes of the digest of a fixed input
+func hashFuncID(hashFunc func() hash.Hash) uint32 {
+	h := hashFunc()
+	h.Write([]byte("kelips"))
+	sum := h.Sum(nil)
+
+	b := make([]byte, 4)
+	copy(b, sum)
+	id := binary.BigEndian.Uint32(b) ^ uint32(h.Size())
+	if id == 0 {
+		// Zero is reserved for clients
+		id = 1
+	}
+	return id
+}
+
+// Number of groups and ids a partitioner is probed with to identify it
+const (
+	partitionerProbeGroups = 13
+	partitionerProbeIDs    = 64
+)
+
+// partitionerID identifies a partitioner by the groups it assigns to a fixed
+// set of ids
+func partitionerID(partFunc PartitionerFunc, hashSize int) uint32 {
+	if partFunc == nil {
+		partFunc = NewRangePartitioner
+	}
+	part := partFunc(partitionerProbeGroups, hashSize)
+
+	h := fnv.New32a()
+	id := make([]byte, hashSize)
+	b := make([]byte, 4)
+	for i := 0; i < partitionerProbeIDs; i++ {
+		sum := sha256.Sum256([]byte(fmt.Sprintf("kelips-%d", i)))
+		for j := range id {
+			id[j] = sum[j%len(sum)]
+		}
+		binary.BigEndian.PutUint32(b, uint32(part.Partition(id)))
+		h.Write(b)
+	}
+
+	if sum := h.Sum32(); sum != 0 {
+		return sum
+	}
+	// Zero is reserved for clients
+	return 1
+}
+
+// Check returns an error if the remote fingerprint is not compatible.  Layouts
+// are only compared when both are of the same generation, as nodes may briefly
+// differ while a resize is propogated
+func (fp Fingerprint) Check(remote Fingerprint) error {
+	if remote.Version != fp.Version {
+		return fmt.Errorf("protocol version mismatch local=%d remote=%d", fp.Version, remote.Version)
+	}
+	if remote.Hash != 0 && fp.Hash != 0 && remote.Hash != fp.Hash {
+		return fmt.Errorf("hash function mismatch local=%08x remote=%08x", fp.Hash, remote.Hash)
+	}
+	if remote.Partitioner != 0 && fp.Partitioner != 0 && remote.Partitioner != fp.Partitioner {
+		return fmt.Errorf("partitioner mismatch local=%08x remote=%08x", fp.Partitioner, remote.Partitioner)
+	}
+	if remote.K != 0 && fp.K != 0 && remote.Generation == fp.Generation && remote.K != fp.K {
+		return fmt.Errorf("group count mismatch generation=%d local=%d remote=%d",
+			fp.Generation, fp.K, remote.K)
+	}
+	return nil
+}
+
+// MarshalBinary encodes the fingerprint into its fixed size header
+func (fp Fingerprint) MarshalBinary() ([]byte, error) {
+	b := make([]byte, fingerprintSize)
+	b[0] = fp.Version
+	binary.BigEndian.PutUint32(b[1:], fp.Hash)
+	binary.BigEndian.PutUint32(b[5:], fp.Partitioner)
+	binary.BigEndian.PutUint64(b[9:], fp.Generation)
+	binary.BigEndian.PutUint16(b[17:], uint16(fp.K))
+	return b, nil
+}
+
+// UnmarshalBinary decodes the fingerprint from the header
+func (fp *Fingerprint) UnmarshalBinary(b []byte) error {
+	if len(b) < fingerprintSize {
+		return fmt.Errorf("fingerprint: size too small")
+	}
+
+	fp.Version = b[0]
+	fp.Hash = binary.BigEndian.Uint32(b[1:])
+	fp.Partitioner = binary.BigEndian.Uint32(b[5:])
+	fp.Generation = binary.BigEndian.Uint64(b[9:])
+	fp.K = int(binary.BigEndian.Uint16(b[17:]))
+	return nil
+}
+
+// Fingerprint returns the fingerprint of the local node based on the current
+// layout
+func (lrpc *localGroup) Fingerprint() Fingerprint {
+	l := lrpc.layout()
+	return Fingerprint{
+		Version:     protocolVersion,
+		Hash:        lrpc.hashID,
+		Partitioner: lrpc.partID,
+		Generation:  l.gen,
+		K:           l.k(),
+	}
+}
@@ -0,0 +1,107 @@
+package kelips
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+)
+
+func Test_Fingerprint(t *testing.T) {
+	part := partitionerID(nil, sha256.Size)
+	fp := Fingerprint{Version: protocolVersion, Hash: hashFuncID(sha256.New), Partitioner: part, Generation: 3, K: 7}
+
+	b, _ := fp.MarshalBinary()
+	if len(b) != fingerprintSize {
+		t.Fatal("wrong size", len(b))
+	}
+	var out Fingerprint
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if out != fp {
+		t.Fatal("fingerprint mismatch", out, fp)
+	}
+	if err := out.UnmarshalBinary(b[:5]); err == nil {
+		t.Fatal("should fail with short header")
+	}
+
+	if hashFuncID(sha256.New) == hashFuncID(sha1.New) {
+		t.Fatal("hash ids should differ")
+	}
+	if part != partitionerID(NewRangePartitioner, sha256.Size) {
+		t.Fatal("default partitioner id should be the range partitioner")
+	}
+	jump := partitionerID(NewJumpPartitioner, sha256.Size)
+	if part == jump {
+		t.Fatal("partitioner ids should differ")
+	}
+
+	compatible := []Fingerprint{
+		fp,
+		clientFingerprint(),
+		{Version: protocolVersion, Hash: fp.Hash, Partitioner: part, Generation: 4, K: 9},
+		{Version: protocolVersion, Hash: fp.Hash, Generation: 3, K: 7},
+	}
+	for _, remote := range compatible {
+		if err := fp.Check(remote); err != nil {
+			t.Error(err)
+		}
+	}
+
+	incompatible := []Fingerprint{
+		{Version: protocolVersion + 1, Hash: fp.Hash, Generation: 3, K: 7},
+		{Version: protocolVersion, Hash: hashFuncID(sha1.New), Generation: 3, K: 7},
+		{Version: protocolVersion, Hash: fp.Hash, Generation: 3, K: 8},
+		{Version: protocolVersion, Hash: fp.Hash, Partitioner: jump, Generation: 3, K: 7},
+	}
+	for _, remote := range incompatible {
+		if err := fp.Check(remote); err == nil {
+			t.Error("should be incompatible", remote)
+		}
+	}
+}
+
+func Test_Kelips_Incompatible(t *testing.T) {
+	k1 := kelipsTestInstance(54580)
+
+	conf := fastTestConf("127.0.0.1:54581")
+	conf.K = 3
+	k2, err := Create(conf, newBareTrans("127.0.0.1:54581"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k2.Join([]string{"127.0.0.1:54580"}); err == nil {
+		t.Fatal("should reject node with different K")
+	}
+
+	conf = fastTestConf("127.0.0.1:54582")
+	conf.HashFunc = sha1.New
+	k3, err := Create(conf, newBareTrans("127.0.0.1:54582"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k3.Join([]string{"127.0.0.1:54580"}); err == nil {
+		t.Fatal("should reject node with different hash function")
+	}
+
+	conf = fastTestConf("127.0.0.1:54583")
+	conf.Partitioner = NewJumpPartitioner
+	k4, err := Create(conf, newBareTrans("127.0.0.1:54583"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = k4.Join([]string{"127.0.0.1:54580"}); err == nil {
+		t.Fatal("should reject node with different partitioner")
+	}
+
+	if k1.groups().nodeCount() != 1 {
+		t.Fatal("incompatible nodes should not be added", k1.groups().nodeCount())
+	}
+
+	// Clients are not checked for K or the hash function
+	client, _ := NewClient("127.0.0.1:54580")
+	defer client.Close()
+	if _, err = client.LookupGroupNodes([]byte("key")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"hash"
 	"log"
+	"net"
 	"sync"
 	"time"
 
@@ -20,6 +21,9 @@ type propReq struct {
 	typ   int
 	key   []byte
 	tuple TupleHost
+
+	// Principal of the original caller if it is trusted
+	principal string
 }
 
 // affinityGroup is a partial view of the nodes part of a given affinity group
@@ -35,6 +39,14 @@ type affinityGroup struct {
 	m  map[string]*kelipspb.Node
 }
 
+func toNodePtrs(n []kelipspb.Node) []*kelipspb.Node {
+	nodes := make([]*kelipspb.Node, len(n))
+	for i := range n {
+		nodes[i] = &n[i]
+	}
+	return nodes
+}
+
 func newAffinityGroup(id []byte, index int) *affinityGroup {
 	return &affinityGroup{
 		id:    id,
@@ -72,21 +84,31 @@ func (group *affinityGroup) getNode(hostname string) (*kelipspb.Node, bool) {
 	return nil, false
 }
 
-// pingNode updates the heartbeat count, rtt, and last seen values
-func (group *affinityGroup) pingNode(hostname string, coord *vivaldi.Coordinate, rtt time.Duration) error {
+// pingNode updates the heartbeat count, rtt, and last seen values.  Coordinates
+// and metadata are only updated if they are not nil
+func (group *affinityGroup) pingNode(hostname string, coord *vivaldi.Coordinate, meta map[string]string, rtt time.Duration) error {
 	group.mu.Lock()
 	defer group.mu.Unlock()
 
-	node, ok := group.m[hostname]
+	n, ok := group.m[hostname]
 	if !ok {
 		return fmt.Errorf("node not found: %s", hostname)
 	}
 
+	// Update a copy as references to the existing node may be held by callers
+	node := *n
 	node.Heartbeats++
 	node.LastSeen = time.Now().UnixNano()
-	node.Coordinates = coord
-
-	//log.Println("[DEBUG] Pinged", hostname, rtt)
+	if coord != nil {
+		node.Coordinates = coord
+	}
+	if meta != nil {
+		node.Meta = meta
+	}
+	if rtt > 0 {
+		node.Latency = rtt
+	}
+	group.m[hostname] = &node
 
 	return nil
 }
@@ -102,10 +124,11 @@ func (group *affinityGroup) removeNode(hostname string) error {
 
 	group.mu.Lock()
 	delete(group.m, hostname)
+	count := len(group.m)
 	group.mu.Unlock()
 
 	log.Printf("[INFO] Node removed group=%d count=%d node=%s", group.index,
-		len(group.m), hostname)
+		count, hostname)
 
 	return nil
 }
@@ -123,42 +146,71 @@ func (group *affinityGroup) addNode(node *kelipspb.Node, force bool) error {
 	group.mu.Lock()
 	node.LastSeen = time.Now().UnixNano()
 	group.m[addr] = node
+	count := len(group.m)
 	group.mu.Unlock()
 
-	log.Printf("[INFO] Node added group=%d count=%d host=%s", group.index, len(group.m), addr)
+	log.Printf("[INFO] Node added group=%d count=%d host=%s", group.index, count, addr)
 
 	return nil
 }
 
 type localGroup struct {
+	// Local node.  Its metadata may be updated at runtime and is guarded by the
+	// lock
+	mu    sync.RWMutex
 	local *kelipspb.Node
 
-	// Local group index
-	idx int
-
-	// hash function
+	// hash function and its identifier
 	hashFunc func() hash.Hash
+	hashID   uint32
+
+	// Partitioner used to build layouts on resize and its identifier
+	partitioner PartitionerFunc
+	partID      uint32
 
 	// Group tuples
 	tuples TupleStore
 
-	// All groups
-	groups affinityGroups
+	// Current layout of all groups and the previous one while a resize is in
+	// progress
+	lmu  sync.RWMutex
+	cur  *layout
+	prev *layout
 
 	// propogation request channel
 	propReqs chan *propReq
 
 	// Network transport
 	trans Transport
+
+	// Local vivaldi coordinate client
+	coordClient *vivaldi.Client
+
+	// Locality preference to order returned nodes
+	locality Locality
+
+	// Require LookupNodes to return nodes in distinct zones
+	distinctZones bool
+
+	// Principal of each owned tuple and the optional authorizer consulted on
+	// inserts and deletes
+	owners     *ownerIndex
+	authorizer Authorizer
+
+	// Version of the tuple store
+	versions *versionedTuples
 }
 
-func (lrpc *localGroup) Insert(key []byte, tuple TupleHost, propogate bool) error {
-	err := lrpc.tuples.Insert(key, tuple)
+// Insert inserts the tuple into the local store if allowed by the authorizer
+// recording the caller principal as its owner if it has none
+func (lrpc *localGroup) Insert(key []byte, tuple TupleHost, caller Caller, propogate bool) error {
+	err := lrpc.insert(key, tuple, caller, propogate)
 	if err == nil && propogate {
 		prop := &propReq{
-			typ:   1,
-			key:   make([]byte, len(key)),
-			tuple: tuple.Copy(),
+			typ:       1,
+			key:       make([]byte, len(key)),
+			tuple:     tuple.Copy(),
+			principal: caller.verified(),
 		}
 		copy(prop.key, key)
 
@@ -169,44 +221,100 @@ func (lrpc *localGroup) Insert(key []byte, tuple TupleHost, propogate bool) erro
 }
 
 func (lrpc *localGroup) LookupNodes(key []byte, min int) ([]*kelipspb.Node, error) {
+	return lrpc.lookupNodes(key, min, lrpc.locality)
+}
+
+// lookupNodes returns atleast min nodes for the key ordered by the locality
+// preference.  If distinct zones are required the first min nodes will each be
+// in a different zone
+func (lrpc *localGroup) lookupNodes(key []byte, min int, pref Locality) ([]*kelipspb.Node, error) {
 	h := lrpc.hashFunc()
 	h.Write(key)
 	sh := h.Sum(nil)
 
-	group := lrpc.groups.get(sh)
-	nodes := group.Nodes()
+	groups := lrpc.groups()
+	group := groups.get(sh)
+	if lrpc.distinctZones {
+		return lrpc.lookupZoneNodes(key, groups, group, min, pref)
+	}
+
+	nodes := toNodePtrs(group.Nodes())
 
 GET_MORE:
 	if len(nodes) >= min {
-		out := make([]*kelipspb.Node, len(nodes))
-		for i := range nodes {
-			out[i] = &nodes[i]
-		}
-		return out, nil
+		lrpc.sortNodes(nodes, pref)
+		return nodes, nil
 	}
 
-	group = lrpc.groups.nextClosestGroup(group)
+	group = groups.nextClosestGroup(group)
 	if group == nil {
 		return nil, fmt.Errorf("nodes not found: %x", key)
 	}
 
-	nodes = append(nodes, group.Nodes()...)
+	nodes = append(nodes, toNodePtrs(group.Nodes())...)
 	goto GET_MORE
 
 }
 
+// lookupZoneNodes walks the groups starting at the given one until nodes from
+// atleast min distinct zones have been found.
+func (lrpc *localGroup) lookupZoneNodes(key []byte, groups affinityGroups, group *affinityGroup, min int, pref Locality) ([]*kelipspb.Node, error) {
+	var nodes []*kelipspb.Node
+
+	for i := 0; i < len(groups.list); i++ {
+		g := groups.list[(group.index+i)%len(groups.list)]
+		nodes = append(nodes, toNodePtrs(g.Nodes())...)
+		if len(nodes) < min {
+			continue
+		}
+
+		lrpc.sortNodes(nodes, pref)
+		if orderDistinctZones(nodes) >= min {
+			return nodes, nil
+		}
+	}
+
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("nodes not found: %x", key)
+	}
+	return nil, fmt.Errorf("not enough zones for %d nodes: %x", min, key)
+}
+
+// sortNodes orders the nodes relative to the local node
+func (lrpc *localGroup) sortNodes(nodes []*kelipspb.Node, pref Locality) {
+	sortByLocality(lrpc.localNode(), nodes, pref)
+}
+
+// localNode returns a copy of the local node with its current metadata and
+// coordinates
+func (lrpc *localGroup) localNode() *kelipspb.Node {
+	lrpc.mu.RLock()
+	meta := lrpc.local.Meta
+	lrpc.mu.RUnlock()
+
+	return &kelipspb.Node{
+		ID:          lrpc.local.ID,
+		Address:     lrpc.local.Address,
+		Meta:        meta,
+		Coordinates: lrpc.coordClient.GetCoordinate(),
+	}
+}
+
+// setMeta replaces the local node metadata.  The map must not be modified after
+// it has been set
+func (lrpc *localGroup) setMeta(meta map[string]string) {
+	lrpc.mu.Lock()
+	lrpc.local.Meta = meta
+	lrpc.mu.Unlock()
+}
+
 func (lrpc *localGroup) LookupGroupNodes(key []byte) ([]*kelipspb.Node, error) {
 	h := lrpc.hashFunc()
 	h.Write(key)
 	sh := h.Sum(nil)
 
-	group := lrpc.groups.get(sh)
-	n := group.Nodes()
-	nodes := make([]*kelipspb.Node, len(n))
-	for i := range n {
-		nodes[i] = &n[i]
-	}
-	return nodes, nil
+	group := lrpc.groups().get(sh)
+	return toNodePtrs(group.Nodes()), nil
 }
 
 func (lrpc *localGroup) Lookup(key []byte) ([]*kelipspb.Node, error) {
@@ -221,7 +329,7 @@ func (lrpc *localGroup) Lookup(key []byte) ([]*kelipspb.Node, error) {
 	for _, tuple := range tuples {
 		h.Reset()
 		id := tuple.ID(h)
-		group := lrpc.groups.get(id)
+		group := lrpc.groups().get(id)
 
 		if node, ok := group.getNode(tuple.String()); ok {
 			nodes = append(nodes, node)
@@ -231,13 +339,47 @@ func (lrpc *localGroup) Lookup(key []byte) ([]*kelipspb.Node, error) {
 	return nodes, nil
 }
 
-func (lrpc *localGroup) Delete(key []byte, tuple TupleHost, propogate bool) error {
-	ok := lrpc.tuples.DeleteKeyHost(key, tuple)
+// TupleVersion returns the version of the local tuple store
+func (lrpc *localGroup) TupleVersion() uint64 {
+	return lrpc.versions.Version()
+}
+
+// insert authorizes and inserts the tuple under the key lock so concurrent
+// callers cannot both claim an unowned tuple
+func (lrpc *localGroup) insert(key []byte, tuple TupleHost, caller Caller, propogate bool) error {
+	unlock := lrpc.owners.lock(key)
+	defer unlock()
+
+	if err := lrpc.authorize(AccessInsert, key, tuple, caller, propogate); err != nil {
+		return err
+	}
+
+	// The owner is set before inserting so the store hook removes it with the
+	// tuple however the tuple is removed
+	claim := lrpc.owner(key, tuple) == ""
+	if claim {
+		lrpc.owners.set(key, tuple, caller.verified())
+	}
+
+	err := lrpc.tuples.Insert(key, tuple)
+	if err != nil && claim {
+		lrpc.owners.remove(key, tuple)
+	}
+	return err
+}
+
+// Delete deletes the tuple from the local store if allowed by the authorizer
+func (lrpc *localGroup) Delete(key []byte, tuple TupleHost, caller Caller, propogate bool) error {
+	ok, err := lrpc.delete(key, tuple, caller, propogate)
+	if err != nil {
+		return err
+	}
 	if ok && propogate {
 		prop := &propReq{
-			typ:   0,
-			key:   make([]byte, len(key)),
-			tuple: make([]byte, len(tuple)),
+			typ:       0,
+			key:       make([]byte, len(key)),
+			tuple:     make([]byte, len(tuple)),
+			principal: caller.verified(),
 		}
 		copy(prop.key, key)
 		copy(prop.tuple, tuple)
@@ -247,23 +389,80 @@ func (lrpc *localGroup) Delete(key []byte, tuple TupleHost, propogate bool) erro
 	return nil
 }
 
+// delete authorizes and deletes the tuple under the key lock returning true if
+// it was deleted
+func (lrpc *localGroup) delete(key []byte, tuple TupleHost, caller Caller, propogate bool) (bool, error) {
+	unlock := lrpc.owners.lock(key)
+	defer unlock()
+
+	if err := lrpc.authorize(AccessDelete, key, tuple, caller, propogate); err != nil {
+		return false, err
+	}
+
+	return lrpc.tuples.DeleteKeyHost(key, tuple), nil
+}
+
+// Ping updates the coordinates and metadata of the remote node if it is known
+// and returns the local node with its current coordinates and metadata.  Callers
+// that are not authenticated may only update the node at their own address
+func (lrpc *localGroup) Ping(node *kelipspb.Node, caller Caller) *kelipspb.Node {
+	if !caller.Remote || caller.Peer != "" || sameIP(node.Address, caller.Addr) {
+		host := node.Address.String()
+		group := lrpc.groups().get(node.HashID(lrpc.hashFunc()))
+		group.pingNode(host, node.Coordinates, node.Meta, 0)
+	}
+
+	return lrpc.localNode()
+}
+
+// sameIP returns true if the address has the ip of the host and port.  Ports
+// are not compared as requests are sent from a different port than the one a
+// node listens on
+func sameIP(addr kelipspb.Address, hostport string) bool {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.Equal(addr.IP())
+}
+
+// Join adds the remote node replacing any existing entry if allowed by the
+// authorizer, and returns the first page of the snapshot containing tuples for
+// the group the node belongs to
+func (lrpc *localGroup) Join(node *kelipspb.Node, req *SnapshotRequest, caller Caller) (*kelipspb.Snapshot, error) {
+	if err := lrpc.authorizeCluster(AccessJoin, TupleHost(node.Address), "", caller); err != nil {
+		return nil, err
+	}
+
+	node.ID = node.HashID(lrpc.hashFunc())
+	group := lrpc.groups().get(node.ID)
+	if err := group.addNode(node, true); err != nil {
+		return nil, err
+	}
+
+	req.Group = group.index
+	return lrpc.SnapshotPage(req)
+}
+
 func (lrpc *localGroup) Snapshot() *kelipspb.Snapshot {
+	l := lrpc.layout()
 	snapshot := &kelipspb.Snapshot{
-		Tuples: make([]*kelipspb.Tuple, 0, lrpc.tuples.Count()),
-		Nodes:  make([]*kelipspb.Node, 0, lrpc.groups.nodeCount()),
+		Groups:      int32(l.k()),
+		Generation:  l.gen,
+		Hash:        lrpc.hashID,
+		Partitioner: lrpc.partID,
+		Tuples:      make([]*kelipspb.Tuple, 0, lrpc.tuples.Count()),
+		Nodes:       make([]*kelipspb.Node, 0, l.groups.nodeCount()),
 	}
 
 	// Handle all tuples
 	lrpc.tuples.Iter(func(key []byte, hosts []TupleHost) bool {
-		tuple := &kelipspb.Tuple{Key: key, Hosts: make([][]byte, 0, len(hosts))}
-		for _, h := range hosts {
-			tuple.Hosts = append(tuple.Hosts, h)
-		}
-		snapshot.Tuples = append(snapshot.Tuples, tuple)
+		snapshot.Tuples = append(snapshot.Tuples, lrpc.snapshotTuple(key, hosts))
 		return true
 	})
 
-	lrpc.groups.iterNodes(func(node kelipspb.Node) bool {
+	l.groups.iterNodes(func(node kelipspb.Node) bool {
 		snapshot.Nodes = append(snapshot.Nodes, &node)
 		return true
 	})
@@ -281,15 +480,15 @@ func (lrpc *localGroup) propogate(hashFunc func() hash.Hash) {
 		h.Write(prop.key)
 		id := h.Sum(nil)
 
-		group := lrpc.groups.get(id)
+		group := lrpc.groups().get(id)
 		nodes := group.Nodes()
 
 		switch prop.typ {
 		case 0:
-			lrpc.propogateDelete(prop.key, prop.tuple, nodes)
+			lrpc.propogateDelete(prop, nodes)
 
 		case 1:
-			lrpc.propogateInsert(prop.key, prop.tuple, nodes)
+			lrpc.propogateInsert(prop, nodes)
 
 		default:
 			log.Printf("[ERROR] Unrecognized propogation request: %d", prop.typ)
@@ -300,77 +499,42 @@ func (lrpc *localGroup) propogate(hashFunc func() hash.Hash) {
 	}
 }
 
-func (lrpc *localGroup) propogateDelete(key []byte, tuple TupleHost, nodes []kelipspb.Node) {
+func (lrpc *localGroup) propogateDelete(prop *propReq, nodes []kelipspb.Node) {
 	for _, node := range nodes {
 		naddr := node.Address.String()
 		if naddr == lrpc.local.Address.String() {
 			continue
 		}
 
-		go lrpc.remoteDelete(naddr, key, tuple)
+		go lrpc.remoteDelete(naddr, prop.key, prop.tuple, prop.principal)
 
 	}
 }
 
-func (lrpc *localGroup) remoteDelete(a string, k []byte, t TupleHost) {
-	err := lrpc.trans.Delete(a, k, t, false)
+func (lrpc *localGroup) remoteDelete(a string, k []byte, t TupleHost, principal string) {
+	err := lrpc.trans.Delete(a, k, t, principal, false)
 	if err != nil {
 		log.Printf("[ERROR] Failed to propogate delete: %s host=%s key=%x",
 			err, a, k)
 	}
 }
 
-func (lrpc *localGroup) propogateInsert(key []byte, tuple TupleHost, nodes []kelipspb.Node) {
+func (lrpc *localGroup) propogateInsert(prop *propReq, nodes []kelipspb.Node) {
 	for _, node := range nodes {
 		naddr := node.Address.String()
 		if naddr == lrpc.local.Address.String() {
 			continue
 		}
 
-		go lrpc.remoteInsert(naddr, key, tuple)
+		go lrpc.remoteInsert(naddr, prop.key, prop.tuple, prop.principal)
 
 	}
 }
 
-func (lrpc *localGroup) remoteInsert(a string, k []byte, t TupleHost) {
-	err := lrpc.trans.Insert(a, k, t, false)
+func (lrpc *localGroup) remoteInsert(a string, k []byte, t TupleHost, principal string) {
+	err := lrpc.trans.Insert(a, k, t, principal, false)
 	if err != nil {
 		log.Printf("[ERROR] Failed to propogate insert: %v host=%s key=%x",
 			err, a, k)
 	}
 }
-
-// localhost is the local host to skip
-// func (group *affinityGroup) checkNodes(localhost string) {
-// 	nodes := group.Nodes()
-// 	for i, n := range nodes {
-// 		if n.Host() == localhost {
-// 			// Update self coordinates
-// 			group.pingNode(n.Host(), group.kelips.coordClient.GetCoordinate(), 0)
-// 			nodes = append(nodes[:i], nodes[i+1:]...)
-// 			break
-// 		}
-// 	}
-//
-// 	for _, n := range nodes {
-// 		coord, rtt, err := group.kelips.trans.Ping(n.Host())
-// 		if err != nil {
-// 			log.Println("[ERROR] Ping failed", n.Host(), err)
-// 			continue
-// 		}
-//
-// 		if rtt == 0 {
-// 			continue
-// 		}
-//
-// 		if err = group.pingNode(n.Host(), coord, rtt); err != nil {
-// 			log.Println("[ERROR] Ping failed", n, err)
-// 			continue
-// 		}
-//
-// 		if _, err = group.kelips.coordClient.Update(n.Host(), coord, rtt); err != nil {
-// 			log.Println("[ERROR] Update coord failed", n, err)
-// 		}
-// 	}
-//
-// }
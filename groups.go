@@ -1,44 +1,24 @@
 package kelips
 
 import (
-	"bytes"
-	"math/big"
-
 	"github.com/hexablock/go-kelips/kelipspb"
 )
 
-type affinityGroups []*affinityGroup
+// affinityGroups contains all affinity groups and the partitioner used to map
+// ids to a group
+type affinityGroups struct {
+	part Partitioner
+	list []*affinityGroup
+}
 
-// get the affinity group for the given hash id.  This uses a binary tree search
-// to find the correct affinity group
+// get the affinity group for the given hash id using the partitioner
 func (ct affinityGroups) get(id []byte) *affinityGroup {
-	var (
-		arr = ct
-		l   = len(arr)
-		i   int
-	)
-
-REPEAT_ON_HALF:
-	i = len(arr) / 2
-	if i != 0 && i != l {
-
-		s := bytes.Compare(id, arr[i].id)
-		if s < 0 {
-			arr = arr[:i]
-			goto REPEAT_ON_HALF
-		} else if s > 0 {
-			arr = arr[i:]
-			goto REPEAT_ON_HALF
-		}
-
-	}
-
-	return arr[i]
+	return ct.list[ct.part.Partition(id)]
 }
 
 func (ct affinityGroups) nodeCount() int {
 	var c int
-	for _, g := range ct {
+	for _, g := range ct.list {
 		c += g.count()
 	}
 	return c
@@ -46,7 +26,7 @@ func (ct affinityGroups) nodeCount() int {
 
 // iterNodes iterates over all nodes in all groups
 func (ct affinityGroups) iterNodes(f func(kelipspb.Node) bool) {
-	for _, group := range ct {
+	for _, group := range ct.list {
 
 		nodes := group.Nodes()
 		for _, node := range nodes {
@@ -66,10 +46,10 @@ func (ct affinityGroups) nextClosestGroup(g *affinityGroup) *affinityGroup {
 	var nodes []kelipspb.Node
 
 NEXT_GROUP:
-	if group.index == (len(ct) - 1) {
-		group = ct[0]
+	if group.index == (len(ct.list) - 1) {
+		group = ct.list[0]
 	} else {
-		group = ct[group.index+1]
+		group = ct.list[group.index+1]
 	}
 
 	nodes = group.Nodes()
@@ -84,23 +64,18 @@ NEXT_GROUP:
 	return nil
 }
 
-func genAffinityGroups(numGroups int64, hashSize int64) affinityGroups {
-	// Calculate the size of the keyspace
-	var keyspace big.Int
-	keyspace.Exp(big.NewInt(2), big.NewInt(hashSize*8), nil)
-	// Number of affinity groups
-	k := big.NewInt(numGroups)
-	// Size of each group given the keyspace
-	groupSize := new(big.Int).Div(&keyspace, k)
+// genAffinityGroups generates the given number of groups using the partitioner.
+// Group ids are the fixed width start of each equal range of the keyspace
+func genAffinityGroups(numGroups int, hashSize int, partFunc PartitionerFunc) affinityGroups {
+	if partFunc == nil {
+		partFunc = NewRangePartitioner
+	}
 
+	ids := groupIDs(numGroups, hashSize)
 	ags := make([]*affinityGroup, numGroups)
-	// First group i.e. 0 group
-	ags[0] = newAffinityGroup(make([]byte, hashSize), 0)
-	// Generate the remainder groups
-	for i := int64(1); i < numGroups; i++ {
-		gi := new(big.Int).Mul(big.NewInt(i), groupSize)
-		ags[i] = newAffinityGroup(gi.Bytes(), int(i))
+	for i := range ags {
+		ags[i] = newAffinityGroup(ids[i], i)
 	}
 
-	return affinityGroups(ags)
+	return affinityGroups{part: partFunc(numGroups, hashSize), list: ags}
 }
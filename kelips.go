@@ -3,10 +3,12 @@ package kelips
 import (
 	"fmt"
 	"log"
+	"math/rand"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hexablock/go-kelips/kelipspb"
-	"github.com/hexablock/iputil"
 	"github.com/hexablock/vivaldi"
 )
 
@@ -37,6 +39,21 @@ type TupleStore interface {
 	ExpireHost(tuple TupleHost) bool
 }
 
+// TupleHook is called by a tuple store while the key is locked when the host is
+// added to or removed from the key changing its number of hosts from before to
+// after.  An error aborts an insert and is ignored for removals
+type TupleHook func(key []byte, host TupleHost, before, after int) error
+
+// HookedTupleStore is a TupleStore that calls hooks on changes.  This allows
+// state derived from the tuples to be kept consistent without locks of its own
+type HookedTupleStore interface {
+	TupleStore
+
+	// AddHook adds a hook called on every change.  Hooks must be added before
+	// the store is used
+	AddHook(hook TupleHook)
+}
+
 // AffinityGroupRPC implements an interface for local rpc's used by the
 // transport
 type AffinityGroupRPC interface {
@@ -49,23 +66,93 @@ type AffinityGroupRPC interface {
 	// Lookup nodes from the local view
 	Lookup(key []byte) ([]*kelipspb.Node, error)
 
-	// Insert to local group
-	Insert(key []byte, tuple TupleHost, propogate bool) error
+	// Insert to local group on behalf of the caller
+	Insert(key []byte, tuple TupleHost, caller Caller, propogate bool) error
+
+	// Delete from local group on behalf of the caller
+	Delete(key []byte, tuple TupleHost, caller Caller, propogate bool) error
+
+	// Ping is called when a remote node pings the local node.  The remote node
+	// is supplied with its current coordinates.  It returns the local node with
+	// its current coordinates
+	Ping(node *kelipspb.Node, caller Caller) *kelipspb.Node
+
+	// Join is called when a remote node joins via the local node.  The node is
+	// added and the first page of a snapshot containing the tuples for the
+	// joining nodes group along with all known nodes is returned.  The caller
+	// is checked by the authorizer
+	Join(node *kelipspb.Node, req *SnapshotRequest, caller Caller) (*kelipspb.Snapshot, error)
+
+	// SnapshotPage returns a page of the local snapshot
+	SnapshotPage(req *SnapshotRequest) (*kelipspb.Snapshot, error)
+
+	// Resize switches to a layout of k groups if the generation is newer than
+	// the current one on behalf of the caller
+	Resize(gen uint64, k int, caller Caller) error
+
+	// Fingerprint returns the local fingerprint used to reject requests from
+	// incompatible nodes
+	Fingerprint() Fingerprint
+
+	// ExpireHost removes the host from all keys on the nodes within the scope
+	// on behalf of the caller
+	ExpireHost(tuple TupleHost, scope ExpireScope, caller Caller) error
+
+	// Scan returns sorted keys with the prefix after the cursor from the local
+	// store or all groups if cluster is true
+	Scan(prefix, cursor []byte, limit int, cluster bool) ([][]byte, bool, error)
 
-	// Delete from local group
-	Delete(key []byte, tuple TupleHost, propogate bool) error
+	// PurgeNamespace deletes all keys in the namespace on the nodes within the
+	// scope on behalf of the caller
+	PurgeNamespace(ns string, scope ExpireScope, caller Caller) error
+
+	// TupleVersion returns the version of the local tuple store.  It changes
+	// whenever a tuple is inserted or removed
+	TupleVersion() uint64
 }
 
 // Transport implements RPC's needed by kelips
 type Transport interface {
 	LookupGroupNodes(host string, key []byte) ([]*kelipspb.Node, error)
 	Lookup(host string, key []byte) ([]*kelipspb.Node, error)
-	Insert(host string, key []byte, tuple TupleHost, propogate bool) error
-	Delete(host string, key []byte, tuple TupleHost, propogate bool) error
+	// Insert and Delete apply the tuple on the host on behalf of the principal
+	Insert(host string, key []byte, tuple TupleHost, principal string, propogate bool) error
+	Delete(host string, key []byte, tuple TupleHost, principal string, propogate bool) error
+	// Ping sends the local node with its coordinates to the host returning the
+	// remote node with its coordinates and the round trip time
+	Ping(host string, node *kelipspb.Node) (*kelipspb.Node, time.Duration, error)
+	// Join announces the local node to the host returning the first page of
+	// its snapshot
+	Join(host string, node *kelipspb.Node) (*kelipspb.Snapshot, error)
+	// Snapshot returns a page of the snapshot from the host
+	Snapshot(host string, req *SnapshotRequest) (*kelipspb.Snapshot, error)
+	// Resize sends the new layout generation and number of groups to the host
+	Resize(host string, gen uint64, k int) error
+	// InsertBatch and DeleteBatch apply the entries on the host on behalf of
+	// the principal returning an error for each entry
+	InsertBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error)
+	DeleteBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error)
+	// LookupBatch looks up each key on the host returning a result for each
+	LookupBatch(host string, keys [][]byte) ([]LookupResult, error)
+	// ExpireHost removes the tuple host from all keys on the host and the
+	// other nodes within the scope
+	ExpireHost(host string, tuple TupleHost, scope ExpireScope) error
+	// Scan returns sorted keys with the prefix after the cursor from the host
+	// or all groups via the host if cluster is true
+	Scan(host string, prefix, cursor []byte, limit int, cluster bool) ([][]byte, bool, error)
+	// PurgeNamespace deletes all keys in the namespace on the host and the
+	// other nodes within the scope
+	PurgeNamespace(host string, ns string, scope ExpireScope) error
 	// Register a local affinity group
 	Register(AffinityGroupRPC)
 }
 
+// authenticatedTransport is implemented by transports that authenticate the
+// hosts responses are received from
+type authenticatedTransport interface {
+	authenticated() bool
+}
+
 // AffinityGroup is an interface used for group lookups.  This is used to get
 // nodes in a group
 type AffinityGroup interface {
@@ -79,32 +166,59 @@ type AffinityGroup interface {
 type Kelips struct {
 	conf *Config
 
-	// All groups
-	groups affinityGroups
-
 	// local affinity group
 	local *localGroup
 
 	// Key tuples
 	tuples TupleStore
 
+	// Namespace tracking wrapper of the tuple store
+	namespaces *NamespaceTuples
+
+	// Versioning wrapper of the underlying tuple store
+	versions *versionedTuples
+
 	// Network transport
 	trans Transport
+
+	// Vivaldi coordinate client for the local node
+	coordClient *vivaldi.Client
+
+	// Closed to stop background pings
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 // Create instantiates kelips and registers the local group to the transport. It
-// inits an in-memory tuple store
-func Create(conf *Config, remote Transport) *Kelips {
+// inits a sharded in-memory tuple store if one is not provided.  An error is
+// returned if the config is invalid
+func Create(conf *Config, remote Transport) (*Kelips, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
 	k := &Kelips{
-		conf:   conf,
-		tuples: conf.TupleStore,
-		trans:  remote,
+		conf:     conf,
+		tuples:   conf.TupleStore,
+		trans:    remote,
+		shutdown: make(chan struct{}),
 	}
 
 	if k.tuples == nil {
-		k.tuples = NewInmemTuples()
+		k.tuples = NewShardedTuples(DefaultTupleShards)
 	}
 
+	// Keep a provided scanner usable after wrapping for namespaces
+	_, scanner := k.tuples.(KeyScanner)
+	k.versions = newVersionedTuples(k.tuples)
+	k.tuples = k.versions
+	k.namespaces = NewNamespaceTuples(k.tuples, conf.NamespaceQuotas, conf.DefaultNamespaceQuota)
+	k.tuples = k.namespaces
+	if conf.EnableScanIndex || scanner {
+		k.tuples = NewIndexedTuples(k.tuples)
+	}
+
+	k.initCoordClient()
 	k.init()
 
 	if conf.EnablePropogation {
@@ -112,36 +226,62 @@ func Create(conf *Config, remote Transport) *Kelips {
 		go k.local.propogate(conf.HashFunc)
 	}
 
-	return k
+	go k.ping()
+
+	return k, nil
+}
+
+func (kelips *Kelips) initCoordClient() {
+	conf := kelips.conf.Vivaldi
+	if conf == nil {
+		conf = vivaldi.DefaultConfig()
+	}
+
+	var err error
+	if kelips.coordClient, err = vivaldi.NewClient(conf); err != nil {
+		log.Printf("[ERROR] Invalid vivaldi config using defaults: %v", err)
+		kelips.coordClient, _ = vivaldi.NewClient(vivaldi.DefaultConfig())
+	}
 }
 
 func (kelips *Kelips) init() {
 	c := kelips.conf
-	// Build affinity groups
-	kelips.groups = genAffinityGroups(int64(c.K), int64(c.HashFunc().Size()))
+	// Build the initial layout of affinity groups
+	groups := genAffinityGroups(c.K, c.HashFunc().Size(), c.Partitioner)
 
 	localNode := &kelipspb.Node{
-		Address: kelipspb.NewAddress(c.AdvertiseHost), //kelipspb.Address(tuple),
-		Meta: map[string]string{
-			"region": c.Region,
-			"sector": c.Sector,
-			"zone":   c.Zone,
-		},
+		Address:     kelipspb.NewAddress(c.AdvertiseHost), //kelipspb.Address(tuple),
+		Meta:        kelips.buildMeta(c.Meta),
+		Coordinates: kelips.coordClient.GetCoordinate(),
 	}
 	localNode.ID = localNode.HashID(c.HashFunc())
 
-	group := kelips.groups.get(localNode.ID)
-	group.addNode(localNode, true)
+	// Add a copy to the group as the local node metadata may be updated
+	group := groups.get(localNode.ID)
+	gnode := *localNode
+	group.addNode(&gnode, true)
+
+	// Owners are removed by the store along with their tuples
+	owners := newOwnerIndex()
+	kelips.versions.AddHook(owners.change)
 
 	// Build local group
 	kelips.local = &localGroup{
-		local:    localNode,
-		idx:      group.index,
-		tuples:   kelips.tuples,
-		groups:   kelips.groups,
-		hashFunc: c.HashFunc,
-		trans:    kelips.trans,
-		propReqs: make(chan *propReq, 32),
+		local:         localNode,
+		tuples:        kelips.tuples,
+		versions:      kelips.versions,
+		cur:           &layout{groups: groups, idx: group.index},
+		hashFunc:      c.HashFunc,
+		hashID:        hashFuncID(c.HashFunc),
+		partitioner:   c.Partitioner,
+		partID:        partitionerID(c.Partitioner, c.HashFunc().Size()),
+		trans:         kelips.trans,
+		coordClient:   kelips.coordClient,
+		locality:      c.Locality,
+		distinctZones: c.DistinctZones,
+		propReqs:      make(chan *propReq, 32),
+		owners:        owners,
+		authorizer:    c.Authorizer,
 	}
 
 	kelips.trans.Register(kelips.local)
@@ -150,26 +290,193 @@ func (kelips *Kelips) init() {
 	log.Printf("[INFO] Kelips group=%d/%d id=%x", group.index, c.K, group.id)
 }
 
-// Join adds the given peers to their respective groups
+// buildMeta returns the node metadata from the given user metadata along with
+// the configured region, sector and zone.  The latter take precedence over user
+// supplied values
+func (kelips *Kelips) buildMeta(meta map[string]string) map[string]string {
+	c := kelips.conf
+
+	m := make(map[string]string, len(meta)+3)
+	for k, v := range meta {
+		m[k] = v
+	}
+	m["region"] = c.Region
+	m["sector"] = c.Sector
+	m["zone"] = c.Zone
+
+	return m
+}
+
+// Join announces the local node to each of the given peers and seeds the local
+// node with the returned snapshots.  If none of the peers belong to the local
+// group, a node from the local group is also joined to retrieve the group
+// tuples.  An error is returned only if none of the peers could be joined
 func (kelips *Kelips) Join(peers []string) error {
-	var err error
-	for i := range peers {
-		addr, port, er := iputil.SplitHostPort(peers[i])
-		if er != nil {
-			err = er
+	local := kelips.local.localNode()
+	localhost := local.Address.String()
+
+	var (
+		joined   int
+		inGroup  bool
+		failures []string
+	)
+
+	for _, peer := range peers {
+		if peer == localhost {
 			continue
 		}
-		node := kelipspb.NewNode(addr, port)
-		if er = kelips.AddNode(node, false); er != nil {
-			err = er
+
+		if err := kelips.join(peer, local); err != nil {
+			log.Printf("[ERROR] Failed to join peer=%s: %v", peer, err)
+			failures = append(failures, peer)
+			continue
+		}
+
+		joined++
+		if kelips.getHostGroup(peer).index == kelips.local.index() {
+			inGroup = true
+		}
+	}
+
+	if joined == 0 {
+		if len(failures) == 0 {
+			return nil
+		}
+		return fmt.Errorf("failed to join peers: %s", strings.Join(failures, ","))
+	}
+
+	if !inGroup {
+		kelips.joinLocalGroup(local)
+	}
+
+	return nil
+}
+
+// join announces the local node to the peer and seeds each page of the
+// returned snapshot
+func (kelips *Kelips) join(peer string, local *kelipspb.Node) error {
+	snapshot, err := kelips.trans.Join(peer, local)
+	if err != nil {
+		return err
+	}
+
+	// Adopt the cluster layout if it is newer.  This fails if the layout
+	// conflicts with the local one
+	if snapshot.Groups > 0 {
+		if err = kelips.local.Resize(snapshot.Generation, int(snapshot.Groups), Caller{Principal: kelips.conf.Principal}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		if err = kelips.Seed(snapshot); err != nil {
+			return err
+		}
+
+		if len(snapshot.Cursor) == 0 {
+			return nil
+		}
+
+		req := &SnapshotRequest{Group: kelips.local.index(), Cursor: snapshot.Cursor}
+		if snapshot, err = kelips.trans.Snapshot(peer, req); err != nil {
+			return err
 		}
 	}
-	return err
+}
+
+// joinLocalGroup joins the first reachable node in the local group
+func (kelips *Kelips) joinLocalGroup(local *kelipspb.Node) {
+	localhost := local.Address.String()
+	l := kelips.local.layout()
+	nodes := l.groups.list[l.idx].Nodes()
+
+	for _, node := range nodes {
+		host := node.Address.String()
+		if host == localhost {
+			continue
+		}
+
+		if err := kelips.join(host, local); err != nil {
+			log.Printf("[ERROR] Failed to join group peer=%s: %v", host, err)
+			continue
+		}
+		return
+	}
+}
+
+// UpdateMeta updates the user metadata of the local node.  The region, sector
+// and zone are retained from the config.  The update is propogated to other
+// nodes with the next ping, which is triggered immediately
+func (kelips *Kelips) UpdateMeta(meta map[string]string) {
+	m := kelips.buildMeta(meta)
+	kelips.local.setMeta(m)
+
+	local := kelips.local.localNode()
+	host := local.Address.String()
+	kelips.getHostGroup(host).pingNode(host, local.Coordinates, m, 0)
+
+	go kelips.checkNodes()
+}
+
+// Layout returns the current layout generation and number of groups
+func (kelips *Kelips) Layout() (uint64, int) {
+	l := kelips.local.layout()
+	return l.gen, l.k()
+}
+
+// Resize changes the number of affinity groups to k across the cluster.  The
+// new layout is given the next generation, applied locally and sent to all
+// known nodes.  Each node migrates tuples to their new groups while lookups
+// consult both layouts until the migration completes.  An error is returned
+// listing the nodes that could not be reached.  These nodes adopt the layout
+// when rejoining
+func (kelips *Kelips) Resize(k int) error {
+	gen := kelips.local.layout().gen + 1
+	if err := kelips.local.Resize(gen, k, Caller{Principal: kelips.conf.Principal}); err != nil {
+		return err
+	}
+
+	local := kelips.local.localNode()
+	localhost := local.Address.String()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		failures []string
+	)
+
+	kelips.groups().iterNodes(func(node kelipspb.Node) bool {
+		host := node.Address.String()
+		if host == localhost {
+			return true
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			if err := kelips.trans.Resize(host, gen, k); err != nil {
+				log.Printf("[ERROR] Resize failed host=%s: %v", host, err)
+				mu.Lock()
+				failures = append(failures, host)
+				mu.Unlock()
+			}
+		}(host)
+
+		return true
+	})
+
+	wg.Wait()
+
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to resize peers: %s", strings.Join(failures, ","))
+	}
+	return nil
 }
 
 // LocalNode returns the local node by performing a lookup
 func (kelips *Kelips) LocalNode() kelipspb.Node {
-	group := kelips.groups[kelips.local.idx]
+	l := kelips.local.layout()
+	group := l.groups.list[l.idx]
 	n, _ := group.getNode(kelips.conf.AdvertiseHost)
 	return *n
 }
@@ -178,8 +485,21 @@ func (kelips *Kelips) LocalNode() kelipspb.Node {
 // group, the insert is forwarded to a node in that group and its response
 // is returned.  If the TupleHost is not known it will not be returned in a
 // lookup though will still be in the tuple store.  Once the node is known/alive
-// it will be returned in lookups
+// it will be returned in lookups.  Keys starting with the namespace marker are
+// rejected and must be inserted via a Namespace
 func (kelips *Kelips) Insert(key []byte, tuple TupleHost) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return kelips.insertKey(key, tuple)
+}
+
+// insertKey inserts the stored key which may be namespaced
+func (kelips *Kelips) insertKey(key []byte, tuple TupleHost) error {
+	return kelips.insert(key, tuple, kelips.conf.Principal)
+}
+
+func (kelips *Kelips) insert(key []byte, tuple TupleHost, principal string) error {
 	h := kelips.conf.HashFunc()
 
 	// Hash key
@@ -187,15 +507,16 @@ func (kelips *Kelips) Insert(key []byte, tuple TupleHost) error {
 	keysh := h.Sum(nil)
 
 	// Get key group
-	group := kelips.groups.get(keysh)
+	l := kelips.local.layout()
+	group := l.groups.get(keysh)
 
 	// Local group
-	if group.index == kelips.local.idx {
-		return kelips.local.Insert(key, tuple, true)
+	if group.index == l.idx {
+		return kelips.local.Insert(key, tuple, Caller{Principal: principal}, true)
 	}
 
 	// Foreign group
-	group = kelips.groups.nextClosestGroup(group)
+	group = l.groups.nextClosestGroup(group)
 	if group == nil {
 		return fmt.Errorf("no nodes found for key: %x", key)
 	}
@@ -204,7 +525,7 @@ func (kelips *Kelips) Insert(key []byte, tuple TupleHost) error {
 	var err error
 	for _, n := range nodes {
 		// Return on first successful one
-		if er := kelips.trans.Insert(n.Address.String(), key, tuple, true); er != nil {
+		if er := kelips.trans.Insert(n.Address.String(), key, tuple, principal, true); er != nil {
 			err = er
 			continue
 		}
@@ -215,18 +536,41 @@ func (kelips *Kelips) Insert(key []byte, tuple TupleHost) error {
 
 // Delete deletes a key and all assoicated tuples.  If the key belongs to a
 // foreign group the delete is forwarded to a node in that group and its
-// response is returned
-func (kelips *Kelips) Delete(key []byte, tuple TupleHost) (err error) {
+// response is returned.  While a resize is in progress the delete is also
+// applied to the group in the previous layout.  Keys starting with the
+// namespace marker are rejected and must be deleted via a Namespace
+func (kelips *Kelips) Delete(key []byte, tuple TupleHost) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	return kelips.deleteKey(key, tuple)
+}
+
+// deleteKey deletes the stored key which may be namespaced
+func (kelips *Kelips) deleteKey(key []byte, tuple TupleHost) error {
 	h := kelips.conf.HashFunc()
 
 	// Hash key
 	h.Write(key)
 	keysh := h.Sum(nil)
 
+	cur, prev := kelips.local.layouts()
+	if err := kelips.delete(cur, keysh, key, tuple); err != nil || prev == nil {
+		return err
+	}
+
+	// Remove the tuple if it has not yet been migrated
+	if err := kelips.delete(prev, keysh, key, tuple); err != nil {
+		log.Printf("[ERROR] Failed to delete from previous layout key=%x: %v", key, err)
+	}
+	return nil
+}
+
+func (kelips *Kelips) delete(l *layout, keysh, key []byte, tuple TupleHost) (err error) {
 	// Get key group
-	group := kelips.groups.get(keysh)
-	if group.index == kelips.local.idx {
-		err = kelips.local.Delete(key, tuple, true)
+	group := l.groups.get(keysh)
+	if group.index == l.idx {
+		err = kelips.local.Delete(key, tuple, Caller{Principal: kelips.conf.Principal}, true)
 		return err
 	}
 
@@ -234,7 +578,7 @@ func (kelips *Kelips) Delete(key []byte, tuple TupleHost) (err error) {
 	nodes := group.Nodes()
 	for _, n := range nodes {
 		// First successful one
-		if er := kelips.trans.Delete(n.Address.String(), key, tuple, true); er != nil {
+		if er := kelips.trans.Delete(n.Address.String(), key, tuple, kelips.conf.Principal, true); er != nil {
 			err = er
 			continue
 		}
@@ -244,11 +588,18 @@ func (kelips *Kelips) Delete(key []byte, tuple TupleHost) (err error) {
 	return err
 }
 
-// LookupNodes returns a minimum of n nodes that a key maps to
+// LookupNodes returns a minimum of n nodes that a key maps to ordered by the
+// configured locality preference
 func (kelips *Kelips) LookupNodes(key []byte, min int) ([]*kelipspb.Node, error) {
 	return kelips.local.LookupNodes(key, min)
 }
 
+// LookupNodesLocality returns a minimum of n nodes that a key maps to ordered by
+// the given locality preference
+func (kelips *Kelips) LookupNodesLocality(key []byte, min int, pref Locality) ([]*kelipspb.Node, error) {
+	return kelips.local.lookupNodes(key, min, pref)
+}
+
 // LookupGroupNodes returns all nodes in a group for the key
 func (kelips *Kelips) LookupGroupNodes(key []byte) ([]*kelipspb.Node, error) {
 	return kelips.local.LookupGroupNodes(key)
@@ -256,22 +607,53 @@ func (kelips *Kelips) LookupGroupNodes(key []byte) ([]*kelipspb.Node, error) {
 
 // Lookup hashes the key and finds its affinity group.  If the group is local
 // it returns all local known nodes for the key otherwise it makes a Lookup call
-// on the owning foreign group and returns its nodes
+// on the owning foreign group and returns its nodes.  Nodes are ordered by the
+// configured locality preference
 func (kelips *Kelips) Lookup(key []byte) ([]*kelipspb.Node, error) {
+	return kelips.LookupLocality(key, kelips.conf.Locality)
+}
+
+// LookupLocality performs a Lookup ordering the nodes by the given locality
+// preference
+func (kelips *Kelips) LookupLocality(key []byte, pref Locality) ([]*kelipspb.Node, error) {
+	nodes, err := kelips.lookup(key)
+	if err == nil {
+		kelips.local.sortNodes(nodes, pref)
+	}
+	return nodes, err
+}
+
+// lookup performs the lookup against the current layout.  If the key is not
+// found and a resize is in progress the previous layout is consulted as the key
+// may not have been migrated yet
+func (kelips *Kelips) lookup(key []byte) ([]*kelipspb.Node, error) {
 	h := kelips.conf.HashFunc()
 	h.Write(key)
 	sh := h.Sum(nil)
 
-	group := kelips.groups.get(sh)
+	cur, prev := kelips.local.layouts()
+	nodes, err := kelips.lookupLayout(cur, sh, key)
+	if (err == nil && len(nodes) > 0) || prev == nil {
+		return nodes, err
+	}
+
+	if pnodes, er := kelips.lookupLayout(prev, sh, key); er == nil && len(pnodes) > 0 {
+		return pnodes, nil
+	}
+	return nodes, err
+}
+
+func (kelips *Kelips) lookupLayout(l *layout, sh, key []byte) ([]*kelipspb.Node, error) {
+	group := l.groups.get(sh)
 	nodes := group.Nodes()
 	if len(nodes) == 0 {
-		group = kelips.groups.nextClosestGroup(group)
+		group = l.groups.nextClosestGroup(group)
 		if group == nil {
 			return nil, fmt.Errorf("no nodes found for key: %x", key)
 		}
 	}
 
-	if group.index == kelips.local.idx {
+	if group.index == l.idx {
 		return kelips.local.Lookup(key)
 	}
 
@@ -296,24 +678,156 @@ func (kelips *Kelips) Lookup(key []byte) ([]*kelipspb.Node, error) {
 // PingNode sets the coords and rtt on a node and updates the heartbeat count
 func (kelips *Kelips) PingNode(hostname string, coord *vivaldi.Coordinate, rtt time.Duration) error {
 	group := kelips.getHostGroup(hostname)
-	return group.pingNode(hostname, coord, rtt)
+	return group.pingNode(hostname, coord, nil, rtt)
+}
+
+// Max number of nodes pinged at a time
+const maxPingRequests = 16
+
+// ping pings all known nodes at a random interval between PingMin and PingMax
+// to maintain the local coordinates as well as the coordinates, rtt and last
+// seen values of each node.  It returns on shutdown
+func (kelips *Kelips) ping() {
+	min, max := kelips.conf.PingMin, kelips.conf.PingMax
+	if min <= 0 {
+		min = DefaultConfig("").PingMin
+	}
+	if max <= min {
+		max = min + 1
+	}
+
+	for {
+		d := min + time.Duration(rand.Int63n(int64(max-min)))
+		select {
+		case <-time.After(d):
+		case <-kelips.shutdown:
+			return
+		}
+
+		kelips.checkNodes()
+	}
+}
+
+// Shutdown stops pinging the known nodes in the background.  It does not
+// close the transport
+func (kelips *Kelips) Shutdown() {
+	kelips.shutdownOnce.Do(func() {
+		close(kelips.shutdown)
+	})
+}
+
+// checkNodes pings all known nodes excluding the local one, updating the local
+// coordinate client and the node views with the returned coordinates and rtt.
+// Upto maxPingRequests nodes are pinged at a time
+func (kelips *Kelips) checkNodes() {
+	local := kelips.local.localNode()
+	localhost := local.Address.String()
+
+	// Update self coordinates
+	kelips.getHostGroup(localhost).pingNode(localhost, local.Coordinates, local.Meta, 0)
+
+	var (
+		wg  sync.WaitGroup
+		sem = make(chan struct{}, maxPingRequests)
+	)
+	kelips.groups().iterNodes(func(node kelipspb.Node) bool {
+		host := node.Address.String()
+		if host == localhost {
+			return true
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-kelips.shutdown:
+			return false
+		}
+
+		wg.Add(1)
+		go func(host string) {
+			kelips.pingHost(host)
+			<-sem
+			wg.Done()
+		}(host)
+
+		return true
+	})
+
+	wg.Wait()
+}
+
+// pingHost pings a single host and updates the coordinates and metadata
+// accordingly
+func (kelips *Kelips) pingHost(host string) {
+	remote, rtt, err := kelips.trans.Ping(host, kelips.local.localNode())
+	if err != nil {
+		log.Printf("[ERROR] Ping failed host=%s: %v", host, err)
+		return
+	}
+
+	if rtt == 0 || remote.Coordinates == nil {
+		return
+	}
+
+	group := kelips.getHostGroup(host)
+	if err = group.pingNode(host, remote.Coordinates, remote.Meta, rtt); err != nil {
+		log.Printf("[ERROR] Ping failed host=%s: %v", host, err)
+		return
+	}
+
+	if _, err = kelips.coordClient.Update(host, remote.Coordinates, rtt); err != nil {
+		log.Printf("[ERROR] Update coord failed host=%s: %v", host, err)
+	}
 }
 
 // AddNode adds a node to the DHT.  It calculates the node id and adds it to the
 // group it belongs to
 func (kelips *Kelips) AddNode(node *kelipspb.Node, force bool) error {
 	node.ID = node.HashID(kelips.conf.HashFunc())
-	group := kelips.groups.get(node.ID)
+	group := kelips.groups().get(node.ID)
 	return group.addNode(node, force)
 }
 
+// ExpireHost removes the host from all keys on every node in every group.  This
+// allows hosts that are not cluster members to remove all of their tuples.  An
+// error is returned listing the groups where no node could be reached
+func (kelips *Kelips) ExpireHost(host string) error {
+	return kelips.local.ExpireHost(NewTupleHost(host), ExpireCluster, Caller{Principal: kelips.conf.Principal})
+}
+
+// Namespace returns a handle to operate on keys within the namespace
+func (kelips *Kelips) Namespace(name string) (*Namespace, error) {
+	return newNamespace(name, kelips)
+}
+
+// Namespaces returns the names of all namespaces with keys in the local tuple
+// store
+func (kelips *Kelips) Namespaces() []string {
+	return kelips.namespaces.Namespaces()
+}
+
+// NamespaceStats returns the counts of the namespace in the local tuple store
+func (kelips *Kelips) NamespaceStats(name string) NamespaceStats {
+	return kelips.namespaces.Stats(name)
+}
+
+// SetNamespaceQuota sets the max number of tuples for the namespace in the
+// local tuple store.  Zero is unlimited
+func (kelips *Kelips) SetNamespaceQuota(name string, quota int) {
+	kelips.namespaces.SetQuota(name, quota)
+}
+
+func (kelips *Kelips) purgeNamespace(ns string) error {
+	return kelips.local.PurgeNamespace(ns, ExpireCluster, Caller{Principal: kelips.conf.Principal})
+}
+
 // RemoveNode removes a node from the DHT.  This will remove the node from the
 // local nodes view as well as remove all references in the tuples
 func (kelips *Kelips) RemoveNode(hostname string) error {
 	group := kelips.getHostGroup(hostname)
-	if group.index == kelips.local.idx {
+	if group.index == kelips.local.index() {
 		// If local remove all tuple references before actually removing the
 		// node.
+		// Owners are removed along with the tuples
 		kelips.tuples.ExpireHost(NewTupleHost(hostname))
 	}
 
@@ -324,22 +838,32 @@ func (kelips *Kelips) RemoveNode(hostname string) error {
 func (kelips *Kelips) getHostGroup(host string) *affinityGroup {
 	tuple := NewTupleHost(host)
 	id := tuple.ID(kelips.conf.HashFunc())
-	return kelips.groups.get(id)
+	return kelips.groups().get(id)
 }
 
-// Snapshot returns a Snapshot of all tuples and nodes known to the node.
-func (kelips *Kelips) Snapshot() *kelipspb.Snapshot {
-	ss := kelips.local.Snapshot()
-	ss.Groups = int32(kelips.conf.K)
+// groups returns the groups of the current layout
+func (kelips *Kelips) groups() affinityGroups {
+	return kelips.local.groups()
+}
 
-	return ss
+// Snapshot returns a Snapshot of all tuples and nodes known to the node along
+// with the current layout
+func (kelips *Kelips) Snapshot() *kelipspb.Snapshot {
+	return kelips.local.Snapshot()
 }
 
-// Seed seeds the local groups with the given snapshot
+// Seed seeds the local groups with the given snapshot.  Tuples belonging to
+// the local group are inserted locally without propogation, all others are
+// inserted into their respective groups
 func (kelips *Kelips) Seed(snapshot *kelipspb.Snapshot) error {
 	var err error
 
+	localhost := kelips.local.local.Address.String()
 	for _, node := range snapshot.Nodes {
+		if node.Address.String() == localhost {
+			continue
+		}
+
 		if er := kelips.AddNode(node, true); er != nil {
 			if er == errNodeExists {
 				continue
@@ -348,10 +872,35 @@ func (kelips *Kelips) Seed(snapshot *kelipspb.Snapshot) error {
 		}
 	}
 
+	// Owners in the snapshot are supplied by the peer so they are only kept if
+	// the transport authenticates it
+	at, ok := kelips.trans.(authenticatedTransport)
+	trusted := ok && at.authenticated()
+
+	h := kelips.conf.HashFunc()
+	l := kelips.local.layout()
 	for _, tuple := range snapshot.Tuples {
-		for _, host := range tuple.Hosts {
+		h.Reset()
+		h.Write(tuple.Key)
+		local := l.groups.get(h.Sum(nil)).index == l.idx
+
+		for i, host := range tuple.Hosts {
 			tupleHost := TupleHost(host)
-			if er := kelips.Insert(tuple.Key, tupleHost); er != nil {
+
+			// Keep the owner of the tuple
+			var owner string
+			if trusted && i < len(tuple.Owners) {
+				owner = tuple.Owners[i]
+			}
+
+			var er error
+			if local {
+				er = kelips.local.Insert(tuple.Key, tupleHost, Caller{Principal: owner}, false)
+			} else {
+				er = kelips.insert(tuple.Key, tupleHost, owner)
+			}
+
+			if er != nil {
 				err = er
 			}
 		}
@@ -6,21 +6,27 @@ import (
 	"os"
 	"testing"
 	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
 )
 
 func fastTestConf(addr string) *Config {
 	c1 := DefaultConfig(addr)
 	c1.Meta["host"] = addr
 	c1.EnablePropogation = true
-	//c1.PingMax = 300 * time.Millisecond
-	//c1.PingMin = 100 * time.Millisecond
+	c1.PingMax = 300 * time.Millisecond
+	c1.PingMin = 100 * time.Millisecond
 	return c1
 }
 func kelipsTestInstance(port int) *Kelips {
 	h := fmt.Sprintf("127.0.0.1:%d", port)
 	c1 := fastTestConf(h)
 	t1 := newBareTrans(h)
-	return Create(c1, t1)
+	k, err := Create(c1, t1)
+	if err != nil {
+		panic(err)
+	}
+	return k
 
 }
 
@@ -83,8 +89,8 @@ func Test_Kelips(t *testing.T) {
 
 	k1.Insert(testkey1, NewTupleHostFromHostPort("127.0.0.1", 54542))
 
-	t.Log(k1.groups[0])
-	t.Log(k1.groups[1])
+	t.Log(k1.groups().list[0])
+	t.Log(k1.groups().list[1])
 
 	kn1 := k1.LocalNode()
 	if kn1.Address.String() != "127.0.0.1:54540" {
@@ -92,8 +98,8 @@ func Test_Kelips(t *testing.T) {
 	}
 
 	ss := k1.Snapshot()
-	if len(ss.Nodes) != k1.local.groups.nodeCount() {
-		t.Error("should have nodes", len(ss.Nodes), k1.local.groups.nodeCount())
+	if len(ss.Nodes) != k1.local.groups().nodeCount() {
+		t.Error("should have nodes", len(ss.Nodes), k1.local.groups().nodeCount())
 	}
 
 	if len(ss.Tuples) != k1.local.tuples.Count() {
@@ -113,3 +119,213 @@ func Test_Kelips(t *testing.T) {
 	}
 
 }
+
+// testHeartbeats returns the sum of the heartbeats of all nodes known to each
+// node
+func testHeartbeats(nodes []*Kelips) uint64 {
+	var sum uint64
+	for _, k := range nodes {
+		k.groups().iterNodes(func(node kelipspb.Node) bool {
+			sum += uint64(node.Heartbeats)
+			return true
+		})
+	}
+	return sum
+}
+
+func Test_Kelips_Ping(t *testing.T) {
+	nodes, _ := testCluster(t, testSimNetwork(t), 3, nil)
+	k1 := nodes[0]
+
+	k1.checkNodes()
+	k1.groups().iterNodes(func(node kelipspb.Node) bool {
+		if node.Heartbeats == 0 {
+			t.Error("node not pinged", node.Address.String())
+		}
+		if node.Coordinates == nil {
+			t.Error("no coordinates", node.Address.String())
+		}
+		if node.Meta["host"] != node.Address.String() {
+			t.Error("meta not propogated", node.Address.String(), node.Meta)
+		}
+		return true
+	})
+
+	k2 := nodes[1]
+	host2 := k2.conf.AdvertiseHost
+	k2.UpdateMeta(map[string]string{"host": host2, "foo": "bar"})
+	k1.checkNodes()
+	if n, _ := k1.getHostGroup(host2).getNode(host2); n.Meta["foo"] != "bar" {
+		t.Fatal("updated meta not propogated", n.Meta)
+	}
+
+	// Only the sending node or an authenticated peer can update a node
+	node := nodes[2].LocalNode()
+	host3 := node.Address.String()
+	node.Meta = map[string]string{"host": "spoofed"}
+	k1.local.Ping(&node, Caller{Remote: true, Addr: host2})
+	if n, _ := k1.getHostGroup(host3).getNode(host3); n.Meta["host"] != host3 {
+		t.Fatal("meta updated by another node", n.Meta)
+	}
+	k1.local.Ping(&node, Caller{Remote: true, Peer: "key:1", Addr: host2})
+	if n, _ := k1.getHostGroup(host3).getNode(host3); n.Meta["host"] != "spoofed" {
+		t.Fatal("meta should be updated by an authenticated peer", n.Meta)
+	}
+
+	// Background pings stop on shutdown
+	for _, k := range nodes {
+		k.Shutdown()
+		k.Shutdown()
+	}
+	time.Sleep(50 * time.Millisecond)
+	sum := testHeartbeats(nodes)
+	time.Sleep(400 * time.Millisecond)
+	if testHeartbeats(nodes) != sum {
+		t.Fatal("nodes pinged after shutdown")
+	}
+}
+
+func Test_Kelips_Join(t *testing.T) {
+	k1 := kelipsTestInstance(54550)
+	k2 := kelipsTestInstance(54551)
+	k3 := kelipsTestInstance(54552)
+
+	if err := k1.Join([]string{"127.0.0.1:54559"}); err == nil {
+		t.Fatal("should fail to join unreachable peer")
+	}
+
+	if err := k2.Join([]string{"127.0.0.1:54550"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k1.Insert([]byte("key"), NewTupleHostFromHostPort("127.0.0.1", 54550)); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(100 * time.Millisecond)
+
+	// Unreachable seeds should be skipped
+	if err := k3.Join([]string{"127.0.0.1:54559", "127.0.0.1:54551"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if k3.groups().nodeCount() != 3 {
+		t.Fatal("should have 3 nodes", k3.groups().nodeCount())
+	}
+	if _, ok := k1.getHostGroup("127.0.0.1:54552").getNode("127.0.0.1:54552"); !ok {
+		t.Error("joined node should be known to the group")
+	}
+
+	n, _ := k3.getHostGroup("127.0.0.1:54550").getNode("127.0.0.1:54550")
+	if n.Meta["host"] != "127.0.0.1:54550" {
+		t.Error("should have meta", n.Meta)
+	}
+
+	nodes, err := k3.Lookup([]byte("key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Fatal("should have 1 node", len(nodes))
+	}
+}
+
+func Test_Kelips_Resize(t *testing.T) {
+	k1 := kelipsTestInstance(54570)
+	k2 := kelipsTestInstance(54571)
+	k3 := kelipsTestInstance(54572)
+	if err := k2.Join([]string{"127.0.0.1:54570"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k3.Join([]string{"127.0.0.1:54570", "127.0.0.1:54571"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Use keys belonging to the group containing the nodes so they are
+	// propogated to all of them
+	hosts := []*Kelips{k1, k2, k3}
+	h := k1.conf.HashFunc()
+	keys := make([][]byte, 0, 30)
+	for i := 0; len(keys) < 30; i++ {
+		key := []byte(fmt.Sprintf("resize-key-%d", i))
+		h.Reset()
+		h.Write(key)
+		if k1.groups().get(h.Sum(nil)).index == k1.local.index() {
+			keys = append(keys, key)
+		}
+	}
+
+	for i := range keys {
+		kl := hosts[i%3]
+		if err := kl.local.Insert(keys[i], NewTupleHost(kl.conf.AdvertiseHost), Caller{}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-time.After(200 * time.Millisecond)
+
+	if err := k1.Resize(5); err != nil {
+		t.Fatal(err)
+	}
+	for _, kl := range hosts {
+		if gen, k := kl.Layout(); gen != 1 || k != 5 {
+			t.Fatalf("wrong layout generation=%d k=%d", gen, k)
+		}
+	}
+
+	// Stale and conflicting layouts
+	if err := k2.local.Resize(0, 3, Caller{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := k2.local.Resize(1, 3, Caller{}); err == nil {
+		t.Fatal("should fail with conflicting layout")
+	}
+
+	// Wait for migration to complete
+	for i := 0; i < 50; i++ {
+		var pending bool
+		for _, kl := range hosts {
+			if _, prev := kl.local.layouts(); prev != nil {
+				pending = true
+			}
+		}
+		if !pending {
+			break
+		}
+		<-time.After(100 * time.Millisecond)
+	}
+
+	for _, kl := range hosts {
+		if _, prev := kl.local.layouts(); prev != nil {
+			t.Fatal("migration not complete")
+		}
+
+		l := kl.local.layout()
+		kl.local.tuples.Iter(func(key []byte, hosts []TupleHost) bool {
+			h.Reset()
+			h.Write(key)
+			if l.migrationGroup(h.Sum(nil)).index != l.idx {
+				t.Error("tuple not migrated", string(key))
+			}
+			return true
+		})
+	}
+
+	for _, key := range keys {
+		for _, kl := range hosts {
+			nodes, err := kl.Lookup(key)
+			if err != nil {
+				t.Fatal(err, string(key))
+			}
+			if len(nodes) == 0 {
+				t.Fatal("should have nodes", string(key))
+			}
+		}
+	}
+
+	// Joining nodes adopt the layout
+	k4 := kelipsTestInstance(54573)
+	if err := k4.Join([]string{"127.0.0.1:54571"}); err != nil {
+		t.Fatal(err)
+	}
+	if gen, k := k4.Layout(); gen != 1 || k != 5 {
+		t.Fatalf("joined node has wrong layout generation=%d k=%d", gen, k)
+	}
+}
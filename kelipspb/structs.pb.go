@@ -40,6 +40,9 @@ const _ = proto.GoGoProtoPackageIsVersion2 // please upgrade the proto package
 type Tuple struct {
 	Key   []byte   `protobuf:"bytes,1,opt,name=Key,proto3" json:"Key,omitempty"`
 	Hosts [][]byte `protobuf:"bytes,2,rep,name=Hosts" json:"Hosts,omitempty"`
+	// Principal that inserted each host in the same order as Hosts.  Empty if
+	// none of the hosts are owned
+	Owners []string `protobuf:"bytes,3,rep,name=Owners" json:"Owners,omitempty"`
 }
 
 func (m *Tuple) Reset()                    { *m = Tuple{} }
@@ -61,6 +64,13 @@ func (m *Tuple) GetHosts() [][]byte {
 	return nil
 }
 
+func (m *Tuple) GetOwners() []string {
+	if m != nil {
+		return m.Owners
+	}
+	return nil
+}
+
 type Node struct {
 	// Auto-generated. Will be unique across cluster
 	ID []byte `protobuf:"bytes,1,opt,name=ID,proto3" json:"ID,omitempty"`
@@ -136,6 +146,9 @@ func (m *Node) GetCoordinates() *vivaldi.Coordinate {
 type ReqResp struct {
 	Key   []byte  `protobuf:"bytes,1,opt,name=Key,proto3" json:"Key,omitempty"`
 	Nodes []*Node `protobuf:"bytes,2,rep,name=Nodes" json:"Nodes,omitempty"`
+	// Version of the tuple store of the responding node.  It changes whenever
+	// a tuple on the node is inserted or removed
+	Version uint64 `protobuf:"varint,3,opt,name=Version,proto3" json:"Version,omitempty"`
 }
 
 func (m *ReqResp) Reset()                    { *m = ReqResp{} }
@@ -157,10 +170,26 @@ func (m *ReqResp) GetNodes() []*Node {
 	return nil
 }
 
+func (m *ReqResp) GetVersion() uint64 {
+	if m != nil {
+		return m.Version
+	}
+	return 0
+}
+
 type Snapshot struct {
 	Groups int32    `protobuf:"varint,1,opt,name=Groups,proto3" json:"Groups,omitempty"`
 	Tuples []*Tuple `protobuf:"bytes,2,rep,name=Tuples" json:"Tuples,omitempty"`
 	Nodes  []*Node  `protobuf:"bytes,3,rep,name=Nodes" json:"Nodes,omitempty"`
+	// Cursor to resume from to get the next page.  Empty if there are no
+	// more pages
+	Cursor []byte `protobuf:"bytes,4,opt,name=Cursor,proto3" json:"Cursor,omitempty"`
+	// Generation of the affinity group layout
+	Generation uint64 `protobuf:"varint,5,opt,name=Generation,proto3" json:"Generation,omitempty"`
+	// Identifier of the hash function used by the cluster
+	Hash uint32 `protobuf:"varint,6,opt,name=Hash,proto3" json:"Hash,omitempty"`
+	// Identifier of the partitioner used by the cluster
+	Partitioner uint32 `protobuf:"varint,7,opt,name=Partitioner,proto3" json:"Partitioner,omitempty"`
 }
 
 func (m *Snapshot) Reset()                    { *m = Snapshot{} }
@@ -189,6 +218,34 @@ func (m *Snapshot) GetNodes() []*Node {
 	return nil
 }
 
+func (m *Snapshot) GetCursor() []byte {
+	if m != nil {
+		return m.Cursor
+	}
+	return nil
+}
+
+func (m *Snapshot) GetGeneration() uint64 {
+	if m != nil {
+		return m.Generation
+	}
+	return 0
+}
+
+func (m *Snapshot) GetHash() uint32 {
+	if m != nil {
+		return m.Hash
+	}
+	return 0
+}
+
+func (m *Snapshot) GetPartitioner() uint32 {
+	if m != nil {
+		return m.Partitioner
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*Tuple)(nil), "kelipspb.Tuple")
 	proto.RegisterType((*Node)(nil), "kelipspb.Node")
@@ -224,6 +281,21 @@ func (m *Tuple) MarshalTo(dAtA []byte) (int, error) {
 			i += copy(dAtA[i:], b)
 		}
 	}
+	if len(m.Owners) > 0 {
+		for _, s := range m.Owners {
+			dAtA[i] = 0x1a
+			i++
+			l = len(s)
+			for l >= 1<<7 {
+				dAtA[i] = uint8(uint64(l)&0x7f | 0x80)
+				l >>= 7
+				i++
+			}
+			dAtA[i] = uint8(l)
+			i++
+			i += copy(dAtA[i:], s)
+		}
+	}
 	return i, nil
 }
 
@@ -332,6 +404,11 @@ func (m *ReqResp) MarshalTo(dAtA []byte) (int, error) {
 			i += n
 		}
 	}
+	if m.Version != 0 {
+		dAtA[i] = 0x18
+		i++
+		i = encodeVarintStructs(dAtA, i, uint64(m.Version))
+	}
 	return i, nil
 }
 
@@ -379,6 +456,27 @@ func (m *Snapshot) MarshalTo(dAtA []byte) (int, error) {
 			i += n
 		}
 	}
+	if len(m.Cursor) > 0 {
+		dAtA[i] = 0x22
+		i++
+		i = encodeVarintStructs(dAtA, i, uint64(len(m.Cursor)))
+		i += copy(dAtA[i:], m.Cursor)
+	}
+	if m.Generation != 0 {
+		dAtA[i] = 0x28
+		i++
+		i = encodeVarintStructs(dAtA, i, uint64(m.Generation))
+	}
+	if m.Hash != 0 {
+		dAtA[i] = 0x30
+		i++
+		i = encodeVarintStructs(dAtA, i, uint64(m.Hash))
+	}
+	if m.Partitioner != 0 {
+		dAtA[i] = 0x38
+		i++
+		i = encodeVarintStructs(dAtA, i, uint64(m.Partitioner))
+	}
 	return i, nil
 }
 
@@ -404,6 +502,12 @@ func (m *Tuple) Size() (n int) {
 			n += 1 + l + sovStructs(uint64(l))
 		}
 	}
+	if len(m.Owners) > 0 {
+		for _, s := range m.Owners {
+			l = len(s)
+			n += 1 + l + sovStructs(uint64(l))
+		}
+	}
 	return n
 }
 
@@ -455,6 +559,9 @@ func (m *ReqResp) Size() (n int) {
 			n += 1 + l + sovStructs(uint64(l))
 		}
 	}
+	if m.Version != 0 {
+		n += 1 + sovStructs(uint64(m.Version))
+	}
 	return n
 }
 
@@ -476,6 +583,19 @@ func (m *Snapshot) Size() (n int) {
 			n += 1 + l + sovStructs(uint64(l))
 		}
 	}
+	l = len(m.Cursor)
+	if l > 0 {
+		n += 1 + l + sovStructs(uint64(l))
+	}
+	if m.Generation != 0 {
+		n += 1 + sovStructs(uint64(m.Generation))
+	}
+	if m.Hash != 0 {
+		n += 1 + sovStructs(uint64(m.Hash))
+	}
+	if m.Partitioner != 0 {
+		n += 1 + sovStructs(uint64(m.Partitioner))
+	}
 	return n
 }
 
@@ -581,6 +701,35 @@ func (m *Tuple) Unmarshal(dAtA []byte) error {
 			m.Hosts = append(m.Hosts, make([]byte, postIndex-iNdEx))
 			copy(m.Hosts[len(m.Hosts)-1], dAtA[iNdEx:postIndex])
 			iNdEx = postIndex
+		case 3:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Owners", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStructs
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthStructs
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Owners = append(m.Owners, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStructs(dAtA[iNdEx:])
@@ -1013,6 +1162,25 @@ func (m *ReqResp) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Version", wireType)
+			}
+			m.Version = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStructs
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Version |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStructs(dAtA[iNdEx:])
@@ -1144,6 +1312,94 @@ func (m *Snapshot) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 4:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Cursor", wireType)
+			}
+			var byteLen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStructs
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				byteLen |= (int(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if byteLen < 0 {
+				return ErrInvalidLengthStructs
+			}
+			postIndex := iNdEx + byteLen
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.Cursor = append(m.Cursor[:0], dAtA[iNdEx:postIndex]...)
+			if m.Cursor == nil {
+				m.Cursor = []byte{}
+			}
+			iNdEx = postIndex
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Generation", wireType)
+			}
+			m.Generation = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStructs
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Generation |= (uint64(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Hash", wireType)
+			}
+			m.Hash = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStructs
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Hash |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 7:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Partitioner", wireType)
+			}
+			m.Partitioner = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowStructs
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.Partitioner |= (uint32(b) & 0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
 		default:
 			iNdEx = preIndex
 			skippy, err := skipStructs(dAtA[iNdEx:])
@@ -1273,34 +1529,39 @@ var (
 func init() { proto.RegisterFile("structs.proto", fileDescriptorStructs) }
 
 var fileDescriptorStructs = []byte{
-	// 454 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x52, 0xcb, 0x6e, 0xd3, 0x40,
-	0x14, 0x65, 0xec, 0x38, 0x8f, 0xeb, 0xb4, 0xa0, 0x01, 0x21, 0x2b, 0x0b, 0xd7, 0x8a, 0x40, 0xb5,
-	0x10, 0xb5, 0xa5, 0x20, 0xc4, 0x63, 0xd7, 0x50, 0x44, 0x2b, 0x0a, 0x8b, 0x29, 0x2b, 0x76, 0xe3,
-	0x78, 0x70, 0xac, 0x18, 0x8f, 0xeb, 0x19, 0x47, 0xe4, 0x2f, 0x58, 0xf2, 0x27, 0xfc, 0x02, 0x4b,
-	0xbe, 0x00, 0x50, 0xf8, 0x0b, 0x56, 0x68, 0xc6, 0x76, 0x93, 0x4a, 0x51, 0x77, 0xf7, 0xdc, 0x7b,
-	0xce, 0xb9, 0x57, 0x67, 0x06, 0xf6, 0x84, 0x2c, 0xab, 0x99, 0x14, 0x41, 0x51, 0x72, 0xc9, 0x71,
-	0x7f, 0xc1, 0xb2, 0xb4, 0x10, 0x45, 0x34, 0x3a, 0x4a, 0x52, 0x39, 0xaf, 0xa2, 0x60, 0xc6, 0x3f,
-	0x87, 0x09, 0x4f, 0x78, 0xa8, 0x09, 0x51, 0xf5, 0x49, 0x23, 0x0d, 0x74, 0x55, 0x0b, 0x47, 0x8f,
-	0xb6, 0xe8, 0x73, 0xf6, 0x85, 0x46, 0x19, 0x9f, 0x2d, 0xc2, 0x65, 0xba, 0xa4, 0x59, 0x9c, 0x86,
-	0xd7, 0x96, 0x8c, 0x43, 0xb0, 0x3e, 0x54, 0x45, 0xc6, 0xf0, 0x1d, 0x30, 0xdf, 0xb2, 0x95, 0x83,
-	0x3c, 0xe4, 0x0f, 0x89, 0x2a, 0xf1, 0x3d, 0xb0, 0x4e, 0xb9, 0x90, 0xc2, 0x31, 0x3c, 0xd3, 0x1f,
-	0x92, 0x1a, 0x8c, 0xbf, 0x1b, 0xd0, 0x79, 0xcf, 0x63, 0x86, 0xf7, 0xc1, 0x38, 0x3b, 0x69, 0xf8,
-	0xc6, 0xd9, 0x09, 0x7e, 0x08, 0xbd, 0xe3, 0x38, 0x2e, 0x99, 0x50, 0x02, 0xe4, 0x0f, 0xa7, 0xf6,
-	0xbf, 0x5f, 0x07, 0x6d, 0x8b, 0xb4, 0x05, 0x1e, 0x41, 0xff, 0x9c, 0x0a, 0x79, 0xc1, 0x58, 0xee,
-	0x98, 0x1e, 0xf2, 0x4d, 0x72, 0x85, 0xb1, 0x0b, 0x70, 0xca, 0x68, 0x29, 0x23, 0x46, 0xa5, 0x70,
-	0x3a, 0x1e, 0xf2, 0xf7, 0xc8, 0x56, 0x07, 0xbb, 0xd0, 0x3b, 0xa7, 0x92, 0xe5, 0xb3, 0x95, 0x63,
-	0x29, 0xe9, 0xb4, 0xf3, 0xed, 0xf7, 0x01, 0x22, 0x6d, 0x13, 0x3f, 0x86, 0xce, 0x3b, 0x26, 0xa9,
-	0xd3, 0xf5, 0x4c, 0xdf, 0x9e, 0x38, 0x41, 0x1b, 0x60, 0xa0, 0x0e, 0x0e, 0xd4, 0xe8, 0x75, 0x2e,
-	0xcb, 0x15, 0xd1, 0x2c, 0xfc, 0x14, 0xec, 0x57, 0x9c, 0x97, 0x71, 0x9a, 0x53, 0xc9, 0x84, 0xd3,
-	0xf3, 0x90, 0x6f, 0x4f, 0xee, 0x06, 0x4d, 0x4e, 0xc1, 0x66, 0x46, 0xb6, 0x79, 0xa3, 0x67, 0x30,
-	0xb8, 0x72, 0x52, 0xa9, 0x2d, 0x9a, 0xd4, 0x06, 0x44, 0x95, 0x2a, 0xb5, 0x25, 0xcd, 0x2a, 0xa6,
-	0x43, 0x18, 0x90, 0x1a, 0xbc, 0x34, 0x9e, 0xa3, 0xf1, 0x31, 0xf4, 0x08, 0xbb, 0x24, 0x4c, 0x14,
-	0x3b, 0xc2, 0x7e, 0x00, 0x96, 0x3a, 0xb2, 0x0e, 0xdb, 0x9e, 0xec, 0x5f, 0xbf, 0x9d, 0xd4, 0xc3,
-	0xf1, 0x25, 0xf4, 0x2f, 0x72, 0x5a, 0x88, 0x39, 0x97, 0xf8, 0x3e, 0x74, 0xdf, 0x94, 0xbc, 0x2a,
-	0x84, 0xb6, 0xb1, 0x48, 0x83, 0xf0, 0x21, 0x74, 0xf5, 0x8b, 0xb6, 0x56, 0xb7, 0x37, 0x56, 0xba,
-	0x4f, 0x9a, 0xf1, 0x66, 0xa5, 0x79, 0xc3, 0xca, 0xe9, 0x8b, 0x1f, 0x6b, 0x17, 0xfd, 0x5c, 0xbb,
-	0xe8, 0xcf, 0xda, 0x45, 0x5f, 0xff, 0xba, 0xb7, 0x3e, 0x1e, 0xee, 0xfc, 0x5e, 0x09, 0x3f, 0xaa,
-	0xf5, 0x61, 0x6b, 0x13, 0x75, 0xf5, 0x17, 0x7b, 0xf2, 0x3f, 0x00, 0x00, 0xff, 0xff, 0xf8, 0xf0,
-	0xf5, 0x40, 0xd8, 0x02, 0x00, 0x00,
+	// 531 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x7c, 0x53, 0xcb, 0x6e, 0xd3, 0x40,
+	0x14, 0x65, 0xe2, 0x47, 0x9a, 0xeb, 0xb4, 0xa0, 0x01, 0x55, 0x56, 0x16, 0xae, 0x15, 0x81, 0x6a,
+	0x21, 0xea, 0x48, 0x45, 0x88, 0xc7, 0x8e, 0xb4, 0x28, 0xa9, 0x28, 0x0f, 0x4d, 0x11, 0x0b, 0x58,
+	0x8d, 0x93, 0x21, 0xb1, 0x12, 0x3c, 0x66, 0x66, 0x1c, 0xc8, 0x5f, 0xb0, 0xe4, 0x4f, 0xf8, 0x05,
+	0x96, 0x7c, 0x01, 0x45, 0xe1, 0x2f, 0x58, 0xa1, 0x19, 0xdb, 0x4d, 0x2a, 0x55, 0xec, 0xee, 0x39,
+	0xf7, 0xfa, 0xde, 0xa3, 0x73, 0xc6, 0xb0, 0x2d, 0x95, 0x28, 0x46, 0x4a, 0xc6, 0xb9, 0xe0, 0x8a,
+	0xe3, 0xad, 0x19, 0x9b, 0xa7, 0xb9, 0xcc, 0x93, 0xce, 0xc1, 0x24, 0x55, 0xd3, 0x22, 0x89, 0x47,
+	0xfc, 0x63, 0x6f, 0xc2, 0x27, 0xbc, 0x67, 0x06, 0x92, 0xe2, 0x83, 0x41, 0x06, 0x98, 0xaa, 0xfc,
+	0xb0, 0x73, 0x77, 0x63, 0x7c, 0xca, 0xbe, 0xd0, 0x64, 0xce, 0x47, 0xb3, 0xde, 0x22, 0x5d, 0xd0,
+	0xf9, 0x38, 0xed, 0x5d, 0x3a, 0xd2, 0x1d, 0x80, 0xf3, 0xa6, 0xc8, 0xe7, 0x0c, 0xdf, 0x00, 0xeb,
+	0x39, 0x5b, 0xfa, 0x28, 0x44, 0x51, 0x9b, 0xe8, 0x12, 0xdf, 0x02, 0x67, 0xc8, 0xa5, 0x92, 0x7e,
+	0x23, 0xb4, 0xa2, 0x36, 0x29, 0x01, 0xde, 0x05, 0xf7, 0xd5, 0xe7, 0x8c, 0x09, 0xe9, 0x5b, 0xa1,
+	0x15, 0xb5, 0x48, 0x85, 0xba, 0xdf, 0x1b, 0x60, 0xbf, 0xe4, 0x63, 0x86, 0x77, 0xa0, 0x71, 0x72,
+	0x5c, 0xed, 0x69, 0x9c, 0x1c, 0xe3, 0x3b, 0xd0, 0x7c, 0x3a, 0x1e, 0x0b, 0x26, 0xf5, 0x22, 0x14,
+	0xb5, 0xfb, 0xde, 0xdf, 0x5f, 0x7b, 0x35, 0x45, 0xea, 0x02, 0x77, 0x60, 0xeb, 0x94, 0x4a, 0x75,
+	0xc6, 0x58, 0xe6, 0x5b, 0x21, 0x8a, 0x2c, 0x72, 0x81, 0x71, 0x00, 0x30, 0x64, 0x54, 0xa8, 0x84,
+	0x51, 0x25, 0x7d, 0x3b, 0x44, 0xd1, 0x36, 0xd9, 0x60, 0x70, 0x00, 0xcd, 0x53, 0xaa, 0x58, 0x36,
+	0x5a, 0xfa, 0x8e, 0xfe, 0xb4, 0x6f, 0x7f, 0x3b, 0xdf, 0x43, 0xa4, 0x26, 0xf1, 0x3d, 0xb0, 0x5f,
+	0x30, 0x45, 0x7d, 0x37, 0xb4, 0x22, 0xef, 0xd0, 0x8f, 0x6b, 0x63, 0x63, 0x2d, 0x38, 0xd6, 0xad,
+	0x67, 0x99, 0x12, 0x4b, 0x62, 0xa6, 0xf0, 0x03, 0xf0, 0x8e, 0x38, 0x17, 0xe3, 0x34, 0xa3, 0x8a,
+	0x49, 0xbf, 0x19, 0xa2, 0xc8, 0x3b, 0xbc, 0x19, 0x57, 0xfe, 0xc5, 0xeb, 0x1e, 0xd9, 0x9c, 0xeb,
+	0x3c, 0x84, 0xd6, 0xc5, 0x26, 0xed, 0xe6, 0xac, 0x72, 0xb3, 0x45, 0xac, 0x59, 0xe9, 0xe6, 0x82,
+	0xce, 0x0b, 0x66, 0x4c, 0x68, 0x91, 0x12, 0x3c, 0x69, 0x3c, 0x42, 0xdd, 0xf7, 0xd0, 0x24, 0xec,
+	0x13, 0x61, 0x32, 0xbf, 0x22, 0x84, 0xdb, 0xe0, 0x68, 0x91, 0x65, 0x08, 0xde, 0xe1, 0xce, 0x65,
+	0xed, 0xa4, 0x6c, 0x62, 0x1f, 0x9a, 0x6f, 0x99, 0x90, 0x29, 0x2f, 0xbd, 0xb3, 0x49, 0x0d, 0xbb,
+	0xe7, 0x08, 0xb6, 0xce, 0x32, 0x9a, 0xcb, 0x29, 0x57, 0x3a, 0xbb, 0x81, 0xe0, 0x45, 0x2e, 0xcd,
+	0x05, 0x87, 0x54, 0x08, 0xef, 0x83, 0x6b, 0x1e, 0x41, 0x7d, 0xe5, 0xfa, 0xfa, 0x8a, 0xe1, 0x49,
+	0xd5, 0x5e, 0xab, 0xb1, 0xfe, 0xa7, 0x66, 0x17, 0xdc, 0xa3, 0x42, 0x48, 0x2e, 0x4c, 0x54, 0x6d,
+	0x52, 0x21, 0x1d, 0xe3, 0x80, 0x65, 0x4c, 0x50, 0xa5, 0x85, 0x3a, 0x46, 0xe8, 0x06, 0x83, 0x31,
+	0xd8, 0x43, 0x2a, 0xa7, 0xbe, 0x6b, 0x02, 0x36, 0x35, 0x0e, 0xc1, 0x7b, 0x4d, 0x85, 0x4a, 0xf5,
+	0x00, 0x13, 0x26, 0x8c, 0x6d, 0xb2, 0x49, 0xf5, 0x1f, 0xff, 0x58, 0x05, 0xe8, 0xe7, 0x2a, 0x40,
+	0xbf, 0x57, 0x01, 0xfa, 0xfa, 0x27, 0xb8, 0xf6, 0x6e, 0xff, 0xca, 0xf7, 0x3f, 0xe1, 0x07, 0xa5,
+	0xda, 0x5e, 0x2d, 0x3a, 0x71, 0xcd, 0x3f, 0x70, 0xff, 0xdf, 0x00, 0x62, 0x01, 0x0b, 0x6e, 0x79,
+	0x03, 0x00, 0x00,
 }
@@ -0,0 +1,233 @@
+package kelips
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+const (
+	// Max number of attempts to migrate tuples after a resize
+	migrateAttempts = 5
+
+	// Time to wait between migration attempts
+	migrateRetryInterval = 3 * time.Second
+)
+
+// layout is a single generation of the affinity groups.  All nodes in the
+// cluster agree on K for a given generation
+type layout struct {
+	// Generation of the layout.  The layout from the config is generation 0
+	gen uint64
+
+	// All groups in this layout
+	groups affinityGroups
+
+	// Local group index in this layout
+	idx int
+}
+
+// k returns the number of groups in the layout
+func (l *layout) k() int {
+	return len(l.groups.list)
+}
+
+// newLayout builds a layout of k groups for the given generation, adding all
+// nodes from the existing groups.  The local group index is set based on the
+// local node id
+func newLayout(gen uint64, k int, hashSize int, partFunc PartitionerFunc, existing affinityGroups, localID []byte) *layout {
+	l := &layout{gen: gen, groups: genAffinityGroups(k, hashSize, partFunc)}
+
+	// Nodes are added directly as the layout is not yet shared
+	existing.iterNodes(func(node kelipspb.Node) bool {
+		n := node
+		group := l.groups.get(n.ID)
+		group.m[n.Address.String()] = &n
+		return true
+	})
+
+	l.idx = l.groups.get(localID).index
+	return l
+}
+
+// layout returns the current layout
+func (lrpc *localGroup) layout() *layout {
+	lrpc.lmu.RLock()
+	defer lrpc.lmu.RUnlock()
+	return lrpc.cur
+}
+
+// layouts returns the current and previous layouts.  The previous layout is
+// nil if a resize is not in progress
+func (lrpc *localGroup) layouts() (*layout, *layout) {
+	lrpc.lmu.RLock()
+	defer lrpc.lmu.RUnlock()
+	return lrpc.cur, lrpc.prev
+}
+
+// groups returns the groups of the current layout
+func (lrpc *localGroup) groups() affinityGroups {
+	return lrpc.layout().groups
+}
+
+// index returns the local group index in the current layout
+func (lrpc *localGroup) index() int {
+	return lrpc.layout().idx
+}
+
+// Resize switches to a layout with k groups if the generation is newer than
+// the current one.  The previous layout is retained for lookups while tuples
+// that no longer belong to the local group are migrated to their new groups.
+// The caller must be allowed to resize by the authorizer
+func (lrpc *localGroup) Resize(gen uint64, k int, caller Caller) error {
+	if k < 1 || k > maxGroups {
+		return fmt.Errorf("invalid number of groups: %d", k)
+	}
+	if err := lrpc.authorizeCluster(AccessResize, nil, "", caller); err != nil {
+		return err
+	}
+
+	lrpc.lmu.Lock()
+	cur := lrpc.cur
+	if gen <= cur.gen {
+		lrpc.lmu.Unlock()
+		if gen == cur.gen && k != cur.k() {
+			return fmt.Errorf("layout conflict generation=%d k=%d have=%d", gen, k, cur.k())
+		}
+		return nil
+	}
+
+	next := newLayout(gen, k, lrpc.hashFunc().Size(), lrpc.partitioner, cur.groups, lrpc.local.ID)
+	lrpc.prev = cur
+	lrpc.cur = next
+	lrpc.lmu.Unlock()
+
+	log.Printf("[INFO] Kelips layout resized generation=%d k=%d->%d group=%d",
+		gen, cur.k(), k, next.idx)
+
+	go lrpc.migrateLayout(next)
+
+	return nil
+}
+
+// migrateLayout moves tuples not belonging to the local group of the layout
+// to their owning groups.  The previous layout is cleared once all tuples have
+// been migrated or the attempts have been exhausted.  Migration is abandoned if
+// the layout is superseded by another resize
+func (lrpc *localGroup) migrateLayout(l *layout) {
+	for i := 0; i < migrateAttempts; i++ {
+		if lrpc.layout() != l {
+			return
+		}
+
+		failed := lrpc.migrate(l)
+		if failed == 0 {
+			break
+		}
+
+		log.Printf("[ERROR] Tuple migration incomplete generation=%d failed=%d attempt=%d",
+			l.gen, failed, i+1)
+		<-time.After(migrateRetryInterval)
+	}
+
+	lrpc.lmu.Lock()
+	if lrpc.cur == l {
+		lrpc.prev = nil
+	}
+	lrpc.lmu.Unlock()
+
+	log.Printf("[INFO] Kelips layout migration complete generation=%d", l.gen)
+}
+
+// migrationGroup returns the group a key with the hash id is migrated to.  As
+// with lookups, the next closest group is used if the owning group has no nodes
+func (l *layout) migrationGroup(id []byte) *affinityGroup {
+	group := l.groups.get(id)
+	if group.count() > 0 {
+		return group
+	}
+	if next := l.groups.nextClosestGroup(group); next != nil {
+		return next
+	}
+	return group
+}
+
+// migrate inserts each foreign tuple into a node of its owning group removing
+// it locally on success.  It returns the number of tuples that failed
+func (lrpc *localGroup) migrate(l *layout) int {
+	type migration struct {
+		key   []byte
+		hosts []TupleHost
+	}
+
+	h := lrpc.hashFunc()
+	var foreign []migration
+
+	lrpc.tuples.Iter(func(key []byte, hosts []TupleHost) bool {
+		h.Reset()
+		h.Write(key)
+		if l.migrationGroup(h.Sum(nil)).index == l.idx {
+			return true
+		}
+
+		m := migration{key: make([]byte, len(key)), hosts: make([]TupleHost, len(hosts))}
+		copy(m.key, key)
+		for i := range hosts {
+			m.hosts[i] = hosts[i].Copy()
+		}
+		foreign = append(foreign, m)
+		return true
+	})
+
+	var failed int
+	for _, m := range foreign {
+		h.Reset()
+		h.Write(m.key)
+		group := l.migrationGroup(h.Sum(nil))
+
+		for _, tuple := range m.hosts {
+			if err := lrpc.migrateTuple(group, m.key, tuple, lrpc.owners.get(m.key, tuple)); err != nil {
+				log.Printf("[ERROR] Failed to migrate key=%x group=%d: %v", m.key, group.index, err)
+				failed++
+				continue
+			}
+			lrpc.tuples.DeleteKeyHost(m.key, tuple)
+		}
+
+		// Remove the key once all hosts have been migrated
+		if hosts, err := lrpc.tuples.Get(m.key); err == nil && len(hosts) == 0 {
+			lrpc.tuples.Delete(m.key)
+		}
+	}
+
+	return failed
+}
+
+// migrateTuple inserts the tuple into each node of the group on behalf of its
+// owner without propogation as the receiving nodes may not have switched
+// layouts yet.  It succeeds if atleast one node accepted the tuple
+func (lrpc *localGroup) migrateTuple(group *affinityGroup, key []byte, tuple TupleHost, owner string) error {
+	nodes := group.Nodes()
+	if len(nodes) == 0 {
+		return fmt.Errorf("no nodes in group")
+	}
+
+	var (
+		ok  bool
+		err error
+	)
+	for _, n := range nodes {
+		if er := lrpc.trans.Insert(n.Address.String(), key, tuple, owner, false); er != nil {
+			err = er
+			continue
+		}
+		ok = true
+	}
+
+	if ok {
+		return nil
+	}
+	return err
+}
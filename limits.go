@@ -0,0 +1,273 @@
+package kelips
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Default number of workers handling requests and the max number of
+	// requests queued for them
+	defaultWorkers   = 64
+	defaultQueueSize = 1024
+
+	// Max number of sources tracked by the rate limiter
+	maxRateSources = 1 << 16
+
+	// Interval at which idle sources are removed from the rate limiter
+	ratePruneInterval = 10 * time.Second
+)
+
+// errAmplification is kept short as it is sent in place of the response
+var errAmplification = errors.New("response exceeds amplification limit")
+
+// ServerLimits bounds the resources used by a UDPTransport to serve requests
+type ServerLimits struct {
+	// Requests per second allowed from a single source ip along with the
+	// number of requests allowed in a burst.  Zero disables rate limiting
+	SourceRate  float64
+	SourceBurst int
+
+	// Number of workers handling requests and the max number of requests
+	// queued for them.  Requests received while the queue is full are dropped
+	Workers   int
+	QueueSize int
+
+	// Max ratio of the response size to the request size for sources that are
+	// not verified.  Larger responses are replaced with an error.  Sources are
+	// verified if the request was authenticated or the source ip is in one of
+	// the trusted networks.  Zero disables the check
+	MaxAmplification int
+	TrustedNetworks  []*net.IPNet
+}
+
+// DefaultServerLimits returns limits suitable for a node reachable by
+// untrusted sources.  Only loopback sources are trusted, so cluster networks
+// should be added to the trusted networks unless authentication is enabled
+func DefaultServerLimits() *ServerLimits {
+	return &ServerLimits{
+		SourceRate:       500,
+		SourceBurst:      1000,
+		Workers:          defaultWorkers,
+		QueueSize:        defaultQueueSize,
+		MaxAmplification: 3,
+		TrustedNetworks: []*net.IPNet{
+			{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+			{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+		},
+	}
+}
+
+// Validate returns an error if any of the limits are invalid
+func (limits *ServerLimits) Validate() error {
+	if limits.SourceRate < 0 || limits.SourceBurst < 0 {
+		return fmt.Errorf("source rate and burst must not be negative")
+	}
+	if limits.SourceRate > 0 && limits.SourceBurst < 1 {
+		return fmt.Errorf("source burst required with source rate")
+	}
+	if limits.Workers < 0 || limits.QueueSize < 0 {
+		return fmt.Errorf("workers and queue size must not be negative")
+	}
+	if limits.MaxAmplification < 0 {
+		return fmt.Errorf("max amplification must not be negative")
+	}
+	return nil
+}
+
+// trusted returns true if the ip is in one of the trusted networks
+func (limits *ServerLimits) trusted(ip net.IP) bool {
+	for _, n := range limits.TrustedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// TransportStats are counters of the requests received by a UDPTransport
+type TransportStats struct {
+	// Number of packets received
+	Received uint64
+
+	// Number of requests dropped as the worker queue was full
+	Dropped uint64
+
+	// Number of packets dropped by the per source rate limit
+	RateLimited uint64
+
+	// Number of responses replaced with an error as they exceeded the
+	// amplification limit
+	Refused uint64
+
+	// Number of packets dropped or rejected as they failed decryption,
+	// authentication or the fingerprint check or were malformed
+	Rejected uint64
+}
+
+// Stats returns the current request counters
+func (trans *UDPTransport) Stats() TransportStats {
+	return TransportStats{
+		Received:    atomic.LoadUint64(&trans.stats.Received),
+		Dropped:     atomic.LoadUint64(&trans.stats.Dropped),
+		RateLimited: atomic.LoadUint64(&trans.stats.RateLimited),
+		Refused:     atomic.LoadUint64(&trans.stats.Refused),
+		Rejected:    atomic.LoadUint64(&trans.stats.Rejected),
+	}
+}
+
+// tokenBucket tracks the tokens available to a single source
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket rate limiter per source ip
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu        sync.Mutex
+	sources   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		sources: make(map[string]*tokenBucket),
+	}
+}
+
+// allow returns true if the source has a token available consuming it
+func (rl *rateLimiter) allow(ip net.IP, now time.Time) bool {
+	key := string(ip.To16())
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastPrune) > ratePruneInterval {
+		rl.prune(now)
+	}
+
+	b, ok := rl.sources[key]
+	if !ok {
+		if len(rl.sources) >= maxRateSources {
+			return false
+		}
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.sources[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes sources whose buckets have refilled.  The lock must be held
+func (rl *rateLimiter) prune(now time.Time) {
+	idle := time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for k, b := range rl.sources {
+		if now.Sub(b.last) >= idle {
+			delete(rl.sources, k)
+		}
+	}
+	rl.lastPrune = now
+}
+
+// inboundRequest is a request queued for a worker
+type inboundRequest struct {
+	remote *net.UDPAddr
+	typ    byte
+	msg    []byte
+	rctx   *requestContext
+}
+
+// SetLimits sets the limits used to serve requests.  It must be called before
+// the transport is registered.  Without limits requests are handled by the
+// default number of workers with no rate limit or amplification check
+func (trans *UDPTransport) SetLimits(limits *ServerLimits) error {
+	if err := limits.Validate(); err != nil {
+		return err
+	}
+
+	trans.limits = limits
+	if limits.SourceRate > 0 {
+		trans.limiter = newRateLimiter(limits.SourceRate, limits.SourceBurst)
+	} else {
+		trans.limiter = nil
+	}
+	return nil
+}
+
+// startWorkers starts the workers handling queued requests
+func (trans *UDPTransport) startWorkers() {
+	workers, size := defaultWorkers, defaultQueueSize
+	if trans.limits != nil {
+		if trans.limits.Workers > 0 {
+			workers = trans.limits.Workers
+		}
+		if trans.limits.QueueSize > 0 {
+			size = trans.limits.QueueSize
+		}
+	}
+
+	trans.queue = make(chan *inboundRequest, size)
+	for i := 0; i < workers; i++ {
+		go func() {
+			for req := range trans.queue {
+				trans.handleRequest(req.remote, req.typ, req.msg, req.rctx)
+			}
+		}()
+	}
+}
+
+// enqueue queues the request for a worker dropping it if the queue is full
+func (trans *UDPTransport) enqueue(req *inboundRequest) {
+	select {
+	case trans.queue <- req:
+	default:
+		atomic.AddUint64(&trans.stats.Dropped, 1)
+	}
+}
+
+// allowSource returns false if the source has exceeded its rate limit
+func (trans *UDPTransport) allowSource(remote *net.UDPAddr) bool {
+	if trans.limiter == nil || trans.limiter.allow(remote.IP, time.Now()) {
+		return true
+	}
+	atomic.AddUint64(&trans.stats.RateLimited, 1)
+	return false
+}
+
+// verified returns true if responses to the request are not subject to the
+// amplification limit
+func (trans *UDPTransport) verified(remote *net.UDPAddr, rctx *requestContext) bool {
+	if trans.limits == nil || trans.limits.MaxAmplification == 0 {
+		return true
+	}
+	return rctx.peer != "" || trans.limits.trusted(remote.IP)
+}
+
+// checkAmplification returns an error if the response is too large for the
+// request size of an unverified source
+func (trans *UDPTransport) checkAmplification(rctx *requestContext, size int) error {
+	if rctx.verified || size <= rctx.size*trans.limits.MaxAmplification {
+		return nil
+	}
+	atomic.AddUint64(&trans.stats.Refused, 1)
+	return errAmplification
+}
@@ -0,0 +1,129 @@
+package kelips
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	rl := newRateLimiter(10, 2)
+	ip := net.ParseIP("10.0.0.1")
+	now := time.Now()
+
+	if !rl.allow(ip, now) || !rl.allow(ip, now) {
+		t.Fatal("burst should be allowed")
+	}
+	if rl.allow(ip, now) {
+		t.Fatal("should be limited after burst")
+	}
+	// Other sources are not affected
+	if !rl.allow(net.ParseIP("10.0.0.2"), now) {
+		t.Fatal("other source should be allowed")
+	}
+
+	// 10/s refills a token every 100ms
+	if !rl.allow(ip, now.Add(100*time.Millisecond)) {
+		t.Fatal("should be allowed after refill")
+	}
+	if rl.allow(ip, now.Add(100*time.Millisecond)) {
+		t.Fatal("should be limited")
+	}
+
+	// Idle sources are pruned
+	rl.allow(ip, now.Add(ratePruneInterval+time.Second))
+	if len(rl.sources) != 1 {
+		t.Fatal("idle source should be pruned", len(rl.sources))
+	}
+}
+
+func Test_ServerLimits_Validate(t *testing.T) {
+	if err := DefaultServerLimits().Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, limits := range []*ServerLimits{
+		{SourceRate: -1},
+		{SourceRate: 10},
+		{Workers: -1},
+		{MaxAmplification: -1},
+	} {
+		if err := limits.Validate(); err == nil {
+			t.Fatalf("should fail %+v", limits)
+		}
+	}
+
+	if !DefaultServerLimits().trusted(net.ParseIP("127.0.0.1")) {
+		t.Fatal("loopback should be trusted")
+	}
+	if DefaultServerLimits().trusted(net.ParseIP("10.0.0.1")) {
+		t.Fatal("should not be trusted")
+	}
+}
+
+func newLimitsTestTransport(addr string, limits *ServerLimits) (*UDPTransport, *MockAffinityGroupRPC) {
+	trans := newBareTrans(addr)
+	if err := trans.SetLimits(limits); err != nil {
+		panic(err)
+	}
+	group := &MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)}
+	trans.Register(group)
+	return trans, group
+}
+
+func Test_UDPTransport_Amplification(t *testing.T) {
+	server, group := newLimitsTestTransport("127.0.0.1:54683", &ServerLimits{MaxAmplification: 2})
+	for i := 0; i < 20; i++ {
+		host := NewTupleHostFromHostPort("127.0.0.1", 10000+i)
+		group.Insert([]byte("big"), host, Caller{}, false)
+	}
+	group.Insert([]byte("small"), NewTupleHost("127.0.0.1:1"), Caller{}, false)
+
+	client := NewUDPTransport(nil)
+	_, err := client.Lookup("127.0.0.1:54683", []byte("big"))
+	if err == nil || !strings.Contains(err.Error(), "amplification") {
+		t.Fatal("large response should be refused", err)
+	}
+	if _, err = client.Lookup("127.0.0.1:54683", []byte("small")); err != nil {
+		t.Fatal(err)
+	}
+
+	if st := server.Stats(); st.Refused != 1 || st.Received != 2 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+}
+
+func Test_UDPTransport_RateLimit(t *testing.T) {
+	server, _ := newLimitsTestTransport("127.0.0.1:54684", &ServerLimits{SourceRate: 1, SourceBurst: 2})
+
+	client := NewUDPTransport(nil)
+	conn, err := net.Dial("udp4", "127.0.0.1:54684")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	req := client.request(reqTypeLookup, []byte("key"))
+	for i := 0; i < 5; i++ {
+		conn.Write(framePacket([]byte{0, 0, 0, 1}, req))
+	}
+
+	buf := make([]byte, maxUDPBufSize)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err = conn.Read(buf); err != nil {
+			t.Fatalf("response %d: %v", i, err)
+		}
+	}
+
+	// Wait for the remaining packets to be read
+	st := server.Stats()
+	for i := 0; i < 10 && st.Received < 5; i++ {
+		time.Sleep(50 * time.Millisecond)
+		st = server.Stats()
+	}
+	if st.Received != 5 || st.RateLimited != 3 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+}
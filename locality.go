@@ -0,0 +1,112 @@
+package kelips
+
+import (
+	"sort"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+// Locality is the preference used to order nodes relative to the local node
+// based on their region, sector and zone metadata
+type Locality uint8
+
+const (
+	// LocalityNone does not apply any locality based ordering
+	LocalityNone Locality = iota
+	// LocalityRegion prefers nodes in the same region
+	LocalityRegion
+	// LocalitySector prefers nodes in the same sector followed by the same
+	// region
+	LocalitySector
+	// LocalityZone prefers nodes in the same zone followed by the same sector
+	// and region
+	LocalityZone
+)
+
+func (loc Locality) String() string {
+	switch loc {
+	case LocalityRegion:
+		return "region"
+	case LocalitySector:
+		return "sector"
+	case LocalityZone:
+		return "zone"
+	}
+	return "none"
+}
+
+// localityScore returns how close a node is to the local node given the
+// preference.  A higher score is closer
+func localityScore(local, node map[string]string, pref Locality) int {
+	if pref == LocalityNone || local["region"] != node["region"] {
+		return 0
+	}
+	if pref == LocalityRegion || local["sector"] != node["sector"] {
+		return 1
+	}
+	if pref == LocalitySector || local["zone"] != node["zone"] {
+		return 2
+	}
+	return 3
+}
+
+// zoneID returns a cluster unique zone identifier for the node
+func zoneID(node *kelipspb.Node) string {
+	return node.Meta["region"] + "/" + node.Meta["sector"] + "/" + node.Meta["zone"]
+}
+
+// sortByLocality orders nodes closest first relative to the local node.  Nodes
+// with the same locality score are ordered by their coordinate distance
+func sortByLocality(local *kelipspb.Node, nodes []*kelipspb.Node, pref Locality) {
+	if pref == LocalityNone {
+		return
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		si := localityScore(local.Meta, nodes[i].Meta, pref)
+		sj := localityScore(local.Meta, nodes[j].Meta, pref)
+		if si != sj {
+			return si > sj
+		}
+
+		di, oki := distance(local, nodes[i])
+		dj, okj := distance(local, nodes[j])
+		if oki && okj {
+			return di < dj
+		}
+		return oki
+	})
+}
+
+// distance returns the coordinate distance between 2 nodes.  It returns false
+// if either does not have compatible coordinates
+func distance(a, b *kelipspb.Node) (time.Duration, bool) {
+	if a.Coordinates == nil || b.Coordinates == nil ||
+		!a.Coordinates.IsCompatibleWith(b.Coordinates) {
+		return 0, false
+	}
+	return a.Coordinates.DistanceTo(b.Coordinates), true
+}
+
+// orderDistinctZones re-orders the nodes such that the first nodes each belong
+// to a distinct zone preserving the existing order otherwise.  It returns the
+// number of distinct zones
+func orderDistinctZones(nodes []*kelipspb.Node) int {
+	seen := make(map[string]bool)
+	first := make([]*kelipspb.Node, 0, len(nodes))
+	rest := make([]*kelipspb.Node, 0, len(nodes))
+
+	for _, node := range nodes {
+		z := zoneID(node)
+		if seen[z] {
+			rest = append(rest, node)
+			continue
+		}
+		seen[z] = true
+		first = append(first, node)
+	}
+
+	copy(nodes, append(first, rest...))
+	return len(first)
+}
@@ -0,0 +1,79 @@
+package kelips
+
+import (
+	"testing"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+func testLocalityNode(host, region, sector, zone string) *kelipspb.Node {
+	return &kelipspb.Node{
+		Address: kelipspb.NewAddress(host),
+		Meta:    map[string]string{"region": region, "sector": sector, "zone": zone},
+	}
+}
+
+func Test_sortByLocality(t *testing.T) {
+	local := testLocalityNode("127.0.0.1:1000", "r1", "s1", "z1")
+	nodes := []*kelipspb.Node{
+		testLocalityNode("127.0.0.1:1001", "r2", "s1", "z1"),
+		testLocalityNode("127.0.0.1:1002", "r1", "s2", "z1"),
+		testLocalityNode("127.0.0.1:1003", "r1", "s1", "z2"),
+		testLocalityNode("127.0.0.1:1004", "r1", "s1", "z1"),
+	}
+
+	sortByLocality(local, nodes, LocalityZone)
+	for i, port := range []uint16{1004, 1003, 1002, 1001} {
+		if nodes[i].Address.Port() != port {
+			t.Errorf("zone: index=%d want=%d have=%d", i, port, nodes[i].Address.Port())
+		}
+	}
+
+	// Region only should not re-order nodes within the region
+	sortByLocality(local, nodes, LocalityRegion)
+	if nodes[3].Address.Port() != 1001 {
+		t.Error("other region should be last", nodes[3].Address.String())
+	}
+}
+
+func Test_orderDistinctZones(t *testing.T) {
+	nodes := []*kelipspb.Node{
+		testLocalityNode("127.0.0.1:1001", "r1", "s1", "z1"),
+		testLocalityNode("127.0.0.1:1002", "r1", "s1", "z1"),
+		testLocalityNode("127.0.0.1:1003", "r1", "s1", "z2"),
+		testLocalityNode("127.0.0.1:1004", "r2", "s1", "z1"),
+	}
+
+	if c := orderDistinctZones(nodes); c != 3 {
+		t.Fatal("should have 3 zones", c)
+	}
+	for i, port := range []uint16{1001, 1003, 1004, 1002} {
+		if nodes[i].Address.Port() != port {
+			t.Errorf("index=%d want=%d have=%d", i, port, nodes[i].Address.Port())
+		}
+	}
+}
+
+func Test_Kelips_DistinctZones(t *testing.T) {
+	conf := fastTestConf("127.0.0.1:54640")
+	conf.DistinctZones = true
+	k, err := Create(conf, newBareTrans("127.0.0.1:54640"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.AddNode(testLocalityNode("127.0.0.1:54641", "global", "sector1", "zone1"), false)
+	k.AddNode(testLocalityNode("127.0.0.1:54642", "global", "sector1", "zone2"), false)
+
+	nodes, err := k.LookupNodes([]byte("key"), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zoneID(nodes[0]) == zoneID(nodes[1]) {
+		t.Fatal("first nodes should be in distinct zones")
+	}
+
+	if _, err = k.LookupNodes([]byte("key"), 3); err == nil {
+		t.Fatal("should fail with not enough zones")
+	}
+}
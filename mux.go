@@ -0,0 +1,282 @@
+package kelips
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// Size of the request id prepended to every packet.  Responses carry the
+	// id of the request they answer
+	requestIDSize = 4
+
+	// Number of sockets outgoing requests are spread over
+	muxSockets = 2
+
+	// Max number of resolved host addresses cached
+	maxResolvedAddrs = 4096
+
+	// Time a resolved host address is cached for so address changes are
+	// picked up
+	resolveTTL = time.Minute
+
+	// Bounds of the delay before reading again after a read error
+	minReadBackoff = 5 * time.Millisecond
+	maxReadBackoff = time.Second
+)
+
+var (
+	errRequestTimeout = errors.New("request timed out")
+	errMuxClosed      = errors.New("transport closed")
+)
+
+// framePacket prepends the request id to the packet
+func framePacket(id []byte, b []byte) []byte {
+	out := make([]byte, 0, len(id)+len(b))
+	return append(append(out, id...), b...)
+}
+
+// pendingRequest is a request awaiting its response
+type pendingRequest struct {
+	remote *net.UDPAddr
+	resp   chan []byte
+}
+
+// muxConn is a socket requests to any host are sent on.  Responses are matched
+// to pending requests by id and source address
+type muxConn struct {
+	conn *net.UDPConn
+
+	mu      sync.Mutex
+	pending map[uint32]*pendingRequest
+
+	// Closed once the socket is no longer read
+	done chan struct{}
+}
+
+func newMuxConn() (*muxConn, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	mc := &muxConn{
+		conn:    conn,
+		pending: make(map[uint32]*pendingRequest),
+		done:    make(chan struct{}),
+	}
+	go mc.read()
+	return mc, nil
+}
+
+// read dispatches responses to the pending requests until the socket is
+// closed.  Responses with no pending request are dropped.  Read errors are
+// backed off exponentially
+func (mc *muxConn) read() {
+	defer close(mc.done)
+
+	var (
+		buf     = make([]byte, maxUDPBufSize)
+		backoff time.Duration
+	)
+	for {
+		n, remote, err := mc.conn.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+
+			if backoff *= 2; backoff == 0 {
+				backoff = minReadBackoff
+			} else if backoff > maxReadBackoff {
+				backoff = maxReadBackoff
+			}
+			log.Printf("[ERROR] Failed to read response retrying in %v: %v", backoff, err)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+
+		if n < requestIDSize {
+			continue
+		}
+
+		id := binary.BigEndian.Uint32(buf)
+		mc.mu.Lock()
+		p, ok := mc.pending[id]
+		if ok && p.remote.Port == remote.Port && p.remote.IP.Equal(remote.IP) {
+			delete(mc.pending, id)
+		} else {
+			ok = false
+		}
+		mc.mu.Unlock()
+
+		if ok {
+			resp := make([]byte, n-requestIDSize)
+			copy(resp, buf[requestIDSize:n])
+			p.resp <- resp
+		}
+	}
+}
+
+// roundTrip sends the packet with the id to the remote address waiting upto
+// the timeout for the response
+func (mc *muxConn) roundTrip(id uint32, raddr *net.UDPAddr, pkt []byte, timeout time.Duration) ([]byte, error) {
+	p := &pendingRequest{remote: raddr, resp: make(chan []byte, 1)}
+
+	mc.mu.Lock()
+	mc.pending[id] = p
+	mc.mu.Unlock()
+
+	defer func() {
+		mc.mu.Lock()
+		delete(mc.pending, id)
+		mc.mu.Unlock()
+	}()
+
+	rid := make([]byte, requestIDSize)
+	binary.BigEndian.PutUint32(rid, id)
+	if _, err := mc.conn.WriteToUDP(framePacket(rid, pkt), raddr); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-p.resp:
+		return resp, nil
+	case <-timer.C:
+		return nil, errRequestTimeout
+	case <-mc.done:
+		return nil, errMuxClosed
+	}
+}
+
+// requestMux multiplexes the outgoing requests of a transport over a few
+// sockets opened on first use.  The zero value is ready to use
+type requestMux struct {
+	mu     sync.Mutex
+	conns  []*muxConn
+	closed bool
+
+	// Id of the last request.  It starts at a random value
+	idOnce sync.Once
+	lastID uint32
+
+	amu   sync.RWMutex
+	addrs map[string]resolvedAddr
+}
+
+// resolvedAddr is a cached host address
+type resolvedAddr struct {
+	addr    *net.UDPAddr
+	expires time.Time
+}
+
+// resolve returns the cached address of the host resolving it if needed or if
+// it has expired
+func (m *requestMux) resolve(host string) (*net.UDPAddr, error) {
+	now := time.Now()
+
+	m.amu.RLock()
+	ra, ok := m.addrs[host]
+	m.amu.RUnlock()
+	if ok && now.Before(ra.expires) {
+		return ra.addr, nil
+	}
+
+	raddr, err := net.ResolveUDPAddr("udp4", host)
+	if err != nil {
+		return nil, err
+	}
+
+	m.amu.Lock()
+	if m.addrs == nil {
+		m.addrs = make(map[string]resolvedAddr)
+	}
+	if len(m.addrs) >= maxResolvedAddrs {
+		for h, ra := range m.addrs {
+			if !now.Before(ra.expires) {
+				delete(m.addrs, h)
+			}
+		}
+		if len(m.addrs) >= maxResolvedAddrs {
+			m.addrs = make(map[string]resolvedAddr)
+		}
+	}
+	m.addrs[host] = resolvedAddr{addr: raddr, expires: now.Add(resolveTTL)}
+	m.amu.Unlock()
+
+	return raddr, nil
+}
+
+// nextID returns a new request id
+func (m *requestMux) nextID() uint32 {
+	m.idOnce.Do(func() {
+		atomic.StoreUint32(&m.lastID, rand.Uint32())
+	})
+	return atomic.AddUint32(&m.lastID, 1)
+}
+
+// conn returns the socket for the request id opening it if needed
+func (m *requestMux) conn(id uint32) (*muxConn, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errMuxClosed
+	}
+	if m.conns == nil {
+		m.conns = make([]*muxConn, muxSockets)
+	}
+
+	i := int(id % muxSockets)
+	if m.conns[i] == nil {
+		mc, err := newMuxConn()
+		if err != nil {
+			return nil, err
+		}
+		m.conns[i] = mc
+	}
+	return m.conns[i], nil
+}
+
+// roundTrip sends the packet to the host returning the response
+func (m *requestMux) roundTrip(host string, pkt []byte, timeout time.Duration) ([]byte, error) {
+	raddr, err := m.resolve(host)
+	if err != nil {
+		return nil, err
+	}
+
+	id := m.nextID()
+	mc, err := m.conn(id)
+	if err != nil {
+		return nil, err
+	}
+	return mc.roundTrip(id, raddr, pkt, timeout)
+}
+
+// close closes all sockets failing pending requests
+func (m *requestMux) close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var err error
+	for _, mc := range m.conns {
+		if mc != nil {
+			if e := mc.conn.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	m.conns = nil
+	m.closed = true
+	return err
+}
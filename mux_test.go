@@ -0,0 +1,190 @@
+package kelips
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// openFDs returns the number of open file descriptors or -1 if unknown
+func openFDs() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func Test_UDPTransport_mux(t *testing.T) {
+	server := newTestTransport("127.0.0.1:54694")
+	group := server.local.(*MockAffinityGroupRPC)
+	for i := 0; i < 10; i++ {
+		group.Insert([]byte(fmt.Sprintf("key-%d", i)), NewTupleHostFromHostPort("127.0.0.1", 10000+i), Caller{}, false)
+	}
+
+	client := NewUDPTransport(nil)
+	defer client.Close()
+	before := openFDs()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			want := NewTupleHostFromHostPort("127.0.0.1", 10000+i)
+			for j := 0; j < 50; j++ {
+				nodes, err := client.Lookup("127.0.0.1:54694", []byte(fmt.Sprintf("key-%d", i)))
+				if err != nil {
+					errs <- err
+					return
+				}
+				if !TupleHost(nodes[0].Address).Equal(want) {
+					errs <- fmt.Errorf("response matched to the wrong request")
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	// Only the multiplexed sockets are opened
+	if before >= 0 {
+		if opened := openFDs() - before; opened > muxSockets {
+			t.Fatalf("opened %d fds", opened)
+		}
+	}
+
+	client.SetTimeout(100 * time.Millisecond)
+	if _, err := client.Lookup("127.0.0.1:54695", []byte("key-0")); err != errRequestTimeout {
+		t.Fatal("should time out", err)
+	}
+
+	client.Close()
+	if _, err := client.Lookup("127.0.0.1:54694", []byte("key-0")); err != errMuxClosed {
+		t.Fatal("should be closed", err)
+	}
+}
+
+func Test_requestMux_resolve(t *testing.T) {
+	var m requestMux
+	raddr, err := m.resolve("127.0.0.1:54694")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached until expired
+	stale := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	m.addrs["127.0.0.1:54694"] = resolvedAddr{addr: stale, expires: time.Now().Add(time.Minute)}
+	if got, _ := m.resolve("127.0.0.1:54694"); got != stale {
+		t.Fatal("should be cached", got)
+	}
+
+	m.addrs["127.0.0.1:54694"] = resolvedAddr{addr: stale, expires: time.Now().Add(-time.Second)}
+	if got, _ := m.resolve("127.0.0.1:54694"); !got.IP.Equal(raddr.IP) || got.Port != raddr.Port {
+		t.Fatal("should be resolved again once expired", got)
+	}
+}
+
+var benchServerOnce sync.Once
+
+// benchmarkFDs runs the request in parallel reporting the peak number of fds
+// opened while running
+func benchmarkFDs(b *testing.B, request func() error) {
+	before := openFDs()
+
+	var peak int64
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			if n := int64(openFDs() - before); n > atomic.LoadInt64(&peak) {
+				atomic.StoreInt64(&peak, n)
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := request(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.StopTimer()
+
+	close(done)
+	<-stopped
+	if before >= 0 {
+		b.ReportMetric(float64(peak), "peak-fds")
+	}
+}
+
+// BenchmarkUDPTransport_Lookup compares the multiplexed sockets with the
+// baseline of dialing a socket per request used before.  Each dialed socket
+// costs a socket, connect and close syscall and an fd on top of the write and
+// read made by both
+func BenchmarkUDPTransport_Lookup(b *testing.B) {
+	const host = "127.0.0.1:54696"
+
+	// Benchmarks are run more than once
+	benchServerOnce.Do(func() {
+		server := newTestTransport(host)
+		server.local.Insert([]byte("key"), NewTupleHost("127.0.0.1:10000"), Caller{}, false)
+	})
+
+	b.Run("mux", func(b *testing.B) {
+		client := NewUDPTransport(nil)
+		defer client.Close()
+
+		before := openFDs()
+		benchmarkFDs(b, func() error {
+			_, err := client.Lookup(host, []byte("key"))
+			return err
+		})
+		if before >= 0 {
+			b.ReportMetric(float64(openFDs()-before)/float64(b.N), "sockets/op")
+		}
+	})
+
+	b.Run("socket-per-request", func(b *testing.B) {
+		client := NewUDPTransport(nil)
+		defer client.Close()
+		req := client.request(reqTypeLookup, []byte("key"))
+
+		var sockets int64
+		benchmarkFDs(b, func() error {
+			atomic.AddInt64(&sockets, 1)
+			conn, err := net.Dial("udp4", host)
+			if err != nil {
+				return err
+			}
+			defer conn.Close()
+
+			if _, err = conn.Write(framePacket([]byte{0, 0, 0, 1}, req)); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(time.Now().Add(reqTimeout))
+
+			buf := make([]byte, maxUDPBufSize)
+			_, err = conn.Read(buf)
+			return err
+		})
+		b.ReportMetric(float64(sockets)/float64(b.N), "sockets/op")
+	})
+}
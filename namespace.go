@@ -0,0 +1,383 @@
+package kelips
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+const (
+	// namespaceMarker is the first byte of a namespaced key.  Keys in the
+	// default namespace must not start with it
+	namespaceMarker byte = 0
+
+	// Max length of a namespace name
+	maxNamespaceLen = 255
+)
+
+// NamespaceKey returns the key as stored and sent on the wire for the
+// namespace.  A namespaced key is the marker byte followed by the length
+// prefixed namespace and the key.  The default namespace "" leaves the key
+// unchanged
+func NamespaceKey(ns string, key []byte) []byte {
+	if ns == "" {
+		return key
+	}
+
+	out := make([]byte, 0, 2+len(ns)+len(key))
+	out = append(out, namespaceMarker, byte(len(ns)))
+	out = append(out, ns...)
+	return append(out, key...)
+}
+
+// SplitNamespace returns the namespace and key of a stored key.  Keys that
+// are not namespaced belong to the default namespace ""
+func SplitNamespace(key []byte) (string, []byte) {
+	if len(key) < 2 || key[0] != namespaceMarker {
+		return "", key
+	}
+
+	l := int(key[1])
+	if l == 0 || len(key) < 2+l {
+		return "", key
+	}
+	return string(key[2 : 2+l]), key[2+l:]
+}
+
+// checkKey returns an error if a key of the default namespace starts with the
+// marker as it cannot be told apart from a namespaced key
+func checkKey(key []byte) error {
+	if len(key) > 0 && key[0] == namespaceMarker {
+		return fmt.Errorf("default namespace key must not start with %#02x", namespaceMarker)
+	}
+	return nil
+}
+
+// storedKey returns the stored key of a key received for the namespace.  Keys
+// of the default namespace are checked so namespaces can only be written by
+// name
+func storedKey(ns string, key []byte) ([]byte, error) {
+	if ns == "" {
+		return key, checkKey(key)
+	}
+	return NamespaceKey(ns, key), nil
+}
+
+func validateNamespace(ns string) error {
+	if len(ns) > maxNamespaceLen {
+		return fmt.Errorf("namespace too long: %d", len(ns))
+	}
+	return nil
+}
+
+// NamespaceStats are the counts and metrics of a namespace in a tuple store
+type NamespaceStats struct {
+	// Number of keys with atleast one host
+	Keys int
+
+	// Number of key host tuples
+	Tuples int
+
+	// Max number of tuples.  Zero is unlimited
+	Quota int
+
+	// Number of inserts rejected due to the quota
+	Rejected uint64
+}
+
+// namespaceState tracks a single namespace.  Counts are updated atomically by
+// the tuple store hook
+type namespaceState struct {
+	keys     int64
+	tuples   int64
+	quota    int64
+	rejected uint64
+}
+
+// reserve adds n tuples returning false if the quota would be exceeded
+func (s *namespaceState) reserve(n int64) bool {
+	for {
+		quota := atomic.LoadInt64(&s.quota)
+		tuples := atomic.LoadInt64(&s.tuples)
+		if quota > 0 && tuples+n > quota {
+			atomic.AddUint64(&s.rejected, 1)
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&s.tuples, tuples, tuples+n) {
+			return true
+		}
+	}
+}
+
+// NamespaceTuples wraps a TupleStore tracking the number of keys and tuples in
+// each namespace and rejecting inserts that exceed the namespace quota.  Counts
+// are kept by a hook on the store so writes take no additional locks
+type NamespaceTuples struct {
+	TupleStore
+
+	// Namespace to its state
+	ns sync.Map
+
+	// Quota for namespaces without one set
+	defaultQuota int
+}
+
+// NewNamespaceTuples returns the store wrapped with namespace tracking.  The
+// quotas are the max number of tuples per namespace with the default quota
+// used for namespaces not listed.  A quota of zero is unlimited
+func NewNamespaceTuples(store TupleStore, quotas map[string]int, defaultQuota int) *NamespaceTuples {
+	hs := hookTuples(store)
+	nt := &NamespaceTuples{
+		TupleStore:   hs,
+		defaultQuota: defaultQuota,
+	}
+
+	for ns, quota := range quotas {
+		nt.namespace(ns).quota = int64(quota)
+	}
+
+	store.Iter(func(key []byte, hosts []TupleHost) bool {
+		if len(hosts) > 0 {
+			ns, _ := SplitNamespace(key)
+			s := nt.namespace(ns)
+			s.keys++
+			s.tuples += int64(len(hosts))
+		}
+		return true
+	})
+
+	hs.AddHook(nt.change)
+	return nt
+}
+
+// AddHook adds a hook to the underlying store
+func (nt *NamespaceTuples) AddHook(hook TupleHook) {
+	nt.TupleStore.(HookedTupleStore).AddHook(hook)
+}
+
+// namespace returns the state of the namespace creating it if needed
+func (nt *NamespaceTuples) namespace(ns string) *namespaceState {
+	if s, ok := nt.ns.Load(ns); ok {
+		return s.(*namespaceState)
+	}
+	s, _ := nt.ns.LoadOrStore(ns, &namespaceState{quota: int64(nt.defaultQuota)})
+	return s.(*namespaceState)
+}
+
+// change is the store hook counting the keys and tuples of the namespace.  It
+// rejects new tuples exceeding the quota
+func (nt *NamespaceTuples) change(key []byte, h TupleHost, before, after int) error {
+	ns, _ := SplitNamespace(key)
+	s := nt.namespace(ns)
+
+	if after > before {
+		if !s.reserve(int64(after - before)) {
+			return fmt.Errorf("namespace quota exceeded: %q quota=%d", ns, atomic.LoadInt64(&s.quota))
+		}
+	} else {
+		atomic.AddInt64(&s.tuples, int64(after-before))
+	}
+
+	if before == 0 && after > 0 {
+		atomic.AddInt64(&s.keys, 1)
+	} else if before > 0 && after == 0 {
+		atomic.AddInt64(&s.keys, -1)
+	}
+	return nil
+}
+
+// SetQuota sets the max number of tuples for the namespace.  Existing tuples
+// are not removed if they exceed it
+func (nt *NamespaceTuples) SetQuota(ns string, quota int) {
+	atomic.StoreInt64(&nt.namespace(ns).quota, int64(quota))
+}
+
+// Stats returns the stats for the namespace
+func (nt *NamespaceTuples) Stats(ns string) NamespaceStats {
+	s := nt.namespace(ns)
+	return NamespaceStats{
+		Keys:     int(atomic.LoadInt64(&s.keys)),
+		Tuples:   int(atomic.LoadInt64(&s.tuples)),
+		Quota:    int(atomic.LoadInt64(&s.quota)),
+		Rejected: atomic.LoadUint64(&s.rejected),
+	}
+}
+
+// Namespaces returns the sorted names of all namespaces with keys
+func (nt *NamespaceTuples) Namespaces() []string {
+	var out []string
+	nt.ns.Range(func(k, v interface{}) bool {
+		if atomic.LoadInt64(&v.(*namespaceState).keys) > 0 {
+			out = append(out, k.(string))
+		}
+		return true
+	})
+	sort.Strings(out)
+	return out
+}
+
+// Purge deletes all keys in the namespace returning the number of keys with
+// hosts that were deleted
+func (nt *NamespaceTuples) Purge(ns string) int {
+	return purgeNamespace(nt, ns)
+}
+
+// purgeNamespace deletes all keys in the namespace from the store returning the
+// number of keys with hosts that were deleted
+func purgeNamespace(store TupleStore, ns string) int {
+	var (
+		keys [][]byte
+		c    int
+	)
+	store.Iter(func(key []byte, hosts []TupleHost) bool {
+		if n, _ := SplitNamespace(key); n == ns {
+			k := make([]byte, len(key))
+			copy(k, key)
+			keys = append(keys, k)
+			if len(hosts) > 0 {
+				c++
+			}
+		}
+		return true
+	})
+
+	for _, key := range keys {
+		store.Delete(key)
+	}
+	return c
+}
+
+func containsHost(hosts []TupleHost, h TupleHost) bool {
+	for _, v := range hosts {
+		if h.Equal(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// PurgeNamespace deletes all keys in the namespace from the local tuple store
+// and the nodes within the scope if allowed by the authorizer.  The default
+// namespace cannot be purged
+func (lrpc *localGroup) PurgeNamespace(ns string, scope ExpireScope, caller Caller) error {
+	if ns == "" {
+		return fmt.Errorf("default namespace cannot be purged")
+	}
+	if scope > ExpireCluster {
+		return fmt.Errorf("invalid purge scope: %d", scope)
+	}
+	if err := lrpc.authorizeCluster(AccessPurge, nil, ns, caller); err != nil {
+		return err
+	}
+
+	purgeNamespace(lrpc.tuples, ns)
+
+	return lrpc.broadcast("purge namespace", scope, func(host string, scope ExpireScope) error {
+		return lrpc.trans.PurgeNamespace(host, ns, scope)
+	})
+}
+
+// namespaceClient is implemented by Kelips and Client to operate on keys
+type namespaceClient interface {
+	insertKey(key []byte, tuple TupleHost) error
+	deleteKey(key []byte, tuple TupleHost) error
+	Lookup(key []byte) ([]*kelipspb.Node, error)
+	Scan(prefix []byte, limit int, cursor []byte) ([][]byte, []byte, error)
+	purgeNamespace(ns string) error
+}
+
+// Namespace operates on keys within a single namespace.  Keys are isolated
+// from keys with the same name in other namespaces
+type Namespace struct {
+	name   string
+	client namespaceClient
+}
+
+func newNamespace(name string, client namespaceClient) (*Namespace, error) {
+	if err := validateNamespace(name); err != nil {
+		return nil, err
+	}
+	return &Namespace{name: name, client: client}, nil
+}
+
+// Name returns the name of the namespace
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+// key returns the stored key for the key in the namespace.  Keys in the
+// default namespace starting with the marker cannot be told apart from
+// namespaced keys and are rejected
+func (ns *Namespace) key(key []byte) ([]byte, error) {
+	if ns.name == "" {
+		return key, checkKey(key)
+	}
+	return NamespaceKey(ns.name, key), nil
+}
+
+// Insert inserts the key tuple into the namespace
+func (ns *Namespace) Insert(key []byte, tuple TupleHost) error {
+	k, err := ns.key(key)
+	if err != nil {
+		return err
+	}
+	return ns.client.insertKey(k, tuple)
+}
+
+// Delete deletes the key tuple from the namespace
+func (ns *Namespace) Delete(key []byte, tuple TupleHost) error {
+	k, err := ns.key(key)
+	if err != nil {
+		return err
+	}
+	return ns.client.deleteKey(k, tuple)
+}
+
+// Lookup returns nodes holding the key in the namespace
+func (ns *Namespace) Lookup(key []byte) ([]*kelipspb.Node, error) {
+	k, err := ns.key(key)
+	if err != nil {
+		return nil, err
+	}
+	return ns.client.Lookup(k)
+}
+
+// Scan returns upto limit sorted keys in the namespace with the prefix.  The
+// returned keys do not include the namespace.  The returned cursor is used to
+// request the next page and is nil when there are no more keys.  The cursor of
+// the default namespace may be a namespaced key skipped by the scan and is
+// passed as is.  This requires the scan index to be enabled
+func (ns *Namespace) Scan(prefix []byte, limit int, cursor []byte) ([][]byte, []byte, error) {
+	p, err := ns.key(prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if cursor != nil {
+		cursor = NamespaceKey(ns.name, cursor)
+	}
+
+	keys, next, err := ns.client.Scan(p, limit, cursor)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The default namespace prefix also matches namespaced keys
+	out := keys[:0]
+	for _, key := range keys {
+		if name, k := SplitNamespace(key); name == ns.name {
+			out = append(out, k)
+		}
+	}
+	if next != nil && ns.name != "" {
+		_, next = SplitNamespace(next)
+	}
+	return out, next, nil
+}
+
+// Purge deletes all keys in the namespace on every node in every group
+func (ns *Namespace) Purge() error {
+	return ns.client.purgeNamespace(ns.name)
+}
@@ -0,0 +1,382 @@
+package kelips
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+func Test_NamespaceKey(t *testing.T) {
+	key := NamespaceKey("payments", []byte("svc/a"))
+	ns, k := SplitNamespace(key)
+	if ns != "payments" || string(k) != "svc/a" {
+		t.Fatalf("wrong split ns=%s key=%s", ns, k)
+	}
+
+	if !bytes.Equal(NamespaceKey("", []byte("svc/a")), []byte("svc/a")) {
+		t.Fatal("default namespace should not change key")
+	}
+	if ns, _ = SplitNamespace([]byte("svc/a")); ns != "" {
+		t.Fatal("should be default namespace", ns)
+	}
+
+	// Same key in different namespaces
+	if bytes.Equal(NamespaceKey("a", []byte("key")), NamespaceKey("b", []byte("key"))) {
+		t.Fatal("keys should differ across namespaces")
+	}
+
+	// Malformed namespaced keys
+	for _, key := range [][]byte{{0}, {0, 0, 'a'}, {0, 5, 'a'}} {
+		if ns, k = SplitNamespace(key); ns != "" || !bytes.Equal(k, key) {
+			t.Fatalf("malformed key should be default namespace %q", key)
+		}
+	}
+}
+
+func Test_NamespaceTuples(t *testing.T) {
+	base := NewShardedTuples(4)
+	base.Insert(NamespaceKey("existing", []byte("a")), NewTupleHost("127.0.0.1:9"))
+
+	nt := NewNamespaceTuples(base, map[string]int{"small": 3}, 0)
+	if st := nt.Stats("existing"); st.Keys != 1 || st.Tuples != 1 {
+		t.Fatalf("existing keys should be counted %+v", st)
+	}
+
+	h1 := NewTupleHost("127.0.0.1:1")
+	h2 := NewTupleHost("127.0.0.1:2")
+	for i := 0; i < 2; i++ {
+		key := NamespaceKey("small", []byte(fmt.Sprintf("key%d", i)))
+		if err := nt.Insert(key, h1); err != nil {
+			t.Fatal(err)
+		}
+		// Duplicate does not count towards the quota
+		if err := nt.Insert(key, h1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := nt.Insert(NamespaceKey("small", []byte("key0")), h2); err != nil {
+		t.Fatal(err)
+	}
+	if err := nt.Insert(NamespaceKey("small", []byte("key2")), h1); err == nil {
+		t.Fatal("should fail with quota exceeded")
+	}
+
+	st := nt.Stats("small")
+	if st.Keys != 2 || st.Tuples != 3 || st.Quota != 3 || st.Rejected != 1 {
+		t.Fatalf("wrong stats %+v", st)
+	}
+
+	// Other namespaces are not affected
+	if err := nt.Insert([]byte("key0"), h1); err != nil {
+		t.Fatal(err)
+	}
+
+	if !nt.DeleteKeyHost(NamespaceKey("small", []byte("key0")), h2) {
+		t.Fatal("should delete")
+	}
+	if err := nt.Insert(NamespaceKey("small", []byte("key2")), h2); err != nil {
+		t.Fatal(err)
+	}
+
+	nt.ExpireHost(h1)
+	if st = nt.Stats("small"); st.Keys != 1 || st.Tuples != 1 {
+		t.Fatalf("wrong stats after expire %+v", st)
+	}
+	if st = nt.Stats(""); st.Keys != 0 || st.Tuples != 0 {
+		t.Fatalf("wrong default stats after expire %+v", st)
+	}
+
+	nt.SetQuota("small", 0)
+	for i := 0; i < 10; i++ {
+		nt.Insert(NamespaceKey("small", []byte(fmt.Sprintf("more%d", i))), h1)
+	}
+	if st = nt.Stats("small"); st.Tuples != 11 {
+		t.Fatalf("quota should be removed %+v", st)
+	}
+
+	if ns := nt.Namespaces(); len(ns) != 2 || ns[0] != "existing" || ns[1] != "small" {
+		t.Fatalf("wrong namespaces %v", ns)
+	}
+
+	if c := nt.Purge("small"); c != 11 {
+		t.Fatalf("should purge=11 got=%d", c)
+	}
+	if st = nt.Stats("small"); st.Keys != 0 || st.Tuples != 0 {
+		t.Fatalf("wrong stats after purge %+v", st)
+	}
+	if st = nt.Stats("existing"); st.Keys != 1 {
+		t.Fatalf("other namespaces should remain %+v", st)
+	}
+}
+
+// unhookedTuples hides the hooks of the store
+type unhookedTuples struct {
+	TupleStore
+}
+
+func Test_NamespaceTuples_concurrent(t *testing.T) {
+	stores := map[string]TupleStore{
+		"inmem":    NewInmemTuples(),
+		"sharded":  NewShardedTuples(8),
+		"unhooked": unhookedTuples{NewShardedTuples(8)},
+	}
+
+	for name, store := range stores {
+		nt := NewNamespaceTuples(store, map[string]int{"small": 100}, 0)
+		h := NewTupleHost("127.0.0.1:1")
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					key := []byte(fmt.Sprintf("key%d/%d", i, j))
+					nt.Insert(NamespaceKey("small", key), h)
+					nt.Insert(key, h)
+					if j%2 == 0 {
+						nt.DeleteKeyHost(key, h)
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		st := nt.Stats("small")
+		if st.Keys != 100 || st.Tuples != 100 || st.Rejected != 300 {
+			t.Fatalf("%s: wrong stats %+v", name, st)
+		}
+		if st = nt.Stats(""); st.Keys != 200 || st.Tuples != 200 {
+			t.Fatalf("%s: wrong default stats %+v", name, st)
+		}
+
+		var n int
+		store.Iter(func(key []byte, hosts []TupleHost) bool {
+			if ns, _ := SplitNamespace(key); ns == "small" {
+				n += len(hosts)
+			}
+			return true
+		})
+		if n != 100 {
+			t.Fatalf("%s: store should have quota tuples=%d", name, n)
+		}
+
+		nt.ExpireHost(h)
+		if st = nt.Stats("small"); st.Keys != 0 || st.Tuples != 0 {
+			t.Fatalf("%s: wrong stats after expire %+v", name, st)
+		}
+	}
+}
+
+func Test_Kelips_Namespace(t *testing.T) {
+	nodes, sn := testScanCluster(t, 8)
+
+	payments, err := nodes[0].Namespace("payments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _ := sn.Client("10.0.1.1:4000", nodes[3].conf.AdvertiseHost)
+	defer client.Close()
+	users, _ := client.Namespace("users")
+
+	tuple := NewTupleHost(nodes[0].conf.AdvertiseHost)
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("svc/%02d", i))
+		if err = payments.Insert(key, tuple); err != nil {
+			t.Fatal(err)
+		}
+		if err = users.Insert(key, tuple); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for propogation
+	<-time.After(300 * time.Millisecond)
+
+	if _, err = payments.Lookup([]byte("svc/00")); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := testScanAll(t, func(cursor []byte) ([][]byte, []byte, error) {
+		return payments.Scan([]byte("svc/"), 6, cursor)
+	})
+	if len(keys) != 20 || string(keys[0]) != "svc/00" || string(keys[19]) != "svc/19" {
+		t.Fatalf("wrong keys %q", keys)
+	}
+
+	if err = users.Purge(); err != nil {
+		t.Fatal(err)
+	}
+
+	keys = testScanAll(t, func(cursor []byte) ([][]byte, []byte, error) {
+		return users.Scan(nil, 100, cursor)
+	})
+	if len(keys) != 0 {
+		t.Fatalf("namespace should be purged %q", keys)
+	}
+	for _, k := range nodes {
+		if st := k.NamespaceStats("users"); st.Keys != 0 {
+			t.Fatalf("host=%s should have no users keys %+v", k.conf.AdvertiseHost, st)
+		}
+	}
+
+	keys = testScanAll(t, func(cursor []byte) ([][]byte, []byte, error) {
+		return payments.Scan(nil, 100, cursor)
+	})
+	if len(keys) != 20 {
+		t.Fatalf("other namespaces should remain %d", len(keys))
+	}
+
+	def, _ := nodes[0].Namespace("")
+	if err = def.Purge(); err == nil {
+		t.Fatal("should not purge default namespace")
+	}
+}
+
+func Test_UDPTransport_namespaceKeys(t *testing.T) {
+	t1 := newTestTransport("127.0.0.1:23459")
+	defer t1.Close()
+	t2 := newTestTransport("127.0.0.1:23460")
+	defer t2.Close()
+
+	tuple := NewTupleHost("127.0.0.1:23459")
+	key := NamespaceKey("a", []byte("key"))
+	if err := t1.Insert("127.0.0.1:23460", key, tuple, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := t1.Lookup("127.0.0.1:23460", key); err != nil {
+		t.Fatal("namespaced key should be stored", err)
+	}
+
+	// Default namespace keys starting with the marker are rejected remotely
+	marker := []byte{namespaceMarker, 0, 'a'}
+	if err := t1.Insert("127.0.0.1:23460", marker, tuple, "", false); err == nil {
+		t.Fatal("should reject marker key")
+	}
+	hdr, _ := mutationHeader("", false)
+	req := t1.request(reqTypeInsert, hdr, namespaceField(""), tuple, key)
+	if _, err := t1.sendRequest("127.0.0.1:23460", req); err == nil {
+		t.Fatal("should reject namespaced key without its namespace")
+	}
+
+	errs, err := t1.InsertBatch("127.0.0.1:23460", []BatchEntry{{Key: key, Tuple: tuple}, {Key: []byte("key"), Tuple: tuple}}, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs[0] == nil || errs[1] != nil {
+		t.Fatal("should only reject the marker key", errs)
+	}
+}
+
+func Test_Kelips_rejectMarkerKeys(t *testing.T) {
+	sn, _ := NewSimNetwork(1, nil)
+	k, err := Create(fastTestConf("10.0.0.1:4000"), sn.Transport("10.0.0.1:4000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := NewTupleHost("10.0.0.1:4000")
+	key := NamespaceKey("a", []byte("key"))
+	if err = k.Insert(key, tuple); err == nil {
+		t.Fatal("should reject marker key")
+	}
+	if err = k.Delete(key, tuple); err == nil {
+		t.Fatal("should reject marker key")
+	}
+	if errs := k.InsertBatch([]BatchEntry{{Key: []byte("key"), Tuple: tuple}, {Key: key, Tuple: tuple}}); errs[0] != nil || errs[1] == nil {
+		t.Fatal("should only reject the marker key", errs)
+	}
+	if st := k.NamespaceStats("a"); st.Keys != 0 {
+		t.Fatal("namespace should not be written", st)
+	}
+
+	ns, _ := k.Namespace("a")
+	if err = ns.Insert([]byte("key"), tuple); err != nil {
+		t.Fatal(err)
+	}
+	if st := k.NamespaceStats("a"); st.Keys != 1 {
+		t.Fatal("namespace should be written", st)
+	}
+
+	client, _ := NewClient("10.0.0.1:4000")
+	defer client.Close()
+	if err = client.Insert(key, tuple); err == nil {
+		t.Fatal("should reject marker key")
+	}
+}
+
+// scanNamespaceClient scans a sorted set of keys
+type scanNamespaceClient struct {
+	keys [][]byte
+}
+
+func (c *scanNamespaceClient) insertKey(key []byte, tuple TupleHost) error {
+	i := sort.Search(len(c.keys), func(i int) bool { return bytes.Compare(c.keys[i], key) >= 0 })
+	c.keys = append(c.keys[:i], append([][]byte{key}, c.keys[i:]...)...)
+	return nil
+}
+
+func (c *scanNamespaceClient) deleteKey(key []byte, tuple TupleHost) error { return nil }
+
+func (c *scanNamespaceClient) Lookup(key []byte) ([]*kelipspb.Node, error) { return nil, nil }
+
+func (c *scanNamespaceClient) purgeNamespace(ns string) error { return nil }
+
+func (c *scanNamespaceClient) Scan(prefix []byte, limit int, cursor []byte) ([][]byte, []byte, error) {
+	var out [][]byte
+	for _, key := range c.keys {
+		if bytes.Compare(key, cursor) <= 0 || !bytes.HasPrefix(key, prefix) {
+			continue
+		}
+		if len(out) == limit {
+			return out, out[len(out)-1], nil
+		}
+		out = append(out, key)
+	}
+	return out, nil, nil
+}
+
+func Test_Namespace_Scan_default(t *testing.T) {
+	client := &scanNamespaceClient{}
+	def, _ := newNamespace("", client)
+	other, _ := newNamespace("a", client)
+
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		def.Insert(key, nil)
+		other.Insert(key, nil)
+	}
+
+	// Pages ending on a namespaced key resume after it
+	for limit := 1; limit < 12; limit++ {
+		keys := testScanAll(t, func(cursor []byte) ([][]byte, []byte, error) {
+			return def.Scan(nil, limit, cursor)
+		})
+		if len(keys) != 10 {
+			t.Fatalf("limit=%d wrong keys %q", limit, keys)
+		}
+		for i, key := range keys {
+			if string(key) != fmt.Sprintf("key-%d", i) {
+				t.Fatalf("limit=%d wrong keys %q", limit, keys)
+			}
+		}
+	}
+
+	marker := []byte{namespaceMarker, 1, 'a', 'k'}
+	if err := def.Insert(marker, nil); err == nil {
+		t.Fatal("should reject key starting with the marker")
+	}
+	if _, err := def.Lookup(marker); err == nil {
+		t.Fatal("should reject key starting with the marker")
+	}
+	if _, _, err := def.Scan(marker, 10, nil); err == nil {
+		t.Fatal("should reject prefix starting with the marker")
+	}
+	if err := other.Insert(marker, nil); err != nil {
+		t.Fatal(err)
+	}
+}
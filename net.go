@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"sync/atomic"
+	"time"
 
 	"github.com/golang/protobuf/proto"
 
@@ -17,23 +19,62 @@ const (
 	reqTypeLookupGroupNodes
 	reqTypeInsert
 	reqTypeDelete
+	reqTypePing
+	reqTypeJoin
+	reqTypeSnapshot
+	reqTypeResize
+	reqTypeInsertBatch
+	reqTypeDeleteBatch
+	reqTypeLookupBatch
+	reqTypeExpireHost
+	reqTypeScan
+	reqTypePurgeNamespace
 )
 
 const (
 	respTypeOk byte = iota + 10
 	respTypeFail
+	respTypeDenied
 )
 
+// Max length of the principal sent with inserts and deletes
+const maxPrincipalLen = 255
+
 const maxUDPBufSize = 65000 // Max UDP buffer size
 
+const reqTimeout = 3 * time.Second // Max time to wait for a ping, join, snapshot or resize response
+
+// Max snapshot page size leaving room for the response header
+const maxSnapshotPageSize = maxUDPBufSize - 1024
+
 // UDPTransport is a udp based transport for kelips.  It is well suited due to
 // the small message size and reliance on gossip.  It only implements rpc's
 // and not the fault-tolerance.  This is primarily used for direct inserts,
 // lookups and deletes
 type UDPTransport struct {
+	// Request counters.  Kept first to be 64-bit aligned for atomic access
+	stats TransportStats
+
 	conn *net.UDPConn
 
 	local AffinityGroupRPC
+
+	// Signs and verifies messages if set
+	auth *TransportAuth
+
+	// Encrypts all packets if set
+	noise *noiseLayer
+
+	// Limits used to serve requests along with the per source rate limiter
+	// and queue of requests for the workers
+	limits  *ServerLimits
+	limiter *rateLimiter
+	queue   chan *inboundRequest
+
+	// Sockets outgoing requests are multiplexed over and the max time to
+	// wait for a response.  Zero uses the default timeout
+	mux     requestMux
+	timeout time.Duration
 }
 
 // NewUDPTransport inits a new UDPTransport using the given server connection.
@@ -43,22 +84,45 @@ func NewUDPTransport(ln *net.UDPConn) *UDPTransport {
 	return &UDPTransport{conn: ln}
 }
 
+// SetAuth enables signing of all requests and responses.  Unsigned requests
+// and those failing verification are dropped before being dispatched to the
+// local group.  It must be called before the transport is used
+func (trans *UDPTransport) SetAuth(auth *TransportAuth) {
+	trans.auth = auth
+}
+
+// NewEncryptedUDPTransport inits a UDPTransport encrypting all requests and
+// responses.  Sessions are established with a Noise XX handshake identifying
+// each node by its static key.  All nodes and clients in the cluster must be
+// encrypted
+func NewEncryptedUDPTransport(ln *net.UDPConn, conf *NoiseConfig) (*UDPTransport, error) {
+	trans := NewUDPTransport(ln)
+	err := trans.SetEncryption(conf)
+	return trans, err
+}
+
+// SetEncryption enables encryption of all requests and responses.  It must be
+// called before the transport is used
+func (trans *UDPTransport) SetEncryption(conf *NoiseConfig) error {
+	nl, err := newNoiseLayer(conf)
+	if err == nil {
+		trans.noise = nl
+	}
+	return err
+}
+
+// authenticated returns true if responses are signed or encrypted by the host
+func (trans *UDPTransport) authenticated() bool {
+	return trans.auth != nil || trans.noise != nil
+}
+
 // LookupNodes performs a lookup request on a host returning at least min nodes
 func (trans *UDPTransport) LookupNodes(host string, key []byte, min int) ([]*kelipspb.Node, error) {
-	conn, err := trans.getConn(host)
-	if err != nil {
-		return nil, err
-	}
 	// Node count
 	mb := make([]byte, 2)
 	binary.BigEndian.PutUint16(mb, uint16(min))
 
-	req := append([]byte{reqTypeLookupNodes}, append(mb, key...)...)
-	if _, err = conn.Write(req); err != nil {
-		return nil, err
-	}
-
-	buf, err := trans.readResponse(conn)
+	buf, err := trans.sendRequest(host, trans.request(reqTypeLookupNodes, mb, key))
 	if err != nil {
 		return nil, err
 	}
@@ -73,16 +137,29 @@ func (trans *UDPTransport) LookupNodes(host string, key []byte, min int) ([]*kel
 
 // Lookup performs a lookup request on a host for a key
 func (trans *UDPTransport) Lookup(host string, key []byte) ([]*kelipspb.Node, error) {
-	conn, err := trans.getConn(host)
+	nodes, _, err := trans.lookup(host, key)
+	return nodes, err
+}
+
+// lookup performs a lookup request on a host for a key returning the version
+// of the tuple store on the host along with the nodes
+func (trans *UDPTransport) lookup(host string, key []byte) ([]*kelipspb.Node, uint64, error) {
+	buf, err := trans.sendRequest(host, trans.request(reqTypeLookup, key))
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	req := append([]byte{reqTypeLookup}, key...)
-	if _, err = conn.Write(req); err != nil {
-		return nil, err
+	var rr kelipspb.ReqResp
+	if err = proto.Unmarshal(buf, &rr); err == nil {
+		return rr.Nodes, rr.Version, nil
 	}
-	buf, err := trans.readResponse(conn)
+
+	return nil, 0, err
+}
+
+// LookupGroupNodes looksup the group nodes for a key on a remote host
+func (trans *UDPTransport) LookupGroupNodes(host string, key []byte) ([]*kelipspb.Node, error) {
+	buf, err := trans.sendRequest(host, trans.request(reqTypeLookupGroupNodes, key))
 	if err != nil {
 		return nil, err
 	}
@@ -95,76 +172,305 @@ func (trans *UDPTransport) Lookup(host string, key []byte) ([]*kelipspb.Node, er
 	return nil, err
 }
 
-// LookupGroupNodes looksup the group nodes for a key on a remote host
-func (trans *UDPTransport) LookupGroupNodes(host string, key []byte) ([]*kelipspb.Node, error) {
-	conn, err := trans.getConn(host)
+// Insert inserts a key to node mapping on a remote host on behalf of the
+// principal
+func (trans *UDPTransport) Insert(host string, key []byte, tuple TupleHost, principal string, propogate bool) error {
+	hdr, err := mutationHeader(principal, propogate)
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	ns, k := SplitNamespace(key)
+	_, err = trans.sendRequest(host, trans.request(reqTypeInsert, hdr, namespaceField(ns), tuple, k))
+	return err
+}
+
+// Delete a key on the the host removing all node mappings for the key on
+// behalf of the principal
+func (trans *UDPTransport) Delete(host string, key []byte, tuple TupleHost, principal string, propogate bool) error {
+	hdr, err := mutationHeader(principal, propogate)
+	if err != nil {
+		return err
+	}
+
+	ns, k := SplitNamespace(key)
+	_, err = trans.sendRequest(host, trans.request(reqTypeDelete, hdr, namespaceField(ns), tuple, k))
+	return err
+}
+
+// namespaceField returns the length prefixed namespace.  Keys are sent without
+// their namespace so it is carried separately
+func namespaceField(ns string) []byte {
+	return append([]byte{byte(len(ns))}, ns...)
+}
+
+// mutationHeader returns the propogation flag followed by the length prefixed
+// principal
+func mutationHeader(principal string, propogate bool) ([]byte, error) {
+	if len(principal) > maxPrincipalLen {
+		return nil, fmt.Errorf("principal too long: %d", len(principal))
+	}
+
+	hdr := make([]byte, 2, 2+len(principal))
+	if propogate {
+		hdr[0] = 1
+	}
+	hdr[1] = byte(len(principal))
+	return append(hdr, principal...), nil
+}
+
+// parseMutationHeader returns the propogation flag, principal and the
+// remaining data
+func parseMutationHeader(msg []byte) (bool, string, []byte, error) {
+	if len(msg) < 2 || len(msg) < 2+int(msg[1]) {
+		return false, "", nil, fmt.Errorf("invalid principal")
+	}
+	pl := int(msg[1])
+	return msg[0] == 1, string(msg[2 : 2+pl]), msg[2+pl:], nil
+}
+
+// Ping sends the local node with its coordinates to the host and returns the
+// remote node with its coordinates along with the round trip time
+func (trans *UDPTransport) Ping(host string, node *kelipspb.Node) (*kelipspb.Node, time.Duration, error) {
+	b, err := proto.Marshal(node)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	buf, err := trans.sendRequest(host, trans.request(reqTypePing, b))
+	if err != nil {
+		return nil, 0, err
 	}
+	rtt := time.Since(start)
 
-	req := append([]byte{reqTypeLookupGroupNodes}, key...)
-	if _, err = conn.Write(req); err != nil {
+	var remote kelipspb.Node
+	if err = proto.Unmarshal(buf, &remote); err != nil {
+		return nil, 0, err
+	}
+
+	return &remote, rtt, nil
+}
+
+// Join sends the local node to the host to join the cluster.  It returns the
+// snapshot of the remote node
+func (trans *UDPTransport) Join(host string, node *kelipspb.Node) (*kelipspb.Snapshot, error) {
+	b, err := proto.Marshal(node)
+	if err != nil {
 		return nil, err
 	}
 
-	buf, err := trans.readResponse(conn)
+	buf, err := trans.sendRequest(host, trans.request(reqTypeJoin, b))
 	if err != nil {
 		return nil, err
 	}
 
-	var rr kelipspb.ReqResp
-	if err = proto.Unmarshal(buf, &rr); err == nil {
-		return rr.Nodes, nil
+	var snapshot kelipspb.Snapshot
+	if err = proto.Unmarshal(buf, &snapshot); err != nil {
+		return nil, err
 	}
 
-	return nil, err
+	return &snapshot, nil
 }
 
-// Insert inserts a key to node mapping on a remote host
-func (trans *UDPTransport) Insert(host string, key []byte, tuple TupleHost, propogate bool) error {
+// Snapshot requests a page of the snapshot from the host.  The returned Cursor
+// is used to request subsequent pages
+func (trans *UDPTransport) Snapshot(host string, req *SnapshotRequest) (*kelipspb.Snapshot, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	// Group, limit and cursor length
+	hdr := make([]byte, 6)
+	binary.BigEndian.PutUint16(hdr, uint16(int16(req.Group)))
+	binary.BigEndian.PutUint16(hdr[2:], uint16(req.Limit))
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(req.Cursor)))
 
-	conn, err := trans.getConn(host)
+	buf, err := trans.sendRequest(host, trans.request(reqTypeSnapshot, hdr, req.Cursor, req.Prefix))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	data := append(tuple, key...)
-	var req []byte
-	if propogate {
-		req = append([]byte{reqTypeInsert, byte(1)}, data...)
-	} else {
-		req = append([]byte{reqTypeInsert, byte(0)}, data...)
+	var snapshot kelipspb.Snapshot
+	if err = proto.Unmarshal(buf, &snapshot); err != nil {
+		return nil, err
 	}
 
-	if _, err = conn.Write(req); err != nil {
-		return err
-	}
+	return &snapshot, nil
+}
 
-	_, err = trans.readResponse(conn)
+// Resize sends the layout generation and number of groups to the host
+func (trans *UDPTransport) Resize(host string, gen uint64, k int) error {
+	// Generation and group count
+	b := make([]byte, 10)
+	binary.BigEndian.PutUint64(b, gen)
+	binary.BigEndian.PutUint16(b[8:], uint16(k))
+
+	_, err := trans.sendRequest(host, trans.request(reqTypeResize, b))
 	return err
 }
 
-// Delete a key on the the host removing all node mappings for the key
-func (trans *UDPTransport) Delete(host string, key []byte, tuple TupleHost, propogate bool) error {
-	conn, err := trans.getConn(host)
+// InsertBatch inserts the entries on the host returning an error for each
+// entry.  Entries are sent in as many requests as needed to fit the max
+// request size.  An error is returned if any request fails in which case
+// entries from preceding requests will have been applied
+func (trans *UDPTransport) InsertBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	return trans.updateBatch(host, reqTypeInsertBatch, entries, principal, propogate)
+}
+
+// DeleteBatch deletes the entries on the host returning an error for each
+// entry.  Requests are split similar to InsertBatch
+func (trans *UDPTransport) DeleteBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	return trans.updateBatch(host, reqTypeDeleteBatch, entries, principal, propogate)
+}
+
+func (trans *UDPTransport) updateBatch(host string, typ byte, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	hdr, err := mutationHeader(principal, propogate)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	d := append(tuple, key...)
+	errs := make([]error, 0, len(entries))
+	for _, chunk := range chunkEntries(entries) {
+		b, err := encodeEntries(chunk)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := trans.sendRequest(host, trans.request(typ, hdr, b))
+		if err != nil {
+			return nil, err
+		}
 
-	var req []byte
-	if propogate {
-		req = append([]byte{reqTypeDelete, byte(1)}, d...)
+		_, cerrs, err := decodeResults(buf, len(chunk))
+		if err != nil {
+			return nil, err
+		}
+		errs = append(errs, cerrs...)
+	}
+
+	return errs, nil
+}
+
+// LookupBatch looks up each key on the host returning a result for each key.
+// Keys are sent in as many requests as needed
+func (trans *UDPTransport) LookupBatch(host string, keys [][]byte) ([]LookupResult, error) {
+	results := make([]LookupResult, 0, len(keys))
+	for _, chunk := range chunkKeys(keys) {
+		b, err := encodeKeys(chunk)
+		if err != nil {
+			return nil, err
+		}
+		buf, err := trans.sendRequest(host, trans.request(reqTypeLookupBatch, b))
+		if err != nil {
+			return nil, err
+		}
+
+		payloads, errs, err := decodeResults(buf, len(chunk))
+		if err != nil {
+			return nil, err
+		}
+
+		for i, key := range chunk {
+			r := LookupResult{Err: errs[i]}
+			if r.Err != nil && r.Err.Error() == errLookupTooLarge.Error() {
+				// Did not fit in the batch response
+				r.Nodes, r.Err = trans.Lookup(host, key)
+			} else if r.Err == nil {
+				var rr kelipspb.ReqResp
+				if r.Err = proto.Unmarshal(payloads[i], &rr); r.Err == nil {
+					r.Nodes = rr.Nodes
+				}
+			}
+			results = append(results, r)
+		}
+	}
+
+	return results, nil
+}
+
+// sendRequest sends a single request to the host returning the response
+func (trans *UDPTransport) sendRequest(host string, req []byte) ([]byte, error) {
+	var (
+		nonce []byte
+		resp  []byte
+		err   error
+	)
+
+	if trans.auth != nil {
+		if req, nonce, err = trans.auth.sealRequest(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if trans.noise != nil {
+		resp, err = trans.noise.roundTrip(trans, host, req)
 	} else {
-		req = append([]byte{reqTypeDelete, byte(0)}, d...)
+		resp, err = trans.roundTrip(host, req)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err = conn.Write(req); err != nil {
-		return err
+	return trans.parseResponse(resp, nonce)
+}
+
+// roundTrip writes the packet to the host returning the raw response
+func (trans *UDPTransport) roundTrip(host string, pkt []byte) ([]byte, error) {
+	timeout := trans.timeout
+	if timeout == 0 {
+		timeout = reqTimeout
+	}
+	return trans.mux.roundTrip(host, pkt, timeout)
+}
+
+// SetTimeout sets the max time to wait for a response.  It must be called
+// before the transport is used
+func (trans *UDPTransport) SetTimeout(timeout time.Duration) {
+	trans.timeout = timeout
+}
+
+// Close closes the sockets used to send requests failing any pending ones.  The
+// connection the transport serves requests on is owned by the caller and is not
+// closed
+func (trans *UDPTransport) Close() error {
+	return trans.mux.close()
+}
+
+// ExpireHost removes the host from all keys on the remote host and the other
+// nodes within the scope
+func (trans *UDPTransport) ExpireHost(host string, tuple TupleHost, scope ExpireScope) error {
+	_, err := trans.sendRequest(host, trans.request(reqTypeExpireHost, []byte{byte(scope)}, tuple))
+	return err
+}
+
+// Scan requests upto limit sorted keys with the prefix after the cursor from
+// the host.  If cluster is true the host scans all groups and merges the
+// results.  It returns true if there may be more keys
+func (trans *UDPTransport) Scan(host string, prefix, cursor []byte, limit int, cluster bool) ([][]byte, bool, error) {
+	// Scope, limit and cursor length
+	hdr := make([]byte, 5)
+	if cluster {
+		hdr[0] = 1
 	}
+	binary.BigEndian.PutUint16(hdr[1:], uint16(limit))
+	binary.BigEndian.PutUint16(hdr[3:], uint16(len(cursor)))
 
-	_, err = trans.readResponse(conn)
+	buf, err := trans.sendRequest(host, trans.request(reqTypeScan, hdr, cursor, prefix))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(buf) < 1 {
+		return nil, false, fmt.Errorf("scan: invalid response")
+	}
+
+	keys, err := decodeKeys(buf[1:])
+	return keys, buf[0] == 1, err
+}
+
+// PurgeNamespace deletes all keys in the namespace on the remote host and the
+// other nodes within the scope
+func (trans *UDPTransport) PurgeNamespace(host string, ns string, scope ExpireScope) error {
+	_, err := trans.sendRequest(host, trans.request(reqTypePurgeNamespace, []byte{byte(scope)}, []byte(ns)))
 	return err
 }
 
@@ -173,10 +479,11 @@ func (trans *UDPTransport) Delete(host string, key []byte, tuple TupleHost, prop
 func (trans *UDPTransport) Register(group AffinityGroupRPC) {
 	trans.local = group
 	log.Println("[INFO] DHT serving on:", trans.conn.LocalAddr())
+	trans.startWorkers()
 	go trans.listen()
 }
 
-func (trans *UDPTransport) handleRequest(remote *net.UDPAddr, typ byte, msg []byte) {
+func (trans *UDPTransport) handleRequest(remote *net.UDPAddr, typ byte, msg []byte, rctx *requestContext) {
 	var (
 		err  error
 		resp []byte
@@ -185,7 +492,7 @@ func (trans *UDPTransport) handleRequest(remote *net.UDPAddr, typ byte, msg []by
 	switch typ {
 
 	case reqTypeLookup:
-		rr := &kelipspb.ReqResp{}
+		rr := &kelipspb.ReqResp{Version: trans.local.TupleVersion()}
 		if rr.Nodes, err = trans.local.Lookup(msg); err != nil {
 			break
 		}
@@ -223,58 +530,229 @@ func (trans *UDPTransport) handleRequest(remote *net.UDPAddr, typ byte, msg []by
 
 		resp, err = proto.Marshal(rr)
 
-	case reqTypeInsert:
-		if len(msg) < 20 {
-			err = fmt.Errorf("insert: size too small")
+	case reqTypeInsert, reqTypeDelete:
+		var (
+			prop   bool
+			caller = Caller{Peer: rctx.peer, Remote: true}
+		)
+		if prop, caller.Principal, msg, err = parseMutationHeader(msg); err != nil {
+			break
+		}
+		if len(msg) < 1 || len(msg) < 1+int(msg[0])+19 {
+			err = fmt.Errorf("insert/delete: size too small %d", len(msg))
 			break
 		}
-		prop := msg[0]
-		tuple := TupleHost(msg[1:19])
-		key := msg[19:]
 
-		if prop == byte(1) {
-			err = trans.local.Insert(key, tuple, true)
+		ns := string(msg[1 : 1+msg[0]])
+		msg = msg[1+len(ns):]
+
+		tuple := TupleHost(msg[:18])
+		var key []byte
+		if key, err = storedKey(ns, msg[18:]); err != nil {
+			break
+		}
+		if typ == reqTypeInsert {
+			err = trans.local.Insert(key, tuple, caller, prop)
 		} else {
-			err = trans.local.Insert(key, tuple, false)
+			err = trans.local.Delete(key, tuple, caller, prop)
 		}
 
-	case reqTypeDelete:
-		if len(msg) < 20 {
-			err = fmt.Errorf("delete: size too small %d", len(msg))
+	case reqTypePing:
+		var node kelipspb.Node
+		if err = proto.Unmarshal(msg, &node); err != nil {
 			break
 		}
 
-		prop := msg[0]
-		tuple := TupleHost(msg[1:19])
-		key := msg[19:]
-		if prop == byte(1) {
-			err = trans.local.Delete(key, tuple, true)
-		} else {
-			err = trans.local.Delete(key, tuple, false)
+		resp, err = proto.Marshal(trans.local.Ping(&node, Caller{Peer: rctx.peer, Remote: true, Addr: remote.String()}))
+
+	case reqTypeJoin:
+		var node kelipspb.Node
+		if err = proto.Unmarshal(msg, &node); err != nil {
+			break
+		}
+
+		req := &SnapshotRequest{MaxSize: maxSnapshotPageSize}
+		var snapshot *kelipspb.Snapshot
+		if snapshot, err = trans.local.Join(&node, req, Caller{Peer: rctx.peer, Remote: true}); err == nil {
+			resp, err = proto.Marshal(snapshot)
+		}
+
+	case reqTypeSnapshot:
+		if len(msg) < 6 {
+			err = fmt.Errorf("snapshot: size too small")
+			break
+		}
+
+		req := &SnapshotRequest{
+			Group:   int(int16(binary.BigEndian.Uint16(msg))),
+			Limit:   int(binary.BigEndian.Uint16(msg[2:])),
+			MaxSize: maxSnapshotPageSize,
+		}
+
+		cl := int(binary.BigEndian.Uint16(msg[4:]))
+		if len(msg) < 6+cl {
+			err = fmt.Errorf("snapshot: invalid cursor")
+			break
 		}
+		req.Cursor = msg[6 : 6+cl]
+		req.Prefix = msg[6+cl:]
+
+		var snapshot *kelipspb.Snapshot
+		if snapshot, err = trans.local.SnapshotPage(req); err == nil {
+			resp, err = proto.Marshal(snapshot)
+		}
+
+	case reqTypeResize:
+		if len(msg) < 10 {
+			err = fmt.Errorf("resize: size too small")
+			break
+		}
+
+		gen := binary.BigEndian.Uint64(msg)
+		k := int(binary.BigEndian.Uint16(msg[8:]))
+		err = trans.local.Resize(gen, k, Caller{Peer: rctx.peer, Remote: true})
+
+	case reqTypeInsertBatch, reqTypeDeleteBatch:
+		var (
+			prop   bool
+			caller = Caller{Peer: rctx.peer, Remote: true}
+		)
+		if prop, caller.Principal, msg, err = parseMutationHeader(msg); err != nil {
+			break
+		}
+
+		var entries []BatchEntry
+		if entries, err = decodeEntries(msg); err != nil {
+			break
+		}
+
+		for _, e := range entries {
+			// Batches are only of the default namespace
+			er := checkKey(e.Key)
+			if er == nil && typ == reqTypeInsertBatch {
+				er = trans.local.Insert(e.Key, e.Tuple, caller, prop)
+			} else if er == nil {
+				er = trans.local.Delete(e.Key, e.Tuple, caller, prop)
+			}
+			resp = encodeResult(resp, nil, er)
+		}
+
+	case reqTypeLookupBatch:
+		var keys [][]byte
+		if keys, err = decodeKeys(msg); err != nil {
+			break
+		}
+
+		results := make([]LookupResult, len(keys))
+		for i, key := range keys {
+			r := &results[i]
+			if r.Nodes, r.Err = trans.local.Lookup(key); r.Err == nil && len(r.Nodes) == 0 {
+				r.Err = fmt.Errorf("no nodes found")
+			}
+		}
+		resp, err = encodeLookupResults(keys, results)
+
+	case reqTypeExpireHost:
+		if len(msg) < 2 {
+			err = fmt.Errorf("expire host: size too small")
+			break
+		}
+		err = trans.local.ExpireHost(TupleHost(msg[1:]), ExpireScope(msg[0]), Caller{Peer: rctx.peer, Remote: true})
+
+	case reqTypeScan:
+		if len(msg) < 5 {
+			err = fmt.Errorf("scan: size too small")
+			break
+		}
+
+		cl := int(binary.BigEndian.Uint16(msg[3:]))
+		if len(msg) < 5+cl {
+			err = fmt.Errorf("scan: invalid cursor")
+			break
+		}
+
+		var (
+			keys [][]byte
+			more bool
+		)
+		limit := int(binary.BigEndian.Uint16(msg[1:]))
+		if keys, more, err = trans.local.Scan(msg[5+cl:], msg[5:5+cl], limit, msg[0] == 1); err == nil {
+			resp, err = encodeScanResult(keys, more)
+		}
+
+	case reqTypePurgeNamespace:
+		if len(msg) < 2 {
+			err = fmt.Errorf("purge namespace: size too small")
+			break
+		}
+		err = trans.local.PurgeNamespace(string(msg[1:]), ExpireScope(msg[0]), Caller{Peer: rctx.peer, Remote: true})
 
 	default:
 		err = fmt.Errorf("unknown request: %x '%s'", typ, msg)
 	}
 
+	trans.writeResponse(remote, rctx, resp, err)
+}
+
+// requestContext holds the state of a received request needed to secure its
+// response
+type requestContext struct {
+	// Id the response is sent with
+	id []byte
+
+	// Request nonce when authentication is enabled
+	nonce []byte
+
+	// Session and request counter when encryption is enabled
+	session *noiseSession
+	counter uint64
+
+	// Authenticated identity of the sender
+	peer string
+
+	// Size of the received packet and whether the source is exempt from the
+	// amplification limit
+	size     int
+	verified bool
+}
+
+// writeResponse writes a failed response if there is an error otherwise a
+// successful one with the given payload.  The response is signed with the
+// request nonce if authentication is enabled and encrypted if encryption is
+// enabled
+func (trans *UDPTransport) writeResponse(remote *net.UDPAddr, rctx *requestContext, resp []byte, err error) {
+	if err == nil && len(resp) >= maxUDPBufSize {
+		// Fail rather than leave the client waiting on a truncated response
+		log.Printf("[ERROR] Response too big size=%d max=%d", len(resp), maxUDPBufSize)
+		err = fmt.Errorf("response too big: %d bytes", len(resp))
+	}
+	if err == nil {
+		err = trans.checkAmplification(rctx, 1+len(resp))
+	}
+
 	if err != nil {
-		resp = append([]byte{respTypeFail}, []byte(err.Error())...)
+		typ, b := encodeError(err)
+		resp = append([]byte{typ}, b...)
 	} else {
 		if resp != nil {
-			// TODO: handle larger payloads
-			if len(resp) >= maxUDPBufSize {
-				log.Printf("[ERROR] Response too big size=%d max=%d", len(resp), maxUDPBufSize)
-			}
-
 			resp = append([]byte{respTypeOk}, resp...)
-
 		} else {
 			resp = []byte{respTypeOk}
 		}
 	}
 
-	var w int
-	w, err = trans.conn.WriteToUDP(resp, remote)
+	if trans.auth != nil {
+		if resp, err = trans.auth.sealResponse(rctx.nonce, resp); err != nil {
+			log.Println("[ERROR] Failed to sign response:", err)
+			return
+		}
+	}
+	if rctx.session != nil {
+		resp, _ = rctx.session.seal(resp, rctx.counter)
+	}
+
+	resp = framePacket(rctx.id, resp)
+	w, err := trans.conn.WriteToUDP(resp, remote)
 	if err != nil {
 		log.Println("[ERROR] Failed to write response:", err)
 	} else {
@@ -295,34 +773,156 @@ func (trans *UDPTransport) listen() {
 			continue
 		}
 
-		typ := buf[0]
-		msg := make([]byte, n-1)
-		copy(msg, buf[1:n])
+		atomic.AddUint64(&trans.stats.Received, 1)
+		if !trans.allowSource(remote) {
+			continue
+		}
+
+		if n < requestIDSize {
+			log.Printf("[ERROR] Packet too small size=%d remote=%s", n, remote)
+			atomic.AddUint64(&trans.stats.Rejected, 1)
+			continue
+		}
+
+		data := buf[requestIDSize:n]
+		rctx := &requestContext{size: n, id: make([]byte, requestIDSize)}
+		copy(rctx.id, buf)
+
+		// Decrypt and authenticate before any other processing
+		if trans.noise != nil {
+			if data, rctx.session, rctx.counter, err = trans.noise.handle(trans.conn, remote, rctx.id, data); err != nil {
+				log.Printf("[ERROR] Rejected encrypted packet remote=%s: %v", remote, err)
+				atomic.AddUint64(&trans.stats.Rejected, 1)
+				continue
+			}
+			if data == nil {
+				// Handshake
+				continue
+			}
+		}
+		var (
+			keyID  uint32
+			signed bool
+		)
+		if trans.auth != nil {
+			var nonce []byte
+			keyID = envelopeKeyID(data)
+			if data, nonce, err = trans.auth.openRequest(data); err != nil {
+				log.Printf("[ERROR] Unauthenticated request remote=%s: %v", remote, err)
+				atomic.AddUint64(&trans.stats.Rejected, 1)
+				continue
+			}
+			rctx.nonce = make([]byte, len(nonce))
+			copy(rctx.nonce, nonce)
+			signed = true
+		}
+		rctx.peer = peerIdentity(keyID, signed, rctx.session)
+		rctx.verified = trans.verified(remote, rctx)
+
+		if len(data) < 1+fingerprintSize {
+			log.Printf("[ERROR] Request too small size=%d remote=%s", len(data), remote)
+			atomic.AddUint64(&trans.stats.Rejected, 1)
+			continue
+		}
+
+		typ := data[0]
 
-		go trans.handleRequest(remote, typ, msg)
+		// Reject requests from incompatible nodes
+		var fp Fingerprint
+		fp.UnmarshalBinary(data[1:])
+		if err = trans.local.Fingerprint().Check(fp); err != nil {
+			log.Printf("[ERROR] Rejected request remote=%s: %v", remote, err)
+			atomic.AddUint64(&trans.stats.Rejected, 1)
+			trans.writeResponse(remote, rctx, nil, err)
+			continue
+		}
+
+		msg := make([]byte, len(data)-1-fingerprintSize)
+		copy(msg, data[1+fingerprintSize:])
+
+		trans.enqueue(&inboundRequest{remote: remote, typ: typ, msg: msg, rctx: rctx})
 	}
 }
 
-func (trans *UDPTransport) getConn(host string) (*net.UDPConn, error) {
-	raddr, err := net.ResolveUDPAddr("udp4", host)
-	if err == nil {
-		return net.DialUDP("udp4", nil, raddr)
+// fingerprint returns the fingerprint of the registered local group or that of
+// a client if the transport is only used as a client
+func (trans *UDPTransport) fingerprint() Fingerprint {
+	if trans.local == nil {
+		return clientFingerprint()
 	}
-	return nil, err
+	return trans.local.Fingerprint()
 }
 
-func (trans *UDPTransport) readResponse(conn *net.UDPConn) ([]byte, error) {
+// request builds a request of the given type with the fingerprint header
+// followed by the data
+func (trans *UDPTransport) request(typ byte, data ...[]byte) []byte {
+	fp, _ := trans.fingerprint().MarshalBinary()
 
-	buf := make([]byte, maxUDPBufSize)
-	n, err := conn.Read(buf)
-	if err == nil {
-		b := buf[:n]
+	size := 1 + len(fp)
+	for _, d := range data {
+		size += len(d)
+	}
 
-		if b[0] == respTypeOk {
-			return b[1:], nil
+	req := make([]byte, 0, size)
+	req = append(append(req, typ), fp...)
+	for _, d := range data {
+		req = append(req, d...)
+	}
+	return req
+}
+
+// parseResponse verifies the response if authentication is enabled returning
+// the payload of a successful response or the error of a failed one
+func (trans *UDPTransport) parseResponse(b []byte, nonce []byte) ([]byte, error) {
+	var err error
+	if trans.auth != nil {
+		if b, err = trans.auth.openResponse(nonce, b); err != nil {
+			return nil, err
 		}
-		err = fmt.Errorf("%s", b[1:])
+	}
+	if len(b) < 1 {
+		return nil, fmt.Errorf("empty response")
 	}
 
-	return nil, err
+	if b[0] == respTypeOk {
+		return b[1:], nil
+	}
+	return nil, decodeError(b[0], b[1:])
+}
+
+// encodeError returns the response type and payload of the error.  Access
+// denied errors are encoded so they can be reconstructed by the caller
+func encodeError(err error) (byte, []byte) {
+	if denied, ok := err.(*AccessDeniedError); ok {
+		if b, er := denied.marshal(); er == nil {
+			return respTypeDenied, b
+		}
+	}
+	return respTypeFail, []byte(err.Error())
+}
+
+// decodeError returns the error of a failed response
+func decodeError(typ byte, b []byte) error {
+	if typ == respTypeDenied {
+		denied, err := unmarshalAccessDenied(b)
+		if err != nil {
+			return err
+		}
+		return denied
+	}
+	return remoteError(b)
+}
+
+// remoteError is an error returned by the remote host as opposed to one
+// reaching it
+type remoteError string
+
+func (e remoteError) Error() string {
+	return string(e)
+}
+
+// isRemoteError returns true if the error was returned by the remote host
+func isRemoteError(err error) bool {
+	_, ok := err.(remoteError)
+	return ok
 }
@@ -1,8 +1,10 @@
 package kelips
 
 import (
+	"bytes"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"testing"
 
@@ -13,11 +15,16 @@ import (
 type MockAffinityGroupRPC struct {
 	mu    sync.Mutex
 	hosts map[string][]TupleHost
+
+	gen uint64
+	k   int
+
+	version uint64
 }
 
 // This is called to set rrt on the local group for the host
-func (group *MockAffinityGroupRPC) Ping() *vivaldi.Coordinate {
-	return &vivaldi.Coordinate{}
+func (group *MockAffinityGroupRPC) Ping(node *kelipspb.Node, caller Caller) *kelipspb.Node {
+	return &kelipspb.Node{Coordinates: &vivaldi.Coordinate{}}
 }
 
 // Lookup nodes from the local view
@@ -69,8 +76,87 @@ func (group *MockAffinityGroupRPC) LookupNodes(key []byte, min int) ([]*kelipspb
 	return nil, fmt.Errorf("key not found: %s", key)
 }
 
+func (group *MockAffinityGroupRPC) Join(node *kelipspb.Node, req *SnapshotRequest, caller Caller) (*kelipspb.Snapshot, error) {
+	return &kelipspb.Snapshot{Nodes: []*kelipspb.Node{node}}, nil
+}
+
+func (group *MockAffinityGroupRPC) SnapshotPage(req *SnapshotRequest) (*kelipspb.Snapshot, error) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	ss := &kelipspb.Snapshot{}
+	for k, hosts := range group.hosts {
+		tuple := &kelipspb.Tuple{Key: []byte(k)}
+		for _, h := range hosts {
+			tuple.Hosts = append(tuple.Hosts, h)
+		}
+		ss.Tuples = append(ss.Tuples, tuple)
+	}
+	return ss, nil
+}
+
+func (group *MockAffinityGroupRPC) Resize(gen uint64, k int, caller Caller) error {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	if gen <= group.gen {
+		return fmt.Errorf("stale generation")
+	}
+	group.gen, group.k = gen, k
+	return nil
+}
+
+func (group *MockAffinityGroupRPC) ExpireHost(tuple TupleHost, scope ExpireScope, caller Caller) error {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	for k, hosts := range group.hosts {
+		for i, h := range hosts {
+			if h.String() == tuple.String() {
+				group.hosts[k] = append(hosts[:i], hosts[i+1:]...)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (group *MockAffinityGroupRPC) Scan(prefix, cursor []byte, limit int, cluster bool) ([][]byte, bool, error) {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	var keys [][]byte
+	for k := range group.hosts {
+		if bytes.HasPrefix([]byte(k), prefix) && k > string(cursor) {
+			keys = append(keys, []byte(k))
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	if limit > 0 && len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+func (group *MockAffinityGroupRPC) PurgeNamespace(ns string, scope ExpireScope, caller Caller) error {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+
+	for k := range group.hosts {
+		if n, _ := SplitNamespace([]byte(k)); n == ns {
+			delete(group.hosts, k)
+		}
+	}
+	return nil
+}
+
+func (group *MockAffinityGroupRPC) Fingerprint() Fingerprint {
+	return clientFingerprint()
+}
+
 // Insert to local group
-func (group *MockAffinityGroupRPC) Insert(key []byte, host TupleHost, prop bool) error {
+func (group *MockAffinityGroupRPC) Insert(key []byte, host TupleHost, caller Caller, prop bool) error {
 	group.mu.Lock()
 	defer group.mu.Unlock()
 
@@ -81,21 +167,29 @@ func (group *MockAffinityGroupRPC) Insert(key []byte, host TupleHost, prop bool)
 	} else {
 		group.hosts[string(key)] = []TupleHost{host}
 	}
+	group.version++
 
 	return nil
 }
 
 // Delete from local group
-func (group *MockAffinityGroupRPC) Delete(key []byte, tuple TupleHost, prop bool) error {
+func (group *MockAffinityGroupRPC) Delete(key []byte, tuple TupleHost, caller Caller, prop bool) error {
 	group.mu.Lock()
 	defer group.mu.Unlock()
 
 	if _, ok := group.hosts[string(key)]; ok {
 		delete(group.hosts, string(key))
+		group.version++
 	}
 	return nil
 }
 
+func (group *MockAffinityGroupRPC) TupleVersion() uint64 {
+	group.mu.Lock()
+	defer group.mu.Unlock()
+	return group.version
+}
+
 func newBareTrans(addr string) *UDPTransport {
 
 	laddr, err := net.ResolveUDPAddr("udp4", addr)
@@ -124,17 +218,17 @@ func Test_UDPTransport(t *testing.T) {
 	t2 := newTestTransport("127.0.0.1:23457")
 	t3 := newTestTransport("127.0.0.1:23458")
 
-	if err := t1.Insert("127.0.0.1:23457", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), false); err != nil {
+	if err := t1.Insert("127.0.0.1:23457", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), "", false); err != nil {
 		t.Fatal(err)
 	}
-	if err := t2.Insert("127.0.0.1:23458", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), false); err != nil {
+	if err := t2.Insert("127.0.0.1:23458", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), "", false); err != nil {
 		t.Fatal(err)
 	}
-	if err := t3.Insert("127.0.0.1:23456", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), false); err != nil {
+	if err := t3.Insert("127.0.0.1:23456", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), "", false); err != nil {
 		t.Fatal(err)
 	}
 
-	t3.Insert("127.0.0.1:23456", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23457), false)
+	t3.Insert("127.0.0.1:23456", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23457), "", false)
 
 	if hosts, err := t1.Lookup("127.0.0.1:23457", []byte("key")); err != nil || hosts == nil || len(hosts) == 0 {
 		t.Fatal("should have hosts", err)
@@ -160,7 +254,7 @@ func Test_UDPTransport(t *testing.T) {
 
 	// DELETE
 
-	if err = t2.Delete("127.0.0.1:23457", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), false); err != nil {
+	if err = t2.Delete("127.0.0.1:23457", []byte("key"), NewTupleHostFromHostPort("127.0.0.1", 23456), "", false); err != nil {
 		t.Fatal(err)
 	}
 
@@ -174,27 +268,56 @@ func Test_UDPTransport(t *testing.T) {
 		t.Fatal("should fail", nodes)
 	}
 
-	// _, rtt1, err := t1.Ping("127.0.0.1:23457")
-	// if err != nil {
-	// 	t.Error("err")
-	// }
-	// if rtt1 <= 0 {
-	// 	t.Error("0 rtt")
-	// }
-	//
-	// _, rtt2, err := t2.Ping("127.0.0.1:23458")
-	// if err != nil {
-	// 	t.Error("err")
-	// }
-	// if rtt2 <= 0 {
-	// 	t.Error("0 rtt")
-	// }
-	//
-	// _, rtt3, err := t3.Ping("127.0.0.1:23456")
-	// if err != nil {
-	// 	t.Error("err")
-	// }
-	// if rtt3 <= 0 {
-	// 	t.Error("0 rtt")
-	// }
+	local := &kelipspb.Node{Coordinates: &vivaldi.Coordinate{}}
+
+	n1, rtt1, err := t1.Ping("127.0.0.1:23457", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt1 <= 0 {
+		t.Error("0 rtt")
+	}
+	if n1.Coordinates == nil {
+		t.Error("should have coordinates")
+	}
+
+	_, rtt2, err := t2.Ping("127.0.0.1:23458", local)
+	if err != nil {
+		t.Error(err)
+	}
+	if rtt2 <= 0 {
+		t.Error("0 rtt")
+	}
+
+	_, rtt3, err := t3.Ping("127.0.0.1:23456", local)
+	if err != nil {
+		t.Error(err)
+	}
+	if rtt3 <= 0 {
+		t.Error("0 rtt")
+	}
+
+	if err = t1.Resize("127.0.0.1:23457", 1, 7); err != nil {
+		t.Fatal(err)
+	}
+	if err = t1.Resize("127.0.0.1:23457", 1, 7); err == nil {
+		t.Fatal("should fail with stale generation")
+	}
+
+	for _, key := range []string{"svc/a", "svc/b", "other"} {
+		t1.Insert("127.0.0.1:23458", []byte(key), NewTupleHostFromHostPort("127.0.0.1", 23456), "", false)
+	}
+	keys, more, err := t1.Scan("127.0.0.1:23458", []byte("svc/"), nil, 1, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0]) != "svc/a" || !more {
+		t.Fatalf("wrong scan keys=%q more=%v", keys, more)
+	}
+	if keys, more, err = t1.Scan("127.0.0.1:23458", []byte("svc/"), keys[0], 1, true); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || string(keys[0]) != "svc/b" || more {
+		t.Fatalf("wrong scan keys=%q more=%v", keys, more)
+	}
 }
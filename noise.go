@@ -0,0 +1,789 @@
+package kelips
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Packet types of the encrypted transport.  They are distinct from request and
+// response types
+const (
+	noiseTypeHandshake1 byte = iota + 0xe1
+	noiseTypeHandshake2
+	noiseTypeHandshake3
+	noiseTypeData
+	noiseTypeUnknownSession
+)
+
+const (
+	noiseProtocolName = "Noise_XX_25519_AESGCM_SHA256"
+	noisePrologue     = "kelips"
+
+	noiseKeySize  = 32
+	noiseTagSize  = 16
+	noiseSIDSize  = 8
+	noiseDataHdr  = 1 + noiseSIDSize + 8
+	noiseMaxIdle  = 10 * time.Minute
+	noiseMaxPeers = 4096
+
+	// Each side of the handshake chooses half of the session id
+	noiseSIDHalf = noiseSIDSize / 2
+
+	// Message 1 is padded to the size of message 2 so the handshake response
+	// is no larger than the request
+	noiseMsg1Size = 2*noiseKeySize + 2*noiseTagSize
+
+	// Max responder sessions per remote ip
+	noiseMaxIPSessions = 64
+)
+
+// NoiseConfig configures the encrypted transport
+type NoiseConfig struct {
+	// Static X25519 key identifying the local node
+	StaticKey *ecdh.PrivateKey
+
+	// Static public keys of trusted peers.  Any peer completing the handshake
+	// is accepted if empty
+	TrustedKeys [][]byte
+}
+
+// GenerateNoiseKey generates a new static X25519 key
+func GenerateNoiseKey() (*ecdh.PrivateKey, error) {
+	return ecdh.X25519().GenerateKey(rand.Reader)
+}
+
+// noiseCipher is an AES-GCM cipher with the nonce formed by the counter as
+// defined by the Noise AESGCM cipher functions
+type noiseCipher struct {
+	aead cipher.AEAD
+}
+
+func newNoiseCipher(key []byte) (*noiseCipher, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &noiseCipher{aead: aead}, nil
+}
+
+func (c *noiseCipher) nonce(n uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], n)
+	return nonce
+}
+
+func (c *noiseCipher) seal(dst []byte, n uint64, ad, pt []byte) []byte {
+	return c.aead.Seal(dst, c.nonce(n), pt, ad)
+}
+
+func (c *noiseCipher) open(n uint64, ad, ct []byte) ([]byte, error) {
+	return c.aead.Open(nil, c.nonce(n), ct, ad)
+}
+
+// noiseHKDF returns the 2 outputs of the Noise HKDF function
+func noiseHKDF(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	return out1, mac.Sum(nil)
+}
+
+// noiseHandshake holds the symmetric and handshake state of a Noise XX
+// handshake
+type noiseHandshake struct {
+	ck []byte
+	h  []byte
+	k  *noiseCipher
+	n  uint64
+
+	s  *ecdh.PrivateKey
+	e  *ecdh.PrivateKey
+	re *ecdh.PublicKey
+	rs *ecdh.PublicKey
+}
+
+func newNoiseHandshake(s *ecdh.PrivateKey) *noiseHandshake {
+	return initNoiseHandshake(s, []byte(noisePrologue))
+}
+
+func initNoiseHandshake(s *ecdh.PrivateKey, prologue []byte) *noiseHandshake {
+	h := make([]byte, sha256.Size)
+	copy(h, noiseProtocolName)
+
+	hs := &noiseHandshake{ck: h, h: h, s: s}
+	hs.mixHash(prologue)
+	return hs
+}
+
+// ephemeral generates the local ephemeral key unless one is already set
+func (hs *noiseHandshake) ephemeral() error {
+	if hs.e != nil {
+		return nil
+	}
+	var err error
+	hs.e, err = GenerateNoiseKey()
+	return err
+}
+
+func (hs *noiseHandshake) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(hs.h)
+	h.Write(data)
+	hs.h = h.Sum(nil)
+}
+
+func (hs *noiseHandshake) mixKey(ikm []byte) error {
+	var k []byte
+	hs.ck, k = noiseHKDF(hs.ck, ikm)
+
+	c, err := newNoiseCipher(k)
+	if err == nil {
+		hs.k, hs.n = c, 0
+	}
+	return err
+}
+
+func (hs *noiseHandshake) dh(priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	return hs.mixKey(shared)
+}
+
+func (hs *noiseHandshake) encryptAndHash(pt []byte) []byte {
+	ct := pt
+	if hs.k != nil {
+		ct = hs.k.seal(nil, hs.n, hs.h, pt)
+		hs.n++
+	}
+	hs.mixHash(ct)
+	return ct
+}
+
+func (hs *noiseHandshake) decryptAndHash(ct []byte) ([]byte, error) {
+	pt := ct
+	if hs.k != nil {
+		var err error
+		if pt, err = hs.k.open(hs.n, hs.h, ct); err != nil {
+			return nil, fmt.Errorf("noise: handshake decryption failed")
+		}
+		hs.n++
+	}
+	hs.mixHash(ct)
+	return pt, nil
+}
+
+// split returns the initiator to responder and responder to initiator ciphers
+func (hs *noiseHandshake) split() (*noiseCipher, *noiseCipher, error) {
+	k1, k2 := noiseHKDF(hs.ck, nil)
+	c1, err := newNoiseCipher(k1)
+	if err != nil {
+		return nil, nil, err
+	}
+	c2, err := newNoiseCipher(k2)
+	return c1, c2, err
+}
+
+// writeMessage1 initiator: -> e.  The payload is sent in plaintext
+func (hs *noiseHandshake) writeMessage1(payload []byte) ([]byte, error) {
+	if err := hs.ephemeral(); err != nil {
+		return nil, err
+	}
+	pub := hs.e.PublicKey().Bytes()
+	hs.mixHash(pub)
+	return append(pub, hs.encryptAndHash(payload)...), nil
+}
+
+// readMessage1 responder: -> e.  The payload is discarded
+func (hs *noiseHandshake) readMessage1(msg []byte) error {
+	if len(msg) < noiseKeySize {
+		return fmt.Errorf("noise: invalid handshake size")
+	}
+
+	var err error
+	if hs.re, err = ecdh.X25519().NewPublicKey(msg[:noiseKeySize]); err != nil {
+		return err
+	}
+	hs.mixHash(msg[:noiseKeySize])
+	_, err = hs.decryptAndHash(msg[noiseKeySize:])
+	return err
+}
+
+// writeMessage2 responder: <- e, ee, s, es
+func (hs *noiseHandshake) writeMessage2() ([]byte, error) {
+	err := hs.ephemeral()
+	if err != nil {
+		return nil, err
+	}
+	msg := hs.e.PublicKey().Bytes()
+	hs.mixHash(msg)
+
+	if err = hs.dh(hs.e, hs.re); err != nil {
+		return nil, err
+	}
+	msg = append(msg, hs.encryptAndHash(hs.s.PublicKey().Bytes())...)
+	if err = hs.dh(hs.s, hs.re); err != nil {
+		return nil, err
+	}
+	return append(msg, hs.encryptAndHash(nil)...), nil
+}
+
+// readMessage2 initiator: <- e, ee, s, es
+func (hs *noiseHandshake) readMessage2(msg []byte) error {
+	if len(msg) != 2*noiseKeySize+2*noiseTagSize {
+		return fmt.Errorf("noise: invalid handshake size")
+	}
+
+	var err error
+	if hs.re, err = ecdh.X25519().NewPublicKey(msg[:noiseKeySize]); err != nil {
+		return err
+	}
+	hs.mixHash(msg[:noiseKeySize])
+	if err = hs.dh(hs.e, hs.re); err != nil {
+		return err
+	}
+
+	s, err := hs.decryptAndHash(msg[noiseKeySize : 2*noiseKeySize+noiseTagSize])
+	if err != nil {
+		return err
+	}
+	if hs.rs, err = ecdh.X25519().NewPublicKey(s); err != nil {
+		return err
+	}
+	if err = hs.dh(hs.e, hs.rs); err != nil {
+		return err
+	}
+
+	_, err = hs.decryptAndHash(msg[2*noiseKeySize+noiseTagSize:])
+	return err
+}
+
+// writeMessage3 initiator: -> s, se
+func (hs *noiseHandshake) writeMessage3() ([]byte, error) {
+	msg := hs.encryptAndHash(hs.s.PublicKey().Bytes())
+	if err := hs.dh(hs.s, hs.re); err != nil {
+		return nil, err
+	}
+	return append(msg, hs.encryptAndHash(nil)...), nil
+}
+
+// readMessage3 responder: -> s, se
+func (hs *noiseHandshake) readMessage3(msg []byte) error {
+	if len(msg) != noiseKeySize+2*noiseTagSize {
+		return fmt.Errorf("noise: invalid handshake size")
+	}
+
+	s, err := hs.decryptAndHash(msg[:noiseKeySize+noiseTagSize])
+	if err != nil {
+		return err
+	}
+	if hs.rs, err = ecdh.X25519().NewPublicKey(s); err != nil {
+		return err
+	}
+	if err = hs.dh(hs.e, hs.rs); err != nil {
+		return err
+	}
+
+	_, err = hs.decryptAndHash(msg[noiseKeySize+noiseTagSize:])
+	return err
+}
+
+// noiseWindow rejects replayed counters using a sliding window
+type noiseWindow struct {
+	mu     sync.Mutex
+	max    uint64
+	bitmap uint64
+	seen   bool
+}
+
+func (w *noiseWindow) check(n uint64) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	switch {
+	case !w.seen || n > w.max:
+		shift := n - w.max
+		if !w.seen || shift >= 64 {
+			w.bitmap = 1
+		} else {
+			w.bitmap = w.bitmap<<shift | 1
+		}
+		w.max, w.seen = n, true
+		return true
+
+	case w.max-n >= 64:
+		return false
+
+	default:
+		bit := uint64(1) << (w.max - n)
+		if w.bitmap&bit != 0 {
+			return false
+		}
+		w.bitmap |= bit
+		return true
+	}
+}
+
+// noiseSession is an established session with a peer
+type noiseSession struct {
+	sid  []byte
+	send *noiseCipher
+	recv *noiseCipher
+	ctr  uint64
+
+	// Remote static key
+	remote []byte
+
+	// IP the session was established from.  Only set for the responder
+	ip string
+
+	// Received counters.  Only used by the responder
+	window noiseWindow
+
+	lastUsed int64
+}
+
+func (sess *noiseSession) touch() {
+	atomic.StoreInt64(&sess.lastUsed, time.Now().UnixNano())
+}
+
+// seal encrypts the payload with the next counter.  The additional data binds
+// a response to the counter of the request
+func (sess *noiseSession) seal(pt []byte, ad uint64) ([]byte, uint64) {
+	n := atomic.AddUint64(&sess.ctr, 1)
+
+	out := make([]byte, noiseDataHdr, noiseDataHdr+len(pt)+noiseTagSize)
+	out[0] = noiseTypeData
+	copy(out[1:], sess.sid)
+	binary.BigEndian.PutUint64(out[1+noiseSIDSize:], n)
+	return sess.send.seal(out, n, noiseAD(ad), pt), n
+}
+
+func (sess *noiseSession) open(b []byte, ad uint64) ([]byte, uint64, error) {
+	if len(b) < noiseDataHdr+noiseTagSize {
+		return nil, 0, fmt.Errorf("noise: size too small")
+	}
+	n := binary.BigEndian.Uint64(b[1+noiseSIDSize:])
+	pt, err := sess.recv.open(n, noiseAD(ad), b[noiseDataHdr:])
+	if err != nil {
+		return nil, 0, fmt.Errorf("noise: decryption failed")
+	}
+	return pt, n, nil
+}
+
+func noiseAD(n uint64) []byte {
+	ad := make([]byte, 8)
+	binary.BigEndian.PutUint64(ad, n)
+	return ad
+}
+
+// pendingHandshake is a responder handshake waiting for the third message from
+// the ip that started it.  The port is not compared as requests are sent over
+// multiple sockets
+type pendingHandshake struct {
+	hs      *noiseHandshake
+	ip      string
+	created time.Time
+}
+
+// noiseDial is a handshake with a host shared by concurrent requests
+type noiseDial struct {
+	done chan struct{}
+	sess *noiseSession
+	err  error
+}
+
+// noiseLayer encrypts all requests and responses of a UDPTransport.  Sessions
+// are established with a Noise XX handshake and cached per peer
+type noiseLayer struct {
+	static  *ecdh.PrivateKey
+	trusted [][]byte
+
+	mu sync.Mutex
+	// Initiator sessions and handshakes in progress by host
+	peers map[string]*noiseSession
+	dials map[string]*noiseDial
+	// Responder sessions and handshakes by session id
+	sessions map[string]*noiseSession
+	pending  map[string]*pendingHandshake
+}
+
+func newNoiseLayer(conf *NoiseConfig) (*noiseLayer, error) {
+	if conf == nil || conf.StaticKey == nil {
+		return nil, fmt.Errorf("static key required")
+	}
+	if conf.StaticKey.Curve() != ecdh.X25519() {
+		return nil, fmt.Errorf("static key must be X25519")
+	}
+
+	return &noiseLayer{
+		static:   conf.StaticKey,
+		trusted:  conf.TrustedKeys,
+		peers:    make(map[string]*noiseSession),
+		dials:    make(map[string]*noiseDial),
+		sessions: make(map[string]*noiseSession),
+		pending:  make(map[string]*pendingHandshake),
+	}, nil
+}
+
+// verifyPeer checks the remote static key is trusted
+func (nl *noiseLayer) verifyPeer(key []byte) error {
+	if len(nl.trusted) == 0 {
+		return nil
+	}
+	for _, k := range nl.trusted {
+		if bytes.Equal(k, key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("noise: untrusted peer key: %x", key)
+}
+
+// roundTrip encrypts the request with the session for the host returning the
+// decrypted response.  A new session is established if the peer does not know
+// the cached one
+func (nl *noiseLayer) roundTrip(trans *UDPTransport, host string, req []byte) ([]byte, error) {
+	for attempt := 0; ; attempt++ {
+		sess, err := nl.session(trans, host)
+		if err != nil {
+			return nil, err
+		}
+
+		pkt, n := sess.seal(req, 0)
+		resp, err := trans.roundTrip(host, pkt)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(resp) > 0 && resp[0] == noiseTypeUnknownSession && attempt == 0 {
+			nl.dropPeer(host, sess)
+			continue
+		}
+		if len(resp) < 1 || resp[0] != noiseTypeData {
+			return nil, fmt.Errorf("noise: invalid response")
+		}
+
+		pt, _, err := sess.open(resp, n)
+		return pt, err
+	}
+}
+
+func (nl *noiseLayer) dropPeer(host string, sess *noiseSession) {
+	nl.mu.Lock()
+	if nl.peers[host] == sess {
+		delete(nl.peers, host)
+	}
+	nl.mu.Unlock()
+}
+
+// session returns the cached session for the host or performs a handshake.
+// Concurrent callers wait for a single handshake with the host
+func (nl *noiseLayer) session(trans *UDPTransport, host string) (*noiseSession, error) {
+	nl.mu.Lock()
+	if sess, ok := nl.peers[host]; ok {
+		nl.mu.Unlock()
+		return sess, nil
+	}
+	if d, ok := nl.dials[host]; ok {
+		nl.mu.Unlock()
+		<-d.done
+		return d.sess, d.err
+	}
+	d := &noiseDial{done: make(chan struct{})}
+	nl.dials[host] = d
+	nl.mu.Unlock()
+
+	d.sess, d.err = nl.handshake(trans, host)
+
+	nl.mu.Lock()
+	delete(nl.dials, host)
+	if d.err == nil {
+		nl.peers[host] = d.sess
+	}
+	nl.mu.Unlock()
+	close(d.done)
+
+	return d.sess, d.err
+}
+
+// handshake performs a handshake with the host as the initiator returning the
+// established session
+func (nl *noiseLayer) handshake(trans *UDPTransport, host string) (*noiseSession, error) {
+	// The responder fills in the second half of the session id
+	sid := make([]byte, noiseSIDSize)
+	if _, err := rand.Read(sid[:noiseSIDHalf]); err != nil {
+		return nil, err
+	}
+
+	hs := newNoiseHandshake(nl.static)
+	msg, err := hs.writeMessage1(make([]byte, noiseMsg1Size-noiseKeySize))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := trans.roundTrip(host, noisePacket(noiseTypeHandshake1, sid, msg))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1+noiseSIDSize || resp[0] != noiseTypeHandshake2 || !bytes.Equal(resp[1:1+noiseSIDHalf], sid[:noiseSIDHalf]) {
+		return nil, fmt.Errorf("noise: invalid handshake response")
+	}
+	copy(sid, resp[1:1+noiseSIDSize])
+	if err = hs.readMessage2(resp[1+noiseSIDSize:]); err != nil {
+		return nil, err
+	}
+
+	remote := hs.rs.Bytes()
+	if err = nl.verifyPeer(remote); err != nil {
+		return nil, err
+	}
+
+	if msg, err = hs.writeMessage3(); err != nil {
+		return nil, err
+	}
+
+	send, recv, err := hs.split()
+	if err != nil {
+		return nil, err
+	}
+	sess := &noiseSession{sid: sid, send: send, recv: recv, remote: remote}
+
+	resp, err = trans.roundTrip(host, noisePacket(noiseTypeHandshake3, sid, msg))
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 1 || resp[0] != noiseTypeData {
+		return nil, fmt.Errorf("noise: handshake rejected")
+	}
+	if _, _, err = sess.open(resp, 0); err != nil {
+		return nil, err
+	}
+
+	return sess, nil
+}
+
+func noisePacket(typ byte, sid []byte, msg []byte) []byte {
+	out := make([]byte, 0, 1+len(sid)+len(msg))
+	out = append(append(append(out, typ), sid...), msg...)
+	return out
+}
+
+// handle processes a packet received by the listener.  Handshake packets are
+// answered directly with the request id and nil is returned.  Data packets are decrypted returning
+// the request along with the session and counter needed to encrypt the
+// response
+func (nl *noiseLayer) handle(conn *net.UDPConn, remote *net.UDPAddr, id []byte, b []byte) ([]byte, *noiseSession, uint64, error) {
+	if len(b) < 1+noiseSIDSize {
+		return nil, nil, 0, fmt.Errorf("noise: size too small")
+	}
+	typ, sid, msg := b[0], string(b[1:1+noiseSIDSize]), b[1+noiseSIDSize:]
+
+	switch typ {
+	case noiseTypeHandshake1:
+		if len(msg) < noiseMsg1Size {
+			return nil, nil, 0, fmt.Errorf("noise: handshake not padded")
+		}
+		hs := newNoiseHandshake(nl.static)
+		if err := hs.readMessage1(msg); err != nil {
+			return nil, nil, 0, err
+		}
+		resp, err := hs.writeMessage2()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+
+		nl.mu.Lock()
+		nl.prune()
+		if len(nl.pending) >= noiseMaxPeers {
+			nl.mu.Unlock()
+			return nil, nil, 0, fmt.Errorf("noise: too many pending handshakes")
+		}
+		if sid, err = nl.newSID(sid[:noiseSIDHalf]); err != nil {
+			nl.mu.Unlock()
+			return nil, nil, 0, err
+		}
+		nl.pending[sid] = &pendingHandshake{hs: hs, ip: remote.IP.String(), created: time.Now()}
+		nl.mu.Unlock()
+
+		nl.write(conn, remote, id, noisePacket(noiseTypeHandshake2, []byte(sid), resp))
+		return nil, nil, 0, nil
+
+	case noiseTypeHandshake3:
+		// Only the ip that started the handshake may complete it
+		ip := remote.IP.String()
+		nl.mu.Lock()
+		p, ok := nl.pending[sid]
+		if ok = ok && p.ip == ip; ok {
+			delete(nl.pending, sid)
+		}
+		nl.mu.Unlock()
+		if !ok {
+			return nil, nil, 0, fmt.Errorf("noise: unknown handshake")
+		}
+
+		hs := p.hs
+		if err := hs.readMessage3(msg); err != nil {
+			return nil, nil, 0, err
+		}
+		remoteKey := hs.rs.Bytes()
+		if err := nl.verifyPeer(remoteKey); err != nil {
+			return nil, nil, 0, err
+		}
+
+		recv, send, err := hs.split()
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		sess := &noiseSession{
+			sid:    []byte(sid),
+			send:   send,
+			recv:   recv,
+			remote: remoteKey,
+			ip:     ip,
+		}
+		sess.touch()
+
+		nl.mu.Lock()
+		nl.establish(sess)
+		nl.mu.Unlock()
+
+		// Acknowledge with an empty encrypted payload
+		pkt, _ := sess.seal(nil, 0)
+		nl.write(conn, remote, id, pkt)
+		return nil, nil, 0, nil
+
+	case noiseTypeData:
+		nl.mu.Lock()
+		sess, ok := nl.sessions[sid]
+		nl.mu.Unlock()
+		if !ok {
+			nl.write(conn, remote, id, noisePacket(noiseTypeUnknownSession, []byte(sid), nil))
+			return nil, nil, 0, fmt.Errorf("noise: unknown session")
+		}
+
+		pt, n, err := sess.open(b, 0)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		if !sess.window.check(n) {
+			return nil, nil, 0, fmt.Errorf("noise: replayed packet")
+		}
+		sess.touch()
+		return pt, sess, n, nil
+	}
+
+	return nil, nil, 0, fmt.Errorf("noise: unknown packet type: %x", typ)
+}
+
+// newSID returns an unused session id made of the initiator half and a random
+// responder half so an initiator cannot choose the id of another session.  The
+// lock must be held
+func (nl *noiseLayer) newSID(initiator string) (string, error) {
+	sid := make([]byte, noiseSIDSize)
+	copy(sid, initiator)
+	for {
+		if _, err := rand.Read(sid[noiseSIDHalf:]); err != nil {
+			return "", err
+		}
+		_, pending := nl.pending[string(sid)]
+		_, established := nl.sessions[string(sid)]
+		if !pending && !established {
+			return string(sid), nil
+		}
+	}
+}
+
+// establish adds a completed responder session.  If the ip has too many
+// sessions its least recently used one is evicted, otherwise the least recently
+// used session overall is evicted once the cache is full.  Sessions of other ips
+// can therefore only be evicted by completing handshakes from many ips.  The
+// lock must be held
+func (nl *noiseLayer) establish(sess *noiseSession) {
+	var (
+		n      int
+		oldest string
+		last   int64
+	)
+	for sid, s := range nl.sessions {
+		if s.ip != sess.ip {
+			continue
+		}
+		n++
+		if used := atomic.LoadInt64(&s.lastUsed); oldest == "" || used < last {
+			oldest, last = sid, used
+		}
+	}
+
+	if n >= noiseMaxIPSessions {
+		delete(nl.sessions, oldest)
+	} else if len(nl.sessions) >= noiseMaxPeers {
+		nl.prune()
+		if len(nl.sessions) >= noiseMaxPeers {
+			nl.evict()
+		}
+	}
+	nl.sessions[string(sess.sid)] = sess
+}
+
+// prune removes idle sessions and stale handshakes.  The lock must be held
+func (nl *noiseLayer) prune() {
+	now := time.Now()
+	for sid, p := range nl.pending {
+		if now.Sub(p.created) > reqTimeout {
+			delete(nl.pending, sid)
+		}
+	}
+
+	idle := now.Add(-noiseMaxIdle).UnixNano()
+	for sid, sess := range nl.sessions {
+		if atomic.LoadInt64(&sess.lastUsed) < idle {
+			delete(nl.sessions, sid)
+		}
+	}
+}
+
+// evict removes the least recently used session.  Its peer establishes a new
+// session on its next request.  The lock must be held
+func (nl *noiseLayer) evict() {
+	var (
+		oldest string
+		last   int64
+	)
+	for sid, sess := range nl.sessions {
+		if used := atomic.LoadInt64(&sess.lastUsed); oldest == "" || used < last {
+			oldest, last = sid, used
+		}
+	}
+	delete(nl.sessions, oldest)
+}
+
+func (nl *noiseLayer) write(conn *net.UDPConn, remote *net.UDPAddr, id []byte, b []byte) {
+	if _, err := conn.WriteToUDP(framePacket(id, b), remote); err != nil {
+		log.Println("[ERROR] Failed to write handshake:", err)
+	}
+}
@@ -0,0 +1,427 @@
+package kelips
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func newNoiseTestTransport(addr string, conf *NoiseConfig) *UDPTransport {
+	trans := newBareTrans(addr)
+	if err := trans.SetEncryption(conf); err != nil {
+		panic(err)
+	}
+	trans.Register(&MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)})
+	return trans
+}
+
+func testNoiseKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := GenerateNoiseKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_noiseHandshake(t *testing.T) {
+	is, rs := testNoiseKey(t), testNoiseKey(t)
+	init, resp := newNoiseHandshake(is), newNoiseHandshake(rs)
+
+	msg, err := init.writeMessage1(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = resp.readMessage1(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = resp.writeMessage2(); err != nil {
+		t.Fatal(err)
+	}
+	if err = init.readMessage2(msg); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = init.writeMessage3(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tampered message is rejected
+	bad := append([]byte{}, msg...)
+	bad[0] ^= 0xff
+	copyHS := *resp
+	if err = copyHS.readMessage3(bad); err == nil {
+		t.Fatal("should fail with tampered message")
+	}
+
+	if err = resp.readMessage3(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(init.h, resp.h) {
+		t.Fatal("handshake hashes should match")
+	}
+	if !bytes.Equal(init.rs.Bytes(), rs.PublicKey().Bytes()) || !bytes.Equal(resp.rs.Bytes(), is.PublicKey().Bytes()) {
+		t.Fatal("static keys should be exchanged")
+	}
+
+	isend, irecv, _ := init.split()
+	rrecv, rsend, _ := resp.split()
+	ct := isend.seal(nil, 1, nil, []byte("hello"))
+	if pt, err := rrecv.open(1, nil, ct); err != nil || string(pt) != "hello" {
+		t.Fatal("should decrypt", err)
+	}
+	ct = rsend.seal(nil, 1, nil, []byte("world"))
+	if pt, err := irecv.open(1, nil, ct); err != nil || string(pt) != "world" {
+		t.Fatal("should decrypt", err)
+	}
+}
+
+// Noise_XX_25519_AESGCM_SHA256 vector with an empty prologue and handshake
+// payloads from the Noise test vectors shipped with github.com/flynn/noise
+var noiseXXVector = struct {
+	initStatic, respStatic, initEphemeral, respEphemeral string
+	handshake                                            [3]string
+	payloads, ciphertexts                                [2]string
+}{
+	initStatic:    "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+	respStatic:    "0102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f20",
+	initEphemeral: "202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f",
+	respEphemeral: "4142434445464748494a4b4c4d4e4f505152535455565758595a5b5c5d5e5f60",
+	handshake: [3]string{
+		"358072d6365880d1aeea329adf9121383851ed21a28e3b75e965d0d2cd166254",
+		"64b101b1d0be5a8704bd078f9895001fc03e8e9f9522f188dd128d9846d484665393019dbd6f438795da206db0886610b26108e424142c2e9b5fd1f7ea70cde8767ce62d7e3c0e9bcefe4ab872c0505b9e824df091b74ffe10a2b32809cab21f",
+		"e610eadc4b00c17708bf223f29a66f02342fbedf6c0044736544b9271821ae40e70144cecd9d265dffdc5bb8e051c3f83db32a425e04d8f510c58a43325fbc56",
+	},
+	payloads: [2]string{"79656c6c6f777375626d6172696e65", "7375626d6172696e6579656c6c6f77"},
+	ciphertexts: [2]string{
+		"9ea1da1ec3bfecfffab213e537ed1791bfa887dd9c631351b3f63d6315ab9a",
+		"217c5111fad7afde33bd28abaff3def88a57ab50515115d23a10f28621f842",
+	},
+}
+
+func testNoiseVectorKey(t *testing.T, s string) *ecdh.PrivateKey {
+	b, _ := hex.DecodeString(s)
+	key, err := ecdh.X25519().NewPrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func Test_noiseHandshake_vector(t *testing.T) {
+	v := noiseXXVector
+	init := initNoiseHandshake(testNoiseVectorKey(t, v.initStatic), nil)
+	resp := initNoiseHandshake(testNoiseVectorKey(t, v.respStatic), nil)
+	init.e = testNoiseVectorKey(t, v.initEphemeral)
+	resp.e = testNoiseVectorKey(t, v.respEphemeral)
+
+	check := func(i int, msg []byte, err error) {
+		if err != nil {
+			t.Fatal(i, err)
+		}
+		if hex.EncodeToString(msg) != v.handshake[i] {
+			t.Fatalf("message %d mismatch: %x", i, msg)
+		}
+	}
+
+	msg, err := init.writeMessage1(nil)
+	check(0, msg, err)
+	if err = resp.readMessage1(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = resp.writeMessage2()
+	check(1, msg, err)
+	if err = init.readMessage2(msg); err != nil {
+		t.Fatal(err)
+	}
+	msg, err = init.writeMessage3()
+	check(2, msg, err)
+	if err = resp.readMessage3(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	// Transport messages with the first counter and no additional data
+	isend, _, err := init.split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, rsend, err := resp.split()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range []*noiseCipher{isend, rsend} {
+		pt, _ := hex.DecodeString(v.payloads[i])
+		if ct := hex.EncodeToString(c.seal(nil, 0, nil, pt)); ct != v.ciphertexts[i] {
+			t.Fatalf("transport message %d mismatch: %s", i, ct)
+		}
+	}
+}
+
+func Test_noiseWindow(t *testing.T) {
+	var w noiseWindow
+	for _, n := range []uint64{1, 3, 2, 100, 40} {
+		if !w.check(n) {
+			t.Fatalf("should accept %d", n)
+		}
+	}
+	for _, n := range []uint64{1, 3, 100, 36} {
+		if w.check(n) {
+			t.Fatalf("should reject %d", n)
+		}
+	}
+	if !w.check(99) {
+		t.Fatal("should accept 99")
+	}
+}
+
+func Test_UDPTransport_Noise(t *testing.T) {
+	serverKey, clientKey := testNoiseKey(t), testNoiseKey(t)
+	server := newNoiseTestTransport("127.0.0.1:54671", &NoiseConfig{
+		StaticKey:   serverKey,
+		TrustedKeys: [][]byte{clientKey.PublicKey().Bytes()},
+	})
+
+	client, err := NewEncryptedUDPTransport(nil, &NoiseConfig{
+		StaticKey:   clientKey,
+		TrustedKeys: [][]byte{serverKey.PublicKey().Bytes()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tuple := NewTupleHost("127.0.0.1:54671")
+	for i := 0; i < 5; i++ {
+		if err = client.Insert("127.0.0.1:54671", []byte(fmt.Sprintf("key%d", i)), tuple, "", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if nodes, err := client.Lookup("127.0.0.1:54671", []byte("key0")); err != nil || len(nodes) == 0 {
+		t.Fatal("should have nodes", err)
+	}
+	server.noise.mu.Lock()
+	sessions := len(server.noise.sessions)
+	server.noise.mu.Unlock()
+	if len(client.noise.peers) != 1 || sessions != 1 {
+		t.Fatal("session should be reused")
+	}
+
+	// Server lost its sessions
+	server.noise.mu.Lock()
+	server.noise.sessions = make(map[string]*noiseSession)
+	server.noise.mu.Unlock()
+	if _, err = client.Lookup("127.0.0.1:54671", []byte("key0")); err != nil {
+		t.Fatal("should re-establish session", err)
+	}
+
+	// A full session cache evicts the least recently used session
+	server.noise.mu.Lock()
+	for i := len(server.noise.sessions); i < noiseMaxPeers; i++ {
+		sid := fmt.Sprintf("%08d", i)
+		server.noise.sessions[sid] = &noiseSession{sid: []byte(sid), lastUsed: time.Now().UnixNano()}
+	}
+	server.noise.sessions["00000001"].lastUsed = time.Now().Add(-time.Minute).UnixNano()
+	server.noise.mu.Unlock()
+
+	fresh, _ := NewEncryptedUDPTransport(nil, &NoiseConfig{StaticKey: clientKey})
+	if _, err = fresh.Lookup("127.0.0.1:54671", []byte("key0")); err != nil {
+		t.Fatal(err)
+	}
+	server.noise.mu.Lock()
+	_, ok := server.noise.sessions["00000001"]
+	sessions = len(server.noise.sessions)
+	server.noise.mu.Unlock()
+	if ok || sessions > noiseMaxPeers {
+		t.Fatal("session cache should stay bounded", sessions)
+	}
+
+	// Plaintext requests are rejected
+	plain := NewUDPTransport(nil)
+	if err = plain.Insert("127.0.0.1:54671", []byte("key"), tuple, "", false); err == nil {
+		t.Fatal("should fail without encryption")
+	}
+
+	// Untrusted key
+	untrusted, _ := NewEncryptedUDPTransport(nil, &NoiseConfig{StaticKey: testNoiseKey(t)})
+	if err = untrusted.Insert("127.0.0.1:54671", []byte("key"), tuple, "", false); err == nil {
+		t.Fatal("should fail with untrusted key")
+	}
+
+	// Client rejects an unexpected server key
+	other, _ := NewEncryptedUDPTransport(nil, &NoiseConfig{
+		StaticKey:   clientKey,
+		TrustedKeys: [][]byte{clientKey.PublicKey().Bytes()},
+	})
+	if err = other.Insert("127.0.0.1:54671", []byte("key"), tuple, "", false); err == nil {
+		t.Fatal("should fail with untrusted server key")
+	}
+
+	// Replayed data packet is dropped
+	sess := client.noise.peers["127.0.0.1:54671"]
+	pkt, _ := sess.seal(client.request(reqTypeLookup, []byte("key0")), 0)
+	conn, _ := net.Dial("udp4", "127.0.0.1:54671")
+	defer conn.Close()
+
+	buf := make([]byte, maxUDPBufSize)
+	for i := 0; i < 2; i++ {
+		conn.Write(framePacket([]byte{0, 0, 0, 1}, pkt))
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		_, err = conn.Read(buf)
+		if i == 0 && err != nil {
+			t.Fatal(err)
+		}
+		if i == 1 && err == nil {
+			t.Fatal("replayed packet should be dropped")
+		}
+	}
+
+	if _, err = NewEncryptedUDPTransport(nil, &NoiseConfig{}); err == nil {
+		t.Fatal("should fail without static key")
+	}
+}
+
+// noiseExchange writes the packet returning the response or nil if there is
+// none
+func noiseExchange(conn net.Conn, pkt []byte) []byte {
+	conn.Write(framePacket([]byte{0, 0, 0, 1}, pkt))
+	conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+
+	buf := make([]byte, maxUDPBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil
+	}
+	return buf[requestIDSize:n]
+}
+
+func Test_UDPTransport_Noise_sessions(t *testing.T) {
+	host := "127.0.0.1:54674"
+	server := newNoiseTestTransport(host, &NoiseConfig{StaticKey: testNoiseKey(t)})
+	client, _ := NewEncryptedUDPTransport(nil, &NoiseConfig{StaticKey: testNoiseKey(t)})
+	tuple := NewTupleHost(host)
+
+	sessions := func() map[string]*noiseSession {
+		server.noise.mu.Lock()
+		defer server.noise.mu.Unlock()
+		out := make(map[string]*noiseSession, len(server.noise.sessions))
+		for sid, sess := range server.noise.sessions {
+			out[sid] = sess
+		}
+		return out
+	}
+
+	// Concurrent requests share a single handshake
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := client.Insert(host, []byte("key"), tuple, "", false); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(sessions()); n != 1 {
+		t.Fatal("should have a single session", n)
+	}
+
+	conn, _ := net.Dial("udp4", host)
+	defer conn.Close()
+	other, _ := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 54674})
+	defer other.Close()
+
+	// The responder chooses half of the session id so the id of another
+	// session cannot be taken over
+	sid := client.noise.peers[host].sid
+	hs := newNoiseHandshake(testNoiseKey(t))
+	msg, _ := hs.writeMessage1(make([]byte, noiseMsg1Size-noiseKeySize))
+	resp := noiseExchange(conn, noisePacket(noiseTypeHandshake1, sid, msg))
+	if len(resp) < 1+noiseSIDSize || resp[0] != noiseTypeHandshake2 {
+		t.Fatal("should respond to handshake")
+	}
+	psid := resp[1 : 1+noiseSIDSize]
+	if !bytes.Equal(psid[:noiseSIDHalf], sid[:noiseSIDHalf]) || bytes.Equal(psid, sid) {
+		t.Fatalf("session id should be new %x", psid)
+	}
+	if len(resp) > 1+noiseSIDSize+len(msg) {
+		t.Fatal("handshake response larger than request", len(resp))
+	}
+
+	// Unpadded handshakes are not answered
+	short, _ := newNoiseHandshake(testNoiseKey(t)).writeMessage1(nil)
+	if noiseExchange(conn, noisePacket(noiseTypeHandshake1, sid, short)) != nil {
+		t.Fatal("unpadded handshake should be dropped")
+	}
+
+	// Only the ip that started the handshake may complete it
+	if err := hs.readMessage2(resp[1+noiseSIDSize:]); err != nil {
+		t.Fatal(err)
+	}
+	msg, _ = hs.writeMessage3()
+	if noiseExchange(other, noisePacket(noiseTypeHandshake3, psid, msg)) != nil {
+		t.Fatal("handshake completed from another ip")
+	}
+	if resp = noiseExchange(conn, noisePacket(noiseTypeHandshake3, psid, msg)); len(resp) < 1 || resp[0] != noiseTypeData {
+		t.Fatal("handshake should complete")
+	}
+	if s := sessions(); len(s) != 2 || s[string(sid)] == nil {
+		t.Fatal("existing session should be kept", len(s))
+	}
+
+	// Sessions of an ip are bounded evicting its least recently used one
+	server.noise.mu.Lock()
+	for i := len(server.noise.sessions); i < noiseMaxIPSessions; i++ {
+		id := fmt.Sprintf("%08d", i)
+		server.noise.sessions[id] = &noiseSession{sid: []byte(id), ip: "127.0.0.1", lastUsed: time.Now().UnixNano()}
+	}
+	server.noise.sessions["00000002"].lastUsed = 1
+	server.noise.mu.Unlock()
+
+	hs = newNoiseHandshake(testNoiseKey(t))
+	msg, _ = hs.writeMessage1(make([]byte, noiseMsg1Size-noiseKeySize))
+	resp = noiseExchange(conn, noisePacket(noiseTypeHandshake1, make([]byte, noiseSIDSize), msg))
+	hs.readMessage2(resp[1+noiseSIDSize:])
+	msg, _ = hs.writeMessage3()
+	noiseExchange(conn, noisePacket(noiseTypeHandshake3, resp[1:1+noiseSIDSize], msg))
+
+	s := sessions()
+	if _, ok := s["00000002"]; ok || len(s) != noiseMaxIPSessions {
+		t.Fatal("least recently used session of the ip should be evicted", len(s))
+	}
+}
+
+func Test_Kelips_Noise(t *testing.T) {
+	keys := []*ecdh.PrivateKey{testNoiseKey(t), testNoiseKey(t)}
+	trusted := [][]byte{keys[0].PublicKey().Bytes(), keys[1].PublicKey().Bytes()}
+
+	var nodes []*Kelips
+	for i, port := range []int{54672, 54673} {
+		conf := fastTestConf(fmt.Sprintf("127.0.0.1:%d", port))
+		trans := newBareTrans(conf.AdvertiseHost)
+		trans.SetEncryption(&NoiseConfig{StaticKey: keys[i], TrustedKeys: trusted})
+
+		k, err := Create(conf, trans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, k)
+	}
+
+	if err := nodes[1].Join([]string{"127.0.0.1:54672"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].Insert([]byte("key"), NewTupleHost("127.0.0.1:54673")); err != nil {
+		t.Fatal(err)
+	}
+	<-time.After(200 * time.Millisecond)
+
+	for _, k := range nodes {
+		if _, err := k.Lookup([]byte("key")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package kelips
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/big"
+	"sort"
+)
+
+// Partitioner maps hash ids to affinity group indexes.  All nodes in a cluster
+// must use the same partitioner
+type Partitioner interface {
+	// Partition returns the group index in the range [0, Groups()) for the id
+	Partition(id []byte) int
+
+	// Groups returns the number of groups
+	Groups() int
+}
+
+// PartitionerFunc returns a Partitioner for k groups and the hash size in bytes
+type PartitionerFunc func(k, hashSize int) Partitioner
+
+// groupIDs divides the keyspace of the hash size into k equal ranges returning
+// the fixed width start id of each range
+func groupIDs(k, hashSize int) [][]byte {
+	// Calculate the size of the keyspace
+	var keyspace big.Int
+	keyspace.Exp(big.NewInt(2), big.NewInt(int64(hashSize)*8), nil)
+	// Size of each group given the keyspace
+	groupSize := new(big.Int).Div(&keyspace, big.NewInt(int64(k)))
+
+	ids := make([][]byte, k)
+	for i := range ids {
+		gi := new(big.Int).Mul(big.NewInt(int64(i)), groupSize).Bytes()
+		// Left pad to the hash size
+		ids[i] = make([]byte, hashSize)
+		copy(ids[i][hashSize-len(gi):], gi)
+	}
+	return ids
+}
+
+// idUint64 returns the first 8 bytes of the id as an integer left aligning ids
+// shorter than 8 bytes
+func idUint64(id []byte) uint64 {
+	if len(id) >= 8 {
+		return binary.BigEndian.Uint64(id)
+	}
+	b := make([]byte, 8)
+	copy(b, id)
+	return binary.BigEndian.Uint64(b)
+}
+
+// RangePartitioner divides the hash keyspace into k contiguous equal sized
+// ranges.  This is the default partitioner
+type RangePartitioner struct {
+	ids [][]byte
+}
+
+// NewRangePartitioner returns a RangePartitioner for k groups
+func NewRangePartitioner(k, hashSize int) Partitioner {
+	return &RangePartitioner{ids: groupIDs(k, hashSize)}
+}
+
+// Partition returns the index of the range the id falls in
+func (p *RangePartitioner) Partition(id []byte) int {
+	// First range starting after the id
+	i := sort.Search(len(p.ids), func(i int) bool {
+		return bytes.Compare(p.ids[i], id) > 0
+	})
+	if i == 0 {
+		return 0
+	}
+	return i - 1
+}
+
+// Groups returns the number of groups
+func (p *RangePartitioner) Groups() int {
+	return len(p.ids)
+}
+
+// ModPartitioner assigns the group based on the modulo of the leading 8 bytes
+// of the id
+type ModPartitioner struct {
+	k uint64
+}
+
+// NewModPartitioner returns a ModPartitioner for k groups
+func NewModPartitioner(k, hashSize int) Partitioner {
+	return &ModPartitioner{k: uint64(k)}
+}
+
+// Partition returns the group index for the id
+func (p *ModPartitioner) Partition(id []byte) int {
+	return int(idUint64(id) % p.k)
+}
+
+// Groups returns the number of groups
+func (p *ModPartitioner) Groups() int {
+	return int(p.k)
+}
+
+// JumpPartitioner uses jump consistent hashing on the leading 8 bytes of the id.
+// Changing the number of groups moves the minimal number of ids
+type JumpPartitioner struct {
+	k int
+}
+
+// NewJumpPartitioner returns a JumpPartitioner for k groups
+func NewJumpPartitioner(k, hashSize int) Partitioner {
+	return &JumpPartitioner{k: k}
+}
+
+// Partition returns the group index for the id
+func (p *JumpPartitioner) Partition(id []byte) int {
+	key := idUint64(id)
+
+	var b, j int64 = -1, 0
+	for j < int64(p.k) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// Groups returns the number of groups
+func (p *JumpPartitioner) Groups() int {
+	return p.k
+}
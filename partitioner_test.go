@@ -0,0 +1,189 @@
+package kelips
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"testing"
+	"testing/quick"
+)
+
+var (
+	testPartitionKs        = []int{1, 2, 3, 7, 16, 100, 257, 1000}
+	testPartitionHashSizes = []int{8, 16, 20, 32, 64}
+	testPartitioners       = map[string]PartitionerFunc{
+		"range": NewRangePartitioner,
+		"mod":   NewModPartitioner,
+		"jump":  NewJumpPartitioner,
+	}
+)
+
+func testRandID(r *rand.Rand, size int) []byte {
+	id := make([]byte, size)
+	r.Read(id)
+	return id
+}
+
+func Test_groupIDs(t *testing.T) {
+	for _, hs := range testPartitionHashSizes {
+		for _, k := range testPartitionKs {
+			ids := groupIDs(k, hs)
+			if len(ids) != k {
+				t.Fatalf("k=%d hs=%d: wrong group count %d", k, hs, len(ids))
+			}
+			for i, id := range ids {
+				if len(id) != hs {
+					t.Fatalf("k=%d hs=%d: group=%d not fixed width %d", k, hs, i, len(id))
+				}
+				if i > 0 && bytes.Compare(ids[i-1], id) >= 0 {
+					t.Fatalf("k=%d hs=%d: group=%d not ordered", k, hs, i)
+				}
+			}
+		}
+	}
+}
+
+func Test_Partitioner_inRange(t *testing.T) {
+	for name, pf := range testPartitioners {
+		for _, hs := range testPartitionHashSizes {
+			for _, k := range testPartitionKs {
+				p := pf(k, hs)
+				if p.Groups() != k {
+					t.Fatalf("%s k=%d: wrong groups %d", name, k, p.Groups())
+				}
+
+				prop := func(seed int64) bool {
+					id := testRandID(rand.New(rand.NewSource(seed)), hs)
+					i := p.Partition(id)
+					return i >= 0 && i < k && p.Partition(id) == i
+				}
+				if err := quick.Check(prop, nil); err != nil {
+					t.Fatalf("%s k=%d hs=%d: %v", name, k, hs, err)
+				}
+			}
+		}
+	}
+}
+
+func Test_RangePartitioner_boundaries(t *testing.T) {
+	for _, hs := range testPartitionHashSizes {
+		for _, k := range testPartitionKs {
+			p := NewRangePartitioner(k, hs)
+			ids := groupIDs(k, hs)
+
+			min := make([]byte, hs)
+			max := bytes.Repeat([]byte{0xff}, hs)
+			if p.Partition(min) != 0 {
+				t.Fatalf("k=%d hs=%d: min id not in first group", k, hs)
+			}
+			if p.Partition(max) != k-1 {
+				t.Fatalf("k=%d hs=%d: max id not in last group", k, hs)
+			}
+
+			for i := 1; i < k; i++ {
+				if p.Partition(ids[i]) != i {
+					t.Fatalf("k=%d hs=%d: group start %d maps to %d", k, hs, i, p.Partition(ids[i]))
+				}
+				if p.Partition(testPrevID(ids[i])) != i-1 {
+					t.Fatalf("k=%d hs=%d: id before group %d not in previous group", k, hs, i)
+				}
+			}
+
+			// Ordered ids map to non-decreasing groups
+			prop := func(a, b uint64) bool {
+				x, y := testIDFromUint(a, hs), testIDFromUint(b, hs)
+				if bytes.Compare(x, y) > 0 {
+					x, y = y, x
+				}
+				return p.Partition(x) <= p.Partition(y)
+			}
+			if err := quick.Check(prop, nil); err != nil {
+				t.Fatalf("k=%d hs=%d: %v", k, hs, err)
+			}
+		}
+	}
+}
+
+func Test_Partitioner_uniform(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for name, pf := range testPartitioners {
+		for _, hs := range []int{20, 32} {
+			for _, k := range testPartitionKs {
+				p := pf(k, hs)
+				n := 500 * k
+				counts := make([]int, k)
+				for i := 0; i < n; i++ {
+					counts[p.Partition(testRandID(r, hs))]++
+				}
+
+				// Allow 6 standard deviations from the expected count
+				exp := float64(n) / float64(k)
+				dev := 6 * math.Sqrt(exp*(1-1/float64(k)))
+				for i, c := range counts {
+					if math.Abs(float64(c)-exp) > dev+1 {
+						t.Fatalf("%s k=%d hs=%d: group=%d count=%d expected=%.0f", name, k, hs, i, c, exp)
+					}
+				}
+			}
+		}
+	}
+}
+
+func Test_JumpPartitioner_minimalMovement(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	p1 := NewJumpPartitioner(10, 32)
+	p2 := NewJumpPartitioner(11, 32)
+
+	var moved int
+	for i := 0; i < 10000; i++ {
+		id := testRandID(r, 32)
+		a, b := p1.Partition(id), p2.Partition(id)
+		if a != b {
+			if b != 10 {
+				t.Fatal("id should only move to the new group", a, b)
+			}
+			moved++
+		}
+	}
+	// Expect ~1/11 of ids to move
+	if moved < 600 || moved > 1200 {
+		t.Fatal("unexpected number of moved ids", moved)
+	}
+}
+
+func Test_affinityGroups_get(t *testing.T) {
+	groups := genAffinityGroups(4, 32, nil)
+	for i, g := range groups.list {
+		if g.index != i || groups.get(g.id) != g {
+			t.Fatal("wrong group", i)
+		}
+	}
+
+	groups = genAffinityGroups(4, 32, NewModPartitioner)
+	if _, ok := groups.part.(*ModPartitioner); !ok {
+		t.Fatal("should use the supplied partitioner")
+	}
+}
+
+// testPrevID returns the id immediately preceding the given one
+func testPrevID(id []byte) []byte {
+	out := make([]byte, len(id))
+	copy(out, id)
+	for i := len(out) - 1; i >= 0; i-- {
+		if out[i] > 0 {
+			out[i]--
+			break
+		}
+		out[i] = 0xff
+	}
+	return out
+}
+
+func testIDFromUint(v uint64, size int) []byte {
+	id := make([]byte, size)
+	for i := 0; i < 8 && i < size; i++ {
+		id[i] = byte(v >> uint(56-8*i))
+	}
+	return id
+}
@@ -0,0 +1,223 @@
+package kelips
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Min and max time a failed peer is tried after healthy ones
+	minPeerBackoff = 100 * time.Millisecond
+	maxPeerBackoff = 30 * time.Second
+
+	// Number of consecutive failures after which a discovered peer is removed.
+	// Seed peers are never removed
+	maxPeerFailures = 5
+
+	// Interval at which the client refreshes its peers from the cluster
+	peerRefreshInterval = 30 * time.Second
+
+	// Max number of peers learned from the cluster
+	maxDiscoveredPeers = 256
+
+	// Max number of peers a single client operation is attempted on
+	maxClientAttempts = 3
+
+	// Max number of requests of a client batch in flight
+	maxBatchRequests = 16
+)
+
+// PeerStatus is the health of a peer known to a client
+type PeerStatus struct {
+	Address string
+
+	// Seed is true if the peer was supplied to the client rather than learned
+	// from the cluster
+	Seed bool
+
+	// Number of consecutive failures and the time until which the peer is
+	// only tried after healthy ones
+	Failures int
+	RetryAt  time.Time
+}
+
+// peerSet tracks the health of the peers used by a client
+type peerSet struct {
+	mu    sync.Mutex
+	peers map[string]*PeerStatus
+
+	lastRefresh time.Time
+	refreshing  bool
+}
+
+func newPeerSet(seeds []string) *peerSet {
+	ps := &peerSet{peers: make(map[string]*PeerStatus, len(seeds))}
+	for _, addr := range seeds {
+		ps.peers[addr] = &PeerStatus{Address: addr, Seed: true}
+	}
+	return ps
+}
+
+// candidates returns healthy peers in random order followed by failed peers
+// ordered by the time they are due to be retried
+func (ps *peerSet) candidates(now time.Time) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var healthy, failed []*PeerStatus
+	for _, p := range ps.peers {
+		if p.Failures == 0 || !now.Before(p.RetryAt) {
+			healthy = append(healthy, p)
+		} else {
+			failed = append(failed, p)
+		}
+	}
+
+	rand.Shuffle(len(healthy), func(i, j int) { healthy[i], healthy[j] = healthy[j], healthy[i] })
+	sort.Slice(failed, func(i, j int) bool { return failed[i].RetryAt.Before(failed[j].RetryAt) })
+
+	out := make([]string, 0, len(ps.peers))
+	for _, p := range append(healthy, failed...) {
+		out = append(out, p.Address)
+	}
+	return out
+}
+
+// healthy returns the given addresses leaving out known peers that are backed
+// off
+func (ps *peerSet) healthy(addrs []string, now time.Time) []string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	out := addrs[:0]
+	for _, addr := range addrs {
+		if p, ok := ps.peers[addr]; ok && p.Failures > 0 && now.Before(p.RetryAt) {
+			continue
+		}
+		out = append(out, addr)
+	}
+	return out
+}
+
+// success resets the failures of the peer
+func (ps *peerSet) success(addr string) {
+	ps.mu.Lock()
+	if p, ok := ps.peers[addr]; ok {
+		p.Failures = 0
+		p.RetryAt = time.Time{}
+	}
+	ps.mu.Unlock()
+}
+
+// failure backs off the peer exponentially removing it if it was discovered
+// and has failed too many times
+func (ps *peerSet) failure(addr string, now time.Time) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	p, ok := ps.peers[addr]
+	if !ok {
+		return
+	}
+
+	p.Failures++
+	if !p.Seed && p.Failures >= maxPeerFailures {
+		delete(ps.peers, addr)
+		return
+	}
+
+	backoff := maxPeerBackoff
+	if p.Failures < 20 {
+		if b := minPeerBackoff << uint(p.Failures-1); b < maxPeerBackoff {
+			backoff = b
+		}
+	}
+	p.RetryAt = now.Add(backoff)
+}
+
+// add adds peers learned from the cluster upto the max number of discovered
+// peers
+func (ps *peerSet) add(addrs []string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	var discovered int
+	for _, p := range ps.peers {
+		if !p.Seed {
+			discovered++
+		}
+	}
+
+	for _, addr := range addrs {
+		if discovered >= maxDiscoveredPeers {
+			return
+		}
+		if _, ok := ps.peers[addr]; !ok {
+			ps.peers[addr] = &PeerStatus{Address: addr}
+			discovered++
+		}
+	}
+}
+
+// update replaces the discovered peers with the given ones keeping the health
+// of existing peers
+func (ps *peerSet) update(addrs []string) {
+	keep := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		keep[addr] = true
+	}
+
+	ps.mu.Lock()
+	for addr, p := range ps.peers {
+		if !p.Seed && !keep[addr] {
+			delete(ps.peers, addr)
+		}
+	}
+	ps.mu.Unlock()
+
+	ps.add(addrs)
+}
+
+// list returns the status of all peers sorted by address
+func (ps *peerSet) list() []PeerStatus {
+	ps.mu.Lock()
+	out := make([]PeerStatus, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		out = append(out, *p)
+	}
+	ps.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Address < out[j].Address })
+	return out
+}
+
+// startRefresh returns true if a refresh is due marking it as in progress
+func (ps *peerSet) startRefresh(now time.Time, force bool) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.refreshing || (!force && now.Sub(ps.lastRefresh) < peerRefreshInterval) {
+		return false
+	}
+	ps.refreshing = true
+	ps.lastRefresh = now
+	return true
+}
+
+func (ps *peerSet) endRefresh() {
+	ps.mu.Lock()
+	ps.refreshing = false
+	ps.mu.Unlock()
+}
+
+// retriable returns true if the error was not returned by the remote host so
+// the request may succeed on another host
+func retriable(err error) bool {
+	switch err.(type) {
+	case nil, remoteError, *AccessDeniedError:
+		return false
+	}
+	return true
+}
@@ -0,0 +1,104 @@
+package kelips
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_peerSet(t *testing.T) {
+	ps := newPeerSet([]string{"a", "b"})
+	now := time.Now()
+
+	ps.failure("a", now)
+	for i := 0; i < 10; i++ {
+		if c := ps.candidates(now); len(c) != 2 || c[0] != "b" {
+			t.Fatal("failed peer should be tried last", c)
+		}
+	}
+	// Due for a retry after the backoff
+	if c := ps.candidates(now.Add(minPeerBackoff)); len(c) != 2 {
+		t.Fatal("wrong candidates", c)
+	}
+
+	ps.failure("a", now)
+	if st := ps.list()[0]; st.Failures != 2 || st.RetryAt != now.Add(2*minPeerBackoff) {
+		t.Fatalf("wrong backoff %+v", st)
+	}
+	ps.success("a")
+	if st := ps.list()[0]; st.Failures != 0 || !st.RetryAt.IsZero() {
+		t.Fatalf("should be reset %+v", st)
+	}
+
+	// Discovered peers are removed after too many failures, seeds are kept
+	ps.add([]string{"c"})
+	for i := 0; i < maxPeerFailures; i++ {
+		ps.failure("a", now)
+		ps.failure("c", now)
+	}
+	if l := ps.list(); len(l) != 2 || l[0].Address != "a" || !l[0].Seed {
+		t.Fatalf("wrong peers %+v", l)
+	}
+
+	ps.add([]string{"c", "d"})
+	ps.update([]string{"d", "e"})
+	if l := ps.list(); len(l) != 4 || l[2].Address != "d" || l[3].Address != "e" {
+		t.Fatalf("wrong peers %+v", l)
+	}
+
+	if !ps.startRefresh(now, false) || ps.startRefresh(now, true) {
+		t.Fatal("refresh should only be started once")
+	}
+	ps.endRefresh()
+	if ps.startRefresh(now.Add(time.Second), false) || !ps.startRefresh(now.Add(time.Second), true) {
+		t.Fatal("refresh should only be due after the interval")
+	}
+}
+
+func Test_Client_failover(t *testing.T) {
+	dead := "127.0.0.1:54686"
+	k1 := kelipsTestInstance(54687)
+	k2 := kelipsTestInstance(54688)
+	if err := k2.Join([]string{"127.0.0.1:54687"}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	client, _ := NewClient(dead, "127.0.0.1:54687")
+	defer client.Close()
+	tuple := NewTupleHost("10.0.0.1:8080")
+	// Peers are tried in random order so the dead seed is tried by atleast
+	// one insert
+	for i := 0; i < 20; i++ {
+		if err := client.Insert([]byte(fmt.Sprintf("key-%d", i)), tuple); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var failed bool
+	for _, st := range client.Peers() {
+		if st.Address == dead {
+			failed = st.Failures > 0 && st.Seed
+		}
+	}
+	if !failed {
+		t.Fatalf("dead peer should be failed %+v", client.Peers())
+	}
+
+	// Wait for the background refresh started by the first insert
+	time.Sleep(100 * time.Millisecond)
+	if err := client.RefreshPeers(); err != nil {
+		t.Fatal(err)
+	}
+	peers := client.Peers()
+	if len(peers) != 3 {
+		t.Fatalf("should discover the second node %+v", peers)
+	}
+	if peers[2].Address != "127.0.0.1:54688" || peers[2].Seed {
+		t.Fatalf("wrong discovered peer %+v", peers[2])
+	}
+
+	if _, err := k1.Lookup([]byte("key-0")); err != nil {
+		t.Fatal(err)
+	}
+}
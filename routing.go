@@ -0,0 +1,179 @@
+package kelips
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"math/rand"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+// Max number of nodes of each group kept by a routing client
+const routeGroupNodes = 4
+
+// Hash functions a routing client picks from when none is configured
+var knownHashFuncs = []func() hash.Hash{sha256.New, sha1.New, sha512.New}
+
+// Partitioners a routing client picks from when none is configured
+var knownPartitioners = []PartitionerFunc{NewRangePartitioner, NewModPartitioner, NewJumpPartitioner}
+
+// RoutingConfig configures a client to send key requests directly to the nodes
+// of the key's affinity group.  The number of groups is learnt from the cluster
+type RoutingConfig struct {
+	// Hash function of the cluster.  If nil it is picked from sha1, sha256
+	// and sha512 based on the identifier returned by the cluster
+	HashFunc func() hash.Hash
+
+	// Partitioner of the cluster.  If nil it is picked from the range, mod
+	// and jump partitioners based on the identifier returned by the cluster
+	Partitioner PartitionerFunc
+}
+
+// hashFunc returns the configured hash function or the known one matching the
+// cluster hash id.  It returns an error if they do not match
+func (conf *RoutingConfig) hashFunc(id uint32) (func() hash.Hash, error) {
+	if conf.HashFunc != nil {
+		if local := hashFuncID(conf.HashFunc); local != id {
+			return nil, fmt.Errorf("hash function mismatch local=%08x remote=%08x", local, id)
+		}
+		return conf.HashFunc, nil
+	}
+
+	for _, hf := range knownHashFuncs {
+		if hashFuncID(hf) == id {
+			return hf, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown hash function: %08x", id)
+}
+
+// partitioner returns the configured partitioner or the known one matching the
+// cluster partitioner id.  Nodes that do not send an id use the range
+// partitioner.  It returns an error if they do not match
+func (conf *RoutingConfig) partitioner(id uint32, hashSize int) (PartitionerFunc, error) {
+	if conf.Partitioner != nil {
+		if local := partitionerID(conf.Partitioner, hashSize); id != 0 && local != id {
+			return nil, fmt.Errorf("partitioner mismatch local=%08x remote=%08x", local, id)
+		}
+		return conf.Partitioner, nil
+	}
+	if id == 0 {
+		return NewRangePartitioner, nil
+	}
+
+	for _, pf := range knownPartitioners {
+		if partitionerID(pf, hashSize) == id {
+			return pf, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown partitioner: %08x", id)
+}
+
+// routeTable maps keys to a sample of the nodes of their affinity group in a
+// single layout generation
+type routeTable struct {
+	gen      uint64
+	hashFunc func() hash.Hash
+	part     Partitioner
+
+	// Node addresses of each group
+	groups [][]string
+	// Number of groups with a full sample
+	full int
+}
+
+// newRouteTable inits an empty route table for the layout of the snapshot page
+func newRouteTable(conf *RoutingConfig, page *kelipspb.Snapshot) (*routeTable, error) {
+	if page.Groups < 1 {
+		return nil, fmt.Errorf("invalid number of groups: %d", page.Groups)
+	}
+
+	hf, err := conf.hashFunc(page.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	partFunc, err := conf.partitioner(page.Partitioner, hf().Size())
+	if err != nil {
+		return nil, err
+	}
+
+	k := int(page.Groups)
+	return &routeTable{
+		gen:      page.Generation,
+		hashFunc: hf,
+		part:     partFunc(k, hf().Size()),
+		groups:   make([][]string, k),
+	}, nil
+}
+
+// add adds the nodes to the sample of their groups
+func (rt *routeTable) add(nodes []*kelipspb.Node) {
+	for _, n := range nodes {
+		i := rt.part.Partition(n.HashID(rt.hashFunc()))
+		if len(rt.groups[i]) >= routeGroupNodes {
+			continue
+		}
+
+		rt.groups[i] = append(rt.groups[i], n.Address.String())
+		if len(rt.groups[i]) == routeGroupNodes {
+			rt.full++
+		}
+	}
+}
+
+// complete returns true if the sample of every group is full
+func (rt *routeTable) complete() bool {
+	return rt.full == len(rt.groups)
+}
+
+// group returns the index of the group the key belongs to
+func (rt *routeTable) group(key []byte) int {
+	h := rt.hashFunc()
+	h.Write(key)
+	return rt.part.Partition(h.Sum(nil))
+}
+
+// route returns the known nodes of the key group in random order
+func (rt *routeTable) route(key []byte) []string {
+	return rt.nodes(rt.group(key))
+}
+
+// nodes returns the known nodes of the group in random order
+func (rt *routeTable) nodes(group int) []string {
+	nodes := rt.groups[group]
+
+	out := make([]string, len(nodes))
+	for i, j := range rand.Perm(len(nodes)) {
+		out[i] = nodes[j]
+	}
+	return out
+}
+
+// closest returns the group or the next one with known nodes wrapping around
+// as done by the cluster.  It returns -1 if no group has known nodes
+func (rt *routeTable) closest(group int) int {
+	for i := range rt.groups {
+		if j := (group + i) % len(rt.groups); len(rt.groups[j]) > 0 {
+			return j
+		}
+	}
+	return -1
+}
+
+// split groups the indexes of n keys by the closest group of each key with
+// known nodes.  It returns nil if no group has known nodes
+func (rt *routeTable) split(n int, key func(i int) []byte) map[int][]int {
+	groups := make(map[int][]int)
+	for i := 0; i < n; i++ {
+		group := rt.closest(rt.group(key(i)))
+		if group < 0 {
+			return nil
+		}
+		groups[group] = append(groups[group], i)
+	}
+	return groups
+}
@@ -0,0 +1,151 @@
+package kelips
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func Test_RoutingConfig_hashFunc(t *testing.T) {
+	id := hashFuncID(sha256.New)
+
+	hf, err := (&RoutingConfig{}).hashFunc(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hashFuncID(hf) != id {
+		t.Fatal("wrong hash function picked")
+	}
+
+	if _, err = (&RoutingConfig{HashFunc: sha1.New}).hashFunc(id); err == nil {
+		t.Fatal("should fail on mismatch")
+	}
+	if _, err = (&RoutingConfig{}).hashFunc(1); err == nil {
+		t.Fatal("should fail on unknown hash function")
+	}
+}
+
+func Test_RoutingConfig_partitioner(t *testing.T) {
+	id := partitionerID(NewModPartitioner, 32)
+
+	pf, err := (&RoutingConfig{}).partitioner(id, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if partitionerID(pf, 32) != id {
+		t.Fatal("wrong partitioner picked")
+	}
+
+	// Nodes not sending an id use the range partitioner
+	if pf, _ = (&RoutingConfig{}).partitioner(0, 32); partitionerID(pf, 32) != partitionerID(NewRangePartitioner, 32) {
+		t.Fatal("should default to the range partitioner")
+	}
+
+	if _, err = (&RoutingConfig{Partitioner: NewJumpPartitioner}).partitioner(id, 32); err == nil {
+		t.Fatal("should fail on mismatch")
+	}
+	if _, err = (&RoutingConfig{}).partitioner(1, 32); err == nil {
+		t.Fatal("should fail on unknown partitioner")
+	}
+}
+
+func Test_Client_routing(t *testing.T) {
+	sn := testSimNetwork(t)
+	nodes, peers := testCluster(t, sn, 4, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	client, _ := sn.Client("10.0.1.1:4000", peers[0])
+	defer client.Close()
+	if err := client.EnableRouting(&RoutingConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	local := nodes[0].local
+	for i := 0; i < 20; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		routes := client.route(key)
+		group, _ := local.LookupGroupNodes(key)
+		if len(routes) != len(group) {
+			t.Fatalf("%s has %d routes for %d group nodes", key, len(routes), len(group))
+		}
+
+		for _, host := range routes {
+			var found bool
+			for _, n := range group {
+				found = found || n.Address.String() == host
+			}
+			if !found {
+				t.Fatalf("%s routed to %s outside its group", key, host)
+			}
+		}
+	}
+
+	// Routed straight to the group holding the key
+	var keys [][]byte
+	for i := 0; len(keys) < 5; i++ {
+		if key := []byte(fmt.Sprintf("key-%d", i)); len(client.route(key)) > 0 {
+			keys = append(keys, key)
+		}
+	}
+
+	tuple := NewTupleHost(peers[1])
+	for _, key := range keys {
+		if err := client.Insert(key, tuple); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for _, key := range keys {
+		if _, err := client.Lookup(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_Client_Batch_layout(t *testing.T) {
+	for name, configure := range map[string]func(conf *Config){
+		"mod":     func(conf *Config) { conf.Partitioner = NewModPartitioner },
+		"unknown": func(conf *Config) { conf.HashFunc = md5.New },
+	} {
+		sn := testSimNetwork(t)
+		nodes, peers := testCluster(t, sn, 4, configure)
+		time.Sleep(100 * time.Millisecond)
+
+		client, _ := sn.Client("10.0.1.1:4000", peers[0])
+		defer client.Close()
+
+		tuple := NewTupleHost(peers[1])
+		entries := make([]BatchEntry, 20)
+		for i := range entries {
+			entries[i] = BatchEntry{Key: []byte(fmt.Sprintf("key-%d", i)), Tuple: tuple}
+		}
+		errs, err := client.InsertBatch(entries)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		for i, er := range errs {
+			if er != nil {
+				t.Fatal(name, i, er)
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+
+		// Every key is held by the nodes of its group
+		for _, e := range entries {
+			group, _ := nodes[0].local.LookupGroupNodes(e.Key)
+			for _, k := range nodes {
+				var member bool
+				for _, n := range group {
+					member = member || n.Address.String() == k.conf.AdvertiseHost
+				}
+				if _, err := k.local.tuples.Get(e.Key); member && err != nil {
+					t.Fatalf("%s: %s missing on %s", name, e.Key, k.conf.AdvertiseHost)
+				}
+			}
+		}
+	}
+}
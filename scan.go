@@ -0,0 +1,354 @@
+package kelips
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Max number of keys returned in a single scan
+	maxScanLimit = 1000
+
+	// Max number of keys in an index block before it is split
+	maxIndexBlockSize = 512
+)
+
+// KeyScanner is implemented by tuple stores that maintain a sorted index of
+// their keys allowing prefix scans
+type KeyScanner interface {
+	// ScanKeys returns upto limit sorted keys with the prefix that come after
+	// the given key.  A nil after starts from the first key with the prefix
+	ScanKeys(prefix, after []byte, limit int) [][]byte
+}
+
+// keyIndex is a sorted set of keys split into blocks to keep inserts and
+// deletes cheap
+type keyIndex struct {
+	blocks [][]string
+}
+
+// block returns the index of the block the key belongs to
+func (idx *keyIndex) block(key string) int {
+	i := sort.Search(len(idx.blocks), func(i int) bool { return idx.blocks[i][0] > key })
+	if i > 0 {
+		i--
+	}
+	return i
+}
+
+func (idx *keyIndex) add(key string) {
+	if len(idx.blocks) == 0 {
+		idx.blocks = [][]string{{key}}
+		return
+	}
+
+	bi := idx.block(key)
+	b := idx.blocks[bi]
+	i := sort.SearchStrings(b, key)
+	if i < len(b) && b[i] == key {
+		return
+	}
+
+	b = append(b, "")
+	copy(b[i+1:], b[i:])
+	b[i] = key
+
+	if len(b) <= maxIndexBlockSize {
+		idx.blocks[bi] = b
+		return
+	}
+
+	// Split the block in half
+	h := len(b) / 2
+	left := make([]string, h, maxIndexBlockSize+1)
+	right := make([]string, len(b)-h, maxIndexBlockSize+1)
+	copy(left, b[:h])
+	copy(right, b[h:])
+
+	idx.blocks = append(idx.blocks, nil)
+	copy(idx.blocks[bi+2:], idx.blocks[bi+1:])
+	idx.blocks[bi] = left
+	idx.blocks[bi+1] = right
+}
+
+func (idx *keyIndex) remove(key string) {
+	if len(idx.blocks) == 0 {
+		return
+	}
+
+	bi := idx.block(key)
+	b := idx.blocks[bi]
+	i := sort.SearchStrings(b, key)
+	if i == len(b) || b[i] != key {
+		return
+	}
+
+	if len(b) == 1 {
+		idx.blocks = append(idx.blocks[:bi], idx.blocks[bi+1:]...)
+		return
+	}
+	idx.blocks[bi] = append(b[:i], b[i+1:]...)
+}
+
+// iter calls f for each key starting with the first key that is greater than
+// or equal to start until f returns false
+func (idx *keyIndex) iter(start string, f func(key string) bool) {
+	if len(idx.blocks) == 0 {
+		return
+	}
+
+	bi := idx.block(start)
+	i := sort.SearchStrings(idx.blocks[bi], start)
+	for ; bi < len(idx.blocks); bi++ {
+		for _, key := range idx.blocks[bi][i:] {
+			if !f(key) {
+				return
+			}
+		}
+		i = 0
+	}
+}
+
+// IndexedTuples wraps a TupleStore maintaining a sorted index of its keys to
+// answer prefix scans.  The index is updated by a store hook so it changes
+// under the same lock as the key
+type IndexedTuples struct {
+	HookedTupleStore
+
+	mu  sync.RWMutex
+	idx keyIndex
+}
+
+// NewIndexedTuples returns the store wrapped with a sorted key index.  Keys
+// already in the store are added to the index
+func NewIndexedTuples(store TupleStore) *IndexedTuples {
+	it := &IndexedTuples{HookedTupleStore: hookTuples(store)}
+	it.Iter(func(key []byte, hosts []TupleHost) bool {
+		if len(hosts) > 0 {
+			it.idx.add(string(key))
+		}
+		return true
+	})
+	it.AddHook(it.change)
+	return it
+}
+
+// change adds a key to the index when it gets its first host and removes it
+// when its last host is removed
+func (it *IndexedTuples) change(key []byte, h TupleHost, before, after int) error {
+	switch {
+	case before == 0 && after > 0:
+		it.mu.Lock()
+		it.idx.add(string(key))
+		it.mu.Unlock()
+
+	case before > 0 && after == 0:
+		it.mu.Lock()
+		it.idx.remove(string(key))
+		it.mu.Unlock()
+	}
+	return nil
+}
+
+// ScanKeys returns upto limit sorted keys with the prefix that come after the
+// given key
+func (it *IndexedTuples) ScanKeys(prefix, after []byte, limit int) [][]byte {
+	start := string(prefix)
+	if len(after) > 0 && bytes.Compare(after, prefix) >= 0 {
+		// Smallest key greater than after
+		start = string(after) + "\x00"
+	}
+
+	var keys [][]byte
+	it.mu.RLock()
+	it.idx.iter(start, func(key string) bool {
+		if !strings.HasPrefix(key, string(prefix)) || len(keys) >= limit {
+			return false
+		}
+		keys = append(keys, []byte(key))
+		return true
+	})
+	it.mu.RUnlock()
+
+	return keys
+}
+
+// Scan returns upto limit sorted keys with the prefix that come after the
+// cursor.  If cluster is false only the local tuple store is scanned otherwise
+// a node from every group is scanned and the results merged.  It returns true
+// if there may be more keys after the last returned key
+func (lrpc *localGroup) Scan(prefix, cursor []byte, limit int, cluster bool) ([][]byte, bool, error) {
+	if limit <= 0 || limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+
+	if !cluster {
+		return lrpc.scanLocal(prefix, cursor, limit)
+	}
+
+	type groupScan struct {
+		keys [][]byte
+		more bool
+	}
+
+	var (
+		l       = lrpc.layout()
+		mu      sync.Mutex
+		wg      sync.WaitGroup
+		failed  []string
+		results []groupScan
+	)
+
+	for _, group := range l.groups.list {
+		if group.index != l.idx && group.count() == 0 {
+			continue
+		}
+
+		wg.Add(1)
+		go func(group *affinityGroup) {
+			defer wg.Done()
+
+			var (
+				keys [][]byte
+				more bool
+				err  error
+			)
+			if group.index == l.idx {
+				keys, more, err = lrpc.scanLocal(prefix, cursor, limit)
+			} else {
+				keys, more, err = lrpc.scanGroup(group, prefix, cursor, limit)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("[ERROR] Failed to scan group=%d: %v", group.index, err)
+				failed = append(failed, strconv.Itoa(group.index))
+				return
+			}
+			results = append(results, groupScan{keys: keys, more: more})
+		}(group)
+	}
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return nil, false, fmt.Errorf("failed to scan groups: %s", strings.Join(failed, ","))
+	}
+
+	// Keys past the last key of a group with more keys cannot be returned as
+	// that group may have smaller keys not yet seen
+	var (
+		bound []byte
+		keys  [][]byte
+		more  bool
+	)
+	for _, r := range results {
+		if r.more && len(r.keys) > 0 {
+			last := r.keys[len(r.keys)-1]
+			if bound == nil || bytes.Compare(last, bound) < 0 {
+				bound = last
+			}
+			more = true
+		}
+		keys = append(keys, r.keys...)
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+
+	out := make([][]byte, 0, limit)
+	for i, key := range keys {
+		if i > 0 && bytes.Equal(key, keys[i-1]) {
+			continue
+		}
+		if bound != nil && bytes.Compare(key, bound) > 0 {
+			break
+		}
+		if len(out) == limit {
+			more = true
+			break
+		}
+		out = append(out, key)
+	}
+
+	return out, more, nil
+}
+
+// Scan returns upto limit sorted keys with the prefix from all groups that come
+// after the cursor.  The returned cursor is used to request the next page and
+// is nil when there are no more keys.  All nodes require the scan index to be
+// enabled
+func (kelips *Kelips) Scan(prefix []byte, limit int, cursor []byte) ([][]byte, []byte, error) {
+	keys, more, err := kelips.local.Scan(prefix, cursor, limit, true)
+	return keys, scanCursor(keys, more), err
+}
+
+// scanCursor returns the cursor for the next page which is the last key if
+// there are more keys
+func scanCursor(keys [][]byte, more bool) []byte {
+	if !more || len(keys) == 0 {
+		return nil
+	}
+	return keys[len(keys)-1]
+}
+
+// scanLocal scans the local tuple store.  It returns true if the limit was
+// reached
+func (lrpc *localGroup) scanLocal(prefix, cursor []byte, limit int) ([][]byte, bool, error) {
+	scanner, ok := lrpc.tuples.(KeyScanner)
+	if !ok {
+		return nil, false, fmt.Errorf("scan index not enabled")
+	}
+
+	keys := scanner.ScanKeys(prefix, cursor, limit+1)
+	if len(keys) > limit {
+		return keys[:limit], true, nil
+	}
+	return keys, false, nil
+}
+
+// scanGroup scans the first reachable node in the group
+func (lrpc *localGroup) scanGroup(group *affinityGroup, prefix, cursor []byte, limit int) ([][]byte, bool, error) {
+	var (
+		keys [][]byte
+		more bool
+		err  error
+	)
+	for _, node := range group.Nodes() {
+		keys, more, err = lrpc.trans.Scan(node.Address.String(), prefix, cursor, limit, false)
+		if err == nil {
+			return keys, more, nil
+		}
+	}
+	return nil, false, err
+}
+
+// encodeScanResult encodes the more flag followed by the keys.  Keys that do
+// not fit in a response are dropped and the more flag set.  It returns an error
+// if the first key alone does not fit
+func encodeScanResult(keys [][]byte, more bool) ([]byte, error) {
+	var (
+		buf = []byte{0}
+		err error
+	)
+	for i, key := range keys {
+		if len(buf)+2+len(key) > maxBatchRequestSize {
+			if i == 0 {
+				return nil, fmt.Errorf("scan: key too large: %d bytes", len(key))
+			}
+			more = true
+			break
+		}
+		if buf, err = appendUint16Bytes(buf, key); err != nil {
+			return nil, err
+		}
+	}
+	if more {
+		buf[0] = 1
+	}
+	return buf, nil
+}
@@ -0,0 +1,252 @@
+package kelips
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_keyIndex(t *testing.T) {
+	var idx keyIndex
+
+	// Enough keys to split blocks, inserted out of order
+	n := maxIndexBlockSize * 4
+	for i := n - 1; i >= 0; i-- {
+		idx.add(fmt.Sprintf("key-%05d", i))
+		idx.add(fmt.Sprintf("key-%05d", i))
+	}
+	if len(idx.blocks) < 4 {
+		t.Fatalf("blocks should be split: %d", len(idx.blocks))
+	}
+
+	for i := 0; i < n; i += 2 {
+		idx.remove(fmt.Sprintf("key-%05d", i))
+	}
+	idx.remove("missing")
+
+	var keys []string
+	idx.iter("", func(key string) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if len(keys) != n/2 {
+		t.Fatalf("should have=%d got=%d", n/2, len(keys))
+	}
+	if !sort.StringsAreSorted(keys) {
+		t.Fatal("keys should be sorted")
+	}
+
+	var first string
+	idx.iter("key-00100", func(key string) bool {
+		first = key
+		return false
+	})
+	if first != "key-00101" {
+		t.Fatal("wrong first key", first)
+	}
+}
+
+func Test_encodeScanResult(t *testing.T) {
+	big := bytes.Repeat([]byte("k"), maxBatchRequestSize/2)
+	keys := [][]byte{[]byte("a"), big, big}
+
+	// Keys that do not fit are dropped setting the more flag
+	buf, err := encodeScanResult(keys, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[0] != 1 {
+		t.Fatal("more should be set with keys remaining")
+	}
+	out, err := decodeKeys(buf[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != 2 || !bytes.Equal(out[0], keys[0]) || !bytes.Equal(out[1], big) {
+		t.Fatal("wrong keys", len(out))
+	}
+
+	if buf, _ = encodeScanResult(keys[:1], false); buf[0] != 0 {
+		t.Fatal("more should not be set")
+	}
+
+	// A key that cannot fit on its own fails
+	if _, err = encodeScanResult([][]byte{make([]byte, maxBatchRequestSize)}, false); err == nil {
+		t.Fatal("should fail on key too large")
+	}
+}
+
+func Test_IndexedTuples_ScanKeys(t *testing.T) {
+	store := NewShardedTuples(4)
+	store.Insert([]byte("existing/a"), NewTupleHost("127.0.0.1:1"))
+
+	it := NewIndexedTuples(store)
+	h := NewTupleHost("127.0.0.1:2")
+	for i := 0; i < 10; i++ {
+		it.Insert([]byte(fmt.Sprintf("svc/a/%d", i)), h)
+		it.Insert([]byte(fmt.Sprintf("svc/b/%d", i)), h)
+	}
+
+	if keys := it.ScanKeys([]byte("existing/"), nil, 10); len(keys) != 1 {
+		t.Fatal("existing keys should be indexed")
+	}
+
+	keys := it.ScanKeys([]byte("svc/a/"), nil, 4)
+	if len(keys) != 4 || string(keys[0]) != "svc/a/0" || string(keys[3]) != "svc/a/3" {
+		t.Fatalf("wrong keys %q", keys)
+	}
+	keys = it.ScanKeys([]byte("svc/a/"), keys[3], 10)
+	if len(keys) != 6 || string(keys[0]) != "svc/a/4" {
+		t.Fatalf("wrong keys %q", keys)
+	}
+
+	// Deleted keys and keys without hosts are skipped
+	it.Delete([]byte("svc/b/0"))
+	it.DeleteKeyHost([]byte("svc/b/1"), h)
+	keys = it.ScanKeys([]byte("svc/b/"), nil, 10)
+	if len(keys) != 8 || string(keys[0]) != "svc/b/2" {
+		t.Fatalf("wrong keys %q", keys)
+	}
+
+	if keys = it.ScanKeys([]byte("svc/c/"), nil, 10); len(keys) != 0 {
+		t.Fatalf("should have no keys %q", keys)
+	}
+
+	// Keys losing their last host are removed from the index
+	it.ExpireHost(h)
+	if keys = it.ScanKeys([]byte("svc/"), nil, 100); len(keys) != 0 {
+		t.Fatalf("should have no keys %q", keys)
+	}
+	var c int
+	it.idx.iter("", func(key string) bool {
+		c++
+		return true
+	})
+	if c != 1 {
+		t.Fatalf("index should only have existing keys: %d", c)
+	}
+}
+
+func Test_IndexedTuples_concurrent(t *testing.T) {
+	it := NewIndexedTuples(NewShardedTuples(4))
+	h := NewTupleHost("127.0.0.1:1")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				key := []byte(fmt.Sprintf("key-%d", j%10))
+				it.Delete(key)
+				it.Insert(key, h)
+				it.ScanKeys([]byte("key-"), nil, 10)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every key left in the store is indexed
+	var stored int
+	it.Iter(func(key []byte, hosts []TupleHost) bool {
+		if len(hosts) > 0 {
+			stored++
+		}
+		return true
+	})
+	if keys := it.ScanKeys([]byte("key-"), nil, 100); len(keys) != stored {
+		t.Fatalf("index has %d keys for %d stored", len(keys), stored)
+	}
+}
+
+// testScanCluster creates a cluster with 3 groups and the scan index enabled
+func testScanCluster(t *testing.T, n int) ([]*Kelips, *SimNetwork) {
+	sn := testSimNetwork(t)
+	nodes, _ := testCluster(t, sn, n, func(conf *Config) {
+		conf.K = 3
+		conf.EnableScanIndex = true
+	})
+	return nodes, sn
+}
+
+// testScanAll pages through all keys with the prefix
+func testScanAll(t *testing.T, scan func(cursor []byte) ([][]byte, []byte, error)) [][]byte {
+	var (
+		all    [][]byte
+		cursor []byte
+	)
+	for {
+		keys, next, err := scan(cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, keys...)
+		if next == nil {
+			return all
+		}
+		cursor = next
+	}
+}
+
+func Test_Kelips_Scan(t *testing.T) {
+	nodes, sn := testScanCluster(t, 8)
+
+	groups := make(map[int]bool)
+	for _, k := range nodes {
+		groups[k.local.index()] = true
+	}
+	if len(groups) < 3 {
+		t.Fatal("test requires nodes in all groups")
+	}
+
+	var entries []BatchEntry
+	for i := 0; i < 50; i++ {
+		entries = append(entries, BatchEntry{Key: []byte(fmt.Sprintf("svc/payments/%02d", i)), Tuple: NewTupleHost("10.0.0.1:8080")})
+		entries = append(entries, BatchEntry{Key: []byte(fmt.Sprintf("svc/users/%02d", i)), Tuple: NewTupleHost("10.0.0.1:8080")})
+	}
+	for _, err := range nodes[0].InsertBatch(entries) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Wait for propogation
+	<-time.After(300 * time.Millisecond)
+
+	keys := testScanAll(t, func(cursor []byte) ([][]byte, []byte, error) {
+		return nodes[1].Scan([]byte("svc/payments/"), 7, cursor)
+	})
+	if len(keys) != 50 {
+		t.Fatalf("should have=50 got=%d", len(keys))
+	}
+	for i, key := range keys {
+		if exp := fmt.Sprintf("svc/payments/%02d", i); string(key) != exp {
+			t.Fatalf("expected=%s got=%s", exp, key)
+		}
+	}
+
+	client, _ := sn.Client("10.0.1.1:4000", nodes[4].conf.AdvertiseHost)
+	defer client.Close()
+	keys = testScanAll(t, func(cursor []byte) ([][]byte, []byte, error) {
+		return client.Scan([]byte("svc/"), 30, cursor)
+	})
+	if len(keys) != 100 {
+		t.Fatalf("should have=100 got=%d", len(keys))
+	}
+	if !sort.SliceIsSorted(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 }) {
+		t.Fatal("keys should be sorted")
+	}
+
+	if keys, cursor, err := client.Scan([]byte("svc/none/"), 10, nil); err != nil || len(keys) != 0 || cursor != nil {
+		t.Fatal("should have no keys", keys, cursor, err)
+	}
+}
+
+func Test_Kelips_Scan_Disabled(t *testing.T) {
+	nodes, _ := testCluster(t, testSimNetwork(t), 1, nil)
+	if _, _, err := nodes[0].Scan([]byte("svc/"), 10, nil); err == nil {
+		t.Fatal("should fail without scan index")
+	}
+}
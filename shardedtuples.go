@@ -0,0 +1,273 @@
+package kelips
+
+import (
+	"net"
+	"sync"
+)
+
+// DefaultTupleShards is the default number of shards used by ShardedTuples
+const DefaultTupleShards = 32
+
+// tupleShard holds a subset of the keys along with a reverse index of its
+// hosts to keys
+type tupleShard struct {
+	mu    sync.RWMutex
+	m     map[string][]TupleHost
+	hosts map[string]map[string]struct{}
+}
+
+// ShardedTuples implements a TupleStore striping keys across a fixed number of
+// independently locked shards.  Hosts are compared byte-wise and host slices are
+// copy-on-write, so Iter only holds a shard lock while taking a snapshot of it
+type ShardedTuples struct {
+	shards []*tupleShard
+	hooks  tupleHooks
+}
+
+// NewShardedTuples instantiates a sharded in-memory tuple store.  The number of
+// shards is rounded up to a power of 2 and defaults to DefaultTupleShards if
+// less than 1
+func NewShardedTuples(shards int) *ShardedTuples {
+	if shards < 1 {
+		shards = DefaultTupleShards
+	}
+
+	n := 1
+	for n < shards {
+		n <<= 1
+	}
+
+	st := &ShardedTuples{shards: make([]*tupleShard, n)}
+	for i := range st.shards {
+		st.shards[i] = &tupleShard{
+			m:     make(map[string][]TupleHost),
+			hosts: make(map[string]map[string]struct{}),
+		}
+	}
+	return st
+}
+
+// AddHook adds a hook called on every change.  Hooks must be added before the
+// store is used
+func (st *ShardedTuples) AddHook(hook TupleHook) {
+	st.hooks = append(st.hooks, hook)
+}
+
+// shard returns the shard for the key using fnv-1a
+func (st *ShardedTuples) shard(key []byte) *tupleShard {
+	h := uint32(2166136261)
+	for _, c := range key {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return st.shards[h&uint32(len(st.shards)-1)]
+}
+
+// Iter iterates over all the tuples.  If the callback returns false, iteration
+// is terminated.  Each shard is snapshotted before the callback is called so
+// writers are not blocked by it
+func (st *ShardedTuples) Iter(f func(key []byte, hosts []TupleHost) bool) {
+	var (
+		keys  []string
+		hosts [][]TupleHost
+	)
+
+	for _, s := range st.shards {
+		keys = keys[:0]
+		hosts = hosts[:0]
+
+		s.mu.RLock()
+		for k, v := range s.m {
+			keys = append(keys, k)
+			hosts = append(hosts, v)
+		}
+		s.mu.RUnlock()
+
+		for i, k := range keys {
+			if !f([]byte(k), hosts[i]) {
+				return
+			}
+		}
+	}
+}
+
+// Count returns the total number of keys in the store
+func (st *ShardedTuples) Count() int {
+	var c int
+	for _, s := range st.shards {
+		s.mu.RLock()
+		c += len(s.m)
+		s.mu.RUnlock()
+	}
+	return c
+}
+
+// Insert adds a new host for a name if it does not already exist
+func (st *ShardedTuples) Insert(key []byte, h TupleHost) error {
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], h)
+
+	s := st.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Check if we already have the host
+	keys, ok := s.hosts[string(hk)]
+	if _, dup := keys[string(key)]; dup {
+		return nil
+	}
+
+	hosts := s.m[string(key)]
+	if err := st.hooks.insert(key, h, len(hosts)); err != nil {
+		return err
+	}
+
+	if !ok {
+		keys = make(map[string]struct{})
+		s.hosts[string(hk)] = keys
+	}
+	name := string(key)
+	keys[name] = struct{}{}
+
+	// Copy on write as the hosts may be held by callers of Get or Iter
+	nh := make([]TupleHost, len(hosts), len(hosts)+1)
+	copy(nh, hosts)
+	s.m[name] = append(nh, h)
+	return nil
+}
+
+// Delete deletes a key removing all associated TupleHosts
+func (st *ShardedTuples) Delete(key []byte) error {
+	var buf [net.IPv6len + 2]byte
+
+	s := st.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	hosts, ok := s.m[string(key)]
+	if !ok {
+		return errKeyNotFound
+	}
+
+	for _, h := range hosts {
+		s.unindex(normalizeHost(buf[:], h), key)
+	}
+	delete(s.m, string(key))
+	st.hooks.removeAll(key, hosts)
+
+	return nil
+}
+
+// Get returns a list of hosts for a key.  It returns nil if the name is not
+// found
+func (st *ShardedTuples) Get(key []byte) ([]TupleHost, error) {
+	s := st.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if hosts, ok := s.m[string(key)]; ok {
+		return hosts, nil
+	}
+	return nil, errKeyNotFound
+}
+
+// KeysForHost returns all keys referring to the host
+func (st *ShardedTuples) KeysForHost(h TupleHost) [][]byte {
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], h)
+
+	var out [][]byte
+	for _, s := range st.shards {
+		s.mu.RLock()
+		for k := range s.hosts[string(hk)] {
+			out = append(out, []byte(k))
+		}
+		s.mu.RUnlock()
+	}
+	return out
+}
+
+// DeleteKeyHost deletes a host associated to the name returning true if it was deleted
+func (st *ShardedTuples) DeleteKeyHost(key []byte, h TupleHost) bool {
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], h)
+
+	s := st.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hosts[string(hk)][string(key)]; !ok {
+		return false
+	}
+
+	n := len(s.m[string(key)])
+	s.unindex(hk, key)
+	s.removeHost(string(key), h)
+	st.hooks.remove(key, h, n)
+	return true
+}
+
+// ExpireHost removes a host from all keys referring to it
+func (st *ShardedTuples) ExpireHost(tuple TupleHost) bool {
+	var buf [net.IPv6len + 2]byte
+	hk := normalizeHost(buf[:], tuple)
+
+	var expired bool
+	for _, s := range st.shards {
+		s.mu.Lock()
+		if keys, ok := s.hosts[string(hk)]; ok {
+			for k := range keys {
+				n := len(s.m[k])
+				s.removeHost(k, tuple)
+				if len(st.hooks) > 0 {
+					st.hooks.remove([]byte(k), tuple, n)
+				}
+			}
+			delete(s.hosts, string(hk))
+			expired = true
+		}
+		s.mu.Unlock()
+	}
+
+	return expired
+}
+
+// removeHost removes the host from the key creating a new slice.  The lock must
+// be held
+func (s *tupleShard) removeHost(key string, h TupleHost) {
+	hosts := s.m[key]
+	nh := make([]TupleHost, 0, len(hosts))
+	for _, v := range hosts {
+		if !h.Equal(v) {
+			nh = append(nh, v)
+		}
+	}
+	s.m[key] = nh
+}
+
+// unindex removes the key from the hosts reverse index.  The lock must be held
+func (s *tupleShard) unindex(hk []byte, key []byte) {
+	keys, ok := s.hosts[string(hk)]
+	if !ok {
+		return
+	}
+
+	delete(keys, string(key))
+	if len(keys) == 0 {
+		delete(s.hosts, string(hk))
+	}
+}
+
+// normalizeHost writes the 16 byte ip form of the host along with the port to
+// buf returning the written bytes.  buf must be at least net.IPv6len+2 bytes
+func normalizeHost(buf []byte, h TupleHost) []byte {
+	if len(h) != net.IPv4len+2 {
+		return h
+	}
+
+	copy(buf, v4InV6Prefix)
+	copy(buf[len(v4InV6Prefix):], h)
+	return buf[:net.IPv6len+2]
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
@@ -0,0 +1,238 @@
+package kelips
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func Test_ShardedTuples(t *testing.T) {
+	st := NewShardedTuples(5)
+	if len(st.shards) != 8 {
+		t.Fatalf("shards should be a power of 2: %d", len(st.shards))
+	}
+
+	h := NewTupleHost("127.0.0.1:1234")
+	other := NewTupleHost("127.0.0.1:4321")
+	for i := 0; i < 100; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		st.Insert(key, h)
+		st.Insert(key, h)
+		if i%2 == 0 {
+			st.Insert(key, other)
+		}
+	}
+
+	if st.Count() != 100 {
+		t.Fatalf("should have=100 got=%d", st.Count())
+	}
+	hosts, _ := st.Get([]byte("key0"))
+	if len(hosts) != 2 {
+		t.Fatalf("should have=2 got=%d", len(hosts))
+	}
+	if _, err := st.Get([]byte("missing")); err != errKeyNotFound {
+		t.Fatal("should fail with key not found")
+	}
+
+	v4 := NewTupleFromIPPort(net.ParseIP("127.0.0.1").To4(), 1234)
+	if keys := st.KeysForHost(v4); len(keys) != 100 {
+		t.Fatalf("should have=100 got=%d", len(keys))
+	}
+	if !st.DeleteKeyHost([]byte("key0"), v4) {
+		t.Fatal("should delete with ipv4 form")
+	}
+	if st.DeleteKeyHost([]byte("key0"), h) {
+		t.Fatal("should not delete twice")
+	}
+
+	// Hosts returned by get should not be modified
+	if len(hosts) != 2 || !hosts[0].Equal(h) {
+		t.Fatal("hosts modified")
+	}
+
+	if err := st.Delete([]byte("key2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.Delete([]byte("key2")); err != errKeyNotFound {
+		t.Fatal("should fail with key not found")
+	}
+	if keys := st.KeysForHost(other); len(keys) != 49 {
+		t.Fatalf("should have=49 got=%d", len(keys))
+	}
+
+	if !st.ExpireHost(h) {
+		t.Fatal("should expire")
+	}
+	if st.ExpireHost(h) {
+		t.Fatal("should not expire twice")
+	}
+
+	var c int
+	st.Iter(func(key []byte, hosts []TupleHost) bool {
+		for _, v := range hosts {
+			if v.Equal(h) {
+				t.Fatalf("host should be expired key=%s", key)
+			}
+		}
+		c++
+		return c < 10
+	})
+	if c != 10 {
+		t.Fatalf("iteration should stop got=%d", c)
+	}
+}
+
+func Test_ShardedTuples_IterWrite(t *testing.T) {
+	st := NewShardedTuples(4)
+	for i := 0; i < 100; i++ {
+		st.Insert([]byte(fmt.Sprintf("key%d", i)), NewTupleHostFromHostPort("127.0.0.1", 1))
+	}
+
+	// Writes from within the callback would deadlock if the shard lock was held
+	st.Iter(func(key []byte, hosts []TupleHost) bool {
+		st.Insert(key, NewTupleHostFromHostPort("127.0.0.1", 2))
+		st.DeleteKeyHost(key, hosts[0])
+		return true
+	})
+
+	st.Iter(func(key []byte, hosts []TupleHost) bool {
+		if len(hosts) != 1 || hosts[0].Port() != 2 {
+			t.Fatalf("wrong hosts key=%s %v", key, hosts)
+		}
+		return true
+	})
+}
+
+func Test_TupleHost_Equal(t *testing.T) {
+	a := NewTupleHost("127.0.0.1:80")
+	if !a.Equal(NewTupleFromIPPort(net.ParseIP("127.0.0.1").To4(), 80)) {
+		t.Fatal("ipv4 forms should be equal")
+	}
+	if a.Equal(NewTupleHost("127.0.0.1:81")) {
+		t.Fatal("ports differ")
+	}
+	if a.Equal(NewTupleHost("[::1]:80")) {
+		t.Fatal("ips differ")
+	}
+}
+
+func Test_ShardedTuples_allocs(t *testing.T) {
+	st := NewShardedTuples(DefaultTupleShards)
+	key := []byte("key")
+	h := NewTupleHostFromHostPort("10.0.0.1", 1000)
+	other := NewTupleHostFromHostPort("10.0.0.2", 1000)
+	st.Insert(key, h)
+
+	// Mutations that change nothing must not allocate
+	if n := testing.AllocsPerRun(100, func() { st.Insert(key, h) }); n != 0 {
+		t.Fatal("insert of existing tuple allocated", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { st.DeleteKeyHost(key, other) }); n != 0 {
+		t.Fatal("delete of missing tuple allocated", n)
+	}
+	if n := testing.AllocsPerRun(100, func() { st.ExpireHost(other) }); n != 0 {
+		t.Fatal("expire of missing host allocated", n)
+	}
+}
+
+// benchTupleStores are the stores compared by the parallel benchmarks
+var benchTupleStores = []struct {
+	name string
+	new  func() TupleStore
+}{
+	{"Inmem", func() TupleStore { return NewInmemTuples() }},
+	{"Sharded", func() TupleStore { return NewShardedTuples(DefaultTupleShards) }},
+}
+
+func benchmarkTupleStores(b *testing.B, f func(b *testing.B, ts TupleStore)) {
+	for _, s := range benchTupleStores {
+		b.Run(s.name, func(b *testing.B) {
+			f(b, s.new())
+		})
+	}
+}
+
+func Benchmark_TupleStore_InsertParallel(b *testing.B) {
+	benchmarkTupleStores(b, func(b *testing.B, ts TupleStore) {
+		var n uint64
+		b.ReportAllocs()
+		b.RunParallel(func(pb *testing.PB) {
+			h := NewTupleHostFromHostPort("10.0.0.1", int(atomic.AddUint64(&n, 1)))
+			var i int
+			for pb.Next() {
+				ts.Insert([]byte(fmt.Sprintf("key-%d", i%100000)), h)
+				i++
+			}
+		})
+	})
+}
+
+func Benchmark_TupleStore_GetParallel(b *testing.B) {
+	benchmarkTupleStores(b, func(b *testing.B, ts TupleStore) {
+		keys := make([][]byte, 100000)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key-%d", i))
+			ts.Insert(keys[i], NewTupleHostFromHostPort("10.0.0.1", 1+i%100))
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			var i int
+			for pb.Next() {
+				ts.Get(keys[i%len(keys)])
+				i++
+			}
+		})
+	})
+}
+
+func Benchmark_TupleStore_MixedParallel(b *testing.B) {
+	benchmarkTupleStores(b, func(b *testing.B, ts TupleStore) {
+		keys := make([][]byte, 100000)
+		for i := range keys {
+			keys[i] = []byte(fmt.Sprintf("key-%d", i))
+			ts.Insert(keys[i], NewTupleHostFromHostPort("10.0.0.1", 1+i%100))
+		}
+
+		// Continuous iteration alongside readers and writers
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				ts.Iter(func([]byte, []TupleHost) bool { return true })
+			}
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			var i int
+			for pb.Next() {
+				key := keys[i%len(keys)]
+				h := NewTupleHostFromHostPort("10.0.0.2", 1+i%100)
+				if i%4 == 0 {
+					ts.Insert(key, h)
+				} else if i%4 == 1 {
+					ts.DeleteKeyHost(key, h)
+				} else {
+					ts.Get(key)
+				}
+				i++
+			}
+		})
+		b.StopTimer()
+
+		close(done)
+		wg.Wait()
+	})
+}
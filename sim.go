@@ -0,0 +1,651 @@
+package kelips
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+var errSimTimeout = errors.New("sim: request timed out")
+
+// SimConfig configures the faults of the links of a SimNetwork.  Each message
+// is a request or a response travelling over the link from its sender to its
+// receiver
+type SimConfig struct {
+	// Min latency of a message and the max random latency added to it
+	Latency time.Duration
+	Jitter  time.Duration
+
+	// Probability a message is lost
+	Loss float64
+
+	// Probability a request is delivered twice
+	Duplicate float64
+
+	// Probability a message is held back by the reorder delay allowing later
+	// messages to overtake it
+	Reorder      float64
+	ReorderDelay time.Duration
+
+	// Time a sender waits before failing when a message is lost or the
+	// receiver is unreachable
+	Timeout time.Duration
+}
+
+// DefaultSimConfig returns a config for a fault free network with no latency
+func DefaultSimConfig() *SimConfig {
+	return &SimConfig{Timeout: 50 * time.Millisecond}
+}
+
+// Validate returns an error if the config is invalid
+func (conf *SimConfig) Validate() error {
+	if conf.Latency < 0 || conf.Jitter < 0 || conf.ReorderDelay < 0 || conf.Timeout < 0 {
+		return fmt.Errorf("durations must not be negative")
+	}
+	for _, p := range []float64{conf.Loss, conf.Duplicate, conf.Reorder} {
+		if p < 0 || p > 1 {
+			return fmt.Errorf("probabilities must be between 0 and 1")
+		}
+	}
+	return nil
+}
+
+// SimStats are counters of the messages sent over a SimNetwork
+type SimStats struct {
+	// Number of messages sent and delivered
+	Sent      uint64
+	Delivered uint64
+
+	// Number of messages lost at random or as the receiver was unreachable
+	Lost        uint64
+	Unreachable uint64
+
+	// Number of requests delivered twice and messages held back
+	Duplicated uint64
+	Reordered  uint64
+}
+
+type simLinkKey struct {
+	from, to string
+}
+
+// simLink is a directed link between two hosts.  Fault decisions are drawn
+// from its own rng so they only depend on the seed and the order of messages
+// over the link.  The rng is a splitmix64 generator as a link is created for
+// every pair of hosts that communicate
+type simLink struct {
+	mu    sync.Mutex
+	state uint64
+	conf  *SimConfig
+}
+
+// next returns the next random number of the link
+func (link *simLink) next() uint64 {
+	link.state += 0x9e3779b97f4a7c15
+	z := link.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+// float64 returns a random number in [0, 1)
+func (link *simLink) float64() float64 {
+	return float64(link.next()>>11) / (1 << 53)
+}
+
+// simFaults are the faults drawn for a single message
+type simFaults struct {
+	delay     time.Duration
+	lost      bool
+	duplicate bool
+	reordered bool
+}
+
+func (link *simLink) draw(conf *SimConfig) simFaults {
+	link.mu.Lock()
+	defer link.mu.Unlock()
+
+	if link.conf != nil {
+		conf = link.conf
+	}
+
+	f := simFaults{delay: conf.Latency}
+	if conf.Jitter > 0 {
+		f.delay += time.Duration(link.next() % uint64(conf.Jitter+1))
+	}
+	f.lost = link.float64() < conf.Loss
+	f.duplicate = link.float64() < conf.Duplicate
+	if f.reordered = link.float64() < conf.Reorder; f.reordered {
+		f.delay += conf.ReorderDelay
+	}
+	return f
+}
+
+// SimNetwork is an in-process network of SimTransports.  Messages between
+// hosts are subject to the configured latency, loss, duplication and
+// reordering along with partitions.  Faults are drawn from a rng per link
+// seeded from the network seed so runs with the same seed and message order
+// are reproducible
+type SimNetwork struct {
+	seed int64
+
+	mu    sync.RWMutex
+	conf  *SimConfig
+	links map[simLinkKey]*simLink
+	hosts map[string]AffinityGroupRPC
+
+	// Partition of each host.  Hosts not in a partition are in partition 0
+	partitions map[string]int
+	// Hosts that are disconnected from all others
+	down map[string]bool
+
+	stats SimStats
+}
+
+// NewSimNetwork returns a network with faults drawn from the seed.  A nil config
+// uses the default config
+func NewSimNetwork(seed int64, conf *SimConfig) (*SimNetwork, error) {
+	if conf == nil {
+		conf = DefaultSimConfig()
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &SimNetwork{
+		seed:       seed,
+		conf:       conf,
+		links:      make(map[simLinkKey]*simLink),
+		hosts:      make(map[string]AffinityGroupRPC),
+		partitions: make(map[string]int),
+		down:       make(map[string]bool),
+	}, nil
+}
+
+// Transport returns a transport for the host on the network.  Requests are
+// served by the host once a local group is registered to the transport
+func (sn *SimNetwork) Transport(host string) *SimTransport {
+	return &SimTransport{host: host, net: sn}
+}
+
+// Client returns a client on the host sending requests over the network to the
+// peers
+func (sn *SimNetwork) Client(host string, peers ...string) (*Client, error) {
+	return newClient(sn.Transport(host), peers)
+}
+
+// SetConfig replaces the config of all links without an override
+func (sn *SimNetwork) SetConfig(conf *SimConfig) error {
+	if err := conf.Validate(); err != nil {
+		return err
+	}
+	sn.mu.Lock()
+	sn.conf = conf
+	sn.mu.Unlock()
+	return nil
+}
+
+// SetLinkConfig overrides the config of the link from one host to another.  A
+// nil config removes the override
+func (sn *SimNetwork) SetLinkConfig(from, to string, conf *SimConfig) error {
+	if conf != nil {
+		if err := conf.Validate(); err != nil {
+			return err
+		}
+	}
+
+	link := sn.link(from, to)
+	link.mu.Lock()
+	link.conf = conf
+	link.mu.Unlock()
+	return nil
+}
+
+// Partition splits the hosts into the given partitions replacing any existing
+// ones.  Hosts not listed form a partition of their own.  Hosts can only reach
+// hosts in the same partition
+func (sn *SimNetwork) Partition(partitions ...[]string) {
+	sn.mu.Lock()
+	sn.partitions = make(map[string]int)
+	for i, hosts := range partitions {
+		for _, host := range hosts {
+			sn.partitions[host] = i + 1
+		}
+	}
+	sn.mu.Unlock()
+}
+
+// Heal removes all partitions
+func (sn *SimNetwork) Heal() {
+	sn.Partition()
+}
+
+// Disconnect makes the host unreachable to and from all other hosts
+func (sn *SimNetwork) Disconnect(host string) {
+	sn.mu.Lock()
+	sn.down[host] = true
+	sn.mu.Unlock()
+}
+
+// Reconnect reverses a Disconnect of the host
+func (sn *SimNetwork) Reconnect(host string) {
+	sn.mu.Lock()
+	delete(sn.down, host)
+	sn.mu.Unlock()
+}
+
+// Stats returns the current message counters
+func (sn *SimNetwork) Stats() SimStats {
+	return SimStats{
+		Sent:        atomic.LoadUint64(&sn.stats.Sent),
+		Delivered:   atomic.LoadUint64(&sn.stats.Delivered),
+		Lost:        atomic.LoadUint64(&sn.stats.Lost),
+		Unreachable: atomic.LoadUint64(&sn.stats.Unreachable),
+		Duplicated:  atomic.LoadUint64(&sn.stats.Duplicated),
+		Reordered:   atomic.LoadUint64(&sn.stats.Reordered),
+	}
+}
+
+func (sn *SimNetwork) register(host string, group AffinityGroupRPC) {
+	sn.mu.Lock()
+	sn.hosts[host] = group
+	sn.mu.Unlock()
+}
+
+// link returns the link between the hosts creating it if needed
+func (sn *SimNetwork) link(from, to string) *simLink {
+	key := simLinkKey{from, to}
+
+	sn.mu.RLock()
+	link, ok := sn.links[key]
+	sn.mu.RUnlock()
+	if ok {
+		return link
+	}
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%d|%s|%s", sn.seed, from, to)
+
+	sn.mu.Lock()
+	defer sn.mu.Unlock()
+	if link, ok = sn.links[key]; !ok {
+		link = &simLink{state: h.Sum64()}
+		sn.links[key] = link
+	}
+	return link
+}
+
+// send delivers a message from one host to another.  It sleeps for the latency
+// of the message and returns the group of the receiver along with whether the
+// request should be duplicated.  If the message is lost or the receiver is
+// unreachable it sleeps for the timeout and returns an error.  Requests are
+// only deliverable to hosts with a registered group
+func (sn *SimNetwork) send(from, to string, request bool) (AffinityGroupRPC, bool, error) {
+	atomic.AddUint64(&sn.stats.Sent, 1)
+
+	sn.mu.RLock()
+	conf := sn.conf
+	group := sn.hosts[to]
+	reachable := !sn.down[from] && !sn.down[to] && sn.partitions[from] == sn.partitions[to]
+	if request {
+		reachable = reachable && group != nil
+	}
+	sn.mu.RUnlock()
+
+	f := sn.link(from, to).draw(conf)
+	if f.reordered {
+		atomic.AddUint64(&sn.stats.Reordered, 1)
+	}
+
+	if !reachable || f.lost {
+		if reachable {
+			atomic.AddUint64(&sn.stats.Lost, 1)
+		} else {
+			atomic.AddUint64(&sn.stats.Unreachable, 1)
+		}
+		time.Sleep(conf.Timeout)
+		return nil, false, errSimTimeout
+	}
+
+	if f.delay > 0 {
+		time.Sleep(f.delay)
+	}
+	atomic.AddUint64(&sn.stats.Delivered, 1)
+	if f.duplicate {
+		atomic.AddUint64(&sn.stats.Duplicated, 1)
+	}
+	return group, f.duplicate, nil
+}
+
+// SimTransport is a Transport over a SimNetwork.  Requests are served by the
+// local group registered to the transport of the remote host.  Values are
+// copied between hosts and remote errors are returned as they would be by the
+// UDPTransport.  Hosts cannot be impersonated on the network so requests are
+// authenticated as "sim:<host>"
+type SimTransport struct {
+	host  string
+	net   *SimNetwork
+	local AffinityGroupRPC
+}
+
+// Register registers the local group to serve requests from other hosts
+func (st *SimTransport) Register(group AffinityGroupRPC) {
+	st.local = group
+	st.net.register(st.host, group)
+}
+
+// fingerprint returns the fingerprint of the registered local group or that of
+// a client
+func (st *SimTransport) fingerprint() Fingerprint {
+	if st.local == nil {
+		return clientFingerprint()
+	}
+	return st.local.Fingerprint()
+}
+
+// call sends a request to the host calling handle with the group of the host
+// and sends back the response.  A duplicated request is handled twice
+func (st *SimTransport) call(host string, handle func(group AffinityGroupRPC) error) error {
+	group, duplicate, err := st.net.send(st.host, host, true)
+	if err != nil {
+		return err
+	}
+
+	if err = group.Fingerprint().Check(st.fingerprint()); err == nil {
+		if duplicate {
+			handle(group)
+		}
+		err = handle(group)
+	}
+
+	if _, _, e := st.net.send(host, st.host, false); e != nil {
+		return e
+	}
+	if err != nil {
+		return decodeError(encodeError(err))
+	}
+	return nil
+}
+
+// Caller of requests made by the transport
+func (st *SimTransport) caller(principal string) Caller {
+	return Caller{Principal: principal, Peer: "sim:" + st.host, Remote: true, Addr: st.host}
+}
+
+// authenticated returns true as responses can only come from the host
+func (st *SimTransport) authenticated() bool {
+	return true
+}
+
+func (st *SimTransport) LookupGroupNodes(host string, key []byte) (nodes []*kelipspb.Node, err error) {
+	key = copyBytes(key)
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		n, er := group.LookupGroupNodes(key)
+		if er == nil && len(n) == 0 {
+			er = fmt.Errorf("no nodes found")
+		}
+		nodes = cloneNodes(n)
+		return er
+	})
+	return
+}
+
+func (st *SimTransport) LookupNodes(host string, key []byte, min int) (nodes []*kelipspb.Node, err error) {
+	key = copyBytes(key)
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		n, er := group.LookupNodes(key, min)
+		nodes = cloneNodes(n)
+		return er
+	})
+	return
+}
+
+func (st *SimTransport) Lookup(host string, key []byte) ([]*kelipspb.Node, error) {
+	nodes, _, err := st.lookup(host, key)
+	return nodes, err
+}
+
+func (st *SimTransport) lookup(host string, key []byte) (nodes []*kelipspb.Node, version uint64, err error) {
+	key = copyBytes(key)
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		n, er := group.Lookup(key)
+		if er == nil && len(n) == 0 {
+			er = fmt.Errorf("no nodes found")
+		}
+		nodes = cloneNodes(n)
+		version = group.TupleVersion()
+		return er
+	})
+	return
+}
+
+// Close is a no-op as the transport holds no resources
+func (st *SimTransport) Close() error {
+	return nil
+}
+
+func (st *SimTransport) Insert(host string, key []byte, tuple TupleHost, principal string, propogate bool) error {
+	key, err := wireKey(key)
+	if err != nil {
+		return err
+	}
+	tuple = tuple.Copy()
+	return st.call(host, func(group AffinityGroupRPC) error {
+		return group.Insert(key, tuple, st.caller(principal), propogate)
+	})
+}
+
+func (st *SimTransport) Delete(host string, key []byte, tuple TupleHost, principal string, propogate bool) error {
+	key, err := wireKey(key)
+	if err != nil {
+		return err
+	}
+	tuple = tuple.Copy()
+	return st.call(host, func(group AffinityGroupRPC) error {
+		return group.Delete(key, tuple, st.caller(principal), propogate)
+	})
+}
+
+// wireKey returns a copy of the key as received by a remote after sending it
+// with its namespace as a separate field
+func wireKey(key []byte) ([]byte, error) {
+	ns, k := SplitNamespace(key)
+	return storedKey(ns, copyBytes(k))
+}
+
+func (st *SimTransport) Ping(host string, node *kelipspb.Node) (remote *kelipspb.Node, rtt time.Duration, err error) {
+	start := time.Now()
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		remote = cloneNode(group.Ping(cloneNode(node), st.caller("")))
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return remote, time.Since(start), nil
+}
+
+func (st *SimTransport) Join(host string, node *kelipspb.Node) (snapshot *kelipspb.Snapshot, err error) {
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		s, er := group.Join(cloneNode(node), &SnapshotRequest{MaxSize: maxSnapshotPageSize}, st.caller(""))
+		snapshot = cloneSnapshot(s)
+		return er
+	})
+	return
+}
+
+func (st *SimTransport) Snapshot(host string, req *SnapshotRequest) (snapshot *kelipspb.Snapshot, err error) {
+	r := &SnapshotRequest{
+		Group:   req.Group,
+		Prefix:  copyBytes(req.Prefix),
+		Limit:   req.Limit,
+		MaxSize: maxSnapshotPageSize,
+		Cursor:  copyBytes(req.Cursor),
+	}
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		s, er := group.SnapshotPage(r)
+		snapshot = cloneSnapshot(s)
+		return er
+	})
+	return
+}
+
+func (st *SimTransport) Resize(host string, gen uint64, k int) error {
+	return st.call(host, func(group AffinityGroupRPC) error {
+		return group.Resize(gen, k, st.caller(""))
+	})
+}
+
+func (st *SimTransport) InsertBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	return st.updateBatch(host, entries, true, principal, propogate)
+}
+
+func (st *SimTransport) DeleteBatch(host string, entries []BatchEntry, principal string, propogate bool) ([]error, error) {
+	return st.updateBatch(host, entries, false, principal, propogate)
+}
+
+func (st *SimTransport) updateBatch(host string, entries []BatchEntry, insert bool, principal string, propogate bool) (errs []error, err error) {
+	batch := make([]BatchEntry, len(entries))
+	for i, e := range entries {
+		batch[i] = BatchEntry{Key: copyBytes(e.Key), Tuple: e.Tuple.Copy()}
+	}
+
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		errs = make([]error, len(batch))
+		for i, e := range batch {
+			er := checkKey(e.Key)
+			if er == nil && insert {
+				er = group.Insert(e.Key, e.Tuple, st.caller(principal), propogate)
+			} else if er == nil {
+				er = group.Delete(e.Key, e.Tuple, st.caller(principal), propogate)
+			}
+			if er != nil {
+				errs[i] = decodeError(encodeError(er))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+func (st *SimTransport) LookupBatch(host string, keys [][]byte) (results []LookupResult, err error) {
+	batch := make([][]byte, len(keys))
+	for i, key := range keys {
+		batch[i] = copyBytes(key)
+	}
+
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		results = make([]LookupResult, len(batch))
+		for i, key := range batch {
+			nodes, er := group.Lookup(key)
+			if er == nil && len(nodes) == 0 {
+				er = fmt.Errorf("no nodes found")
+			}
+			if er != nil {
+				results[i].Err = decodeError(encodeError(er))
+				continue
+			}
+			results[i].Nodes = cloneNodes(nodes)
+		}
+		return nil
+	})
+	return
+}
+
+func (st *SimTransport) ExpireHost(host string, tuple TupleHost, scope ExpireScope) error {
+	tuple = tuple.Copy()
+	return st.call(host, func(group AffinityGroupRPC) error {
+		return group.ExpireHost(tuple, scope, st.caller(""))
+	})
+}
+
+func (st *SimTransport) Scan(host string, prefix, cursor []byte, limit int, cluster bool) (keys [][]byte, more bool, err error) {
+	prefix, cursor = copyBytes(prefix), copyBytes(cursor)
+	err = st.call(host, func(group AffinityGroupRPC) error {
+		k, m, er := group.Scan(prefix, cursor, limit, cluster)
+		keys = make([][]byte, len(k))
+		for i := range k {
+			keys[i] = copyBytes(k[i])
+		}
+		more = m
+		return er
+	})
+	return
+}
+
+func (st *SimTransport) PurgeNamespace(host string, ns string, scope ExpireScope) error {
+	return st.call(host, func(group AffinityGroupRPC) error {
+		return group.PurgeNamespace(ns, scope, st.caller(""))
+	})
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+// cloneNode returns a deep copy of the node as it would be received over the
+// wire
+func cloneNode(node *kelipspb.Node) *kelipspb.Node {
+	if node == nil {
+		return nil
+	}
+
+	n := *node
+	n.ID = copyBytes(node.ID)
+	n.Address = kelipspb.Address(copyBytes(node.Address))
+	if node.Meta != nil {
+		n.Meta = make(map[string]string, len(node.Meta))
+		for k, v := range node.Meta {
+			n.Meta[k] = v
+		}
+	}
+	if node.Coordinates != nil {
+		n.Coordinates = node.Coordinates.Clone()
+	}
+	return &n
+}
+
+func cloneNodes(nodes []*kelipspb.Node) []*kelipspb.Node {
+	if nodes == nil {
+		return nil
+	}
+	out := make([]*kelipspb.Node, len(nodes))
+	for i, n := range nodes {
+		out[i] = cloneNode(n)
+	}
+	return out
+}
+
+func cloneSnapshot(snapshot *kelipspb.Snapshot) *kelipspb.Snapshot {
+	if snapshot == nil {
+		return nil
+	}
+
+	s := *snapshot
+	s.Cursor = copyBytes(snapshot.Cursor)
+	s.Nodes = cloneNodes(snapshot.Nodes)
+	if snapshot.Tuples != nil {
+		s.Tuples = make([]*kelipspb.Tuple, len(snapshot.Tuples))
+		for i, t := range snapshot.Tuples {
+			tuple := &kelipspb.Tuple{Key: copyBytes(t.Key), Hosts: make([][]byte, len(t.Hosts))}
+			for j := range t.Hosts {
+				tuple.Hosts[j] = copyBytes(t.Hosts[j])
+			}
+			if t.Owners != nil {
+				tuple.Owners = append([]string(nil), t.Owners...)
+			}
+			s.Tuples[i] = tuple
+		}
+	}
+	return &s
+}
@@ -0,0 +1,152 @@
+package kelips
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testCluster creates n nodes on the network with hosts 10.0.0.1:4000 onwards.
+// Each node joins all preceding nodes.  configure is called with the config of
+// each node if not nil
+func testCluster(t *testing.T, sn *SimNetwork, n int, configure func(conf *Config)) ([]*Kelips, []string) {
+	var (
+		nodes []*Kelips
+		peers []string
+	)
+	for i := 0; i < n; i++ {
+		host := fmt.Sprintf("10.0.0.%d:4000", i+1)
+		conf := fastTestConf(host)
+		if configure != nil {
+			configure(conf)
+		}
+
+		k, err := Create(conf, sn.Transport(host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = k.Join(peers); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, k)
+		peers = append(peers, host)
+	}
+	return nodes, peers
+}
+
+// testSimNetwork returns a fault free network
+func testSimNetwork(t *testing.T) *SimNetwork {
+	sn, err := NewSimNetwork(1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sn
+}
+
+func Test_SimConfig_Validate(t *testing.T) {
+	if err := DefaultSimConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&SimConfig{Loss: 1.5}).Validate(); err == nil {
+		t.Fatal("should fail on probability")
+	}
+	if err := (&SimConfig{Latency: -1}).Validate(); err == nil {
+		t.Fatal("should fail on duration")
+	}
+}
+
+func Test_SimNetwork(t *testing.T) {
+	sn, _ := NewSimNetwork(1, &SimConfig{
+		Latency:   time.Millisecond,
+		Jitter:    time.Millisecond,
+		Duplicate: 0.2,
+		Timeout:   10 * time.Millisecond,
+	})
+	nodes, peers := testCluster(t, sn, 4, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	tuple := NewTupleHost(peers[1])
+	for i := 0; i < 10; i++ {
+		if err := nodes[0].Insert([]byte(fmt.Sprintf("key-%d", i)), tuple); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 10; i++ {
+		nodes, err := nodes[3].Lookup([]byte(fmt.Sprintf("key-%d", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !TupleHost(nodes[0].Address).Equal(tuple) {
+			t.Fatal("wrong tuple host")
+		}
+	}
+
+	stats := sn.Stats()
+	if stats.Delivered == 0 || stats.Duplicated == 0 || stats.Lost != 0 {
+		t.Fatalf("%+v", stats)
+	}
+
+	// Remote errors are returned as by the udp transport
+	client := sn.Transport("10.0.1.1:4000")
+	if _, err := client.Lookup(peers[0], []byte("missing")); !isRemoteError(err) {
+		t.Fatal("should be a remote error", err)
+	}
+
+	unreachable := sn.Stats().Unreachable
+	sn.Partition([]string{peers[0]})
+	if _, err := client.Lookup(peers[0], []byte("key-0")); err != errSimTimeout {
+		t.Fatal("should be partitioned", err)
+	}
+	if _, err := client.Lookup(peers[1], []byte("key-0")); err != nil {
+		t.Fatal(err)
+	}
+
+	sn.Heal()
+	sn.Disconnect(peers[0])
+	if _, err := client.Lookup(peers[0], []byte("key-0")); err != errSimTimeout {
+		t.Fatal("should be disconnected", err)
+	}
+	sn.Reconnect(peers[0])
+	if _, err := client.Lookup(peers[0], []byte("key-0")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Background pings to the node may also be unreachable
+	if sn.Stats().Unreachable < unreachable+2 {
+		t.Fatalf("%+v", sn.Stats())
+	}
+}
+
+func Test_SimNetwork_seed(t *testing.T) {
+	conf := &SimConfig{Loss: 0.5, Reorder: 0.3}
+
+	pattern := func(seed int64) []bool {
+		sn, _ := NewSimNetwork(seed, conf)
+		sn.Transport("10.0.0.1:4000").Register(&MockAffinityGroupRPC{hosts: make(map[string][]TupleHost)})
+
+		client := sn.Transport("10.0.0.2:4000")
+		out := make([]bool, 50)
+		for i := range out {
+			_, _, err := client.Ping("10.0.0.1:4000", nil)
+			out[i] = err == nil
+		}
+		return out
+	}
+
+	a, b := pattern(7), pattern(7)
+	c := pattern(8)
+
+	var lost, differ bool
+	for i := range a {
+		if a[i] != b[i] {
+			t.Fatal("same seed should drop the same messages")
+		}
+		lost = lost || !a[i]
+		differ = differ || a[i] != c[i]
+	}
+	if !lost || !differ {
+		t.Fatal("loss not drawn from the seed")
+	}
+}
@@ -0,0 +1,663 @@
+package kelips
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+// SimClusterConfig configures a simulated cluster of Kelips nodes
+type SimClusterConfig struct {
+	// Seed of the network faults and the workload
+	Seed int64
+
+	// Number of affinity groups
+	Groups int
+
+	// Network faults.  Defaults to a fault free network
+	Network *SimConfig
+
+	// Number of random peers a node joins when added and in each gossip round
+	Peers int
+
+	// Number of concurrent operations of a workload
+	Workers int
+
+	// Returns the config of the node with the host.  By default nodes use the
+	// default config with propogation enabled and pings once a minute
+	Config func(host string) *Config
+}
+
+// DefaultSimClusterConfig returns a config for a cluster of 8 groups over a
+// fault free network
+func DefaultSimClusterConfig() *SimClusterConfig {
+	return &SimClusterConfig{
+		Groups:  8,
+		Network: &SimConfig{Timeout: 10 * time.Millisecond},
+		Peers:   3,
+		Workers: 16,
+	}
+}
+
+func (conf *SimClusterConfig) nodeConfig(host string) *Config {
+	var c *Config
+	if conf.Config != nil {
+		c = conf.Config(host)
+	} else {
+		c = DefaultConfig(host)
+		c.EnablePropogation = true
+		// Pinging every node is quadratic and not needed for membership
+		c.PingMin = time.Minute
+		c.PingMax = 2 * time.Minute
+	}
+	c.K = conf.Groups
+	return c
+}
+
+// SimReport is the state of a simulated cluster and the results of its
+// workloads
+type SimReport struct {
+	// Number of live, left and crashed nodes
+	Nodes   int
+	Left    int
+	Crashed int
+
+	// Number of keys with a live tuple host
+	Keys int
+
+	// Lookups performed and failed.  A lookup fails if it errors or the
+	// tuple host of the key is not returned
+	Lookups        int
+	LookupFailures int
+	SuccessRate    float64
+
+	// Number of lookup requests made per lookup.  Lookups of keys in the
+	// local group make none
+	MeanHops float64
+	MaxHops  int
+
+	// Number of nodes known and tuples stored per live node
+	MinNodes, MaxNodes   int
+	MeanNodes            float64
+	MinTuples, MaxTuples int
+	MeanTuples           float64
+
+	// Number of known nodes that have left and that have crashed summed over
+	// all live nodes.  Kelips has no failure detector so crashed nodes remain
+	// known until removed
+	StaleLeft    int
+	StaleCrashed int
+
+	// Gossip rounds and time taken by the last convergence
+	ConvergenceRounds int
+	ConvergenceTime   time.Duration
+}
+
+// String returns the report on a single line
+func (r *SimReport) String() string {
+	return fmt.Sprintf("nodes=%d left=%d crashed=%d keys=%d lookups=%d success=%.4f hops=%.2f/%d"+
+		" known=%d/%.1f/%d tuples=%d/%.1f/%d stale=%d/%d converged=%d/%v",
+		r.Nodes, r.Left, r.Crashed, r.Keys, r.Lookups, r.SuccessRate, r.MeanHops, r.MaxHops,
+		r.MinNodes, r.MeanNodes, r.MaxNodes, r.MinTuples, r.MeanTuples, r.MaxTuples,
+		r.StaleLeft, r.StaleCrashed, r.ConvergenceRounds, r.ConvergenceTime)
+}
+
+// simNodeTransport counts the lookup requests made by a node
+type simNodeTransport struct {
+	*SimTransport
+	lookups uint64
+}
+
+func (trans *simNodeTransport) Lookup(host string, key []byte) ([]*kelipspb.Node, error) {
+	atomic.AddUint64(&trans.lookups, 1)
+	return trans.SimTransport.Lookup(host, key)
+}
+
+type simNode struct {
+	k     *Kelips
+	trans *simNodeTransport
+
+	// Serializes measured lookups so requests are attributed to them
+	mu sync.Mutex
+}
+
+// SimCluster is a cluster of Kelips nodes over a SimNetwork.  It drives join,
+// leave and crash churn along with insert and lookup workloads and checks the
+// invariants of the cluster.  Kelips does not include a gossip layer so the
+// cluster models one with rounds of joins between random live peers.  Left and
+// crashed nodes are disconnected from the network and shut down
+type SimCluster struct {
+	conf *SimClusterConfig
+	net  *SimNetwork
+	rng  *rand.Rand
+
+	mu      sync.RWMutex
+	nodes   map[string]*simNode
+	live    []string
+	left    map[string]bool
+	crashed map[string]bool
+	// Tuple host of each inserted key
+	keys    map[string]string
+	nextKey int
+	nextIdx int
+
+	// Lookup results and hops
+	lookups  int
+	failures int
+	hops     int
+	maxHops  int
+
+	rounds      int
+	convergence time.Duration
+}
+
+// NewSimCluster returns a cluster with no nodes.  A nil config uses the
+// default config
+func NewSimCluster(conf *SimClusterConfig) (*SimCluster, error) {
+	if conf == nil {
+		conf = DefaultSimClusterConfig()
+	}
+	if conf.Groups < 1 || conf.Groups > maxGroups {
+		return nil, fmt.Errorf("number of groups must be between 1 and %d", maxGroups)
+	}
+	if conf.Peers < 1 {
+		return nil, fmt.Errorf("peers must be at least 1")
+	}
+	if conf.Workers < 1 {
+		return nil, fmt.Errorf("workers must be at least 1")
+	}
+
+	sn, err := NewSimNetwork(conf.Seed, conf.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SimCluster{
+		conf:    conf,
+		net:     sn,
+		rng:     rand.New(rand.NewSource(conf.Seed)),
+		nodes:   make(map[string]*simNode),
+		left:    make(map[string]bool),
+		crashed: make(map[string]bool),
+		keys:    make(map[string]string),
+	}, nil
+}
+
+// Network returns the network of the cluster
+func (sc *SimCluster) Network() *SimNetwork {
+	return sc.net
+}
+
+// Node returns the node with the host or nil if it does not exist
+func (sc *SimCluster) Node(host string) *Kelips {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	if n, ok := sc.nodes[host]; ok {
+		return n.k
+	}
+	return nil
+}
+
+// Live returns the hosts of the live nodes
+func (sc *SimCluster) Live() []string {
+	sc.mu.RLock()
+	defer sc.mu.RUnlock()
+
+	out := make([]string, len(sc.live))
+	copy(out, sc.live)
+	return out
+}
+
+// pick returns n distinct random hosts from the list excluding the host
+func (sc *SimCluster) pick(hosts []string, n int, exclude string) []string {
+	out := make([]string, 0, n)
+	for _, i := range sc.rng.Perm(len(hosts)) {
+		if len(out) == n {
+			break
+		}
+		if hosts[i] != exclude {
+			out = append(out, hosts[i])
+		}
+	}
+	return out
+}
+
+// Add adds n nodes each joining random live peers.  It returns the hosts of
+// the nodes
+func (sc *SimCluster) Add(n int) ([]string, error) {
+	hosts := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		sc.mu.Lock()
+		sc.nextIdx++
+		idx := sc.nextIdx
+		host := fmt.Sprintf("10.%d.%d.%d:4000", idx>>16&0xff, idx>>8&0xff, idx&0xff)
+		peers := sc.pick(sc.live, sc.conf.Peers, "")
+		sc.mu.Unlock()
+
+		trans := &simNodeTransport{SimTransport: sc.net.Transport(host)}
+		k, err := Create(sc.conf.nodeConfig(host), trans)
+		if err != nil {
+			return hosts, err
+		}
+		if err = k.Join(peers); err != nil {
+			return hosts, err
+		}
+
+		sc.mu.Lock()
+		sc.nodes[host] = &simNode{k: k, trans: trans}
+		sc.live = append(sc.live, host)
+		sc.mu.Unlock()
+
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// remove removes the host from the live nodes along with the keys it is the
+// tuple host of
+func (sc *SimCluster) remove(host string) error {
+	for i, h := range sc.live {
+		if h != host {
+			continue
+		}
+		sc.live = append(sc.live[:i], sc.live[i+1:]...)
+
+		for key, th := range sc.keys {
+			if th == host {
+				delete(sc.keys, key)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("node not live: %s", host)
+}
+
+// Leave gracefully removes the live node.  The departure is announced to all
+// live nodes before the node is disconnected
+func (sc *SimCluster) Leave(host string) error {
+	sc.mu.Lock()
+	if err := sc.remove(host); err != nil {
+		sc.mu.Unlock()
+		return err
+	}
+	sc.left[host] = true
+	live := make([]string, len(sc.live))
+	copy(live, sc.live)
+	sc.mu.Unlock()
+
+	sc.parallel(len(live), func(i int) {
+		// The node may not be known yet
+		sc.Node(live[i]).RemoveNode(host)
+	})
+	sc.net.Disconnect(host)
+	sc.Node(host).Shutdown()
+
+	return nil
+}
+
+// Crash disconnects the live node without notice.  Other nodes keep it in
+// their view
+func (sc *SimCluster) Crash(host string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err := sc.remove(host); err != nil {
+		return err
+	}
+	sc.crashed[host] = true
+	sc.net.Disconnect(host)
+	sc.nodes[host].k.Shutdown()
+
+	return nil
+}
+
+// Churn adds, removes and crashes the given number of random nodes in that
+// order
+func (sc *SimCluster) Churn(joins, leaves, crashes int) error {
+	if _, err := sc.Add(joins); err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	hosts := sc.pick(sc.live, leaves+crashes, "")
+	sc.mu.Unlock()
+	if len(hosts) < leaves+crashes {
+		return fmt.Errorf("not enough live nodes: %d", len(hosts))
+	}
+
+	for _, host := range hosts[:leaves] {
+		if err := sc.Leave(host); err != nil {
+			return err
+		}
+	}
+	for _, host := range hosts[leaves:] {
+		if err := sc.Crash(host); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Insert inserts n new keys via random live nodes with a random live node as
+// the tuple host.  Keys that fail to insert are not tracked
+func (sc *SimCluster) Insert(n int) error {
+	type insert struct {
+		key, via, tuple string
+	}
+
+	sc.mu.Lock()
+	if len(sc.live) == 0 {
+		sc.mu.Unlock()
+		return fmt.Errorf("no live nodes")
+	}
+	ops := make([]insert, n)
+	for i := range ops {
+		ops[i] = insert{
+			key:   fmt.Sprintf("sim-key-%d", sc.nextKey),
+			via:   sc.live[sc.rng.Intn(len(sc.live))],
+			tuple: sc.live[sc.rng.Intn(len(sc.live))],
+		}
+		sc.nextKey++
+	}
+	sc.mu.Unlock()
+
+	var failed int64
+	sc.parallel(len(ops), func(i int) {
+		op := ops[i]
+		if err := sc.Node(op.via).Insert([]byte(op.key), NewTupleHost(op.tuple)); err != nil {
+			log.Printf("[ERROR] Sim insert failed key=%s: %v", op.key, err)
+			atomic.AddInt64(&failed, 1)
+			return
+		}
+
+		sc.mu.Lock()
+		// The tuple host may have been removed meanwhile
+		if sc.nodes[op.tuple] != nil && !sc.left[op.tuple] && !sc.crashed[op.tuple] {
+			sc.keys[op.key] = op.tuple
+		}
+		sc.mu.Unlock()
+	})
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d inserts failed", failed, n)
+	}
+	return nil
+}
+
+// lookup looks up the key via the node returning whether the tuple host was
+// found along with the number of lookup requests made
+func (sc *SimCluster) lookup(via, key, tuple string) (bool, int) {
+	sc.mu.RLock()
+	node := sc.nodes[via]
+	sc.mu.RUnlock()
+
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	before := atomic.LoadUint64(&node.trans.lookups)
+	nodes, err := node.k.Lookup([]byte(key))
+	hops := int(atomic.LoadUint64(&node.trans.lookups) - before)
+	if err != nil {
+		return false, hops
+	}
+
+	for _, n := range nodes {
+		if n.Address.String() == tuple {
+			return true, hops
+		}
+	}
+	return false, hops
+}
+
+// Lookup looks up n random live keys via random live nodes and adds the results
+// to the report
+func (sc *SimCluster) Lookup(n int) error {
+	type lookup struct {
+		via, key, tuple string
+	}
+
+	sc.mu.Lock()
+	keys := sc.sortedKeys()
+	if len(sc.live) == 0 || len(keys) == 0 {
+		sc.mu.Unlock()
+		return fmt.Errorf("no live nodes or keys")
+	}
+	ops := make([]lookup, n)
+	for i := range ops {
+		key := keys[sc.rng.Intn(len(keys))]
+		ops[i] = lookup{via: sc.live[sc.rng.Intn(len(sc.live))], key: key, tuple: sc.keys[key]}
+	}
+	sc.mu.Unlock()
+
+	sc.parallel(len(ops), func(i int) {
+		op := ops[i]
+		found, hops := sc.lookup(op.via, op.key, op.tuple)
+
+		sc.mu.Lock()
+		sc.lookups++
+		if !found {
+			sc.failures++
+		}
+		sc.hops += hops
+		if hops > sc.maxHops {
+			sc.maxHops = hops
+		}
+		sc.mu.Unlock()
+	})
+	return nil
+}
+
+// sortedKeys returns the live keys in a stable order so they are picked
+// reproducibly
+func (sc *SimCluster) sortedKeys() []string {
+	keys := make([]string, 0, len(sc.keys))
+	for key := range sc.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Gossip runs a round of gossip where each live node joins random live peers
+// exchanging membership and the tuples of its group
+func (sc *SimCluster) Gossip() {
+	sc.mu.Lock()
+	live := make([]string, len(sc.live))
+	copy(live, sc.live)
+	peers := make([][]string, len(live))
+	for i, host := range live {
+		peers[i] = sc.pick(live, sc.conf.Peers, host)
+	}
+	sc.mu.Unlock()
+
+	sc.parallel(len(live), func(i int) {
+		if err := sc.Node(live[i]).Join(peers[i]); err != nil {
+			log.Printf("[ERROR] Sim gossip failed host=%s: %v", live[i], err)
+		}
+	})
+}
+
+// Converge runs gossip rounds until the invariants hold or the max number of
+// rounds is reached.  The rounds and time taken are added to the report
+func (sc *SimCluster) Converge(maxRounds int) error {
+	start := time.Now()
+
+	var errs []error
+	for round := 0; round <= maxRounds; round++ {
+		if errs = sc.Check(); len(errs) == 0 {
+			sc.mu.Lock()
+			sc.rounds = round
+			sc.convergence = time.Since(start)
+			sc.mu.Unlock()
+			return nil
+		}
+
+		if round < maxRounds {
+			sc.Gossip()
+		}
+	}
+	return fmt.Errorf("not converged after %d rounds: %v", maxRounds, errs[0])
+}
+
+// Check returns an error for each violated invariant.  Every live node must
+// know every live node and no left node, and every live key must be resolvable
+// via a random live node.  Crashed nodes are never removed without a failure
+// detector so are counted by the report instead
+func (sc *SimCluster) Check() []error {
+	sc.mu.Lock()
+	if len(sc.live) == 0 {
+		sc.mu.Unlock()
+		return []error{fmt.Errorf("no live nodes")}
+	}
+	live := make([]string, len(sc.live))
+	copy(live, sc.live)
+	left := make(map[string]bool, len(sc.left))
+	for host := range sc.left {
+		left[host] = true
+	}
+	keys := sc.sortedKeys()
+	tuples := make([]string, len(keys))
+	via := make([]string, len(keys))
+	for i, key := range keys {
+		tuples[i] = sc.keys[key]
+		via[i] = live[sc.rng.Intn(len(live))]
+	}
+	sc.mu.Unlock()
+
+	isLive := make(map[string]bool, len(live))
+	for _, host := range live {
+		isLive[host] = true
+	}
+
+	var missing, known, unresolved int64
+	sc.parallel(len(live), func(i int) {
+		var n, l int64
+		sc.Node(live[i]).groups().iterNodes(func(node kelipspb.Node) bool {
+			host := node.Address.String()
+			if isLive[host] {
+				n++
+			} else if left[host] {
+				l++
+			}
+			return true
+		})
+		atomic.AddInt64(&missing, int64(len(live))-n)
+		atomic.AddInt64(&known, l)
+	})
+
+	sc.parallel(len(keys), func(i int) {
+		if found, _ := sc.lookup(via[i], keys[i], tuples[i]); !found {
+			atomic.AddInt64(&unresolved, 1)
+		}
+	})
+
+	var errs []error
+	if missing > 0 {
+		errs = append(errs, fmt.Errorf("live nodes missing from views: %d", missing))
+	}
+	if known > 0 {
+		errs = append(errs, fmt.Errorf("left nodes in views: %d", known))
+	}
+	if unresolved > 0 {
+		errs = append(errs, fmt.Errorf("live keys not resolvable: %d/%d", unresolved, len(keys)))
+	}
+	return errs
+}
+
+// Report returns the current state of the cluster and the workload results
+func (sc *SimCluster) Report() *SimReport {
+	sc.mu.RLock()
+	r := &SimReport{
+		Nodes:             len(sc.live),
+		Left:              len(sc.left),
+		Crashed:           len(sc.crashed),
+		Keys:              len(sc.keys),
+		Lookups:           sc.lookups,
+		LookupFailures:    sc.failures,
+		MaxHops:           sc.maxHops,
+		ConvergenceRounds: sc.rounds,
+		ConvergenceTime:   sc.convergence,
+	}
+	if sc.lookups > 0 {
+		r.SuccessRate = float64(sc.lookups-sc.failures) / float64(sc.lookups)
+		r.MeanHops = float64(sc.hops) / float64(sc.lookups)
+	}
+	live := make([]*simNode, len(sc.live))
+	for i, host := range sc.live {
+		live[i] = sc.nodes[host]
+	}
+	left := make(map[string]bool, len(sc.left))
+	for host := range sc.left {
+		left[host] = true
+	}
+	crashed := make(map[string]bool, len(sc.crashed))
+	for host := range sc.crashed {
+		crashed[host] = true
+	}
+	sc.mu.RUnlock()
+
+	var totalNodes, totalTuples int
+	for i, node := range live {
+		var n int
+		node.k.groups().iterNodes(func(kn kelipspb.Node) bool {
+			n++
+			if host := kn.Address.String(); left[host] {
+				r.StaleLeft++
+			} else if crashed[host] {
+				r.StaleCrashed++
+			}
+			return true
+		})
+		t := node.k.tuples.Count()
+
+		if i == 0 || n < r.MinNodes {
+			r.MinNodes = n
+		}
+		if n > r.MaxNodes {
+			r.MaxNodes = n
+		}
+		if i == 0 || t < r.MinTuples {
+			r.MinTuples = t
+		}
+		if t > r.MaxTuples {
+			r.MaxTuples = t
+		}
+		totalNodes += n
+		totalTuples += t
+	}
+	if len(live) > 0 {
+		r.MeanNodes = float64(totalNodes) / float64(len(live))
+		r.MeanTuples = float64(totalTuples) / float64(len(live))
+	}
+
+	return r
+}
+
+// parallel calls f for 0 to n-1 on the configured number of workers
+func (sc *SimCluster) parallel(n int, f func(i int)) {
+	var (
+		wg   sync.WaitGroup
+		next int64 = -1
+	)
+	for w := 0; w < sc.conf.Workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= n {
+					return
+				}
+				f(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,186 @@
+package kelips
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func Test_SimCluster(t *testing.T) {
+	conf := DefaultSimClusterConfig()
+	conf.Seed = 1
+	sc, err := NewSimCluster(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = sc.Add(40); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Converge(10); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = sc.Insert(200); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Converge(10); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Lookup(500); err != nil {
+		t.Fatal(err)
+	}
+
+	r := sc.Report()
+	if r.Nodes != 40 || r.Keys != 200 || r.SuccessRate != 1 {
+		t.Fatal(r)
+	}
+	// Kelips lookups take at most one hop with all nodes up
+	if r.MaxHops > 1 || r.MeanHops == 0 {
+		t.Fatal(r)
+	}
+	if r.MinNodes != 40 || r.StaleLeft != 0 || r.StaleCrashed != 0 {
+		t.Fatal(r)
+	}
+
+	if err = sc.Churn(5, 3, 3); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Insert(50); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Converge(10); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Lookup(500); err != nil {
+		t.Fatal(err)
+	}
+
+	r = sc.Report()
+	if r.Nodes != 39 || r.Left != 3 || r.Crashed != 3 {
+		t.Fatal(r)
+	}
+	if r.Lookups != 1000 || r.SuccessRate != 1 {
+		t.Fatal(r)
+	}
+	// Crashed nodes stay in the views without a failure detector
+	if r.StaleLeft != 0 || r.StaleCrashed != 3*r.Nodes {
+		t.Fatal(r)
+	}
+	t.Log(r)
+
+	if err = sc.Leave(sc.Live()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if errs := sc.Check(); len(errs) != 0 {
+		t.Fatal(errs)
+	}
+}
+
+func Test_SimCluster_churn(t *testing.T) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	conf := DefaultSimClusterConfig()
+	conf.Seed = 2
+	conf.Groups = 8
+	sc, err := NewSimCluster(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = sc.Add(100); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Converge(20); err != nil {
+		t.Fatal(err)
+	}
+	if err = sc.Insert(500); err != nil {
+		t.Fatal(err)
+	}
+	// Inserts are propagated through the group asynchronously so converge
+	// before the holders of new keys are removed
+	if err = sc.Converge(20); err != nil {
+		t.Fatal(err)
+	}
+
+	var crashed int
+	for i := 0; i < 3; i++ {
+		if err = sc.Churn(10, 5, 5); err != nil {
+			t.Fatal(err)
+		}
+		crashed += 5
+		if err = sc.Insert(100); err != nil {
+			t.Fatal(err)
+		}
+		if err = sc.Converge(20); err != nil {
+			t.Fatal(err)
+		}
+		if err = sc.Lookup(500); err != nil {
+			t.Fatal(err)
+		}
+
+		r := sc.Report()
+		if r.Nodes != 100 || r.Left != crashed || r.Crashed != crashed {
+			t.Fatal(r)
+		}
+		if r.SuccessRate != 1 {
+			t.Fatal(r)
+		}
+		// Left nodes are removed while crashed ones stay in every view.  Nodes
+		// joining after a crash learn of it through gossip
+		if r.StaleLeft != 0 || r.StaleCrashed != crashed*r.Nodes {
+			t.Fatal(r)
+		}
+		if r.MinNodes != r.Nodes+crashed || r.MaxNodes != r.Nodes+crashed {
+			t.Fatal(r)
+		}
+		t.Log(r)
+	}
+}
+
+// Run with -bench SimCluster -benchtime 1x
+func BenchmarkSimCluster_1000(b *testing.B) {
+	log.SetOutput(io.Discard)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < b.N; i++ {
+		conf := DefaultSimClusterConfig()
+		conf.Seed = int64(i)
+		conf.Groups = 32
+		sc, _ := NewSimCluster(conf)
+
+		if _, err := sc.Add(1000); err != nil {
+			b.Fatal(err)
+		}
+		// Keys inserted before a group is known are placed in another group
+		if err := sc.Converge(20); err != nil {
+			b.Fatal(err)
+		}
+		if err := sc.Insert(10000); err != nil {
+			b.Fatal(err)
+		}
+		if err := sc.Converge(20); err != nil {
+			b.Fatal(err)
+		}
+		if err := sc.Churn(50, 25, 25); err != nil {
+			b.Fatal(err)
+		}
+		if err := sc.Converge(20); err != nil {
+			b.Fatal(err)
+		}
+		if err := sc.Lookup(10000); err != nil {
+			b.Fatal(err)
+		}
+
+		r := sc.Report()
+		b.ReportMetric(r.SuccessRate, "success")
+		b.ReportMetric(r.MeanHops, "hops")
+		b.ReportMetric(r.MeanNodes, "nodes/node")
+		b.ReportMetric(float64(r.StaleCrashed)/float64(r.Nodes), "crashed/node")
+		b.ReportMetric(r.MeanTuples, "tuples/node")
+		b.ReportMetric(float64(r.ConvergenceRounds), "rounds")
+		b.ReportMetric(r.ConvergenceTime.Seconds(), "convergence-s")
+	}
+}
@@ -0,0 +1,268 @@
+package kelips
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+const (
+	cursorTuples byte = iota
+	cursorNodes
+)
+
+// Number of keys read from the scan index at a time when building a page
+const snapshotScanBatch = 256
+
+// SnapshotRequest is a request for a single page of a snapshot.  Tuples are
+// returned first ordered by key followed by all known nodes ordered by address.
+// Filters only apply to tuples
+type SnapshotRequest struct {
+	// Only return tuples belonging to the affinity group index.  A negative
+	// value returns tuples for all groups
+	Group int
+
+	// Only return tuples whose key has the prefix
+	Prefix []byte
+
+	// Max number of tuples and nodes in the page.  Zero is unlimited
+	Limit int
+
+	// Max size of the page in bytes.  Zero is unlimited.  This is set by the
+	// transport based on its constraints
+	MaxSize int
+
+	// Cursor returned in the previous page to resume from.  Nil starts from
+	// the beginning
+	Cursor []byte
+}
+
+// validate returns an error if the request cannot be encoded by a transport
+func (req *SnapshotRequest) validate() error {
+	if req.Limit < 0 || req.Limit > math.MaxUint16 {
+		return fmt.Errorf("snapshot limit must be between 0 and %d: %d", math.MaxUint16, req.Limit)
+	}
+	if req.Group < math.MinInt16 || req.Group > math.MaxInt16 {
+		return fmt.Errorf("invalid snapshot group: %d", req.Group)
+	}
+	if len(req.Cursor) > math.MaxUint16 {
+		return fmt.Errorf("snapshot cursor too large: %d", len(req.Cursor))
+	}
+	return nil
+}
+
+// snapshotPage accumulates items in a page checking the request constraints
+type snapshotPage struct {
+	req   *SnapshotRequest
+	count int
+	size  int
+}
+
+// fits returns true if an item of the given size can be added to the page
+// along with the cursor resuming after it from last.  A page always accepts
+// atleast one item.  An error is returned if the item and its cursor are larger
+// than the max size of a page
+func (page *snapshotPage) fits(size int, last []byte) (bool, error) {
+	// Size plus tag and length overhead and the cursor
+	size += 6 + cursorSize(last)
+	if page.req.MaxSize > 0 && size > page.req.MaxSize {
+		return false, fmt.Errorf("snapshot item of %d bytes with cursor exceeds max page size %d", size, page.req.MaxSize)
+	}
+	if page.count == 0 {
+		return true, nil
+	}
+	if page.req.Limit > 0 && page.count >= page.req.Limit {
+		return false, nil
+	}
+	return page.req.MaxSize <= 0 || page.size+size <= page.req.MaxSize, nil
+}
+
+func (page *snapshotPage) add(size int) {
+	page.count++
+	page.size += size + 6
+}
+
+// cursorSize returns the encoded size of the cursor resuming after last
+// including its tag and length overhead
+func cursorSize(last []byte) int {
+	return 1 + len(last) + 6
+}
+
+func parseCursor(cursor []byte) (byte, []byte, error) {
+	if len(cursor) == 0 {
+		return cursorTuples, nil, nil
+	}
+	if cursor[0] != cursorTuples && cursor[0] != cursorNodes {
+		return 0, nil, fmt.Errorf("invalid cursor")
+	}
+	return cursor[0], cursor[1:], nil
+}
+
+func newCursor(typ byte, last []byte) []byte {
+	return append([]byte{typ}, last...)
+}
+
+// SnapshotPage returns a page of the snapshot based on the request.  The
+// returned Cursor is set if there are more pages
+func (lrpc *localGroup) SnapshotPage(req *SnapshotRequest) (*kelipspb.Snapshot, error) {
+	if err := req.validate(); err != nil {
+		return nil, err
+	}
+
+	typ, last, err := parseCursor(req.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	l := lrpc.layout()
+	snapshot := &kelipspb.Snapshot{Groups: int32(l.k()), Generation: l.gen, Hash: lrpc.hashID, Partitioner: lrpc.partID}
+	page := &snapshotPage{req: req}
+
+	if typ == cursorTuples {
+		var full bool
+		err = lrpc.snapshotKeys(req, last, func(key []byte) (bool, error) {
+			hosts, er := lrpc.tuples.Get(key)
+			if er != nil {
+				// Deleted since listed
+				return true, nil
+			}
+
+			tuple := lrpc.snapshotTuple(key, hosts)
+			size := tuple.Size()
+			ok, er := page.fits(size, key)
+			if er != nil || !ok {
+				full = true
+				return false, er
+			}
+			page.add(size)
+			snapshot.Tuples = append(snapshot.Tuples, tuple)
+			last = key
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if full {
+			snapshot.Cursor = newCursor(cursorTuples, last)
+			return snapshot, nil
+		}
+
+		// Start nodes from the beginning
+		last = nil
+	}
+
+	for _, node := range lrpc.snapshotNodes(last) {
+		size := node.Size()
+		ok, err := page.fits(size, node.Address)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			snapshot.Cursor = newCursor(cursorNodes, last)
+			return snapshot, nil
+		}
+		page.add(size)
+		snapshot.Nodes = append(snapshot.Nodes, node)
+		last = node.Address
+	}
+
+	return snapshot, nil
+}
+
+// snapshotKeys calls f with the sorted keys matching the request that come
+// after the last key until f returns false or an error.  Keys are read from the
+// scan index when available so a page only visits the keys it returns,
+// otherwise all keys are listed and sorted
+func (lrpc *localGroup) snapshotKeys(req *SnapshotRequest, last []byte, f func(key []byte) (bool, error)) error {
+	h := lrpc.hashFunc()
+	groups := lrpc.groups()
+	inGroup := func(key []byte) bool {
+		if req.Group < 0 {
+			return true
+		}
+		h.Reset()
+		h.Write(key)
+		return groups.get(h.Sum(nil)).index == req.Group
+	}
+
+	if scanner, ok := lrpc.tuples.(KeyScanner); ok {
+		for {
+			keys := scanner.ScanKeys(req.Prefix, last, snapshotScanBatch)
+			for _, key := range keys {
+				if !inGroup(key) {
+					continue
+				}
+				if ok, err := f(key); err != nil || !ok {
+					return err
+				}
+			}
+			if len(keys) < snapshotScanBatch {
+				return nil
+			}
+			last = keys[len(keys)-1]
+		}
+	}
+
+	keys := make([][]byte, 0)
+	lrpc.tuples.Iter(func(key []byte, hosts []TupleHost) bool {
+		if last != nil && bytes.Compare(key, last) <= 0 {
+			return true
+		}
+		if !bytes.HasPrefix(key, req.Prefix) || !inGroup(key) {
+			return true
+		}
+
+		k := make([]byte, len(key))
+		copy(k, key)
+		keys = append(keys, k)
+		return true
+	})
+
+	sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+	for _, key := range keys {
+		if ok, err := f(key); err != nil || !ok {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshotNodes returns all nodes sorted by address that come after the last
+// address
+func (lrpc *localGroup) snapshotNodes(last []byte) []*kelipspb.Node {
+	nodes := make([]*kelipspb.Node, 0, lrpc.groups().nodeCount())
+	lrpc.groups().iterNodes(func(node kelipspb.Node) bool {
+		if last == nil || bytes.Compare(node.Address, last) > 0 {
+			nodes = append(nodes, &node)
+		}
+		return true
+	})
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].Address, nodes[j].Address) < 0
+	})
+	return nodes
+}
+
+// snapshotTuple returns the tuple for the key with the owner of each host if
+// any are owned
+func (lrpc *localGroup) snapshotTuple(key []byte, hosts []TupleHost) *kelipspb.Tuple {
+	tuple := &kelipspb.Tuple{Key: key, Hosts: make([][]byte, 0, len(hosts))}
+
+	var owned bool
+	owners := make([]string, len(hosts))
+	for i, h := range hosts {
+		tuple.Hosts = append(tuple.Hosts, h)
+		if owners[i] = lrpc.owners.get(key, h); owners[i] != "" {
+			owned = true
+		}
+	}
+
+	if owned {
+		tuple.Owners = owners
+	}
+	return tuple
+}
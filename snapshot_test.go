@@ -0,0 +1,213 @@
+package kelips
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/hexablock/go-kelips/kelipspb"
+)
+
+func Test_SnapshotPage(t *testing.T) {
+	k := kelipsTestInstance(54660)
+	for i := 0; i < 50; i++ {
+		prefix := "a/"
+		if i%2 == 0 {
+			prefix = "b/"
+		}
+		key := []byte(fmt.Sprintf("%skey%d", prefix, i))
+		k.local.Insert(key, NewTupleHostFromHostPort("127.0.0.1", 54660), Caller{}, false)
+	}
+
+	var (
+		tuples [][]byte
+		nodes  int
+		req    = &SnapshotRequest{Group: -1, Limit: 7}
+	)
+	for {
+		page, err := k.local.SnapshotPage(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Tuples)+len(page.Nodes) > 7 {
+			t.Fatal("page over limit")
+		}
+		for _, tuple := range page.Tuples {
+			tuples = append(tuples, tuple.Key)
+		}
+		nodes += len(page.Nodes)
+
+		if len(page.Cursor) == 0 {
+			break
+		}
+		req.Cursor = page.Cursor
+	}
+
+	if len(tuples) != 50 || nodes != 1 {
+		t.Fatalf("tuples=%d nodes=%d", len(tuples), nodes)
+	}
+	for i := 1; i < len(tuples); i++ {
+		if bytes.Compare(tuples[i-1], tuples[i]) >= 0 {
+			t.Fatal("tuples not ordered", string(tuples[i-1]), string(tuples[i]))
+		}
+	}
+
+	// Prefix filter
+	page, err := k.local.SnapshotPage(&SnapshotRequest{Group: -1, Prefix: []byte("a/")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Tuples) != 25 || len(page.Cursor) != 0 {
+		t.Fatal("should have 25 tuples", len(page.Tuples))
+	}
+
+	// Group filter
+	page, err = k.local.SnapshotPage(&SnapshotRequest{Group: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := k.conf.HashFunc()
+	for _, tuple := range page.Tuples {
+		h.Reset()
+		h.Write(tuple.Key)
+		if k.groups().get(h.Sum(nil)).index != 1 {
+			t.Fatal("tuple not in group", string(tuple.Key))
+		}
+	}
+
+	// Size limit
+	page, err = k.local.SnapshotPage(&SnapshotRequest{Group: -1, MaxSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Tuples) == 0 || len(page.Tuples) == 50 || len(page.Cursor) == 0 {
+		t.Fatal("page should be size limited", len(page.Tuples))
+	}
+
+	if _, err = k.local.SnapshotPage(&SnapshotRequest{Cursor: []byte{9}}); err == nil {
+		t.Fatal("should fail with invalid cursor")
+	}
+}
+
+func Test_SnapshotPage_index(t *testing.T) {
+	sn, _ := NewSimNetwork(1, nil)
+	conf := fastTestConf("10.0.0.1:4000")
+	conf.EnableScanIndex = true
+	k, err := Create(conf, sn.Transport("10.0.0.1:4000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 600; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		k.local.Insert(key, NewTupleHost("10.0.0.1:4000"), Caller{}, false)
+	}
+
+	// Pages span several reads of the scan index
+	var (
+		tuples [][]byte
+		req    = &SnapshotRequest{Group: -1, Limit: 100}
+	)
+	for {
+		page, err := k.local.SnapshotPage(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tuple := range page.Tuples {
+			tuples = append(tuples, tuple.Key)
+		}
+		if len(page.Cursor) == 0 {
+			break
+		}
+		req.Cursor = page.Cursor
+	}
+
+	if len(tuples) != 600 {
+		t.Fatal("wrong number of tuples", len(tuples))
+	}
+	for i := 1; i < len(tuples); i++ {
+		if bytes.Compare(tuples[i-1], tuples[i]) >= 0 {
+			t.Fatal("tuples not ordered", string(tuples[i-1]), string(tuples[i]))
+		}
+	}
+
+	// An item larger than a page cannot be returned
+	if _, err = k.local.SnapshotPage(&SnapshotRequest{Group: -1, MaxSize: 10}); err == nil {
+		t.Fatal("should fail on oversized item")
+	}
+
+	if _, err = k.local.SnapshotPage(&SnapshotRequest{Group: -1, Limit: 1 << 16}); err == nil {
+		t.Fatal("should fail on limit")
+	}
+	if _, err = sn.Transport("10.0.0.2:4000").Snapshot("10.0.0.1:4000", &SnapshotRequest{Limit: -1}); err == nil {
+		t.Fatal("should fail on limit")
+	}
+}
+
+func Test_SnapshotPage_cursorSize(t *testing.T) {
+	nodes, _ := testCluster(t, testSimNetwork(t), 1, nil)
+	k := nodes[0]
+
+	// Long keys make for long cursors
+	for i := 0; i < 20; i++ {
+		key := append(bytes.Repeat([]byte("k"), 300), fmt.Sprintf("%02d", i)...)
+		k.local.Insert(key, NewTupleHost(k.conf.AdvertiseHost), Caller{}, false)
+	}
+
+	req := &SnapshotRequest{Group: -1, MaxSize: 1000}
+	var count int
+	for {
+		page, err := k.local.SnapshotPage(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr := (&kelipspb.Snapshot{Groups: page.Groups, Generation: page.Generation, Hash: page.Hash}).Size()
+		if size := page.Size() - hdr; size > req.MaxSize {
+			t.Fatalf("page of %d bytes exceeds max size %d", size, req.MaxSize)
+		}
+		count += len(page.Tuples)
+		if len(page.Cursor) == 0 {
+			break
+		}
+		req.Cursor = page.Cursor
+	}
+	if count != 20 {
+		t.Fatal("wrong number of tuples", count)
+	}
+}
+
+func Test_Client_IterSnapshot(t *testing.T) {
+	k := kelipsTestInstance(54661)
+	for i := 0; i < 30; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		k.local.Insert(key, NewTupleHostFromHostPort("127.0.0.1", 54661), Caller{}, false)
+	}
+
+	client, _ := NewClient("127.0.0.1:54661")
+	defer client.Close()
+
+	var (
+		tuples int
+		pages  int
+	)
+	err := client.IterSnapshot("127.0.0.1:54661", &SnapshotRequest{Group: -1, Limit: 10},
+		func(page *kelipspb.Snapshot) bool {
+			tuples += len(page.Tuples)
+			pages++
+			return true
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tuples != 30 || pages != 4 {
+		t.Fatalf("tuples=%d pages=%d", tuples, pages)
+	}
+
+	page, err := client.Snapshot(&SnapshotRequest{Group: -1, Prefix: []byte("key1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Tuples) != 11 {
+		t.Fatal("should have 11 tuples", len(page.Tuples))
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"hash"
-	"log"
+	"hash/fnv"
 	"net"
 	"strconv"
 	"sync"
@@ -67,15 +67,47 @@ func (host TupleHost) Copy() TupleHost {
 	return out
 }
 
-// InmemTuples implements an in-memory  TupleStore
+// Equal returns true if both hosts have the same ip and port.  The 4 and 16
+// byte forms of an IPv4 address are considered equal
+func (host TupleHost) Equal(other TupleHost) bool {
+	if len(host) < 2 || len(other) < 2 {
+		return len(host) == len(other)
+	}
+	return host.Port() == other.Port() && host.IPAddress().Equal(other.IPAddress())
+}
+
+// hostKey returns the key used to index a host.  IPv4 addresses are indexed
+// by their 16 byte form so both forms of the same host match
+func hostKey(h TupleHost) string {
+	var buf [net.IPv6len + 2]byte
+	return string(normalizeHost(buf[:], h))
+}
+
+// InmemTuples implements an in-memory  TupleStore.  A reverse index of hosts to
+// keys is maintained so operations on a host are proportional to the number of
+// keys referring to it
 type InmemTuples struct {
 	mu sync.RWMutex
 	m  map[string][]TupleHost
+
+	// Host key to the set of keys referring to it
+	hosts map[string]map[string]struct{}
+
+	hooks tupleHooks
 }
 
 // NewInmemTuples instantiates an in-memory tuple store
 func NewInmemTuples() *InmemTuples {
-	return &InmemTuples{m: make(map[string][]TupleHost)}
+	return &InmemTuples{
+		m:     make(map[string][]TupleHost),
+		hosts: make(map[string]map[string]struct{}),
+	}
+}
+
+// AddHook adds a hook called on every change.  Hooks must be added before the
+// store is used
+func (ft *InmemTuples) AddHook(hook TupleHook) {
+	ft.hooks = append(ft.hooks, hook)
 }
 
 // Iter iterates over all the tuples.  If the callback returns false, iteration
@@ -103,26 +135,33 @@ func (ft *InmemTuples) Count() int {
 // if the host was added
 func (ft *InmemTuples) Insert(key []byte, h TupleHost) error {
 	name := string(key)
+	hk := hostKey(h)
 
 	ft.mu.Lock()
 	defer ft.mu.Unlock()
 
-	hosts, ok := ft.m[name]
-	if !ok {
-		ft.m[name] = []TupleHost{h}
-		log.Printf("[DEBUG] Tuple added key=%q host=%s", name, h)
+	// Check if we already have the host
+	keys, ok := ft.hosts[hk]
+	if _, dup := keys[name]; dup {
 		return nil
 	}
 
-	// Check if we already have the host
-	for _, v := range hosts {
-		if h.String() == v.String() {
-			return nil
-		}
+	hosts := ft.m[name]
+	if err := ft.hooks.insert(key, h, len(hosts)); err != nil {
+		return err
+	}
+
+	if !ok {
+		keys = make(map[string]struct{})
+		ft.hosts[hk] = keys
 	}
+	keys[name] = struct{}{}
+
+	// Copy on write as the hosts may be held by callers of Get
+	nh := make([]TupleHost, len(hosts), len(hosts)+1)
+	copy(nh, hosts)
+	ft.m[name] = append(nh, h)
 
-	ft.m[name] = append(hosts, h)
-	log.Printf("[DEBUG] Tuple added key=%x host=%s", name, h)
 	return nil
 }
 
@@ -131,13 +170,20 @@ func (ft *InmemTuples) Delete(key []byte) error {
 	k := string(key)
 
 	ft.mu.Lock()
-	if _, ok := ft.m[k]; ok {
-		delete(ft.m, k)
-		ft.mu.Unlock()
-		return nil
+	defer ft.mu.Unlock()
+
+	hosts, ok := ft.m[k]
+	if !ok {
+		return errKeyNotFound
+	}
+
+	for _, h := range hosts {
+		ft.unindex(hostKey(h), k)
 	}
-	ft.mu.Unlock()
-	return errKeyNotFound
+	delete(ft.m, k)
+	ft.hooks.removeAll(key, hosts)
+
+	return nil
 }
 
 // Get returns a list of hosts for a key.  It returns nil if the name is not
@@ -155,47 +201,243 @@ func (ft *InmemTuples) Get(key []byte) ([]TupleHost, error) {
 	return nil, errKeyNotFound
 }
 
+// KeysForHost returns all keys referring to the host
+func (ft *InmemTuples) KeysForHost(h TupleHost) [][]byte {
+	ft.mu.RLock()
+	defer ft.mu.RUnlock()
+
+	keys := ft.hosts[hostKey(h)]
+	out := make([][]byte, 0, len(keys))
+	for k := range keys {
+		out = append(out, []byte(k))
+	}
+	return out
+}
+
 // DeleteKeyHost deletes a host associated to the name returning true if it was deleted
 func (ft *InmemTuples) DeleteKeyHost(key []byte, h TupleHost) bool {
 	name := string(key)
+	hk := hostKey(h)
 
 	ft.mu.Lock()
 	defer ft.mu.Unlock()
 
-	hosts, ok := ft.m[name]
+	if _, ok := ft.hosts[hk][name]; !ok {
+		return false
+	}
+
+	n := len(ft.m[name])
+	ft.unindex(hk, name)
+	ft.removeHost(name, h)
+	ft.hooks.remove(key, h, n)
+
+	return true
+}
+
+// ExpireHost removes a host from all keys referring to it
+func (ft *InmemTuples) ExpireHost(tuple TupleHost) bool {
+	hk := hostKey(tuple)
+
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+
+	keys, ok := ft.hosts[hk]
 	if !ok {
 		return false
 	}
 
-	for i, v := range hosts {
-		if h.String() == v.String() {
-			ft.m[name] = append(hosts[:i], hosts[i+1:]...)
+	for k := range keys {
+		n := len(ft.m[k])
+		ft.removeHost(k, tuple)
+		if len(ft.hooks) > 0 {
+			ft.hooks.remove([]byte(k), tuple, n)
+		}
+	}
+	delete(ft.hosts, hk)
 
-			log.Printf("[DEBUG] Tuple deleted key=%q host=%s", key, h)
-			return true
+	return true
+}
+
+// removeHost removes the host from the key creating a new slice as the
+// existing one may be held by callers of Get.  The lock must be held
+func (ft *InmemTuples) removeHost(key string, h TupleHost) {
+	hosts := ft.m[key]
+	nh := make([]TupleHost, 0, len(hosts))
+	for _, v := range hosts {
+		if !h.Equal(v) {
+			nh = append(nh, v)
 		}
 	}
+	ft.m[key] = nh
+}
 
-	return false
+// unindex removes the key from the hosts reverse index.  The lock must be held
+func (ft *InmemTuples) unindex(hk string, key string) {
+	keys, ok := ft.hosts[hk]
+	if !ok {
+		return
+	}
+
+	delete(keys, key)
+	if len(keys) == 0 {
+		delete(ft.hosts, hk)
+	}
+}
+
+// tupleHooks are the hooks of a tuple store
+type tupleHooks []TupleHook
+
+// insert calls the hooks for a host added to a key with n hosts.  If a hook
+// fails the change is reverted on the hooks already called and its error
+// returned
+func (hooks tupleHooks) insert(key []byte, h TupleHost, n int) error {
+	for i, hook := range hooks {
+		if err := hook(key, h, n, n+1); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				hooks[j](key, h, n+1, n)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// remove calls the hooks for a host removed from a key with n hosts
+func (hooks tupleHooks) remove(key []byte, h TupleHost, n int) {
+	if n < 1 {
+		return
+	}
+	for _, hook := range hooks {
+		hook(key, h, n, n-1)
+	}
+}
+
+// removeAll calls the hooks for each of the hosts of a deleted key
+func (hooks tupleHooks) removeAll(key []byte, hosts []TupleHost) {
+	for i, h := range hosts {
+		hooks.remove(key, h, len(hosts)-i)
+	}
+}
+
+// hostKeysLister is implemented by tuple stores with a reverse index of hosts
+// to keys
+type hostKeysLister interface {
+	KeysForHost(h TupleHost) [][]byte
+}
+
+// hookedTuples calls hooks for a TupleStore that does not support them.  Keys
+// are locked by stripe around each change and expiring a host locks all
+// stripes
+type hookedTuples struct {
+	TupleStore
+
+	locks [ownerLockStripes]sync.Mutex
+	hooks tupleHooks
+}
+
+// hookTuples returns the store if it supports hooks otherwise it is wrapped to
+// call them
+func hookTuples(store TupleStore) HookedTupleStore {
+	if hs, ok := store.(HookedTupleStore); ok {
+		return hs
+	}
+	return &hookedTuples{TupleStore: store}
+}
+
+// AddHook adds a hook called on every change.  Hooks must be added before the
+// store is used
+func (ht *hookedTuples) AddHook(hook TupleHook) {
+	ht.hooks = append(ht.hooks, hook)
+}
+
+// lock locks the stripe of the key returning the function to unlock it
+func (ht *hookedTuples) lock(key []byte) func() {
+	h := fnv.New32a()
+	h.Write(key)
+	mu := &ht.locks[h.Sum32()%ownerLockStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// Insert inserts the tuple if allowed by the hooks
+func (ht *hookedTuples) Insert(key []byte, h TupleHost) error {
+	unlock := ht.lock(key)
+	defer unlock()
+
+	hosts, _ := ht.TupleStore.Get(key)
+	if containsHost(hosts, h) {
+		return nil
+	}
+
+	n := len(hosts)
+	if err := ht.hooks.insert(key, h, n); err != nil {
+		return err
+	}
+	if err := ht.TupleStore.Insert(key, h); err != nil {
+		ht.hooks.remove(key, h, n+1)
+		return err
+	}
+	return nil
+}
+
+// Delete deletes the key and all its hosts
+func (ht *hookedTuples) Delete(key []byte) error {
+	unlock := ht.lock(key)
+	defer unlock()
+
+	hosts, _ := ht.TupleStore.Get(key)
+	if err := ht.TupleStore.Delete(key); err != nil {
+		return err
+	}
+	ht.hooks.removeAll(key, hosts)
+	return nil
+}
+
+// DeleteKeyHost deletes a host associated to the key returning true if it was
+// deleted
+func (ht *hookedTuples) DeleteKeyHost(key []byte, h TupleHost) bool {
+	unlock := ht.lock(key)
+	defer unlock()
+
+	hosts, _ := ht.TupleStore.Get(key)
+	if !ht.TupleStore.DeleteKeyHost(key, h) {
+		return false
+	}
+	ht.hooks.remove(key, h, len(hosts))
+	return true
 }
 
 // ExpireHost removes a host from all keys referring to it
-func (ft *InmemTuples) ExpireHost(tuple TupleHost) bool {
-	var ok bool
-	th := tuple.String()
+func (ht *hookedTuples) ExpireHost(tuple TupleHost) bool {
+	for i := range ht.locks {
+		ht.locks[i].Lock()
+		defer ht.locks[i].Unlock()
+	}
 
-	ft.mu.Lock()
-	for k, hosts := range ft.m {
-		for i, h := range hosts {
-			if h.String() == th {
-				ft.m[k] = append(hosts[:i], hosts[i+1:]...)
-				log.Printf("[DEBUG] Tuple expired key=%q host=%s", k, th)
-				ok = true
-				break
-			}
+	// Count the hosts of affected keys before expiring
+	var (
+		keys   [][]byte
+		counts []int
+	)
+	count := func(key []byte, hosts []TupleHost) bool {
+		if containsHost(hosts, tuple) {
+			keys = append(keys, append([]byte(nil), key...))
+			counts = append(counts, len(hosts))
 		}
+		return true
+	}
+	if lister, ok := ht.TupleStore.(hostKeysLister); ok {
+		for _, key := range lister.KeysForHost(tuple) {
+			hosts, _ := ht.TupleStore.Get(key)
+			count(key, hosts)
+		}
+	} else {
+		ht.TupleStore.Iter(count)
 	}
-	ft.mu.Unlock()
 
+	ok := ht.TupleStore.ExpireHost(tuple)
+	for i, key := range keys {
+		ht.hooks.remove(key, tuple, counts[i])
+	}
 	return ok
 }
@@ -2,6 +2,7 @@ package kelips
 
 import (
 	"fmt"
+	"net"
 	"testing"
 )
 
@@ -58,3 +59,131 @@ func Test_InmemTuples(t *testing.T) {
 		}
 	}
 }
+
+func Test_InmemTuples_KeysForHost(t *testing.T) {
+	ft := NewInmemTuples()
+
+	h := NewTupleHost("127.0.0.1:1234")
+	other := NewTupleHost("127.0.0.1:4321")
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("key%d", i))
+		ft.Insert(key, h)
+		if i%2 == 0 {
+			ft.Insert(key, other)
+		}
+	}
+
+	if keys := ft.KeysForHost(h); len(keys) != 10 {
+		t.Fatalf("should have=10 got=%d", len(keys))
+	}
+	if keys := ft.KeysForHost(other); len(keys) != 5 {
+		t.Fatalf("should have=5 got=%d", len(keys))
+	}
+
+	// 4 byte form of the same host
+	v4 := NewTupleFromIPPort(net.ParseIP("127.0.0.1").To4(), 1234)
+	if keys := ft.KeysForHost(v4); len(keys) != 10 {
+		t.Fatalf("ipv4 form should have=10 got=%d", len(keys))
+	}
+
+	if !ft.DeleteKeyHost([]byte("key0"), v4) {
+		t.Fatal("should delete with ipv4 form")
+	}
+	if ft.DeleteKeyHost([]byte("key0"), h) {
+		t.Fatal("should not delete twice")
+	}
+	if keys := ft.KeysForHost(h); len(keys) != 9 {
+		t.Fatalf("should have=9 got=%d", len(keys))
+	}
+
+	if err := ft.Delete([]byte("key2")); err != nil {
+		t.Fatal(err)
+	}
+	if keys := ft.KeysForHost(other); len(keys) != 4 {
+		t.Fatalf("should have=4 got=%d", len(keys))
+	}
+
+	if !ft.ExpireHost(h) {
+		t.Fatal("should expire")
+	}
+	if ft.ExpireHost(h) {
+		t.Fatal("should not expire twice")
+	}
+	if keys := ft.KeysForHost(h); len(keys) != 0 {
+		t.Fatalf("should have=0 got=%d", len(keys))
+	}
+
+	hosts, _ := ft.Get([]byte("key4"))
+	if len(hosts) != 1 || hosts[0].String() != other.String() {
+		t.Fatalf("wrong hosts %v", hosts)
+	}
+}
+
+func Test_InmemTuples_GetCopy(t *testing.T) {
+	ft := NewInmemTuples()
+
+	key := []byte("key")
+	h1 := NewTupleHost("127.0.0.1:1")
+	h2 := NewTupleHost("127.0.0.1:2")
+	ft.Insert(key, h1)
+	ft.Insert(key, h2)
+
+	hosts, _ := ft.Get(key)
+	ft.DeleteKeyHost(key, h1)
+
+	if len(hosts) != 2 || hosts[0].String() != h1.String() {
+		t.Fatal("hosts returned by Get should not be modified")
+	}
+}
+
+// benchTuples returns a store with n keys spread across hosts with 3 hosts
+// per key
+func benchTuples(n, hosts int) *InmemTuples {
+	ft := NewInmemTuples()
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i))
+		for j := 0; j < 3; j++ {
+			ft.Insert(key, NewTupleHostFromHostPort("10.0.0.1", 1+(i+j)%hosts))
+		}
+	}
+	return ft
+}
+
+func Benchmark_InmemTuples_ExpireHost(b *testing.B) {
+	ft := benchTuples(1000000, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h := NewTupleHostFromHostPort("10.0.0.1", 1+i%10000)
+		keys := ft.KeysForHost(h)
+		ft.ExpireHost(h)
+
+		b.StopTimer()
+		for _, k := range keys {
+			ft.Insert(k, h)
+		}
+		b.StartTimer()
+	}
+}
+
+func Benchmark_InmemTuples_DeleteKeyHost(b *testing.B) {
+	ft := benchTuples(1000000, 10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := []byte(fmt.Sprintf("key-%d", i%1000000))
+		h := NewTupleHostFromHostPort("10.0.0.1", 1+(i%1000000)%10000)
+		ft.DeleteKeyHost(key, h)
+
+		b.StopTimer()
+		ft.Insert(key, h)
+		b.StartTimer()
+	}
+}
+
+func Benchmark_InmemTuples_KeysForHost(b *testing.B) {
+	ft := benchTuples(1000000, 10000)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ft.KeysForHost(NewTupleHostFromHostPort("10.0.0.1", 1+i%10000))
+	}
+}